@@ -0,0 +1,11 @@
+package main
+
+import (
+	"flag"
+	"github.com/da-coda/mailpie"
+	"os"
+)
+
+func main() {
+	mailpie.Run(flag.CommandLine, os.Args[1:])
+}
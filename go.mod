@@ -4,6 +4,7 @@ go 1.16
 
 require (
 	github.com/emersion/go-imap v1.0.6
+	github.com/emersion/go-imap-idle v0.0.0-20210907174914-db2568431445
 	github.com/gorilla/mux v1.8.0
 	github.com/mhale/smtpd v0.0.0-20200509114310-d7a07f752336
 	github.com/pkg/errors v0.9.1
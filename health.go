@@ -0,0 +1,72 @@
+package mailpie
+
+import (
+	"fmt"
+	"github.com/da-coda/mailpie/internal/apiutil"
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+//healthHandler serves the state of the services on the HTTP server, e.g. for the health checks of Docker or the
+//probes of Kubernetes
+type healthHandler struct {
+	server *Server
+}
+
+//health is the JSON response of /healthz and /readyz
+type health struct {
+	//Status is ok or ready if the check passed, unhealthy or unready otherwise
+	Status string `json:"status"`
+	//Reasons lists why the check failed
+	Reasons  []string       `json:"reasons,omitempty"`
+	Services []ServiceState `json:"services"`
+}
+
+//Register adds the health and readiness routes
+func (h healthHandler) Register(router *mux.Router) {
+	router.HandleFunc("/healthz", h.health).Methods("GET")
+	router.HandleFunc("/readyz", h.ready).Methods("GET")
+}
+
+//health handles GET /healthz. Responds with 503 if a service is not running, so that the health check fails while a
+//failed service is restarted
+func (h healthHandler) health(w http.ResponseWriter, _ *http.Request) {
+	services := h.server.Services()
+	writeHealth(w, "ok", "unhealthy", unhealthy(services), services)
+}
+
+//ready handles GET /readyz. Responds with 503 until the server is started and all services are running, and once the
+//server shuts down, so that no traffic is routed to Mailpie before it can take it
+func (h healthHandler) ready(w http.ResponseWriter, _ *http.Request) {
+	services := h.server.Services()
+	reasons := unhealthy(services)
+	h.server.lock.Lock()
+	if h.server.stopping {
+		reasons = append(reasons, "server is shutting down")
+	} else if !h.server.started {
+		reasons = append(reasons, "server is not started")
+	}
+	h.server.lock.Unlock()
+	writeHealth(w, "ready", "unready", reasons, services)
+}
+
+//unhealthy returns a reason for every service which does not accept connections
+func unhealthy(services []ServiceState) []string {
+	var reasons []string
+	for _, state := range services {
+		if !state.Healthy() {
+			reasons = append(reasons, fmt.Sprintf("%s is %s", state.Name, state.Status))
+		}
+	}
+	return reasons
+}
+
+func writeHealth(w http.ResponseWriter, passed string, failed string, reasons []string, services []ServiceState) {
+	response := health{Status: passed, Reasons: reasons, Services: services}
+	status := http.StatusOK
+	if len(reasons) > 0 {
+		response.Status = failed
+		status = http.StatusServiceUnavailable
+	}
+	apiutil.WriteJSON(w, status, response)
+}
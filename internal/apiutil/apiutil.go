@@ -0,0 +1,46 @@
+//Package apiutil holds what the HTTP APIs of Mailpie have in common, like writing JSON responses and creating the ids
+//of the emulated providers
+package apiutil
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net/http"
+)
+
+//WriteJSON writes the body as JSON response with the status. Headers have to be set before
+func WriteJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(body)
+	if err != nil {
+		logrus.WithError(err).Error("Unable to write JSON response")
+	}
+}
+
+//NewUUID returns a random UUID (version 4), like the message ids of Postmark or the request ids of Amazon SES
+func NewUUID() string {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:])
+}
+
+//NewToken returns size random bytes encoded as unpadded URL safe base64, like the message ids of SendGrid
+func NewToken(size int) string {
+	id := make([]byte, size)
+	_, _ = rand.Read(id)
+	return base64.RawURLEncoding.EncodeToString(id)
+}
+
+//NewHexToken returns size random bytes encoded as hex, like the tokens Mailgun signs
+func NewHexToken(size int) string {
+	id := make([]byte, size)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,46 @@
+package apiutil
+
+import (
+	"github.com/stretchr/testify/suite"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+type APIUtilTestSuite struct {
+	suite.Suite
+}
+
+func (suite *APIUtilTestSuite) TestWriteJSON() {
+	recorder := httptest.NewRecorder()
+	recorder.Header().Set("X-Custom", "kept")
+	WriteJSON(recorder, http.StatusCreated, map[string]string{"id": "1"})
+	suite.Equal(http.StatusCreated, recorder.Code)
+	suite.Equal("application/json", recorder.Header().Get("Content-Type"))
+	suite.Equal("kept", recorder.Header().Get("X-Custom"))
+	suite.JSONEq(`{"id": "1"}`, recorder.Body.String())
+}
+
+func (suite *APIUtilTestSuite) TestNewUUID() {
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	first := NewUUID()
+	suite.Regexp(uuid, first)
+	suite.NotEqual(first, NewUUID())
+}
+
+func (suite *APIUtilTestSuite) TestNewToken() {
+	first := NewToken(16)
+	suite.Regexp(`^[A-Za-z0-9_-]{22}$`, first)
+	suite.NotEqual(first, NewToken(16))
+}
+
+func (suite *APIUtilTestSuite) TestNewHexToken() {
+	first := NewHexToken(8)
+	suite.Regexp(`^[0-9a-f]{16}$`, first)
+	suite.NotEqual(first, NewHexToken(8))
+}
+
+func TestAPIUtil(t *testing.T) {
+	suite.Run(t, new(APIUtilTestSuite))
+}
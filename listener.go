@@ -0,0 +1,191 @@
+package mailpie
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"net"
+	"sync"
+	"time"
+)
+
+//connections keeps track of the open SMTP connections and whether their client is inside a mail transaction, so that
+//shutdown can close the idle sessions right away and only waits for running transactions. The callbacks of smtpd only
+//tell about recipients, logins and accepted mails, not about MAIL, RSET or rejected data, so the state is followed from
+//the commands and replies passing the connections, see smtpTransaction. The connections outlive the listeners, which
+//are bound again if a service restarts
+type connections struct {
+	lock sync.Mutex
+	open map[*trackedConn]bool
+	//changed is signalled whenever a connection is closed or leaves its transaction
+	changed chan struct{}
+	//accepted counts the mails accepted by the server which are not handled yet, smtpd hands them to the handler in
+	//the background after the reply. handled is closed whenever none are left
+	accepted int
+	handled  chan struct{}
+}
+
+func newConnections() *connections {
+	handled := make(chan struct{})
+	close(handled)
+	return &connections{open: make(map[*trackedConn]bool), changed: make(chan struct{}, 1), handled: handled}
+}
+
+//track returns a listener whose accepted connections are tracked
+func (c *connections) track(listener net.Listener) net.Listener {
+	return &trackingListener{Listener: listener, connections: c}
+}
+
+func (c *connections) add(conn *trackedConn) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.open[conn] = true
+}
+
+func (c *connections) forget(conn *trackedConn) {
+	c.lock.Lock()
+	delete(c.open, conn)
+	c.lock.Unlock()
+	c.signal()
+}
+
+func (c *connections) signal() {
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+//read passes the data the client sent to the transaction of the connection
+func (c *connections) read(conn *trackedConn, p []byte) {
+	c.lock.Lock()
+	running := conn.transaction.running()
+	conn.transaction.read(p)
+	left := running && !conn.transaction.running()
+	c.lock.Unlock()
+	if left {
+		c.signal()
+	}
+}
+
+//written passes the reply of the server to the transaction of the connection before it is sent, so that an accepted
+//mail is counted before the client knows about it. smtpd hands the mail to the handler even if the reply fails
+func (c *connections) written(conn *trackedConn, p []byte) {
+	c.lock.Lock()
+	running := conn.transaction.running()
+	if accepted := conn.transaction.written(p); accepted > 0 {
+		if c.accepted == 0 {
+			c.handled = make(chan struct{})
+		}
+		c.accepted += accepted
+	}
+	left := running && !conn.transaction.running()
+	c.lock.Unlock()
+	if left {
+		c.signal()
+	}
+}
+
+//done is called once an accepted mail is handled
+func (c *connections) done() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.accepted--
+	if c.accepted == 0 {
+		close(c.handled)
+	}
+}
+
+//settled returns a channel which is closed once the mails accepted so far are handled
+func (c *connections) settled() <-chan struct{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.handled
+}
+
+//drain closes the connections outside of a transaction and waits until the others left their transaction to close
+//them as well, and until the accepted mails are handled. Once the context ends, the remaining connections are closed
+//and an error is returned
+func (c *connections) drain(ctx context.Context) error {
+	for {
+		c.lock.Lock()
+		var idle, running []*trackedConn
+		for conn := range c.open {
+			if conn.transaction.running() {
+				running = append(running, conn)
+			} else {
+				idle = append(idle, conn)
+			}
+		}
+		c.lock.Unlock()
+		for _, conn := range idle {
+			conn.bye()
+		}
+		if len(running) == 0 {
+			select {
+			case <-c.settled():
+				return nil
+			case <-ctx.Done():
+				return errors.Wrap(ctx.Err(), "Unable to wait for the accepted mails")
+			}
+		}
+		select {
+		case <-c.changed:
+		case <-ctx.Done():
+			for _, conn := range running {
+				_ = conn.Close()
+			}
+			return errors.Wrapf(ctx.Err(), "closed %d connections inside a transaction", len(running))
+		}
+	}
+}
+
+//trackingListener adds the connections it accepts to the tracked connections
+type trackingListener struct {
+	net.Listener
+	connections *connections
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tracked := &trackedConn{Conn: conn, connections: l.connections}
+	l.connections.add(tracked)
+	return tracked, nil
+}
+
+//trackedConn follows the transaction of its session and removes itself from the tracked connections when it is closed
+type trackedConn struct {
+	net.Conn
+	connections *connections
+	once        sync.Once
+	//transaction is guarded by the lock of the connections
+	transaction smtpTransaction
+}
+
+func (c *trackedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.connections.read(c, p[:n])
+	return n, err
+}
+
+func (c *trackedConn) Write(p []byte) (int, error) {
+	c.connections.written(c, p)
+	return c.Conn.Write(p)
+}
+
+//bye tells the client that the server shuts down and closes the connection. The session waits for a command, so the
+//reply does not interfere with the server
+func (c *trackedConn) bye() {
+	_ = c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_, _ = c.Conn.Write([]byte(smtpShutdownReply))
+	_ = c.Close()
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.connections.forget(c)
+	})
+	return c.Conn.Close()
+}
@@ -1,156 +1,87 @@
-package main
+//Package mailpie runs the Mailpie mail servers. The command in cmd/mailpie starts them via Run, programs and tests can
+//embed any number of instances with NewServer
+package mailpie
 
 import (
+	"context"
 	"embed"
 	"flag"
 	"fmt"
 	"github.com/da-coda/mailpie/pkg/config"
-	"github.com/da-coda/mailpie/pkg/event"
-	"github.com/da-coda/mailpie/pkg/handler"
-	"github.com/da-coda/mailpie/pkg/handler/imap"
-	"github.com/da-coda/mailpie/pkg/store"
-	"github.com/emersion/go-imap/server"
-	"github.com/gorilla/mux"
-	"github.com/mhale/smtpd"
 	"github.com/sirupsen/logrus"
-	"net"
-	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
 	"syscall"
 	"time"
 )
 
-type errorOrigin string
+//Service names a listener of the Server
+type Service string
 
 const (
-	SMTP errorOrigin = "smtp"
-	SPA  errorOrigin = "spa"
-	IMAP errorOrigin = "imap"
+	SMTP  Service = "smtp"
+	SPA   Service = "spa"
+	IMAP  Service = "imap"
+	IMAPS Service = "imaps"
+	POP3  Service = "pop3"
+	SES   Service = "ses"
 )
 
-type errorState struct {
-	err    error
-	origin errorOrigin
-}
+//embed the index html and the dist directory(introduced in go 1.16)
+//
+//go:embed "dist/index.html"
+var indexHtml string
 
-func main() {
-	Run(flag.CommandLine, os.Args[1:])
-}
+//go:embed "dist"
+var dist embed.FS
 
-//Run main entry point for mailpie. Loads the config, setup of globalMailStore and globalMessageQueue, starts all services
+//Run main entry point for the mailpie command. Loads the config, starts a Server with all enabled services and runs
+//until the process receives SIGINT or SIGTERM. The server is shut down gracefully within the shutdown timeout of the
+//config, a second signal exits right away. Exits with status 1 if the shutdown failed or a service failed more often in
+//a row than MaxServiceFailures allows, so that Docker or Kubernetes restart Mailpie
 func Run(flags *flag.FlagSet, arguments []string) {
 	err := config.Load(flags, arguments)
 	if err != nil {
 		logrus.WithError(err).Fatal("Error during configuration setup")
 	}
-	logrus.SetLevel(config.GetConfig().LogrusLevel)
 	conf := config.GetConfig()
-	globalMessageQueue := event.CreateOrGet()
-	globalMailStore := store.CreateMailStore(*globalMessageQueue)
+	logrus.SetLevel(conf.LogrusLevel)
 
-	errorChannel := make(chan errorState)
-	if !conf.DisableHTTP {
-		go serveSPA(errorChannel)
-	}
-
-	if !conf.DisableSMTP {
-		smtpHandler := handler.CreateSmtpHandler(*globalMailStore)
-		go serveSMTP(errorChannel, smtpHandler)
+	server, err := NewServer(Options{Config: conf})
+	if err != nil {
+		logrus.WithError(err).Fatal("Error during setup")
 	}
-
-	if !conf.DisableIMAP {
-		go serveIMAP(errorChannel)
+	err = server.Start(context.Background())
+	if err != nil {
+		logrus.WithError(err).Fatal("Error during start")
 	}
 
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
-
+	failed := false
+	select {
+	case <-signals:
+		fmt.Print("\r")
+		logrus.WithField("timeout", conf.ShutdownTimeout).Info("Received SIGTERM, shutting down")
+	case err := <-server.Failed():
+		logrus.WithError(err).WithField("timeout", conf.ShutdownTimeout).Error("Service failed, shutting down")
+		failed = true
+	}
 	go func() {
 		<-signals
-		fmt.Print("\r")
-		logrus.Info("Received SIGTERM")
-		os.Exit(0)
+		logrus.Warn("Received second signal, exiting without waiting for open connections")
+		os.Exit(1)
 	}()
 
-	var errorState errorState
-	for {
-		errorState = <-errorChannel
-		logrus.WithError(errorState.err).WithField("Origin", errorState.origin).Error("Service received unexpected error")
-	}
-}
-
-//serveSMTP Setup SMTP-Server and run ListenAndServe. If some error occurs during service runtime, the error gets send to Run
-//via the errorChannel. Needs an SMTP handler which handles incoming mails
-func serveSMTP(errorChannel chan errorState, smtpHandler handler.SmtpHandler) {
-	addr := config.GetConfig().NetworkConfigs.SMTP.Host + ":" + strconv.Itoa(config.GetConfig().NetworkConfigs.SMTP.Port)
-	srv := &smtpd.Server{
-		Addr:         addr,
-		Handler:      smtpHandler.Handle,
-		Appname:      "Mailpie",
-		Hostname:     "localhost",
-		AuthRequired: false,
-		//currently no auth is needed and implemented, so always return true on login
-		AuthHandler: func(remoteAddr net.Addr, mechanism string, username []byte, password []byte, shared []byte) (bool, error) {
-			return true, nil
-		},
-		LogWrite: func(remoteIP, verb, line string) {
-			logrus.WithField("ip", remoteIP).WithField("verb", verb).Debug(line)
-		},
-		AuthMechs: map[string]bool{"PLAIN": true, "LOGIN": true, "CRAM-MD5": false},
-	}
-	logrus.WithField("Address", addr).Info("Starting SMTP server")
-	//run the server. In best case, this will never stop. If there is some error, send it to Run via errorChannel
-	err := srv.ListenAndServe()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(conf.ShutdownTimeout)*time.Second)
+	err = server.Shutdown(ctx)
+	cancel()
 	if err != nil {
-		errorChannel <- errorState{err: err, origin: SMTP}
+		logrus.WithError(err).Error("Unable to shut down gracefully")
+		os.Exit(1)
 	}
-}
-
-//embed the index html and the dist directory(introduced in go 1.16)
-//go:embed "dist/index.html"
-var indexHtml string
-
-//go:embed "dist"
-var dist embed.FS
-
-//serveSPA serve the MailPie Single-Page-Application
-func serveSPA(errorChannel chan errorState) {
-	router := mux.NewRouter()
-	spa := handler.NewSpaHandler(dist, indexHtml)
-	router.PathPrefix("/").Handler(spa).Methods("GET")
-
-	srv := &http.Server{
-		Handler:      router,
-		Addr:         config.GetConfig().NetworkConfigs.HTTP.Host + ":" + strconv.Itoa(config.GetConfig().NetworkConfigs.HTTP.Port),
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second,
+	logrus.Info("Shut down gracefully")
+	if failed {
+		os.Exit(1)
 	}
-
-	logrus.WithField("Address", fmt.Sprintf("http://%s", srv.Addr)).Info("Starting SPA server")
-	//should run forever unless an error occurs
-	err := srv.ListenAndServe()
-	if err != nil {
-		errorChannel <- errorState{err: err, origin: SPA}
-	}
-}
-
-//serveIMAP runs the IMAP server
-func serveIMAP(errorChannel chan errorState) {
-	be := imap.NewBackend()
-	s := server.New(be)
-	imapLogger := logrus.StandardLogger()
-	s.Debug = imapLogger.Writer()
-	s.Addr = config.GetConfig().NetworkConfigs.IMAP.Host + ":" + strconv.Itoa(config.GetConfig().NetworkConfigs.IMAP.Port)
-	s.AllowInsecureAuth = true
-	logrus.WithField("Address", s.Addr).Info("Starting IMAP server")
-	err := s.ListenAndServe()
-	if err != nil {
-		errorChannel <- errorState{err: err, origin: IMAP}
-	}
-}
-
-func (state errorState) String() string {
-	return fmt.Sprintf("error at %s: %s", state.origin, state.err.Error())
 }
@@ -1,4 +1,4 @@
-package main
+package mailpie
 
 import (
 	"flag"
@@ -78,7 +78,7 @@ disable_http: false
 
 	//IMAP running
 	if suite.True(checkPortOpen("127.0.0.1", 2143), "IMAP not running") {
-		imapConnect(suite.T(), "127.0.0.1:2143")
+		imapConnect(suite.T(), "127.0.0.1:2143", "Hello!")
 	}
 
 	//HTTP running
@@ -119,7 +119,7 @@ func checkPortOpen(host string, port int) bool {
 	return true
 }
 
-func imapConnect(t *testing.T, address string) {
+func imapConnect(t *testing.T, address string, subject string) {
 	// Connect to server
 	c, err := client.Dial(address)
 	if err != nil {
@@ -151,7 +151,7 @@ func imapConnect(t *testing.T, address string) {
 	if !assert.Len(t, messages, 1) {
 		assert.FailNow(t, "No messages found")
 	}
-	assert.Equal(t, "Hello!", messages[0].Envelope.Subject)
+	assert.Equal(t, subject, messages[0].Envelope.Subject)
 
 	if err := <-done; err != nil {
 		assert.FailNow(t, "Error during fetching", err)
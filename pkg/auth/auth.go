@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"github.com/da-coda/mailpie/pkg/config"
+)
+
+//Authenticator checks login credentials against the users from the config. It is shared by all protocols, so a tester
+//uses the same credentials for sending via SMTP and reading via IMAP
+type Authenticator struct {
+	users map[string]string
+}
+
+func NewAuthenticator(users []config.User) *Authenticator {
+	authenticator := &Authenticator{users: make(map[string]string, len(users))}
+	for _, user := range users {
+		authenticator.users[user.Username] = user.Password
+	}
+	return authenticator
+}
+
+//Enabled reports whether users are configured. Without users Mailpie accepts every login
+func (a *Authenticator) Enabled() bool {
+	return a != nil && len(a.users) > 0
+}
+
+//Authenticate returns true if the credentials belong to a configured user or if no users are configured
+func (a *Authenticator) Authenticate(username string, password string) bool {
+	if !a.Enabled() {
+		return true
+	}
+	expected, exists := a.users[username]
+	if !exists {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+}
+
+//Password returns the password of a configured user. Needed for challenge response mechanisms like APOP, which don't
+//send the password itself
+func (a *Authenticator) Password(username string) (string, bool) {
+	if !a.Enabled() {
+		return "", false
+	}
+	password, exists := a.users[username]
+	return password, exists
+}
@@ -0,0 +1,37 @@
+package auth
+
+import (
+	"github.com/da-coda/mailpie/pkg/config"
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+type AuthUnitTestSuite struct {
+	suite.Suite
+}
+
+func (suite *AuthUnitTestSuite) TestAuthenticate_NoUsers() {
+	authenticator := NewAuthenticator(nil)
+	suite.False(authenticator.Enabled())
+	suite.True(authenticator.Authenticate("anyone", "anything"))
+	var unset *Authenticator
+	suite.True(unset.Authenticate("anyone", "anything"), "A missing authenticator should accept every login")
+}
+
+func (suite *AuthUnitTestSuite) TestAuthenticate_Users() {
+	authenticator := NewAuthenticator([]config.User{{Username: "bob", Password: "secret"}, {Username: "cora", Password: ""}})
+	suite.True(authenticator.Enabled())
+	suite.True(authenticator.Authenticate("bob", "secret"))
+	suite.False(authenticator.Authenticate("bob", "Secret"))
+	suite.False(authenticator.Authenticate("dan", "secret"))
+	suite.True(authenticator.Authenticate("cora", ""))
+	password, exists := authenticator.Password("bob")
+	suite.True(exists)
+	suite.Equal("secret", password)
+	_, exists = authenticator.Password("dan")
+	suite.False(exists)
+}
+
+func TestAuth(t *testing.T) {
+	suite.Run(t, new(AuthUnitTestSuite))
+}
@@ -0,0 +1,93 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+//validity of generated self-signed certificates
+const validity = 365 * 24 * time.Hour
+
+//Load creates the TLS config used by all Mailpie listeners. If certFile and keyFile are set, the key pair is loaded
+//from these files, if both are empty a self-signed certificate for localhost and the machine hostname is generated
+func Load(certFile string, keyFile string) (*tls.Config, error) {
+	var certificate tls.Certificate
+	var err error
+	switch {
+	case certFile != "" && keyFile != "":
+		certificate, err = tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to load TLS key pair")
+		}
+	case certFile != "" || keyFile != "":
+		return nil, errors.New("TLS certificate and key file have to be set together")
+	default:
+		hosts := []string{"localhost", "127.0.0.1", "::1"}
+		hostname, err := os.Hostname()
+		if err == nil && hostname != "localhost" {
+			hosts = append(hosts, hostname)
+		}
+		certPEM, keyPEM, err := GenerateSelfSigned(hosts...)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to generate self-signed certificate")
+		}
+		certificate, err = tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to use generated certificate")
+		}
+		logrus.WithField("hosts", hosts).Info("No TLS certificate configured, using a generated self-signed certificate")
+	}
+	return &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12}, nil
+}
+
+//GenerateSelfSigned creates a PEM encoded certificate and ECDSA key valid for the given DNS names and IP addresses
+func GenerateSelfSigned(hosts ...string) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "unable to generate key")
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "unable to generate serial number")
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Mailpie"}, CommonName: "Mailpie"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "unable to create certificate")
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "unable to marshal key")
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
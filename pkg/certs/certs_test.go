@@ -0,0 +1,50 @@
+package certs
+
+import (
+	"crypto/x509"
+	"github.com/stretchr/testify/suite"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type CertsUnitTestSuite struct {
+	suite.Suite
+}
+
+func (suite *CertsUnitTestSuite) TestLoad_SelfSigned() {
+	config, err := Load("", "")
+	suite.Require().Nil(err)
+	suite.Require().Len(config.Certificates, 1)
+	certificate, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	suite.Require().Nil(err)
+	suite.Nil(certificate.VerifyHostname("localhost"))
+	suite.Nil(certificate.VerifyHostname("127.0.0.1"))
+}
+
+func (suite *CertsUnitTestSuite) TestLoad_Files() {
+	certPEM, keyPEM, err := GenerateSelfSigned("mail.example.com")
+	suite.Require().Nil(err)
+	dir := suite.T().TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	suite.Require().Nil(os.WriteFile(certFile, certPEM, 0600))
+	suite.Require().Nil(os.WriteFile(keyFile, keyPEM, 0600))
+
+	config, err := Load(certFile, keyFile)
+	suite.Require().Nil(err)
+	certificate, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	suite.Require().Nil(err)
+	suite.Nil(certificate.VerifyHostname("mail.example.com"))
+}
+
+func (suite *CertsUnitTestSuite) TestLoad_Errors() {
+	_, err := Load("cert.pem", "")
+	suite.Error(err, "Only one of certificate and key should be rejected")
+	_, err = Load("/does/not/exist.pem", "/does/not/exist.key")
+	suite.Error(err)
+}
+
+func TestCerts(t *testing.T) {
+	suite.Run(t, new(CertsUnitTestSuite))
+}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"github.com/sirupsen/logrus"
+	"time"
 )
 
 var configuration Config
@@ -22,10 +23,167 @@ type Config struct {
 			Host string `flag:"httpHost"`
 			Port int    `flag:"httpPort"`
 		}
+		POP3 struct {
+			Host string `flag:"pop3Host"`
+			Port int    `flag:"pop3Port"`
+		}
+		SES struct {
+			Host string `flag:"sesHost"`
+			Port int    `flag:"sesPort"`
+		}
 	}
 	DisableIMAP bool `yaml:"disable_imap" flag:"disableImap"`
 	DisableSMTP bool `yaml:"disable_smtp" flag:"disableSmtp"`
 	DisableHTTP bool `yaml:"disable_http" flag:"disableHttp"`
+	DisablePOP3 bool `yaml:"disable_pop3" flag:"disablePop3"`
+	DisableSES  bool `yaml:"disable_ses" flag:"disableSes"`
+	DisableJMAP bool `yaml:"disable_jmap" flag:"disableJmap"`
+	//DisableSendGrid removes the SendGrid v3 Mail Send API from the HTTP server
+	DisableSendGrid bool `yaml:"disable_sendgrid" flag:"disableSendgrid"`
+	//DisableMailgun removes the Mailgun messages API from the HTTP server
+	DisableMailgun bool `yaml:"disable_mailgun" flag:"disableMailgun"`
+	//DisablePostmark removes the Postmark email API from the HTTP server
+	DisablePostmark bool `yaml:"disable_postmark" flag:"disablePostmark"`
+	//DisableSparkPost removes the SparkPost transmissions API from the HTTP server
+	DisableSparkPost bool `yaml:"disable_sparkpost" flag:"disableSparkpost"`
+	//EnableMailCatcher serves the MailCatcher API on the HTTP server. Off by default, since its /messages routes would
+	//shadow paths of the SPA
+	EnableMailCatcher bool   `yaml:"enable_mailcatcher" flag:"enableMailcatcher"`
+	SieveScript       string `yaml:"sieve_script" flag:"sieveScript"`
+	DataDir           string `yaml:"data_dir" flag:"dataDir"`
+	//ShutdownTimeout is the number of seconds to wait on SIGTERM for open connections, exec hooks and notifications
+	ShutdownTimeout int `yaml:"shutdown_timeout" flag:"shutdownTimeout"`
+	//MaxServiceFailures exits Mailpie once a service failed this many times in a row, so that Docker or Kubernetes can
+	//restart it. With 0, failed services are restarted until the shutdown
+	MaxServiceFailures int `yaml:"max_service_failures" flag:"maxServiceFailures"`
+	IMAP               struct {
+		PerRecipient bool   `yaml:"per_recipient" flag:"imapPerRecipient"`
+		AdminUser    string `yaml:"admin_user" flag:"imapAdminUser"`
+		//TLSPort is the port of the implicit TLS (IMAPS) listener on the IMAP host
+		TLSPort             int  `yaml:"tls_port" flag:"imapsPort"`
+		DisableIMAPS        bool `yaml:"disable_imaps" flag:"disableImaps"`
+		DisableStartTLS     bool `yaml:"disable_starttls" flag:"disableImapStartTls"`
+		DisableInsecureAuth bool `yaml:"disable_insecure_auth" flag:"disableImapInsecureAuth"`
+	} `yaml:"imap"`
+	POP3 struct {
+		//DeletePerUser only hides mails deleted with DELE from the user instead of removing them for everyone
+		DeletePerUser bool `yaml:"delete_per_user" flag:"pop3DeletePerUser"`
+	} `yaml:"pop3"`
+	SendGrid struct {
+		//TemplateDir holds a directory per dynamic template, named like the template id
+		TemplateDir string `yaml:"template_dir" flag:"sendgridTemplateDir"`
+	} `yaml:"sendgrid"`
+	SES struct {
+		//TemplateDir holds the templates of SendTemplatedEmail as JSON files named like the template
+		TemplateDir string `yaml:"template_dir" flag:"sesTemplateDir"`
+		//VerifySignatures rejects requests which are not signed with Signature Version 4 by one of the Credentials
+		VerifySignatures bool `yaml:"verify_signatures" flag:"sesVerifySignatures"`
+		//Credentials maps access key ids to their secret access keys
+		Credentials map[string]string `yaml:"credentials,omitempty"`
+	} `yaml:"ses"`
+	Postmark struct {
+		//TemplateDir holds the templates of /email/withTemplate as JSON files named like the template id or alias
+		TemplateDir string `yaml:"template_dir" flag:"postmarkTemplateDir"`
+		//ServerTokens are accepted in the X-Postmark-Server-Token header. If empty, every token is accepted
+		ServerTokens []string `yaml:"server_tokens,omitempty"`
+	} `yaml:"postmark"`
+	SparkPost struct {
+		//APIKeys are accepted in the Authorization header. If empty, every key is accepted
+		APIKeys []string `yaml:"api_keys,omitempty"`
+	} `yaml:"sparkpost"`
+	//TLS is the certificate used by all TLS listeners. Without certificate and key a self-signed certificate is generated
+	TLS struct {
+		CertFile string `yaml:"cert_file" flag:"tlsCert"`
+		KeyFile  string `yaml:"key_file" flag:"tlsKey"`
+	} `yaml:"tls"`
+	//Users which are allowed to log in. If empty, every login is accepted
+	Users []User `yaml:"users,omitempty"`
+	//Webhooks receive simulated delivery events for every stored mail, formatted like the events of the provider
+	Webhooks []Webhook `yaml:"webhooks,omitempty"`
+	//InboundRoutes forward stored mails to the application like the inbound parsing of a mail provider
+	InboundRoutes []InboundRoute `yaml:"inbound_routes,omitempty"`
+	//Notifications post stored and deleted mails to chat bots, CI jobs or other services
+	Notifications []Notification `yaml:"notifications,omitempty"`
+	//ExecHooks run a command for every stored mail
+	ExecHooks []ExecHook `yaml:"exec_hooks,omitempty"`
+}
+
+//Webhook is an endpoint of the tested application which processes the delivery events of a mail provider
+type Webhook struct {
+	//Provider is the format of the events and their signature, sendgrid or mailgun
+	Provider string `yaml:"provider"`
+	URL      string `yaml:"url"`
+	//SigningKey is the HMAC key of Mailgun or the path to the PEM encoded ECDSA private key of SendGrid. Without a
+	//key, SendGrid events are signed with a generated key
+	SigningKey string `yaml:"signing_key,omitempty"`
+	//Events are sent for every recipient in this order, only delivered if empty
+	Events []string `yaml:"events,omitempty"`
+	//Delay is waited before every event
+	Delay time.Duration `yaml:"delay,omitempty"`
+	//Rules replace the events for the recipients they match, e.g. to let a recipient bounce
+	Rules []WebhookRule `yaml:"rules,omitempty"`
+}
+
+type WebhookRule struct {
+	//Recipient is a regular expression matched against the recipient address
+	Recipient string   `yaml:"recipient"`
+	Events    []string `yaml:"events"`
+}
+
+//InboundRoute posts mails to the application in the format of SendGrid Inbound Parse or a forwarding Mailgun route
+type InboundRoute struct {
+	//Provider is the format of the posted form, sendgrid or mailgun
+	Provider string `yaml:"provider"`
+	URL      string `yaml:"url"`
+	//Recipient is a regular expression. Stored mails with a matching recipient are forwarded automatically, all others
+	//only on demand via the API
+	Recipient string `yaml:"recipient,omitempty"`
+	//SigningKey is the key Mailgun signs the posts with
+	SigningKey string `yaml:"signing_key,omitempty"`
+}
+
+//Notification is an endpoint notified about mail events. Failed deliveries are retried with exponential backoff,
+//pending deliveries are persisted in the data directory
+type Notification struct {
+	URL string `yaml:"url"`
+	//Events are stored and deleted, both if empty
+	Events []string `yaml:"events,omitempty"`
+	//Format of the body, summary for a JSON summary of the mail or raw for the message itself. Defaults to summary
+	Format string `yaml:"format,omitempty"`
+	//Secret signs the body with HMAC-SHA256 if set
+	Secret string `yaml:"secret,omitempty"`
+	//Recipient, Sender and Subject are regular expressions the mail has to match to be posted
+	Recipient string `yaml:"recipient,omitempty"`
+	Sender    string `yaml:"sender,omitempty"`
+	Subject   string `yaml:"subject,omitempty"`
+	//MaxAttempts is the number of tries before a delivery is given up, 5 if zero
+	MaxAttempts int `yaml:"max_attempts,omitempty"`
+	//RetryDelay is waited before the first retry and doubled before every other, a second if zero
+	RetryDelay time.Duration `yaml:"retry_delay,omitempty"`
+}
+
+//ExecHook runs a command with the raw mail on stdin and its metadata in MAILPIE_* environment variables. The output of
+//the command is added to the mail as annotation
+type ExecHook struct {
+	//Command is the program followed by its arguments, it is not run in a shell
+	Command []string `yaml:"command"`
+	//Timeout kills the command after the duration, 30 seconds if zero
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	//Concurrency is the number of mails the command runs for at the same time, 4 if zero
+	Concurrency int `yaml:"concurrency,omitempty"`
+	//OnFailure is what happens to the mail if the command fails or exits with a code other than 0: tag adds Tag to the
+	//mail, reject removes the mail from the store. If empty, the mail is only annotated. Hooks run after the mail was
+	//stored, so a rejected mail was already visible in the APIs and handed to the webhooks and notifications before
+	//it is removed
+	OnFailure string `yaml:"on_failure,omitempty"`
+	//Tag is added by OnFailure tag, hook-failed if empty
+	Tag string `yaml:"tag,omitempty"`
+}
+
+//User are the credentials of a tester for IMAP and SMTP logins
+type User struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
 }
 
 func GetConfig() Config {
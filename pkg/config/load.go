@@ -57,6 +57,19 @@ func Load(flags *flag.FlagSet, arguments []string) error {
 	return nil
 }
 
+//Default returns the configuration with the default values of the flags. Neither a config file nor the command line is
+//read and the configuration returned by GetConfig is not changed, so it can be used to embed Mailpie into a program
+func Default() (Config, error) {
+	flags := flag.NewFlagSet("mailpie", flag.ContinueOnError)
+	initFlags(flags)
+	defaults, err := combineConfigAndFlags(Config{}, flags)
+	if err != nil {
+		return Config{}, errors.Wrap(err, "Error applying the default flags")
+	}
+	defaults.LogrusLevel = logrus.Level(defaults.LogLevel)
+	return defaults, nil
+}
+
 func initFlags(flags *flag.FlagSet) {
 	flags.Int("logLevel", int(logrus.WarnLevel), "Possible log leves are:\n0 - Panic\n1 - Fatal\n2 - Error\n3 - Warn\n4 - Info\n5 - Debug\n6 - Trace")
 	flags.String("imapHost", "0.0.0.0", "IMAP-host which Mailpie is listening to - Use 127.0.0.1 for local access & 0.0.0.0 for network access")
@@ -65,11 +78,40 @@ func initFlags(flags *flag.FlagSet) {
 	flags.Int("imapPort", 1143, "IMAP-port where Mailpie is listening")
 	flags.Int("smtpPort", 1025, "SMTP-port where Mailpie is listening")
 	flags.Int("httpPort", 8000, "HTTP-port where Mailpie serves ths SPA")
+	flags.String("pop3Host", "0.0.0.0", "POP3-host which Mailpie is listening to - Use 127.0.0.1 for local access & 0.0.0.0 for network access")
+	flags.Int("pop3Port", 1110, "POP3-port where Mailpie is listening")
+	flags.String("sesHost", "0.0.0.0", "Host where Mailpie serves the Amazon SES API - Use 127.0.0.1 for local access & 0.0.0.0 for network access")
+	flags.Int("sesPort", 4579, "Port where Mailpie serves the Amazon SES API")
 	flags.Bool("disableImap", false, "Disable the IMAP handler")
 	flags.Bool("disableSmtp", false, "Disable the SMTP handler")
 	flags.Bool("disableHttp", false, "Disable the SPA")
+	flags.Bool("disablePop3", false, "Disable the POP3 handler")
+	flags.Bool("disableSes", false, "Disable the Amazon SES API")
+	flags.Bool("disableJmap", false, "Disable the JMAP API on the HTTP server")
+	flags.Bool("disableSendgrid", false, "Disable the SendGrid v3 Mail Send API on the HTTP server")
+	flags.Bool("disableMailgun", false, "Disable the Mailgun messages API on the HTTP server")
+	flags.Bool("disablePostmark", false, "Disable the Postmark email API on the HTTP server")
+	flags.Bool("disableSparkpost", false, "Disable the SparkPost transmissions API on the HTTP server")
+	flags.String("postmarkTemplateDir", "", "Directory with the Postmark templates as JSON files named like the template id or alias, e.g. welcome.json")
+	flags.String("sesTemplateDir", "", "Directory with the Amazon SES templates as JSON files named like the template, e.g. welcome.json")
+	flags.Bool("sesVerifySignatures", false, "Reject Amazon SES requests which are not signed by one of the credentials in the config file")
+	flags.String("sendgridTemplateDir", "", "Directory with the SendGrid dynamic templates, one directory per template id containing subject.hbs, html.hbs and text.hbs")
+	flags.Bool("enableMailcatcher", false, "Serve the MailCatcher compatible API and WebSocket on the HTTP server")
+	flags.Bool("pop3DeletePerUser", false, "Only hide mails deleted via POP3 from the deleting user instead of removing them for everyone")
+	flags.Bool("imapPerRecipient", false, "Give every IMAP login its own INBOX with only the mails sent to the login address")
+	flags.String("imapAdminUser", "", "IMAP login which sees all mails if imapPerRecipient is enabled")
+	flags.Int("imapsPort", 1993, "IMAPS-port where Mailpie is listening with implicit TLS")
+	flags.Bool("disableImaps", false, "Disable the IMAPS listener")
+	flags.Bool("disableImapStartTls", false, "Disable STARTTLS on the IMAP listener")
+	flags.Bool("disableImapInsecureAuth", false, "Only allow IMAP logins over TLS or after STARTTLS")
+	flags.String("tlsCert", "", "Path to the PEM encoded TLS certificate. If not set, a self-signed certificate is generated")
+	flags.String("tlsKey", "", "Path to the PEM encoded TLS key belonging to tlsCert")
+	flags.String("sieveScript", "", "Path to a sieve script (RFC 5228) which decides the IMAP folders and flags of incoming mails")
+	flags.Int("shutdownTimeout", 5, "Seconds to wait on shutdown for open connections, exec hooks and notifications before they are cut off")
+	flags.Int("maxServiceFailures", 0, "Exit once a service failed this many times in a row instead of restarting it again, 0 restarts forever")
 	usr, _ := user.Current()
 	dir := usr.HomeDir
+	flags.String("dataDir", dir+"/.local/share/mailpie", "Directory where Mailpie persists data like the folders created by IMAP clients")
 	flags.String("config", dir+"/.config/mailpie.yml", "sets the config file path. If file not exits, MailPie will create one with default values.")
 }
 
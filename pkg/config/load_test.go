@@ -86,6 +86,16 @@ func (suite *LoadConfigUnitSuite) TestLoad_ConfigNotExists() {
 	_ = os.Remove("/tmp/mailpie_test.yml")
 }
 
+func (suite *LoadConfigUnitSuite) TestDefault() {
+	defaults, err := Default()
+	suite.Nil(err)
+	suite.Equal(1025, defaults.NetworkConfigs.SMTP.Port)
+	suite.Equal(1143, defaults.NetworkConfigs.IMAP.Port)
+	suite.Equal(8000, defaults.NetworkConfigs.HTTP.Port)
+	suite.Equal(logrus.WarnLevel, defaults.LogrusLevel)
+	suite.Equal(Config{}, GetConfig(), "Default should not change the global configuration")
+}
+
 //
 // initFlags
 //
@@ -139,6 +149,14 @@ disable_http: true
 				Host string `flag:"httpHost"`
 				Port int    `flag:"httpPort"`
 			}
+			POP3 struct {
+				Host string `flag:"pop3Host"`
+				Port int    `flag:"pop3Port"`
+			}
+			SES struct {
+				Host string `flag:"sesHost"`
+				Port int    `flag:"sesPort"`
+			}
 		}{
 			SMTP: struct {
 				Host string `flag:"smtpHost"`
@@ -186,6 +204,20 @@ func (suite *LoadConfigUnitSuite) TestParseConfig_ReadCorruption() {
 	suite.Error(err)
 }
 
+func (suite *LoadConfigUnitSuite) TestParseConfig_Users() {
+	configFile := []byte(
+		`
+users:
+    - username: bob@example.com
+      password: secret
+    - username: cora
+      password: hunter2
+`)
+	c, err := parseConfig(Config{}, bytes.NewReader(configFile))
+	suite.Nil(err)
+	suite.Equal([]User{{Username: "bob@example.com", Password: "secret"}, {Username: "cora", Password: "hunter2"}}, c.Users)
+}
+
 func (suite *LoadConfigUnitSuite) TestParseConfig_InvalidYaml() {
 	corruptedYaml := []byte(
 		`
@@ -473,6 +505,14 @@ func (suite *LoadConfigUnitSuite) TestWriteConfig_ValidYaml() {
 				Host string `flag:"httpHost"`
 				Port int    `flag:"httpPort"`
 			}
+			POP3 struct {
+				Host string `flag:"pop3Host"`
+				Port int    `flag:"pop3Port"`
+			}
+			SES struct {
+				Host string `flag:"sesHost"`
+				Port int    `flag:"sesPort"`
+			}
 		}{
 			SMTP: struct {
 				Host string `flag:"smtpHost"`
@@ -1,45 +1,270 @@
 package event
 
-import "github.com/sirupsen/logrus"
+import (
+	"github.com/sirupsen/logrus"
+	"runtime/debug"
+	"sync"
+)
 
+//Handler processes the data of an event. Handlers of the mail store events receive the typed payloads of the store
+//package, e.g. store.MailStored
 type Handler func(dispatcher string, data interface{})
 
 type Event string
 
+//OverflowPolicy decides what happens if an event is dispatched while the buffer of a subscriber is full
+type OverflowPolicy int
+
+const (
+	//Block lets Dispatch wait until the subscriber has handled an event
+	Block OverflowPolicy = iota
+	//DropOldest discards the oldest event the subscriber has not handled yet, so that a slow subscriber never holds up
+	//the dispatcher
+	DropOldest
+)
+
+//DefaultBufferSize is the number of events buffered per subscriber if the options give none
+const DefaultBufferSize = 256
+
+//SubscribeOptions configure a subscription
+type SubscribeOptions struct {
+	//Events are delivered to the handler in the order they are dispatched, regardless of their type
+	Events []Event
+	//BufferSize is the number of events which can wait for the handler, DefaultBufferSize if zero
+	BufferSize int
+	Overflow   OverflowPolicy
+}
+
 type Subscribable interface {
-	Subscribe(event Event, handler Handler)
+	Subscribe(event Event, handler Handler) *Subscription
+	SubscribeWithOptions(options SubscribeOptions, handler Handler) *Subscription
 }
 
 type Dispatcher interface {
 	Dispatch(event Event, from string, data interface{})
 }
 
+//MessageQueue delivers the dispatched events to the subscribers. Every subscriber has its own buffer and goroutine, so
+//Dispatch doesn't wait for the handlers and a slow or panicking handler doesn't affect the others
 type MessageQueue struct {
-	topics map[Event][]Handler
+	lock   sync.RWMutex
+	topics map[Event][]*Subscription
 }
 
 var mq *MessageQueue
+var mqLock sync.Mutex
+
+//New creates a MessageQueue without subscribers
+func New() *MessageQueue {
+	return &MessageQueue{topics: make(map[Event][]*Subscription)}
+}
 
+//CreateOrGet returns the MessageQueue shared by the whole process, which is created on the first call
 func CreateOrGet() *MessageQueue {
-	if mq != nil {
-		return mq
+	mqLock.Lock()
+	defer mqLock.Unlock()
+	if mq == nil {
+		mq = New()
 	}
-	topics := make(map[Event][]Handler)
-	mq = &MessageQueue{topics}
 	return mq
 }
 
-func (mq MessageQueue) Dispatch(event Event, from string, data interface{}) {
+//Dispatch adds the event to the buffers of its subscribers and returns without waiting for the handlers, unless the
+//buffer of a subscriber with the Block policy is full
+func (mq *MessageQueue) Dispatch(event Event, from string, data interface{}) {
 	logrus.WithFields(map[string]interface{}{"event": event, "from": from}).Debug("New Event Dispatched")
-	subscriber, ok := mq.topics[event]
-	if !ok {
+	mq.lock.RLock()
+	subscriptions := mq.topics[event]
+	mq.lock.RUnlock()
+	for _, subscription := range subscriptions {
+		subscription.push(message{event: event, from: from, data: data})
+	}
+}
+
+//Subscribe delivers the event to the handler with the default options
+func (mq *MessageQueue) Subscribe(event Event, handler Handler) *Subscription {
+	return mq.SubscribeWithOptions(SubscribeOptions{Events: []Event{event}}, handler)
+}
+
+//SubscribeWithOptions delivers the events of the options to the handler until the subscription is cancelled
+func (mq *MessageQueue) SubscribeWithOptions(options SubscribeOptions, handler Handler) *Subscription {
+	if options.BufferSize <= 0 {
+		options.BufferSize = DefaultBufferSize
+	}
+	subscription := &Subscription{queue: mq, options: options, handler: handler, done: make(chan struct{})}
+	subscription.changed = sync.NewCond(&subscription.lock)
+	mq.lock.Lock()
+	for _, event := range options.Events {
+		//copy on write, Dispatch iterates the slices without holding the lock
+		subscriptions := make([]*Subscription, 0, len(mq.topics[event])+1)
+		mq.topics[event] = append(append(subscriptions, mq.topics[event]...), subscription)
+	}
+	mq.lock.Unlock()
+	go subscription.deliver()
+	return subscription
+}
+
+//Flush waits until every event dispatched before the call is handled or dropped by the subscribers. Must not be called
+//by a handler
+func (mq *MessageQueue) Flush() {
+	for _, subscription := range mq.subscriptions() {
+		subscription.flush()
+	}
+}
+
+//Close cancels all subscriptions and waits until their handlers returned, so that no handler runs after the owner of
+//the queue shut down. Must not be called by a handler
+func (mq *MessageQueue) Close() {
+	subscriptions := mq.subscriptions()
+	for _, subscription := range subscriptions {
+		subscription.Cancel()
+	}
+	for _, subscription := range subscriptions {
+		<-subscription.Done()
+	}
+}
+
+//subscriptions returns every subscription once, even if it is subscribed to several events
+func (mq *MessageQueue) subscriptions() []*Subscription {
+	mq.lock.RLock()
+	defer mq.lock.RUnlock()
+	seen := make(map[*Subscription]bool)
+	var subscriptions []*Subscription
+	for _, topic := range mq.topics {
+		for _, subscription := range topic {
+			if !seen[subscription] {
+				seen[subscription] = true
+				subscriptions = append(subscriptions, subscription)
+			}
+		}
+	}
+	return subscriptions
+}
+
+func (mq *MessageQueue) unsubscribe(subscription *Subscription) {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+	for _, event := range subscription.options.Events {
+		subscriptions := make([]*Subscription, 0, len(mq.topics[event]))
+		for _, existing := range mq.topics[event] {
+			if existing != subscription {
+				subscriptions = append(subscriptions, existing)
+			}
+		}
+		mq.topics[event] = subscriptions
+	}
+}
+
+type message struct {
+	event Event
+	from  string
+	data  interface{}
+}
+
+//Subscription is the handle of a subscribed handler
+type Subscription struct {
+	queue   *MessageQueue
+	options SubscribeOptions
+	handler Handler
+	lock    sync.Mutex
+	//changed is signalled whenever pending, cancelled or handled change
+	changed *sync.Cond
+	pending []message
+	//queued and handled count the events added to pending and the events handled or dropped since the subscription
+	//was created, Flush waits until handled catches up with queued
+	queued    uint64
+	handled   uint64
+	dropped   uint64
+	cancelled bool
+	done      chan struct{}
+}
+
+func (s *Subscription) push(m message) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for s.options.Overflow == Block && len(s.pending) >= s.options.BufferSize && !s.cancelled {
+		s.changed.Wait()
+	}
+	if s.cancelled {
 		return
 	}
-	for _, handler := range subscriber {
-		handler(from, data)
+	if len(s.pending) >= s.options.BufferSize {
+		s.pending = s.pending[1:]
+		s.dropped++
+		s.handled++
+	}
+	s.pending = append(s.pending, m)
+	s.queued++
+	s.changed.Broadcast()
+}
+
+//deliver passes the pending events to the handler one after the other until the subscription is cancelled
+func (s *Subscription) deliver() {
+	defer close(s.done)
+	for {
+		s.lock.Lock()
+		for len(s.pending) == 0 && !s.cancelled {
+			s.changed.Wait()
+		}
+		if s.cancelled {
+			s.lock.Unlock()
+			return
+		}
+		m := s.pending[0]
+		s.pending[0] = message{}
+		s.pending = s.pending[1:]
+		//the handler may block, so a subscriber with Block policy gets room for the next event right away
+		s.changed.Broadcast()
+		s.lock.Unlock()
+
+		s.handle(m)
+
+		s.lock.Lock()
+		s.handled++
+		s.changed.Broadcast()
+		s.lock.Unlock()
+	}
+}
+
+//handle calls the handler and recovers from its panics, so that one broken handler doesn't stop the delivery
+func (s *Subscription) handle(m message) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			logrus.WithFields(map[string]interface{}{"event": m.event, "from": m.from, "panic": recovered}).
+				Errorf("Event handler panicked\n%s", debug.Stack())
+		}
+	}()
+	s.handler(m.from, m.data)
+}
+
+func (s *Subscription) flush() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	target := s.queued
+	for s.handled < target && !s.cancelled {
+		s.changed.Wait()
 	}
 }
 
-func (mq MessageQueue) Subscribe(event Event, handler Handler) {
-	mq.topics[event] = append(mq.topics[event], handler)
+//Cancel stops the delivery to the handler. Events which are not handled yet are discarded. A handler currently
+//running is not interrupted, Done is closed once it returned. Safe to call several times and from the handler
+func (s *Subscription) Cancel() {
+	s.queue.unsubscribe(s)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.cancelled = true
+	s.pending = nil
+	s.changed.Broadcast()
+}
+
+//Done is closed when the subscription is cancelled and its handler is no longer running
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+//Dropped returns the number of events discarded because the buffer was full
+func (s *Subscription) Dropped() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.dropped
 }
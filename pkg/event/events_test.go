@@ -5,7 +5,9 @@ import (
 	"github.com/stretchr/testify/suite"
 	"reflect"
 	"runtime"
+	"sync"
 	"testing"
+	"time"
 )
 
 type EventsUnitTestSuite struct {
@@ -16,6 +18,24 @@ func (suite *EventsUnitTestSuite) AfterTest(_, _ string) {
 	mq = nil
 }
 
+//recorder collects the data of the handled events
+type recorder struct {
+	sync.Mutex
+	data []interface{}
+}
+
+func (r *recorder) handle(_ string, data interface{}) {
+	r.Lock()
+	defer r.Unlock()
+	r.data = append(r.data, data)
+}
+
+func (r *recorder) handled() []interface{} {
+	r.Lock()
+	defer r.Unlock()
+	return append([]interface{}{}, r.data...)
+}
+
 func (suite *EventsUnitTestSuite) TestNewOrGet_New() {
 	assert.Nil(suite.T(), mq, "MessageQueue should be nil at the beginning")
 	messagequeue := CreateOrGet()
@@ -35,23 +55,33 @@ func (suite *EventsUnitTestSuite) TestSubscribe() {
 	messagequeue := CreateOrGet()
 	_, exists := mq.topics["test"]
 	assert.False(suite.T(), exists, "Topic 'test' should not exist already")
-	messagequeue.Subscribe("test", handler)
-	handlersForTopic, exists := mq.topics["test"]
-	handlerInTopic := handlersForTopic[0]
+	subscription := messagequeue.Subscribe("test", handler)
+	defer subscription.Cancel()
+	subscriptionsForTopic, exists := mq.topics["test"]
 	assert.True(suite.T(), exists, "Topic 'test' should exist")
+	assert.Same(suite.T(), subscription, subscriptionsForTopic[0])
 	funcName1 := runtime.FuncForPC(reflect.ValueOf(handler).Pointer()).Name()
-	funcName2 := runtime.FuncForPC(reflect.ValueOf(handlerInTopic).Pointer()).Name()
+	funcName2 := runtime.FuncForPC(reflect.ValueOf(subscriptionsForTopic[0].handler).Pointer()).Name()
 	assert.Equal(suite.T(), funcName1, funcName2, "Subscribed handler is not the same as the one found in topic")
 }
 
 func (suite *EventsUnitTestSuite) TestDispatch_WithSubscriber() {
-	messagequeue := CreateOrGet()
-	handler := Handler(func(dispatcher string, data interface{}) {
-		assert.Equal(suite.T(), "TestDispatch", dispatcher)
-		assert.Equal(suite.T(), "This is a Test", data)
+	messagequeue := New()
+	var dispatcher string
+	var received interface{}
+	handled := make(chan struct{})
+	messagequeue.Subscribe("test", func(from string, data interface{}) {
+		dispatcher, received = from, data
+		close(handled)
 	})
-	messagequeue.Subscribe("test", handler)
 	messagequeue.Dispatch("test", "TestDispatch", "This is a Test")
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		suite.FailNow("Event not handled")
+	}
+	assert.Equal(suite.T(), "TestDispatch", dispatcher)
+	assert.Equal(suite.T(), "This is a Test", received)
 }
 
 func (suite *EventsUnitTestSuite) TestDispatch_WithoutSubscriber() {
@@ -61,6 +91,144 @@ func (suite *EventsUnitTestSuite) TestDispatch_WithoutSubscriber() {
 	})
 }
 
+func (suite *EventsUnitTestSuite) TestDispatch_DoesNotWait() {
+	messagequeue := New()
+	release := make(chan struct{})
+	messagequeue.Subscribe("test", func(_ string, _ interface{}) { <-release })
+	done := make(chan struct{})
+	go func() {
+		messagequeue.Dispatch("test", "TestDispatch", 1)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		suite.Fail("Dispatch should not wait for the handler")
+	}
+	close(release)
+}
+
+func (suite *EventsUnitTestSuite) TestSubscribeWithOptions_Order() {
+	messagequeue := New()
+	r := &recorder{}
+	messagequeue.SubscribeWithOptions(SubscribeOptions{Events: []Event{"stored", "deleted"}}, r.handle)
+	for i := 0; i < 100; i++ {
+		messagequeue.Dispatch("stored", "test", i)
+		messagequeue.Dispatch("deleted", "test", -i)
+	}
+	messagequeue.Flush()
+	handled := r.handled()
+	suite.Require().Len(handled, 200)
+	for i := 0; i < 100; i++ {
+		suite.Equal(i, handled[2*i])
+		suite.Equal(-i, handled[2*i+1])
+	}
+}
+
+func (suite *EventsUnitTestSuite) TestOverflow_DropOldest() {
+	messagequeue := New()
+	release := make(chan struct{})
+	r := &recorder{}
+	started := make(chan struct{}, 1)
+	subscription := messagequeue.SubscribeWithOptions(SubscribeOptions{Events: []Event{"test"}, BufferSize: 2, Overflow: DropOldest}, func(from string, data interface{}) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		r.handle(from, data)
+	})
+	messagequeue.Dispatch("test", "test", 0)
+	<-started
+	//0 is handled, 1 and 2 are dropped in favor of 3 and 4
+	for i := 1; i <= 4; i++ {
+		messagequeue.Dispatch("test", "test", i)
+	}
+	close(release)
+	messagequeue.Flush()
+	suite.Equal([]interface{}{0, 3, 4}, r.handled())
+	suite.Equal(uint64(2), subscription.Dropped())
+}
+
+func (suite *EventsUnitTestSuite) TestOverflow_Block() {
+	messagequeue := New()
+	release := make(chan struct{})
+	r := &recorder{}
+	messagequeue.SubscribeWithOptions(SubscribeOptions{Events: []Event{"test"}, BufferSize: 1}, func(from string, data interface{}) {
+		<-release
+		r.handle(from, data)
+	})
+	dispatched := make(chan struct{})
+	go func() {
+		for i := 0; i < 3; i++ {
+			messagequeue.Dispatch("test", "test", i)
+		}
+		close(dispatched)
+	}()
+	select {
+	case <-dispatched:
+		suite.Fail("Dispatch should block while the buffer is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-dispatched
+	messagequeue.Flush()
+	suite.Equal([]interface{}{0, 1, 2}, r.handled())
+}
+
+func (suite *EventsUnitTestSuite) TestCancel() {
+	messagequeue := New()
+	r := &recorder{}
+	subscription := messagequeue.Subscribe("test", r.handle)
+	messagequeue.Dispatch("test", "test", 1)
+	messagequeue.Flush()
+	subscription.Cancel()
+	subscription.Cancel()
+	select {
+	case <-subscription.Done():
+	case <-time.After(5 * time.Second):
+		suite.FailNow("Delivery should stop after Cancel")
+	}
+	messagequeue.Dispatch("test", "test", 2)
+	messagequeue.Flush()
+	suite.Equal([]interface{}{1}, r.handled())
+	suite.Empty(messagequeue.topics["test"])
+}
+
+func (suite *EventsUnitTestSuite) TestClose() {
+	messagequeue := New()
+	r := &recorder{}
+	first := messagequeue.Subscribe("first", r.handle)
+	second := messagequeue.SubscribeWithOptions(SubscribeOptions{Events: []Event{"first", "second"}}, r.handle)
+	messagequeue.Dispatch("first", "test", 1)
+	messagequeue.Flush()
+	messagequeue.Close()
+	for _, subscription := range []*Subscription{first, second} {
+		select {
+		case <-subscription.Done():
+		default:
+			suite.Fail("Close should wait until the delivery stopped")
+		}
+	}
+	messagequeue.Dispatch("second", "test", 2)
+	suite.Equal([]interface{}{1, 1}, r.handled())
+}
+
+func (suite *EventsUnitTestSuite) TestPanic_Isolated() {
+	messagequeue := New()
+	r := &recorder{}
+	messagequeue.Subscribe("test", func(_ string, data interface{}) {
+		if data == 1 {
+			panic("broken handler")
+		}
+	})
+	messagequeue.Subscribe("test", r.handle)
+	messagequeue.Dispatch("test", "test", 1)
+	messagequeue.Dispatch("test", "test", 2)
+	messagequeue.Flush()
+	suite.Equal([]interface{}{1, 2}, r.handled(), "A panicking handler should not affect other handlers")
+}
+
 func TestEventsUnitTestSuite(t *testing.T) {
 	suite.Run(t, new(EventsUnitTestSuite))
 }
@@ -0,0 +1,311 @@
+//Package exechook runs commands for every stored mail, e.g. to extract a token or to lint the mail. The raw mail is
+//passed on stdin and the metadata in environment variables. The output of the command is added to the mail as
+//annotation, a failing command can tag the mail or remove it from the store. The commands run after the mail was
+//stored and dispatched, removing a mail does not undo its delivery to the other subscribers
+package exechook
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/da-coda/mailpie/internal/apiutil"
+	"github.com/da-coda/mailpie/pkg/config"
+	"github.com/da-coda/mailpie/pkg/event"
+	"github.com/da-coda/mailpie/pkg/instances"
+	"github.com/da-coda/mailpie/pkg/store"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//what happens to the mail if the command fails
+const (
+	Tag    = "tag"
+	Reject = "reject"
+)
+
+const (
+	defaultTimeout     = 30 * time.Second
+	defaultConcurrency = 4
+	defaultTag         = "hook-failed"
+	//maxOutput limits the captured stdout and stderr, the rest is discarded
+	maxOutput = 64 * 1024
+)
+
+//hook is a configured exec hook
+type hook struct {
+	config.ExecHook
+	//slots limits the commands running at the same time
+	slots chan struct{}
+}
+
+//Runner runs the hooks for the mails of a store
+type Runner struct {
+	mailStore *store.MailStore
+	hooks     []*hook
+	running   sync.WaitGroup
+}
+
+//NewRunner validates the hooks, which run for every mail the messageQueue announces as stored. Their annotations are
+//added to the mail in the mailStore
+func NewRunner(mailStore *store.MailStore, messageQueue event.Subscribable, hooks []config.ExecHook) (*Runner, error) {
+	r := &Runner{mailStore: mailStore}
+	for i, execHook := range hooks {
+		if len(execHook.Command) == 0 {
+			return nil, errors.Errorf("invalid exec hook %d: missing command", i)
+		}
+		switch execHook.OnFailure {
+		case "", Tag, Reject:
+		default:
+			return nil, errors.Errorf("invalid exec hook %d: unknown on_failure '%s'", i, execHook.OnFailure)
+		}
+		if execHook.Timeout <= 0 {
+			execHook.Timeout = defaultTimeout
+		}
+		if execHook.Concurrency <= 0 {
+			execHook.Concurrency = defaultConcurrency
+		}
+		if execHook.Tag == "" {
+			execHook.Tag = defaultTag
+		}
+		r.hooks = append(r.hooks, &hook{ExecHook: execHook, slots: make(chan struct{}, execHook.Concurrency)})
+	}
+	messageQueue.Subscribe(store.NewMailStoredEvent, r.mailStored)
+	return r, nil
+}
+
+func (r *Runner) mailStored(_ string, data interface{}) {
+	mail := data.(store.MailStored).Mail
+	if _, err := r.mailStore.GetSingle(mail.Key); err != nil {
+		return
+	}
+	for _, h := range r.hooks {
+		r.running.Add(1)
+		go func(h *hook) {
+			defer r.running.Done()
+			h.slots <- struct{}{}
+			defer func() { <-h.slots }()
+			r.handle(h, mail)
+		}(h)
+	}
+}
+
+//Wait blocks until all started commands are finished
+func (r *Runner) Wait() {
+	r.running.Wait()
+}
+
+//handle runs the command of the hook and annotates, tags or removes the mail depending on the result
+func (r *Runner) handle(h *hook, mail instances.Mail) {
+	annotation := run(h, mail)
+	logger := logrus.WithField("command", annotation.Source).WithField("key", mail.Key).WithField("exitCode", annotation.ExitCode)
+	failed := annotation.Error != "" || annotation.ExitCode != 0
+	if failed {
+		logger.WithField("error", annotation.Error).Warn("Exec hook failed")
+	} else {
+		logger.Debug("Exec hook finished")
+	}
+	if failed && h.OnFailure == Reject {
+		if err := r.mailStore.Delete(mail.Key); err != nil && err != store.KeyNotExistsError {
+			logger.WithError(err).Error("Unable to reject mail")
+		}
+		return
+	}
+	err := r.mailStore.Update(mail.Key, func(stored *instances.Mail) {
+		stored.Annotations = append(stored.Annotations[:len(stored.Annotations):len(stored.Annotations)], annotation)
+		if failed && h.OnFailure == Tag && !contains(stored.Metadata.Tags, h.Tag) {
+			stored.Metadata.Tags = append(stored.Metadata.Tags[:len(stored.Metadata.Tags):len(stored.Metadata.Tags)], h.Tag)
+		}
+	})
+	if err != nil && err != store.KeyNotExistsError {
+		logger.WithError(err).Error("Unable to annotate mail")
+	}
+}
+
+//run executes the command with the raw mail on stdin and returns its result. Except on Windows, the command runs in its
+//own process group, so that the timeout also kills the processes it started, e.g. through a shell
+func run(h *hook, mail instances.Mail) instances.Annotation {
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+	annotation := instances.Annotation{Source: strings.Join(h.Command, " "), Time: time.Now()}
+	cmd := exec.Command(h.Command[0], h.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(mail.RawMessage)
+	cmd.Env = append(os.Environ(), environment(mail)...)
+	setProcessGroup(cmd)
+	stdout := &limitedBuffer{limit: maxOutput}
+	stderr := &limitedBuffer{limit: maxOutput}
+	output, err := capture(cmd, stdout, stderr)
+	if err != nil {
+		annotation.Error = err.Error()
+		return annotation
+	}
+	if err = cmd.Start(); err != nil {
+		output.close()
+		<-output.done
+		annotation.Error = err.Error()
+		return annotation
+	}
+	output.started()
+
+	waited := make(chan error, 1)
+	go func() {
+		waited <- cmd.Wait()
+	}()
+	select {
+	case err = <-waited:
+	case <-ctx.Done():
+		kill(cmd)
+		err = <-waited
+	}
+	//processes started by the command may still hold the pipes open, they are not waited for after the timeout
+	select {
+	case <-output.done:
+	case <-ctx.Done():
+		kill(cmd)
+		output.close()
+		<-output.done
+	}
+
+	annotation.Stdout = stdout.String()
+	annotation.Stderr = stderr.String()
+	if cmd.ProcessState != nil {
+		annotation.ExitCode = cmd.ProcessState.ExitCode()
+	}
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		annotation.Error = fmt.Sprintf("timed out after %s", h.Timeout)
+	case err != nil:
+		if _, exited := err.(*exec.ExitError); !exited {
+			annotation.Error = err.Error()
+		}
+	}
+	return annotation
+}
+
+//pipes copies stdout and stderr of a command. Unlike the pipes of exec.Cmd, Wait does not block on them, so that
+//they can be closed while other processes still hold them open
+type pipes struct {
+	readers []*os.File
+	writers []*os.File
+	done    chan struct{}
+}
+
+//capture connects stdout and stderr of the command to the writers
+func capture(cmd *exec.Cmd, stdout io.Writer, stderr io.Writer) (*pipes, error) {
+	p := &pipes{done: make(chan struct{})}
+	var copying sync.WaitGroup
+	for _, w := range []io.Writer{stdout, stderr} {
+		r, pw, err := os.Pipe()
+		if err != nil {
+			p.close()
+			return nil, errors.Wrap(err, "unable to create pipe")
+		}
+		p.readers = append(p.readers, r)
+		p.writers = append(p.writers, pw)
+		copying.Add(1)
+		go func(w io.Writer, r *os.File) {
+			defer copying.Done()
+			_, _ = io.Copy(w, r)
+		}(w, r)
+	}
+	cmd.Stdout = p.writers[0]
+	cmd.Stderr = p.writers[1]
+	go func() {
+		copying.Wait()
+		close(p.done)
+	}()
+	return p, nil
+}
+
+//started closes the ends of the pipes the command writes to, they are inherited by the command
+func (p *pipes) started() {
+	for _, w := range p.writers {
+		_ = w.Close()
+	}
+}
+
+//close stops copying the output
+func (p *pipes) close() {
+	p.started()
+	for _, r := range p.readers {
+		_ = r.Close()
+	}
+}
+
+//environment returns the metadata of the mail as environment variables
+func environment(mail instances.Mail) []string {
+	return []string{
+		"MAILPIE_KEY=" + mail.Key,
+		"MAILPIE_FROM=" + mail.EnvelopeFrom,
+		"MAILPIE_TO=" + strings.Join(mail.Recipients(), ","),
+		"MAILPIE_SUBJECT=" + mail.Subject(),
+		"MAILPIE_MESSAGE_ID=" + mail.Header.Get("Message-Id"),
+		"MAILPIE_SIZE=" + strconv.Itoa(len(mail.RawMessage)),
+		"MAILPIE_RECEIVED=" + mail.Received.Format(time.RFC3339),
+		"MAILPIE_PROVIDER=" + mail.Metadata.Provider,
+		"MAILPIE_TAGS=" + strings.Join(mail.Metadata.Tags, ","),
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+//limitedBuffer keeps the first limit bytes written to it and discards the rest, without failing the writer
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if remaining := b.limit - b.Len(); remaining > 0 {
+		if len(p) > remaining {
+			b.Buffer.Write(p[:remaining])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+//Register adds the route to read the annotations of a mail
+func (r *Runner) Register(router *mux.Router) {
+	router.HandleFunc("/api/annotations/{key}", r.annotations).Methods("GET")
+}
+
+//annotation is the JSON representation of an instances.Annotation
+type annotation struct {
+	Source   string    `json:"source"`
+	Time     time.Time `json:"time"`
+	ExitCode int       `json:"exitCode"`
+	Stdout   string    `json:"stdout"`
+	Stderr   string    `json:"stderr"`
+	Error    string    `json:"error,omitempty"`
+}
+
+//annotations handles GET /api/annotations/{key}
+func (r *Runner) annotations(w http.ResponseWriter, req *http.Request) {
+	mail, err := r.mailStore.GetSingle(mux.Vars(req)["key"])
+	if err != nil {
+		http.Error(w, "Mail not found", http.StatusNotFound)
+		return
+	}
+	annotations := make([]annotation, 0, len(mail.Annotations))
+	for _, a := range mail.Annotations {
+		annotations = append(annotations, annotation(a))
+	}
+	apiutil.WriteJSON(w, http.StatusOK, annotations)
+}
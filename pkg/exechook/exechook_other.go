@@ -0,0 +1,21 @@
+//go:build windows
+// +build windows
+
+package exechook
+
+import (
+	"github.com/sirupsen/logrus"
+	"os"
+	"os/exec"
+)
+
+//setProcessGroup does nothing, there are no process groups to kill on Windows
+func setProcessGroup(_ *exec.Cmd) {}
+
+//kill kills the process of the command. Processes it started keep running and may hold the output open, which is not
+//waited for after the timeout
+func kill(cmd *exec.Cmd) {
+	if err := cmd.Process.Kill(); err != nil && err != os.ErrProcessDone {
+		logrus.WithError(err).WithField("pid", cmd.Process.Pid).Warn("Unable to kill exec hook")
+	}
+}
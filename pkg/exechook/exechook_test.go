@@ -0,0 +1,144 @@
+package exechook
+
+import (
+	"encoding/json"
+	"github.com/da-coda/mailpie/pkg/config"
+	"github.com/da-coda/mailpie/pkg/event"
+	"github.com/da-coda/mailpie/pkg/instances"
+	"github.com/da-coda/mailpie/pkg/store"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/suite"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const rawMail = "From: alex@example.com\r\nTo: bob@example.com\r\nSubject: Your token\r\n\r\nToken: 1234\r\n"
+
+type RunnerTestSuite struct {
+	suite.Suite
+	mailStore *store.MailStore
+}
+
+func (suite *RunnerTestSuite) SetupTest() {
+	suite.mailStore = store.CreateMailStore(event.CreateOrGet())
+}
+
+//store runs the hook for a new mail and returns the mail after the hook finished, false if it was removed. The mail is
+//stored with a new key, since the runners of previous tests are still subscribed to their stores
+func (suite *RunnerTestSuite) store(execHook config.ExecHook) (*Runner, instances.Mail, bool) {
+	runner, err := NewRunner(suite.mailStore, event.CreateOrGet(), []config.ExecHook{execHook})
+	suite.Require().Nil(err)
+	mail, err := instances.ParseMail([]byte(rawMail))
+	suite.Require().Nil(err)
+	mail.EnvelopeFrom = "alex@example.com"
+	mail.EnvelopeTo = []string{"bob@example.com"}
+	key := strconv.FormatInt(time.Now().UnixNano(), 10)
+	suite.Require().Nil(suite.mailStore.Add(key, *mail))
+	event.CreateOrGet().Flush()
+	runner.Wait()
+	stored, err := suite.mailStore.GetSingle(key)
+	return runner, stored, err == nil
+}
+
+func (suite *RunnerTestSuite) TestAnnotate() {
+	runner, mail, found := suite.store(config.ExecHook{Command: []string{"sh", "-c", `echo "$MAILPIE_SUBJECT for $MAILPIE_TO"; grep Token: ; echo checked >&2`}})
+	suite.Require().True(found)
+	suite.Require().Len(mail.Annotations, 1)
+	annotation := mail.Annotations[0]
+	suite.Equal(0, annotation.ExitCode)
+	suite.Empty(annotation.Error)
+	suite.Equal("Your token for bob@example.com\nToken: 1234\r\n", annotation.Stdout, "The mail should be passed on stdin")
+	suite.Equal("checked\n", annotation.Stderr)
+	suite.Empty(mail.Metadata.Tags)
+
+	router := mux.NewRouter()
+	runner.Register(router)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/annotations/"+mail.Key, nil))
+	suite.Equal(http.StatusOK, recorder.Code)
+	var annotations []map[string]interface{}
+	suite.Require().Nil(json.Unmarshal(recorder.Body.Bytes(), &annotations))
+	suite.Require().Len(annotations, 1)
+	suite.Equal("checked\n", annotations[0]["stderr"])
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/annotations/missing", nil))
+	suite.Equal(http.StatusNotFound, recorder.Code)
+}
+
+func (suite *RunnerTestSuite) TestTag() {
+	_, mail, found := suite.store(config.ExecHook{Command: []string{"sh", "-c", "exit 3"}, OnFailure: Tag, Tag: "lint"})
+	suite.Require().True(found)
+	suite.Equal([]string{"lint"}, mail.Metadata.Tags)
+	suite.Require().Len(mail.Annotations, 1)
+	suite.Equal(3, mail.Annotations[0].ExitCode)
+}
+
+func (suite *RunnerTestSuite) TestReject() {
+	_, _, found := suite.store(config.ExecHook{Command: []string{"false"}, OnFailure: Reject})
+	suite.False(found, "The mail should be removed from the store")
+}
+
+func (suite *RunnerTestSuite) TestTimeout() {
+	start := time.Now()
+	_, mail, found := suite.store(config.ExecHook{Command: []string{"sleep", "5"}, Timeout: 50 * time.Millisecond, OnFailure: Tag})
+	suite.Less(int64(time.Since(start)), int64(4*time.Second), "The command should be killed")
+	suite.Require().True(found)
+	suite.Require().Len(mail.Annotations, 1)
+	suite.Equal("timed out after 50ms", mail.Annotations[0].Error)
+	suite.Equal([]string{defaultTag}, mail.Metadata.Tags)
+}
+
+func (suite *RunnerTestSuite) TestTimeout_Shell() {
+	start := time.Now()
+	_, mail, found := suite.store(config.ExecHook{Command: []string{"sh", "-c", "echo started; sleep 3; echo done"}, Timeout: 100 * time.Millisecond})
+	suite.Less(int64(time.Since(start)), int64(2*time.Second), "The processes started by the shell should be killed")
+	suite.Require().True(found)
+	suite.Require().Len(mail.Annotations, 1)
+	suite.Equal("timed out after 100ms", mail.Annotations[0].Error)
+	suite.Equal("started\n", mail.Annotations[0].Stdout)
+}
+
+func (suite *RunnerTestSuite) TestTimeout_Background() {
+	start := time.Now()
+	_, mail, found := suite.store(config.ExecHook{Command: []string{"sh", "-c", "setsid sleep 3 & echo started"}, Timeout: 100 * time.Millisecond})
+	suite.Less(int64(time.Since(start)), int64(2*time.Second), "The pipes held open by other processes should not be waited for")
+	suite.Require().True(found)
+	suite.Require().Len(mail.Annotations, 1)
+	suite.Equal("timed out after 100ms", mail.Annotations[0].Error)
+	suite.Equal("started\n", mail.Annotations[0].Stdout)
+}
+
+func (suite *RunnerTestSuite) TestMissingCommand() {
+	_, mail, found := suite.store(config.ExecHook{Command: []string{"/does/not/exist"}})
+	suite.Require().True(found)
+	suite.Require().Len(mail.Annotations, 1)
+	suite.NotEmpty(mail.Annotations[0].Error)
+}
+
+func (suite *RunnerTestSuite) TestLimitedBuffer() {
+	buffer := &limitedBuffer{limit: 4}
+	for _, chunk := range []string{"abc", "def", "ghi"} {
+		n, err := buffer.Write([]byte(chunk))
+		suite.Nil(err)
+		suite.Equal(3, n)
+	}
+	suite.Equal("abcd", buffer.String())
+}
+
+func (suite *RunnerTestSuite) TestNewRunner_Invalid() {
+	for _, execHook := range []config.ExecHook{
+		{},
+		{Command: []string{"true"}, OnFailure: "ignore"},
+	} {
+		_, err := NewRunner(suite.mailStore, event.CreateOrGet(), []config.ExecHook{execHook})
+		suite.NotNil(err, execHook)
+	}
+}
+
+func TestRunnerTestSuite(t *testing.T) {
+	suite.Run(t, new(RunnerTestSuite))
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+package exechook
+
+import (
+	"github.com/sirupsen/logrus"
+	"os/exec"
+	"syscall"
+)
+
+//setProcessGroup runs the command in its own process group, so that kill also kills the processes it started, e.g.
+//through a shell
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+//kill kills the process group of the command
+func kill(cmd *exec.Cmd) {
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+		logrus.WithError(err).WithField("pid", cmd.Process.Pid).Warn("Unable to kill exec hook")
+	}
+}
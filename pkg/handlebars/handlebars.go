@@ -0,0 +1,344 @@
+//Package handlebars renders the subset of Handlebars used by mail templates of SendGrid and Mailgun: variables with
+//dotted paths, triple stash for unescaped output, comments, whitespace control and the block helpers if, unless,
+//each and with together with the comparison helpers of SendGrid
+package handlebars
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//SyntaxError describes why a template could not be parsed
+type SyntaxError struct {
+	Line    int
+	Message string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("handlebars: line %d: %s", e.Line, e.Message)
+}
+
+func syntaxErrorf(line int, format string, args ...interface{}) error {
+	return &SyntaxError{Line: line, Message: fmt.Sprintf(format, args...)}
+}
+
+//Template is a parsed template which can be rendered any number of times
+type Template struct {
+	nodes []node
+}
+
+type tokenKind int
+
+const (
+	tokenText tokenKind = iota
+	tokenComment
+	tokenMustache
+	tokenRaw
+	tokenOpen
+	tokenElse
+	tokenClose
+)
+
+type token struct {
+	kind tokenKind
+	//text is the text or the content of the mustache without braces, sigil and whitespace control
+	text string
+	line int
+	//trimLeft and trimRight are set by ~ and remove the whitespace of the neighbouring text
+	trimLeft  bool
+	trimRight bool
+}
+
+//argument is a path, like user.name, ../title or @index, or a literal
+type argument struct {
+	path    string
+	literal interface{}
+	isPath  bool
+}
+
+//call is the content of a mustache, a helper or path followed by its arguments
+type call struct {
+	name      string
+	arguments []argument
+}
+
+type node interface{}
+
+type textNode string
+
+type mustacheNode struct {
+	call
+	escape bool
+	line   int
+}
+
+type blockNode struct {
+	call
+	body    []node
+	inverse []node
+	line    int
+}
+
+var blockHelpers = map[string]bool{"if": true, "unless": true, "each": true, "with": true, "equals": true,
+	"notEquals": true, "and": true, "or": true, "greaterThan": true, "lessThan": true}
+
+var inlineHelpers = map[string]bool{"insert": true, "length": true}
+
+//Parse parses the template source
+func Parse(source string) (*Template, error) {
+	tokens, err := lex(source)
+	if err != nil {
+		return nil, err
+	}
+	trimWhitespace(tokens)
+	p := &parser{tokens: tokens}
+	nodes, stop, err := p.parseNodes()
+	if err != nil {
+		return nil, err
+	}
+	if stop != nil {
+		return nil, syntaxErrorf(stop.line, "unexpected {{%s}} outside of a block", describe(*stop))
+	}
+	return &Template{nodes: nodes}, nil
+}
+
+//MustParse is like Parse but panics if the template can't be parsed. Meant for templates in tests and code
+func MustParse(source string) *Template {
+	template, err := Parse(source)
+	if err != nil {
+		panic(err)
+	}
+	return template
+}
+
+func describe(t token) string {
+	switch t.kind {
+	case tokenClose:
+		return "/" + t.text
+	case tokenOpen:
+		return "#" + t.text
+	}
+	return t.text
+}
+
+func lex(source string) ([]token, error) {
+	var tokens []token
+	line := 1
+	for len(source) > 0 {
+		start := strings.Index(source, "{{")
+		if start < 0 {
+			tokens = append(tokens, token{kind: tokenText, text: source, line: line})
+			break
+		}
+		if start > 0 {
+			tokens = append(tokens, token{kind: tokenText, text: source[:start], line: line})
+			line += strings.Count(source[:start], "\n")
+			source = source[start:]
+		}
+
+		closing := "}}"
+		switch {
+		case strings.HasPrefix(source, "{{{") || strings.HasPrefix(source, "{{~{"):
+			closing = "}}}"
+		case strings.HasPrefix(source, "{{!--") || strings.HasPrefix(source, "{{~!--"):
+			closing = "--}}"
+		}
+		end := strings.Index(source, closing)
+		if end < 0 {
+			return nil, syntaxErrorf(line, "unclosed mustache")
+		}
+		end += len(closing)
+		content := source[2 : end-2]
+		t := token{line: line}
+		if strings.HasPrefix(content, "~") {
+			t.trimLeft = true
+			content = content[1:]
+		}
+		if strings.HasSuffix(content, "~") && closing != "}}}" {
+			t.trimRight = true
+			content = content[:len(content)-1]
+		}
+		switch {
+		case strings.HasPrefix(content, "!"):
+			t.kind = tokenComment
+		case strings.HasPrefix(content, "{"):
+			content = content[1 : len(content)-1]
+			if strings.HasSuffix(content, "~") {
+				t.trimRight = true
+				content = content[:len(content)-1]
+			}
+			t.kind, t.text = tokenRaw, strings.TrimSpace(content)
+		case strings.HasPrefix(content, "&"):
+			t.kind, t.text = tokenRaw, strings.TrimSpace(content[1:])
+		case strings.HasPrefix(content, "#"):
+			t.kind, t.text = tokenOpen, strings.TrimSpace(content[1:])
+		case strings.HasPrefix(content, "/"):
+			t.kind, t.text = tokenClose, strings.TrimSpace(content[1:])
+		case strings.TrimSpace(content) == "else" || strings.HasPrefix(strings.TrimSpace(content), "else "):
+			t.kind, t.text = tokenElse, strings.TrimSpace(content)
+		case strings.TrimSpace(content) == "^":
+			t.kind, t.text = tokenElse, "else"
+		default:
+			t.kind, t.text = tokenMustache, strings.TrimSpace(content)
+		}
+		if t.text == "" && t.kind != tokenComment && t.kind != tokenElse {
+			return nil, syntaxErrorf(line, "empty mustache")
+		}
+		tokens = append(tokens, t)
+		line += strings.Count(source[:end], "\n")
+		source = source[end:]
+	}
+	return tokens, nil
+}
+
+//trimWhitespace applies the whitespace control of {{~ and ~}} to the neighbouring text tokens
+func trimWhitespace(tokens []token) {
+	for i, t := range tokens {
+		if t.kind == tokenText {
+			continue
+		}
+		if t.trimLeft && i > 0 && tokens[i-1].kind == tokenText {
+			tokens[i-1].text = strings.TrimRight(tokens[i-1].text, " \t\r\n")
+		}
+		if t.trimRight && i+1 < len(tokens) && tokens[i+1].kind == tokenText {
+			tokens[i+1].text = strings.TrimLeft(tokens[i+1].text, " \t\r\n")
+		}
+	}
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+//parseNodes parses until the end of the template or an else or closing mustache, which is returned
+func (p *parser) parseNodes() ([]node, *token, error) {
+	var nodes []node
+	for p.pos < len(p.tokens) {
+		t := p.tokens[p.pos]
+		p.pos++
+		switch t.kind {
+		case tokenText:
+			nodes = append(nodes, textNode(t.text))
+		case tokenComment:
+		case tokenMustache, tokenRaw:
+			c, err := parseCall(t.text, t.line)
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(c.arguments) > 0 && !inlineHelpers[c.name] {
+				return nil, nil, syntaxErrorf(t.line, "unknown helper %s", c.name)
+			}
+			nodes = append(nodes, &mustacheNode{call: c, escape: t.kind == tokenMustache, line: t.line})
+		case tokenOpen:
+			c, err := parseCall(t.text, t.line)
+			if err != nil {
+				return nil, nil, err
+			}
+			block, err := p.parseBlock(c, c.name, t.line)
+			if err != nil {
+				return nil, nil, err
+			}
+			nodes = append(nodes, block)
+		case tokenElse, tokenClose:
+			return nodes, &t, nil
+		}
+	}
+	return nodes, nil, nil
+}
+
+//parseBlock parses the body and inverse of a block which ends with {{/closing}}. An {{else if ...}} starts a nested
+//block which ends with the same closing mustache
+func (p *parser) parseBlock(c call, closing string, line int) (*blockNode, error) {
+	if !blockHelpers[c.name] {
+		return nil, syntaxErrorf(line, "unknown block helper %s", c.name)
+	}
+	block := &blockNode{call: c, line: line}
+	body, stop, err := p.parseNodes()
+	if err != nil {
+		return nil, err
+	}
+	block.body = body
+	if stop != nil && stop.kind == tokenElse {
+		if chained := strings.TrimSpace(strings.TrimPrefix(stop.text, "else")); chained != "" {
+			c, err := parseCall(chained, stop.line)
+			if err != nil {
+				return nil, err
+			}
+			nested, err := p.parseBlock(c, closing, stop.line)
+			if err != nil {
+				return nil, err
+			}
+			block.inverse = []node{nested}
+			return block, nil
+		}
+		block.inverse, stop, err = p.parseNodes()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if stop == nil || stop.kind != tokenClose {
+		return nil, syntaxErrorf(line, "unclosed block {{#%s}}", closing)
+	}
+	if stop.text != closing {
+		return nil, syntaxErrorf(stop.line, "{{/%s}} does not close {{#%s}}", stop.text, closing)
+	}
+	return block, nil
+}
+
+func parseCall(content string, line int) (call, error) {
+	words, err := splitArguments(content, line)
+	if err != nil {
+		return call{}, err
+	}
+	c := call{name: words[0]}
+	for _, word := range words[1:] {
+		c.arguments = append(c.arguments, parseArgument(word))
+	}
+	return c, nil
+}
+
+//splitArguments splits the content of a mustache at whitespace outside of quotes. Quoted arguments keep their quotes
+func splitArguments(content string, line int) ([]string, error) {
+	var words []string
+	for content = strings.TrimSpace(content); content != ""; content = strings.TrimSpace(content) {
+		if content[0] == '"' || content[0] == '\'' {
+			end := strings.IndexByte(content[1:], content[0])
+			if end < 0 {
+				return nil, syntaxErrorf(line, "unterminated string %s", content)
+			}
+			words = append(words, content[:end+2])
+			content = content[end+2:]
+			continue
+		}
+		end := strings.IndexAny(content, " \t\r\n")
+		if end < 0 {
+			end = len(content)
+		}
+		words = append(words, content[:end])
+		content = content[end:]
+	}
+	if len(words) == 0 {
+		return nil, syntaxErrorf(line, "empty mustache")
+	}
+	return words, nil
+}
+
+func parseArgument(word string) argument {
+	if word[0] == '"' || word[0] == '\'' {
+		return argument{literal: word[1 : len(word)-1]}
+	}
+	switch word {
+	case "true":
+		return argument{literal: true}
+	case "false":
+		return argument{literal: false}
+	case "null", "undefined":
+		return argument{}
+	}
+	if number, err := strconv.ParseFloat(word, 64); err == nil {
+		return argument{literal: number}
+	}
+	return argument{path: word, isPath: true}
+}
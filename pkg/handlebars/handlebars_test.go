@@ -0,0 +1,87 @@
+package handlebars
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+type HandlebarsTestSuite struct {
+	suite.Suite
+	data map[string]interface{}
+}
+
+func (suite *HandlebarsTestSuite) SetupTest() {
+	suite.data = make(map[string]interface{})
+	err := json.Unmarshal([]byte(`{
+		"name": "Alex <Admin>",
+		"user": {"first": "Bob", "orders": 3},
+		"items": [{"title": "Book", "price": 12.5}, {"title": "Pen", "price": 2}],
+		"tags": {"b": "two", "a": "one"},
+		"empty": [],
+		"zero": 0,
+		"plan": "pro"
+	}`), &suite.data)
+	suite.Require().Nil(err)
+}
+
+func (suite *HandlebarsTestSuite) render(source string) string {
+	template, err := Parse(source)
+	suite.Require().Nil(err)
+	return template.Execute(suite.data)
+}
+
+func (suite *HandlebarsTestSuite) TestVariables() {
+	suite.Equal("Hello Alex &lt;Admin&gt;!", suite.render("Hello {{name}}!"))
+	suite.Equal("Hello Alex <Admin>!", suite.render("Hello {{{name}}}!"), "Triple stash does not escape")
+	suite.Equal("Alex <Admin>", suite.render("{{& name}}"))
+	suite.Equal("Bob has 3 orders", suite.render("{{user.first}} has {{ user.orders }} orders"))
+	suite.Equal("Pen", suite.render("{{items.1.title}}"))
+	suite.Equal("", suite.render("{{missing.path}}"), "Missing values are empty")
+	suite.Equal("ab", suite.render("a{{! comment }}{{!-- {{name}} --}}b"))
+}
+
+func (suite *HandlebarsTestSuite) TestWhitespaceControl() {
+	suite.Equal("[Bob]", suite.render("[  {{~user.first~}}  ]"))
+	suite.Equal("Book,Pen,", suite.render("{{#each items~}}\n  {{title}},\n{{~/each}}"))
+}
+
+func (suite *HandlebarsTestSuite) TestConditionals() {
+	suite.Equal("yes", suite.render("{{#if user}}yes{{else}}no{{/if}}"))
+	suite.Equal("no", suite.render("{{#if zero}}yes{{else}}no{{/if}}"), "Zero is false")
+	suite.Equal("no", suite.render("{{#if empty}}yes{{else}}no{{/if}}"), "Empty lists are false")
+	suite.Equal("none", suite.render("{{#unless user}}some{{else}}none{{/unless}}"))
+	suite.Equal("b", suite.render("{{#if missing}}a{{else if user}}b{{else}}c{{/if}}"))
+	suite.Equal("c", suite.render("{{#if missing}}a{{else if zero}}b{{else}}c{{/if}}"))
+}
+
+func (suite *HandlebarsTestSuite) TestSendGridHelpers() {
+	suite.Equal("Pro", suite.render(`{{#equals plan "pro"}}Pro{{else}}Free{{/equals}}`))
+	suite.Equal("Free", suite.render(`{{#notEquals plan "pro"}}Pro{{else}}Free{{/notEquals}}`))
+	suite.Equal("many", suite.render(`{{#greaterThan user.orders 2}}many{{/greaterThan}}`))
+	suite.Equal("", suite.render(`{{#lessThan user.orders 2}}few{{/lessThan}}`))
+	suite.Equal("both", suite.render(`{{#and user plan}}both{{/and}}`))
+	suite.Equal("one", suite.render(`{{#or missing plan}}one{{/or}}`))
+	suite.Equal("Bob Guest", suite.render(`{{insert user.first "default=Guest"}} {{insert nobody "default=Guest"}}`))
+	suite.Equal("2", suite.render(`{{length items}}`))
+}
+
+func (suite *HandlebarsTestSuite) TestEachAndWith() {
+	suite.Equal("0:Book=12.5 1:Pen=2 ", suite.render("{{#each items}}{{@index}}:{{title}}={{price}} {{/each}}"))
+	suite.Equal("Book(pro)Pen(pro)", suite.render("{{#each items}}{{title}}({{../plan}}){{/each}}"))
+	suite.Equal("a=one,b=two", suite.render("{{#each tags}}{{@key}}={{this}}{{#unless @last}},{{/unless}}{{/each}}"))
+	suite.Equal("nothing", suite.render("{{#each empty}}item{{else}}nothing{{/each}}"))
+	suite.Equal("Bob 3", suite.render("{{#with user}}{{first}} {{./orders}}{{/with}}"))
+}
+
+func (suite *HandlebarsTestSuite) TestSyntaxErrors() {
+	for _, source := range []string{"{{name", "{{#if name}}open", "{{#if name}}{{/each}}", "{{/if}}", "{{#loop x}}{{/loop}}",
+		"{{unknown a b}}", "{{}}", `{{insert "open}}`} {
+		_, err := Parse(source)
+		suite.IsType(&SyntaxError{}, err, source)
+	}
+}
+
+func TestHandlebarsTestSuite(t *testing.T) {
+	suite.Run(t, new(HandlebarsTestSuite))
+}
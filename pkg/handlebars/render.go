@@ -0,0 +1,256 @@
+package handlebars
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//scope is the context a part of the template is rendered in. Blocks like each and with render their body in a new
+//scope, ../ refers to the parent scope
+type scope struct {
+	value  interface{}
+	parent *scope
+	//data holds the @ variables of each
+	data map[string]interface{}
+}
+
+//Execute renders the template with the data, usually decoded by encoding/json into maps, slices and primitives.
+//Missing values render as empty strings like in Handlebars
+func (t *Template) Execute(data interface{}) string {
+	var builder strings.Builder
+	render(&builder, t.nodes, &scope{value: data})
+	return builder.String()
+}
+
+func render(builder *strings.Builder, nodes []node, s *scope) {
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case textNode:
+			builder.WriteString(string(n))
+		case *mustacheNode:
+			value := stringify(evaluateInline(n.call, s))
+			if n.escape {
+				value = escape(value)
+			}
+			builder.WriteString(value)
+		case *blockNode:
+			renderBlock(builder, n, s)
+		}
+	}
+}
+
+func evaluateInline(c call, s *scope) interface{} {
+	switch c.name {
+	case "insert":
+		var value interface{}
+		if len(c.arguments) > 0 {
+			value = resolveArgument(c.arguments[0], s)
+		}
+		if !truthy(value) && len(c.arguments) > 1 {
+			return strings.TrimPrefix(stringify(resolveArgument(c.arguments[1], s)), "default=")
+		}
+		return value
+	case "length":
+		if len(c.arguments) == 0 {
+			return 0.0
+		}
+		switch value := resolveArgument(c.arguments[0], s).(type) {
+		case []interface{}:
+			return float64(len(value))
+		case string:
+			return float64(len([]rune(value)))
+		case map[string]interface{}:
+			return float64(len(value))
+		}
+		return 0.0
+	}
+	return resolve(c.name, s)
+}
+
+func renderBlock(builder *strings.Builder, block *blockNode, s *scope) {
+	arguments := make([]interface{}, len(block.arguments))
+	for i, arg := range block.arguments {
+		arguments[i] = resolveArgument(arg, s)
+	}
+	first := func() interface{} {
+		if len(arguments) == 0 {
+			return nil
+		}
+		return arguments[0]
+	}
+
+	var condition bool
+	switch block.name {
+	case "if":
+		condition = truthy(first())
+	case "unless":
+		condition = !truthy(first())
+	case "with":
+		if truthy(first()) {
+			render(builder, block.body, &scope{value: first(), parent: s})
+			return
+		}
+	case "each":
+		if renderEach(builder, block, first(), s) {
+			return
+		}
+	case "equals", "notEquals":
+		condition = len(arguments) == 2 && stringify(arguments[0]) == stringify(arguments[1])
+		if block.name == "notEquals" {
+			condition = len(arguments) == 2 && !condition
+		}
+	case "and":
+		condition = len(arguments) > 0
+		for _, argument := range arguments {
+			condition = condition && truthy(argument)
+		}
+	case "or":
+		for _, argument := range arguments {
+			condition = condition || truthy(argument)
+		}
+	case "greaterThan", "lessThan":
+		if len(arguments) == 2 {
+			left, leftOk := number(arguments[0])
+			right, rightOk := number(arguments[1])
+			condition = leftOk && rightOk && ((block.name == "greaterThan" && left > right) || (block.name == "lessThan" && left < right))
+		}
+	}
+	if condition {
+		render(builder, block.body, s)
+	} else {
+		render(builder, block.inverse, s)
+	}
+}
+
+//renderEach renders the body for every element of a list or every value of an object, the latter sorted by key.
+//Returns false if there was nothing to iterate
+func renderEach(builder *strings.Builder, block *blockNode, value interface{}, s *scope) bool {
+	switch value := value.(type) {
+	case []interface{}:
+		for i, item := range value {
+			data := map[string]interface{}{"index": float64(i), "first": i == 0, "last": i == len(value)-1}
+			render(builder, block.body, &scope{value: item, parent: s, data: data})
+		}
+		return len(value) > 0
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for i, key := range keys {
+			data := map[string]interface{}{"key": key, "index": float64(i), "first": i == 0, "last": i == len(keys)-1}
+			render(builder, block.body, &scope{value: value[key], parent: s, data: data})
+		}
+		return len(keys) > 0
+	}
+	return false
+}
+
+func resolveArgument(arg argument, s *scope) interface{} {
+	if !arg.isPath {
+		return arg.literal
+	}
+	return resolve(arg.path, s)
+}
+
+//resolve looks up a path like this, name, user.name, ../title, ./name or @index in the scope
+func resolve(path string, s *scope) interface{} {
+	for strings.HasPrefix(path, "../") {
+		path = path[3:]
+		if s.parent != nil {
+			s = s.parent
+		}
+	}
+	path = strings.TrimPrefix(path, "./")
+	if strings.HasPrefix(path, "@") {
+		for ; s != nil; s = s.parent {
+			if value, exists := s.data[path[1:]]; exists {
+				return value
+			}
+		}
+		return nil
+	}
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "this"), ".")
+	if path == "" {
+		return s.value
+	}
+	value := s.value
+	for _, segment := range strings.Split(path, ".") {
+		switch current := value.(type) {
+		case map[string]interface{}:
+			value = current[segment]
+		case []interface{}:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(current) {
+				return nil
+			}
+			value = current[index]
+		default:
+			return nil
+		}
+	}
+	return value
+}
+
+//truthy follows Handlebars, which treats false, null, empty strings, 0 and empty lists as false
+func truthy(value interface{}) bool {
+	switch value := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return value
+	case string:
+		return value != ""
+	case float64:
+		return value != 0
+	case int:
+		return value != 0
+	case []interface{}:
+		return len(value) > 0
+	}
+	return true
+}
+
+func number(value interface{}) (float64, bool) {
+	switch value := value.(type) {
+	case float64:
+		return value, true
+	case int:
+		return float64(value), true
+	case string:
+		parsed, err := strconv.ParseFloat(value, 64)
+		return parsed, err == nil
+	}
+	return 0, false
+}
+
+//stringify converts a value the way JavaScript does when it is concatenated to a string
+func stringify(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case bool:
+		return strconv.FormatBool(value)
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case int:
+		return strconv.Itoa(value)
+	case []interface{}:
+		items := make([]string, len(value))
+		for i, item := range value {
+			items[i] = stringify(item)
+		}
+		return strings.Join(items, ",")
+	}
+	return "[object Object]"
+}
+
+var escaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\"", "&quot;", "'", "&#x27;", "`", "&#x60;", "=", "&#x3D;")
+
+func escape(value string) string {
+	return escaper.Replace(value)
+}
@@ -1,56 +1,370 @@
 package imap
 
 import (
+	"fmt"
+	"github.com/da-coda/mailpie/pkg/auth"
 	"github.com/da-coda/mailpie/pkg/event"
 	"github.com/da-coda/mailpie/pkg/instances"
+	"github.com/da-coda/mailpie/pkg/sieve"
 	"github.com/da-coda/mailpie/pkg/store"
 	"github.com/emersion/go-imap"
 	imapBackend "github.com/emersion/go-imap/backend"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"strings"
+	"sync"
 	"time"
 )
 
+//BackendOptions configures how the backend maps logins to users and mails to mailboxes
+type BackendOptions struct {
+	//PerRecipient gives every login its own INBOX containing only the mails addressed to the login name
+	PerRecipient bool
+	//AdminUser is a login name which sees every mail in PerRecipient mode
+	AdminUser string
+	//Authenticator checks the login credentials. Without configured users every login is accepted
+	Authenticator *auth.Authenticator
+	//Sieve decides which mailboxes a mail is placed in. Without a script every mail goes into the INBOX
+	Sieve *sieve.Script
+	//MailStore receives the mails appended by clients and records which folders mails are in. Without a store appended
+	//mails only exist in the IMAP mailbox
+	MailStore *store.MailStore
+	//MessageQueue is the queue the MailStore dispatches to, the backend places the stored mails in the mailboxes and
+	//removes the deleted ones. Without a queue only the mails appended by clients reach the mailboxes
+	MessageQueue event.Subscribable
+	//DataDir is the directory the folders created by clients are persisted in. Without a directory they are only
+	//kept in memory
+	DataDir string
+}
+
+//receivedMail is a mail together with the mailboxes it was placed in, so that users created later get the same view
+type receivedMail struct {
+	mail       instances.Mail
+	deliveries []sieve.Delivery
+}
+
 type backend struct {
-	Magpie        imapBackend.User
+	sync.Mutex
+	options BackendOptions
+	folders *folderStore
+	users   map[string]*user
+	mails   []receivedMail
+	//appended are the keys of mails appended by clients which are not distributed to the INBOX of all users
+	appended map[string]bool
+	//UpdateChannel receives the updates for the clients, delivered by the server created with NewServer
 	UpdateChannel chan imapBackend.Update
+	//subscription receives the events of the MailStore until the backend is closed
+	subscription *event.Subscription
+	//closed is closed once the server delivering the updates stopped, later updates are discarded
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
-func NewBackend() imapBackend.Backend {
-	user := NewUser("Magpie")
+func NewBackend(options BackendOptions) imapBackend.Backend {
 	updates := make(chan imapBackend.Update)
-	backend := &backend{Magpie: user, UpdateChannel: updates}
-	events := event.CreateOrGet()
-	events.Subscribe(store.NewMailStoredEvent, backend.Handler)
+	backend := &backend{options: options, users: make(map[string]*user), appended: make(map[string]bool), UpdateChannel: updates, closed: make(chan struct{})}
+	if options.DataDir != "" {
+		folders, err := loadFolderStore(options.DataDir)
+		if err != nil {
+			logrus.WithError(err).Error("Unable to load persisted IMAP folders")
+		}
+		backend.folders = folders
+	}
+	if options.MessageQueue != nil {
+		//one subscription for both events, so that a deletion is never handled before the mail was placed
+		backend.subscription = options.MessageQueue.SubscribeWithOptions(event.SubscribeOptions{Events: []event.Event{store.NewMailStoredEvent, store.MailDeletedEvent}}, backend.Handler)
+	}
 	return backend
 }
 
-func (b backend) Updates() <-chan imapBackend.Update {
-	return b.UpdateChannel
+//Login checks the credentials, maps the login name to a user and creates the user with all mails visible to it if it
+//doesn't exist yet. Every user has its own mailboxes, so flags and moved mails of one login don't affect others
+func (b *backend) Login(_ *imap.ConnInfo, username, password string) (imapBackend.User, error) {
+	if !b.options.Authenticator.Authenticate(username, password) {
+		logrus.WithField("user", username).Info("Rejected IMAP login with invalid credentials")
+		return nil, imapBackend.ErrInvalidCredentials
+	}
+	name := b.username(username)
+
+	b.Lock()
+	defer b.Unlock()
+	u, exists := b.users[name]
+	if exists {
+		return u, nil
+	}
+	u = newUser(name, b.folders)
+	u.backend = b
+	for _, received := range b.mails {
+		if !b.visibleTo(name, received.mail) {
+			continue
+		}
+		for _, delivery := range received.deliveries {
+			_, err := b.place(u, received.mail, delivery)
+			if err != nil {
+				logrus.WithError(err).WithField("user", name).Error("Unable to create message for new IMAP user")
+			}
+		}
+	}
+	b.users[name] = u
+	return u, nil
+}
+
+//Handler processes the events of the MailStore
+func (b *backend) Handler(_ string, data interface{}) {
+	switch e := data.(type) {
+	case store.MailStored:
+		b.mailStored(e.Mail)
+	case store.MailDeleted:
+		b.mailDeleted(e.Mail)
+	}
+}
+
+//mailStored puts a newly stored mail into the mailboxes chosen by the sieve script for every user allowed to see it and
+//notifies connected clients. Mails appended by clients are skipped, they are already in their mailbox, as well as mails
+//of other stores
+func (b *backend) mailStored(mail instances.Mail) {
+	if b.options.MailStore != nil {
+		if _, err := b.options.MailStore.GetSingle(mail.Key); err != nil {
+			return
+		}
+	}
+	b.Lock()
+	if b.appended[mail.Key] {
+		delete(b.appended, mail.Key)
+		b.Unlock()
+		return
+	}
+	b.Unlock()
+	deliveries := b.deliveries(mail)
+
+	b.Lock()
+	b.mails = append(b.mails, receivedMail{mail: mail, deliveries: deliveries})
+	var recipients []*user
+	for name, u := range b.users {
+		if b.visibleTo(name, mail) {
+			recipients = append(recipients, u)
+		}
+	}
+	b.Unlock()
+
+	for _, u := range recipients {
+		for _, delivery := range deliveries {
+			b.deliver(u, mail, delivery)
+		}
+	}
+}
+
+//mailDeleted removes a mail deleted from the MailStore, e.g. by a POP3 client, from the mailboxes of all users and
+//notifies connected clients about the expunged messages
+func (b *backend) mailDeleted(mail instances.Mail) {
+	if mail.Key == "" {
+		return
+	}
+	b.Lock()
+	for i, received := range b.mails {
+		if received.mail.Key == mail.Key {
+			b.mails = append(b.mails[:i:i], b.mails[i+1:]...)
+			break
+		}
+	}
+	delete(b.appended, mail.Key)
+	users := make([]*user, 0, len(b.users))
+	for _, u := range b.users {
+		users = append(users, u)
+	}
+	b.Unlock()
+
+	for _, u := range users {
+		mailboxes, _ := u.ListMailboxes(false)
+		for _, mb := range mailboxes {
+			mb.(*mailbox).expunge(func(msg *message) bool {
+				return msg.key == mail.Key
+			})
+		}
+	}
 }
 
-func (b backend) Login(_ *imap.ConnInfo, _, _ string) (imapBackend.User, error) {
-	return b.Magpie, nil
+//deliveries evaluates the sieve script for the mail. If there is no script or the script fails, the mail is kept in
+//the INBOX so that no mail gets lost
+func (b *backend) deliveries(mail instances.Mail) []sieve.Delivery {
+	inbox := []sieve.Delivery{{Mailbox: sieve.Inbox}}
+	if b.options.Sieve == nil {
+		return inbox
+	}
+	result, err := b.options.Sieve.Evaluate(mail)
+	if err != nil {
+		logrus.WithError(err).Error("Unable to evaluate sieve script, keeping mail in INBOX")
+		return inbox
+	}
+	return result.Deliveries()
 }
 
-func (b backend) Handler(_ string, data interface{}) {
-	mail := data.(instances.Mail)
-	mb, err := b.Magpie.GetMailbox("INBOX")
+func (b *backend) deliver(u *user, mail instances.Mail, delivery sieve.Delivery) {
+	mb, err := b.place(u, mail, delivery)
+	if err != nil {
+		logrus.WithError(err).WithField("user", u.username).WithField("mailbox", delivery.Mailbox).Error("Unable to create message in IMAP handler")
+		return
+	}
+	b.notifyMailbox(u, mb)
+}
 
+//place puts the mail into the mailbox of the delivery, creating the mailbox if it doesn't exist yet
+func (b *backend) place(u *user, mail instances.Mail, delivery sieve.Delivery) (*mailbox, error) {
+	mb, err := u.getMailbox(delivery.Mailbox)
+	if err == imapBackend.ErrNoSuchMailbox {
+		err = u.createMailbox(delivery.Mailbox)
+		if err != nil && err != imapBackend.ErrMailboxAlreadyExists {
+			return nil, err
+		}
+		mb, err = u.getMailbox(delivery.Mailbox)
+	}
 	if err != nil {
-		logrus.WithError(err).Error("Unable to get mailbox 'INBOX' in IMAP handler")
+		return nil, err
 	}
+	flags := append([]string{imap.RecentFlag}, delivery.Flags...)
+	mb.appendMessage(mail.Key, flags, time.Now(), mail.RawMessage)
+	b.addToFolder(mail.Key, u.username, mb.Name())
+	return mb, nil
+}
 
-	err = mb.CreateMessage([]string{imap.RecentFlag}, time.Now(), &mail)
+//appendMail adds a mail appended by a client to the MailStore, so that it is handled like every other stored mail, but
+//puts it only into the mailbox it was appended to. Returns the UID of the new message
+func (b *backend) appendMail(u *user, mb *mailbox, flags []string, date time.Time, content []byte) (uint32, error) {
+	if b.options.MailStore == nil {
+		uid := mb.appendMessage("", flags, date, content)
+		b.notifyMailbox(u, mb)
+		return uid, nil
+	}
+	mail, err := instances.ParseMail(content)
 	if err != nil {
-		logrus.WithError(err).Error("Unable to create message in IMAP handler")
+		return 0, errors.Wrap(err, "unable to parse appended mail")
 	}
-	update := imapBackend.NewUpdate("Magpie", "INBOX")
-	mailboxStatus, err := mb.Status([]imap.StatusItem{imap.StatusMessages, imap.StatusUidNext, imap.StatusRecent, imap.StatusUidValidity, imap.StatusRecent})
+	key := fmt.Sprintf("%s_%s_%d", u.username, mb.Name(), time.Now().UnixNano())
+	b.Lock()
+	b.appended[key] = true
+	b.Unlock()
+	err = b.options.MailStore.Add(key, *mail)
+	if err != nil {
+		b.Lock()
+		delete(b.appended, key)
+		b.Unlock()
+		return 0, errors.Wrap(err, "unable to store appended mail")
+	}
+	uid := mb.appendMessage(key, flags, date, content)
+	b.addToFolder(key, u.username, mb.Name())
+	b.notifyMailbox(u, mb)
+	return uid, nil
+}
+
+//notifyMailbox sends the current status of the mailbox to the clients which selected it
+func (b *backend) notifyMailbox(u *user, mb *mailbox) {
+	if b == nil {
+		return
+	}
+	mailboxStatus, err := mb.Status([]imap.StatusItem{imap.StatusMessages, imap.StatusUidNext, imap.StatusRecent, imap.StatusUidValidity})
 	if err != nil {
 		logrus.WithError(err).Error("Unable to get mailbox status")
+		return
 	}
-	b.UpdateChannel <- &imapBackend.MailboxUpdate{
-		Update:        update,
+	b.send(&imapBackend.MailboxUpdate{
+		Update:        imapBackend.NewUpdate(u.username, mailboxStatus.Name),
 		MailboxStatus: mailboxStatus,
+	})
+}
+
+//notify sends the update to the clients and waits until they received it, so that untagged responses are written
+//before the tagged response of the command causing them
+func (b *backend) notify(update imapBackend.Update) {
+	if b == nil {
+		return
+	}
+	//Done creates the channel lazily, so it has to be called before the update is handed over
+	done := update.Done()
+	if b.send(update) {
+		<-done
+	}
+}
+
+//send hands the update over to the server, returns false if it was discarded because the backend is closed
+func (b *backend) send(update imapBackend.Update) bool {
+	select {
+	case b.UpdateChannel <- update:
+		return true
+	case <-b.closed:
+		return false
+	}
+}
+
+//close stops handling the events of the MailStore and discards the updates from now on, called once the server
+//delivering them is closed
+func (b *backend) close() {
+	b.closeOnce.Do(func() {
+		if b.subscription != nil {
+			b.subscription.Cancel()
+		}
+		close(b.closed)
+	})
+}
+
+//addToFolder records in the MailStore that the mail is in the folder of the user
+func (b *backend) addToFolder(key string, username string, folder string) {
+	if b == nil || b.options.MailStore == nil || key == "" {
+		return
+	}
+	err := b.options.MailStore.AddToFolder(key, username, folder)
+	if err != nil {
+		logrus.WithError(err).WithField("key", key).Error("Unable to record folder of mail")
+	}
+}
+
+//removeFromFolder records in the MailStore that the mail is no longer in the folder of the user
+func (b *backend) removeFromFolder(key string, username string, folder string) {
+	if b == nil || b.options.MailStore == nil || key == "" {
+		return
+	}
+	b.options.MailStore.RemoveFromFolder(key, username, folder)
+}
+
+//renameFolder updates the folders of all mails of the user in the MailStore after a mailbox was renamed
+func (b *backend) renameFolder(username string, from string, to string) {
+	if b == nil || b.options.MailStore == nil {
+		return
+	}
+	b.options.MailStore.RenameFolder(username, from, to, Delimiter)
+}
+
+//username returns the internal user name for a login name. In per recipient mode addresses are normalized so that
+//plus addressed logins share the mailboxes of the address
+func (b *backend) username(login string) string {
+	if !b.options.PerRecipient || (b.options.AdminUser != "" && login == b.options.AdminUser) {
+		return login
+	}
+	return NormalizeAddress(login)
+}
+
+//visibleTo must be called while holding the lock
+func (b *backend) visibleTo(name string, mail instances.Mail) bool {
+	if !b.options.PerRecipient || (b.options.AdminUser != "" && name == b.options.AdminUser) {
+		return true
+	}
+	for _, recipient := range mail.Recipients() {
+		if NormalizeAddress(recipient) == name {
+			return true
+		}
+	}
+	return false
+}
+
+//NormalizeAddress lowercases an address and removes plus addressing, so bob+test@Example.com becomes bob@example.com
+func NormalizeAddress(address string) string {
+	address = strings.ToLower(strings.Trim(strings.TrimSpace(address), "<>"))
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return address
+	}
+	local, domain := address[:at], address[at:]
+	if plus := strings.Index(local, "+"); plus >= 0 {
+		local = local[:plus]
 	}
+	return local + domain
 }
@@ -0,0 +1,162 @@
+package imap
+
+import (
+	"github.com/da-coda/mailpie/pkg/auth"
+	"github.com/da-coda/mailpie/pkg/config"
+	"github.com/da-coda/mailpie/pkg/event"
+	"github.com/da-coda/mailpie/pkg/instances"
+	"github.com/da-coda/mailpie/pkg/sieve"
+	"github.com/da-coda/mailpie/pkg/store"
+	"github.com/emersion/go-imap"
+	imapBackend "github.com/emersion/go-imap/backend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+var rawMail = []byte(`MIME-Version: 1.0
+Date: Wed, 27 Jan 2021 17:00:48 +0100
+From: alex@example.com
+To: bob@example.com, cora@example.com
+Subject: Hello!
+Content-Type: text/plain; charset=UTF-8
+
+Hello Bob and Cora!
+`)
+
+type BackendUnitTestSuite struct {
+	suite.Suite
+}
+
+func newTestBackend(options BackendOptions) *backend {
+	be := NewBackend(options).(*backend)
+	go func() {
+		for update := range be.UpdateChannel {
+			close(update.Done())
+		}
+	}()
+	return be
+}
+
+func newTestMail(t *testing.T, envelopeTo ...string) instances.Mail {
+	mail, err := instances.ParseMail(rawMail)
+	assert.Nil(t, err, "Unexpected error")
+	mail.EnvelopeFrom = "alex@example.com"
+	mail.EnvelopeTo = envelopeTo
+	return *mail
+}
+
+func inboxMessages(t *testing.T, be *backend, login string) uint32 {
+	u, err := be.Login(nil, login, "")
+	assert.Nil(t, err, "Unexpected error")
+	inbox, err := u.GetMailbox("INBOX")
+	assert.Nil(t, err, "Unexpected error")
+	status, err := inbox.Status([]imap.StatusItem{imap.StatusMessages})
+	assert.Nil(t, err, "Unexpected error")
+	return status.Messages
+}
+
+func (suite *BackendUnitTestSuite) TestLogin_SeparateUsers() {
+	be := newTestBackend(BackendOptions{})
+	be.Handler("test", store.MailStored{Mail: newTestMail(suite.T(), "bob@example.com")})
+	first, err := be.Login(nil, "bob@example.com", "")
+	suite.Nil(err)
+	second, err := be.Login(nil, "dan@example.com", "")
+	suite.Nil(err)
+	suite.NotSame(first, second, "Every login should have its own mailbox state")
+	suite.Equal(uint32(1), inboxMessages(suite.T(), be, "dan@example.com"), "Without per recipient mode every user sees all mails")
+
+	inbox, err := first.GetMailbox("INBOX")
+	suite.Require().Nil(err)
+	seqSet, _ := imap.ParseSeqSet("1")
+	suite.Nil(inbox.UpdateMessagesFlags(false, seqSet, imap.AddFlags, []string{imap.SeenFlag}))
+	otherInbox, err := second.GetMailbox("INBOX")
+	suite.Require().Nil(err)
+	status, err := otherInbox.Status([]imap.StatusItem{imap.StatusUnseen})
+	suite.Nil(err)
+	suite.Equal(uint32(1), status.Unseen, "Read flags of one user should not affect others")
+}
+
+func (suite *BackendUnitTestSuite) TestLogin_Credentials() {
+	be := newTestBackend(BackendOptions{Authenticator: auth.NewAuthenticator([]config.User{{Username: "bob", Password: "secret"}})})
+	_, err := be.Login(nil, "bob", "wrong")
+	suite.Equal(imapBackend.ErrInvalidCredentials, err)
+	_, err = be.Login(nil, "dan", "secret")
+	suite.Equal(imapBackend.ErrInvalidCredentials, err)
+	u, err := be.Login(nil, "bob", "secret")
+	suite.Nil(err)
+	suite.Equal("bob", u.Username())
+}
+
+func (suite *BackendUnitTestSuite) TestPerRecipient_MailsBeforeLogin() {
+	be := newTestBackend(BackendOptions{PerRecipient: true, AdminUser: "admin"})
+	be.Handler("test", store.MailStored{Mail: newTestMail(suite.T(), "Bob+newsletter@example.com")})
+	be.Handler("test", store.MailStored{Mail: newTestMail(suite.T(), "cora@example.com")})
+
+	suite.Equal(uint32(1), inboxMessages(suite.T(), be, "bob@example.com"))
+	suite.Equal(uint32(1), inboxMessages(suite.T(), be, "cora@example.com"))
+	suite.Equal(uint32(0), inboxMessages(suite.T(), be, "dan@example.com"))
+	suite.Equal(uint32(2), inboxMessages(suite.T(), be, "admin"))
+}
+
+func (suite *BackendUnitTestSuite) TestPerRecipient_MailsAfterLogin() {
+	be := newTestBackend(BackendOptions{PerRecipient: true, AdminUser: "admin"})
+	suite.Equal(uint32(0), inboxMessages(suite.T(), be, "bob@example.com"))
+	suite.Equal(uint32(0), inboxMessages(suite.T(), be, "admin"))
+	be.Handler("test", store.MailStored{Mail: newTestMail(suite.T(), "bob@example.com", "cora@example.com")})
+	be.Handler("test", store.MailStored{Mail: newTestMail(suite.T(), "cora@example.com")})
+
+	suite.Equal(uint32(1), inboxMessages(suite.T(), be, "bob+imap@example.com"))
+	suite.Equal(uint32(2), inboxMessages(suite.T(), be, "cora@example.com"))
+	suite.Equal(uint32(2), inboxMessages(suite.T(), be, "admin"))
+}
+
+func (suite *BackendUnitTestSuite) TestPerRecipient_HeaderFallback() {
+	be := newTestBackend(BackendOptions{PerRecipient: true})
+	be.Handler("test", store.MailStored{Mail: newTestMail(suite.T())})
+	suite.Equal(uint32(1), inboxMessages(suite.T(), be, "cora@example.com"))
+}
+
+func (suite *BackendUnitTestSuite) TestSieve_FileIntoAndDiscard() {
+	script, err := sieve.Parse(`require ["fileinto", "imap4flags", "envelope"];
+if envelope :is "to" "dan@example.com" { discard; stop; }
+if header :contains "subject" "hello" { fileinto :flags "\\Flagged" "Greetings"; }`)
+	suite.Require().Nil(err)
+	be := newTestBackend(BackendOptions{Sieve: script})
+	be.Handler("test", store.MailStored{Mail: newTestMail(suite.T(), "bob@example.com")})
+	be.Handler("test", store.MailStored{Mail: newTestMail(suite.T(), "dan@example.com")})
+
+	u, err := be.Login(nil, "bob@example.com", "")
+	suite.Require().Nil(err)
+	suite.Equal(uint32(0), inboxMessages(suite.T(), be, "bob@example.com"))
+	greetings, err := u.GetMailbox("Greetings")
+	suite.Require().Nil(err, "Mailbox from fileinto should be created")
+	status, err := greetings.Status([]imap.StatusItem{imap.StatusMessages})
+	suite.Nil(err)
+	suite.Equal(uint32(1), status.Messages)
+	suite.Contains(status.Flags, "\\Flagged")
+}
+
+func (suite *BackendUnitTestSuite) TestHandler_DeletedMail() {
+	messageQueue := event.New()
+	mailStore := store.CreateMailStore(messageQueue)
+	be := newTestBackend(BackendOptions{MailStore: mailStore, MessageQueue: messageQueue})
+	suite.Nil(mailStore.Add("deleted-mail", newTestMail(suite.T(), "bob@example.com")))
+	messageQueue.Flush()
+	suite.Equal(uint32(1), inboxMessages(suite.T(), be, "bob@example.com"))
+
+	suite.Nil(mailStore.Delete("deleted-mail"))
+	messageQueue.Flush()
+	suite.Equal(uint32(0), inboxMessages(suite.T(), be, "bob@example.com"), "Deleted mail should be expunged for existing users")
+	suite.Equal(uint32(0), inboxMessages(suite.T(), be, "dan@example.com"), "Deleted mail should not be placed for new users")
+}
+
+func (suite *BackendUnitTestSuite) TestNormalizeAddress() {
+	suite.Equal("bob@example.com", NormalizeAddress("bob@example.com"))
+	suite.Equal("bob@example.com", NormalizeAddress("<Bob+Test@Example.COM>"))
+	suite.Equal("bob", NormalizeAddress("bob"))
+}
+
+func TestBackend(t *testing.T) {
+	suite.Run(t, new(BackendUnitTestSuite))
+}
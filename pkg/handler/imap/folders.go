@@ -0,0 +1,75 @@
+package imap
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+//folderStore persists the mailboxes created by IMAP clients per user, so that they survive a restart of Mailpie.
+//Mails are not persisted, only the folder hierarchy
+type folderStore struct {
+	sync.Mutex
+	path    string
+	folders map[string][]string
+}
+
+//loadFolderStore reads the folders from the folders.json in dataDir. A missing file is not an error
+func loadFolderStore(dataDir string) (*folderStore, error) {
+	store := &folderStore{path: filepath.Join(dataDir, "folders.json"), folders: make(map[string][]string)}
+	content, err := os.ReadFile(store.path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return store, errors.Wrap(err, "unable to read folders")
+	}
+	err = json.Unmarshal(content, &store.folders)
+	if err != nil {
+		return store, errors.Wrap(err, "unable to parse folders")
+	}
+	return store, nil
+}
+
+//get returns the persisted folders of the user. Safe to call on a nil store
+func (s *folderStore) get(username string) []string {
+	if s == nil {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	return append([]string{}, s.folders[username]...)
+}
+
+//set replaces the persisted folders of the user and writes all folders to disk. Safe to call on a nil store
+func (s *folderStore) set(username string, folders []string) error {
+	if s == nil {
+		return nil
+	}
+	sort.Strings(folders)
+	s.Lock()
+	defer s.Unlock()
+	if len(folders) == 0 {
+		delete(s.folders, username)
+	} else {
+		s.folders[username] = folders
+	}
+	content, err := json.MarshalIndent(s.folders, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal folders")
+	}
+	err = os.MkdirAll(filepath.Dir(s.path), 0755)
+	if err != nil {
+		return errors.Wrap(err, "unable to create data directory")
+	}
+	//write to a temporary file first so that a crash doesn't leave a broken file behind
+	tmp := s.path + ".tmp"
+	err = os.WriteFile(tmp, content, 0644)
+	if err != nil {
+		return errors.Wrap(err, "unable to write folders")
+	}
+	return errors.Wrap(os.Rename(tmp, s.path), "unable to replace folders")
+}
@@ -0,0 +1,381 @@
+package imap
+
+import (
+	"github.com/emersion/go-imap"
+	imapBackend "github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-imap/backend/memory"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const Delimiter = "/"
+
+//lastUidValidity is the UIDVALIDITY of the last created mailbox
+var lastUidValidity uint32
+
+//nextUidValidity returns a UIDVALIDITY higher than all previous ones, so that a recreated mailbox never reuses the UIDs
+//of a deleted mailbox with the same name
+func nextUidValidity() uint32 {
+	for {
+		last := atomic.LoadUint32(&lastUidValidity)
+		next := uint32(time.Now().Unix())
+		if next <= last {
+			next = last + 1
+		}
+		if atomic.CompareAndSwapUint32(&lastUidValidity, last, next) {
+			return next
+		}
+	}
+}
+
+//message is a memory.Message which knows the key of its mail in the MailStore. Messages appended without a MailStore
+//have no key
+type message struct {
+	memory.Message
+	key string
+}
+
+//mailbox is a named in-memory mailbox. Messages embed memory.Message so that fetching and searching can reuse the
+//implementation of go-imaps memory backend
+type mailbox struct {
+	sync.RWMutex
+	Subscribed bool
+	Messages   []*message
+
+	name        string
+	specialUse  string
+	uidValidity uint32
+	uidNext     uint32
+	user        *user
+}
+
+func newMailbox(name string, user *user) *mailbox {
+	return &mailbox{Subscribed: true, Messages: []*message{}, name: name, uidValidity: nextUidValidity(), uidNext: 1, user: user}
+}
+
+func (mbox *mailbox) Name() string {
+	mbox.RLock()
+	defer mbox.RUnlock()
+	return mbox.name
+}
+
+func (mbox *mailbox) rename(name string) {
+	mbox.Lock()
+	defer mbox.Unlock()
+	mbox.name = name
+}
+
+//Info returns the special use attribute of the mailbox if it has one and whether it has children
+func (mbox *mailbox) Info() (*imap.MailboxInfo, error) {
+	mbox.RLock()
+	info := &imap.MailboxInfo{
+		Delimiter: Delimiter,
+		Name:      mbox.name,
+	}
+	if mbox.specialUse != "" {
+		info.Attributes = append(info.Attributes, mbox.specialUse)
+	}
+	mbox.RUnlock()
+	if mbox.user.hasChildren(info.Name) {
+		info.Attributes = append(info.Attributes, HasChildrenAttr)
+	} else {
+		info.Attributes = append(info.Attributes, HasNoChildrenAttr)
+	}
+	return info, nil
+}
+
+func (mbox *mailbox) flags() []string {
+	flagsMap := make(map[string]bool)
+	for _, msg := range mbox.Messages {
+		for _, f := range msg.Flags {
+			flagsMap[f] = true
+		}
+	}
+
+	var flags []string
+	for f := range flagsMap {
+		flags = append(flags, f)
+	}
+	return flags
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+func (mbox *mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	mbox.RLock()
+	defer mbox.RUnlock()
+
+	status := imap.NewMailboxStatus(mbox.name, items)
+	status.Flags = mbox.flags()
+	status.PermanentFlags = []string{"\\*"}
+	for i, msg := range mbox.Messages {
+		if !hasFlag(msg.Flags, imap.SeenFlag) {
+			status.UnseenSeqNum = uint32(i + 1)
+			break
+		}
+	}
+
+	for _, name := range items {
+		switch name {
+		case imap.StatusMessages:
+			status.Messages = uint32(len(mbox.Messages))
+		case imap.StatusUidNext:
+			status.UidNext = mbox.uidNext
+		case imap.StatusUidValidity:
+			status.UidValidity = mbox.uidValidity
+		case imap.StatusRecent:
+			status.Recent = 0
+			for _, msg := range mbox.Messages {
+				if hasFlag(msg.Flags, imap.RecentFlag) {
+					status.Recent++
+				}
+			}
+		case imap.StatusUnseen:
+			status.Unseen = 0
+			for _, msg := range mbox.Messages {
+				if !hasFlag(msg.Flags, imap.SeenFlag) {
+					status.Unseen++
+				}
+			}
+		}
+	}
+
+	return status, nil
+}
+
+func (mbox *mailbox) SetSubscribed(subscribed bool) error {
+	mbox.Lock()
+	defer mbox.Unlock()
+	mbox.Subscribed = subscribed
+	return nil
+}
+
+func (mbox *mailbox) Check() error {
+	return nil
+}
+
+func (mbox *mailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+	mbox.RLock()
+	defer mbox.RUnlock()
+
+	for i, msg := range mbox.Messages {
+		seqNum := uint32(i + 1)
+
+		id := seqNum
+		if uid {
+			id = msg.Uid
+		}
+		if !seqSet.Contains(id) {
+			continue
+		}
+
+		m, err := msg.Fetch(seqNum, items)
+		if err != nil {
+			continue
+		}
+
+		ch <- m
+	}
+
+	return nil
+}
+
+func (mbox *mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	mbox.RLock()
+	defer mbox.RUnlock()
+
+	var ids []uint32
+	for i, msg := range mbox.Messages {
+		seqNum := uint32(i + 1)
+
+		ok, err := msg.Match(seqNum, criteria)
+		if err != nil || !ok {
+			continue
+		}
+
+		id := seqNum
+		if uid {
+			id = msg.Uid
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+//CreateMessage is called for APPEND commands of clients
+func (mbox *mailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	_, err := mbox.createMessage(flags, date, body)
+	return err
+}
+
+//createMessage adds the appended mail to the MailStore if the mailbox belongs to a backend and returns the UID of the
+//new message
+func (mbox *mailbox) createMessage(flags []string, date time.Time, body imap.Literal) (uint32, error) {
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		return 0, err
+	}
+	if mbox.user.backend != nil {
+		return mbox.user.backend.appendMail(mbox.user, mbox, flags, date, content)
+	}
+	return mbox.appendMessage("", flags, date, content), nil
+}
+
+//appendMessage adds a message for the mail with the key and returns its UID
+func (mbox *mailbox) appendMessage(key string, flags []string, date time.Time, content []byte) uint32 {
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	mbox.Lock()
+	defer mbox.Unlock()
+	uid := mbox.uidNext
+	mbox.uidNext++
+	mbox.Messages = append(mbox.Messages, &message{
+		Message: memory.Message{
+			Uid:   uid,
+			Date:  date,
+			Size:  uint32(len(content)),
+			Flags: flags,
+			Body:  content,
+		},
+		key: key,
+	})
+	return uid
+}
+
+func (mbox *mailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	mbox.Lock()
+	defer mbox.Unlock()
+
+	for i, msg := range mbox.Messages {
+		id := uint32(i + 1)
+		if uid {
+			id = msg.Uid
+		}
+		if !seqset.Contains(id) {
+			continue
+		}
+
+		msg.Flags = backendutil.UpdateFlags(msg.Flags, op, flags)
+	}
+
+	return nil
+}
+
+func (mbox *mailbox) CopyMessages(uid bool, seqset *imap.SeqSet, destName string) error {
+	_, _, err := mbox.copyMessages(uid, seqset, destName)
+	return err
+}
+
+//copyMessages copies the messages into the destination mailbox and returns the UIDs of the copied messages in this
+//mailbox and the UIDs of their copies in the same order
+func (mbox *mailbox) copyMessages(uid bool, seqset *imap.SeqSet, destName string) ([]uint32, []uint32, error) {
+	dest, err := mbox.user.getMailbox(destName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mbox.RLock()
+	var copies []message
+	for i, msg := range mbox.Messages {
+		id := uint32(i + 1)
+		if uid {
+			id = msg.Uid
+		}
+		if !seqset.Contains(id) {
+			continue
+		}
+		copies = append(copies, *msg)
+	}
+	mbox.RUnlock()
+	if len(copies) == 0 {
+		return nil, nil, nil
+	}
+
+	sourceUids := make([]uint32, 0, len(copies))
+	destUids := make([]uint32, 0, len(copies))
+	dest.Lock()
+	for _, msgCopy := range copies {
+		msgCopy := msgCopy
+		sourceUids = append(sourceUids, msgCopy.Uid)
+		msgCopy.Uid = dest.uidNext
+		dest.uidNext++
+		destUids = append(destUids, msgCopy.Uid)
+		msgCopy.Flags = backendutil.UpdateFlags(append([]string{}, msgCopy.Flags...), imap.AddFlags, []string{imap.RecentFlag})
+		dest.Messages = append(dest.Messages, &msgCopy)
+	}
+	destName = dest.name
+	dest.Unlock()
+
+	for _, msgCopy := range copies {
+		mbox.user.backend.addToFolder(msgCopy.key, mbox.user.username, destName)
+	}
+	mbox.user.backend.notifyMailbox(mbox.user, dest)
+	return sourceUids, destUids, nil
+}
+
+//Expunge removes all messages flagged as deleted
+func (mbox *mailbox) Expunge() error {
+	mbox.expunge(func(msg *message) bool {
+		return hasFlag(msg.Flags, imap.DeletedFlag)
+	})
+	return nil
+}
+
+//expunge removes all messages matching remove, updates the folder membership in the MailStore and notifies the clients
+//about the removed sequence numbers. The notifications are sent before returning, so that clients receive them before
+//the response of the command
+func (mbox *mailbox) expunge(remove func(msg *message) bool) {
+	mbox.Lock()
+	var seqNums []uint32
+	var removed []*message
+	for i := len(mbox.Messages) - 1; i >= 0; i-- {
+		if remove(mbox.Messages[i]) {
+			seqNums = append(seqNums, uint32(i+1))
+			removed = append(removed, mbox.Messages[i])
+			mbox.Messages = append(mbox.Messages[:i], mbox.Messages[i+1:]...)
+		}
+	}
+	remaining := make(map[string]bool, len(mbox.Messages))
+	for _, msg := range mbox.Messages {
+		remaining[msg.key] = true
+	}
+	name := mbox.name
+	mbox.Unlock()
+
+	for _, msg := range removed {
+		if !remaining[msg.key] {
+			mbox.user.backend.removeFromFolder(msg.key, mbox.user.username, name)
+		}
+	}
+	//sequence numbers are descending, so every number is still valid when the client receives it
+	for _, seqNum := range seqNums {
+		mbox.user.backend.notify(&imapBackend.ExpungeUpdate{
+			Update: imapBackend.NewUpdate(mbox.user.username, name),
+			SeqNum: seqNum,
+		})
+	}
+}
+
+//keys returns the MailStore keys of all messages
+func (mbox *mailbox) keys() []string {
+	mbox.RLock()
+	defer mbox.RUnlock()
+	keys := make([]string, 0, len(mbox.Messages))
+	for _, msg := range mbox.Messages {
+		keys = append(keys, msg.key)
+	}
+	return keys
+}
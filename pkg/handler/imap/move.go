@@ -0,0 +1,77 @@
+package imap
+
+import (
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/server"
+)
+
+//moveExtension implements MOVE (RFC 6851), so clients don't have to copy, flag and expunge messages to move them
+type moveExtension struct{}
+
+func (ext *moveExtension) Capabilities(_ server.Conn) []string {
+	return []string{"MOVE"}
+}
+
+func (ext *moveExtension) Command(name string) server.HandlerFactory {
+	if name != "MOVE" {
+		return nil
+	}
+	return func() server.Handler { return &moveCommand{} }
+}
+
+//moveCommand is MOVE and UID MOVE. MOVE takes the same arguments as COPY
+type moveCommand struct {
+	commands.Copy
+}
+
+//handle copies the messages, sends the COPYUID code of UIDPLUS in an untagged response and expunges the moved messages
+//from the selected mailbox
+func (cmd *moveCommand) handle(uid bool, conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return server.ErrNoMailboxSelected
+	}
+	if ctx.MailboxReadOnly {
+		return server.ErrMailboxReadOnly
+	}
+	mb, ok := ctx.Mailbox.(*mailbox)
+	if !ok {
+		return server.ErrStatusResp(&imap.StatusResp{Type: imap.StatusRespNo, Info: "MOVE is not supported for this mailbox"})
+	}
+	sourceUids, destUids, err := mb.copyMessages(uid, cmd.SeqSet, cmd.Mailbox)
+	if err != nil {
+		return tryCreate(err)
+	}
+	if len(sourceUids) == 0 {
+		return nil
+	}
+	dest, err := mb.user.getMailbox(cmd.Mailbox)
+	if err != nil {
+		return err
+	}
+	err = conn.WriteResp(&imap.StatusResp{
+		Type:      imap.StatusRespOk,
+		Code:      CodeCopyUid,
+		Arguments: []interface{}{dest.uidValidity, uidSet(sourceUids), uidSet(destUids)},
+	})
+	if err != nil {
+		return err
+	}
+	moved := make(map[uint32]bool, len(sourceUids))
+	for _, sourceUid := range sourceUids {
+		moved[sourceUid] = true
+	}
+	mb.expunge(func(msg *message) bool {
+		return moved[msg.Uid]
+	})
+	return nil
+}
+
+func (cmd *moveCommand) Handle(conn server.Conn) error {
+	return cmd.handle(false, conn)
+}
+
+func (cmd *moveCommand) UidHandle(conn server.Conn) error {
+	return cmd.handle(true, conn)
+}
@@ -0,0 +1,55 @@
+package imap
+
+import (
+	"context"
+	idle "github.com/emersion/go-imap-idle"
+	imapBackend "github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/server"
+)
+
+//Server is a go-imap server which knows which of its connections run a command
+type Server struct {
+	*server.Server
+	sessions *sessions
+	//backend is set if the server delivers the updates of a Mailpie backend
+	backend *backend
+}
+
+//NewServer creates an IMAP server for the backend with all extensions supported by Mailpie enabled. IDLE (RFC 2177)
+//lets clients receive the backend updates for new mails instantly instead of polling, SPECIAL-USE (RFC 6154) tells them
+//which mailboxes to use for sent, drafted and deleted mails. MOVE (RFC 6851) and UIDPLUS (RFC 4315) let clients move
+//mails between folders and keep track of the UIDs of stored and moved messages. The updates of a Mailpie backend are
+//delivered by the server from the start, not by Serve
+func NewServer(be imapBackend.Backend) *Server {
+	s := server.New(be)
+	extensions := []server.Extension{idle.NewExtension(), &specialUseExtension{}, &moveExtension{}, &uidplusExtension{}}
+	b, ok := be.(*backend)
+	if ok {
+		dispatcher := newUpdateDispatcher(s)
+		extensions = append(extensions, dispatcher)
+		go dispatcher.listen(b.UpdateChannel, b.closed)
+	}
+	//go-imap asks the extensions in the order they were enabled, the sessions come first and look up the handlers
+	//they wrap in the other extensions themselves
+	tracked := newSessions(extensions)
+	s.Enable(append([]server.Extension{tracked}, extensions...)...)
+	return &Server{Server: s, sessions: tracked, backend: b}
+}
+
+//Close closes the listeners and connections and stops delivering the updates of a Mailpie backend, which stops
+//handling the events of the MailStore as well, so that nothing of the server keeps running. The backend can't be
+//served again afterwards
+func (s *Server) Close() error {
+	err := s.Server.Close()
+	if s.backend != nil {
+		s.backend.close()
+	}
+	return err
+}
+
+//Drain logs out the idle connections, including the idling ones, and waits until the others finished their command.
+//Once the context ends, the remaining connections are closed and an error is returned if a command was still running.
+//The listeners are not closed
+func (s *Server) Drain(ctx context.Context) error {
+	return s.sessions.drain(ctx)
+}
@@ -0,0 +1,377 @@
+package imap
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"github.com/da-coda/mailpie/pkg/certs"
+	"github.com/da-coda/mailpie/pkg/event"
+	"github.com/da-coda/mailpie/pkg/handler"
+	"github.com/da-coda/mailpie/pkg/store"
+	"github.com/emersion/go-imap"
+	idle "github.com/emersion/go-imap-idle"
+	imapBackend "github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/mhale/smtpd"
+	"github.com/stretchr/testify/suite"
+	"net"
+	"net/smtp"
+	"sync"
+	"testing"
+	"time"
+)
+
+type ServerTestSuite struct {
+	suite.Suite
+	server       *Server
+	tlsConfig    *tls.Config
+	messageQueue *event.MessageQueue
+	mailStore    *store.MailStore
+	smtpHandler  handler.SmtpHandler
+}
+
+func (suite *ServerTestSuite) SetupTest() {
+	tlsConfig, err := certs.Load("", "")
+	suite.Require().Nil(err)
+	suite.tlsConfig = tlsConfig
+	//every test has its own queue, so that the backends of earlier tests don't handle the mails of later ones
+	suite.messageQueue = event.New()
+	suite.mailStore = store.CreateMailStore(suite.messageQueue)
+	suite.server = NewServer(NewBackend(BackendOptions{PerRecipient: true, MailStore: suite.mailStore, MessageQueue: suite.messageQueue}))
+	suite.server.AllowInsecureAuth = true
+	suite.server.TLSConfig = tlsConfig
+	suite.smtpHandler = handler.CreateSmtpHandler(suite.mailStore)
+}
+
+func (suite *ServerTestSuite) TearDownTest() {
+	_ = suite.server.Close()
+	suite.messageQueue.Close()
+}
+
+//serve starts serving the configured server on a random local port
+func (suite *ServerTestSuite) serve(implicitTLS bool) string {
+	var listener net.Listener
+	var err error
+	if implicitTLS {
+		listener, err = tls.Listen("tcp", "127.0.0.1:0", suite.tlsConfig)
+	} else {
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	suite.Require().Nil(err)
+	go func() {
+		_ = suite.server.Serve(listener)
+	}()
+	return listener.Addr().String()
+}
+
+//serveSMTP starts an SMTP server handing the mails to the SMTP handler of the suite on a random local port, closed
+//once the test ended
+func (suite *ServerTestSuite) serveSMTP() string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	suite.Require().Nil(err)
+	suite.T().Cleanup(func() {
+		_ = listener.Close()
+	})
+	srv := &smtpd.Server{Handler: suite.smtpHandler.Handle, Appname: "Mailpie", Hostname: "localhost"}
+	go func() {
+		_ = srv.Serve(listener)
+	}()
+	return listener.Addr().String()
+}
+
+func (suite *ServerTestSuite) TestStartTLS_InsecureAuthDisabled() {
+	suite.server.AllowInsecureAuth = false
+	c, err := client.Dial(suite.serve(false))
+	suite.Require().Nil(err)
+	defer c.Logout()
+	supported, err := c.SupportStartTLS()
+	suite.Nil(err)
+	suite.True(supported, "Server should advertise STARTTLS")
+	suite.Error(c.Login("bob@example.com", "password"), "Login without TLS should be refused")
+
+	suite.Require().Nil(c.StartTLS(&tls.Config{InsecureSkipVerify: true}))
+	suite.Nil(c.Login("bob@example.com", "password"))
+}
+
+func (suite *ServerTestSuite) TestImplicitTLS() {
+	suite.server.AllowInsecureAuth = false
+	c, err := client.DialTLS(suite.serve(true), &tls.Config{InsecureSkipVerify: true})
+	suite.Require().Nil(err)
+	defer c.Logout()
+	supported, err := c.SupportStartTLS()
+	suite.Nil(err)
+	suite.False(supported, "STARTTLS makes no sense on an encrypted connection")
+	suite.Nil(c.Login("bob@example.com", "password"))
+}
+
+func (suite *ServerTestSuite) TestSpecialUse_List() {
+	c, err := client.Dial(suite.serve(false))
+	suite.Require().Nil(err)
+	defer c.Logout()
+	suite.Require().Nil(c.Login("bob@example.com", "password"))
+	supported, err := c.Support("SPECIAL-USE")
+	suite.Nil(err)
+	suite.True(supported, "Server should advertise SPECIAL-USE")
+
+	mailboxes := make(chan *imap.MailboxInfo, 20)
+	suite.Require().Nil(c.List("", "*", mailboxes))
+	attributes := make(map[string][]string)
+	for info := range mailboxes {
+		attributes[info.Name] = info.Attributes
+		suite.Equal(Delimiter, info.Delimiter)
+	}
+	suite.Contains(attributes["Sent Messages"], SentAttr)
+	suite.Contains(attributes["Deleted Messages"], TrashAttr)
+	suite.Contains(attributes["INBOX"], HasNoChildrenAttr)
+}
+
+//moveCommander is the client side of MOVE, which go-imaps client doesn't support
+type moveCommander struct {
+	seqSet  *imap.SeqSet
+	mailbox string
+}
+
+func (cmd *moveCommander) Command() *imap.Command {
+	return &imap.Command{Name: "MOVE", Arguments: []interface{}{cmd.seqSet, cmd.mailbox}}
+}
+
+func (suite *ServerTestSuite) messages(c *client.Client, mailbox string) uint32 {
+	status, err := c.Status(mailbox, []imap.StatusItem{imap.StatusMessages})
+	suite.Require().Nil(err)
+	return status.Messages
+}
+
+//expunged returns the sequence numbers of all EXPUNGE responses received so far
+func expunged(updates chan client.Update) []uint32 {
+	var seqNums []uint32
+	for {
+		select {
+		case update := <-updates:
+			if expunge, ok := update.(*client.ExpungeUpdate); ok {
+				seqNums = append(seqNums, expunge.SeqNum)
+			}
+		default:
+			return seqNums
+		}
+	}
+}
+
+func (suite *ServerTestSuite) TestUidPlus_AppendAndCopy() {
+	c, err := client.Dial(suite.serve(false))
+	suite.Require().Nil(err)
+	defer c.Logout()
+	suite.Require().Nil(c.Login("append@example.com", "password"))
+	supported, err := c.Support("UIDPLUS")
+	suite.Nil(err)
+	suite.True(supported, "Server should advertise UIDPLUS")
+
+	status, err := c.Execute(&commands.Append{Mailbox: "Sent Messages", Flags: []string{imap.SeenFlag}, Date: time.Now(), Message: bytes.NewBuffer(rawMail)}, nil)
+	suite.Require().Nil(err)
+	suite.Equal(imap.StatusRespOk, status.Type)
+	suite.Equal(CodeAppendUid, status.Code)
+	suite.Len(status.Arguments, 2)
+
+	keys := suite.mailStore.Keys()
+	suite.Require().Len(keys, 1, "Appended mail should be added to the store")
+	suite.Equal(map[string][]string{"append@example.com": {"Sent Messages"}}, suite.mailStore.Folders(keys[0]))
+	suite.Zero(suite.messages(c, "INBOX"), "Appended mail should not be delivered to the INBOX")
+
+	_, err = c.Select("Sent Messages", false)
+	suite.Require().Nil(err)
+	seqSet, _ := imap.ParseSeqSet("1")
+	status, err = c.Execute(&commands.Copy{SeqSet: seqSet, Mailbox: "Archive"}, nil)
+	suite.Require().Nil(err)
+	suite.Equal(CodeCopyUid, status.Code)
+	suite.Len(status.Arguments, 3)
+	suite.Equal(map[string][]string{"append@example.com": {"Archive", "Sent Messages"}}, suite.mailStore.Folders(keys[0]))
+
+	status, err = c.Execute(&commands.Copy{SeqSet: seqSet, Mailbox: "Nope"}, nil)
+	suite.Require().Nil(err)
+	suite.Equal(imap.CodeTryCreate, status.Code)
+}
+
+func (suite *ServerTestSuite) TestMove_UidExpunge() {
+	suite.smtpHandler.Handle(nil, "alex@example.com", []string{"move@example.com"}, rawMail)
+	c, err := client.Dial(suite.serve(false))
+	suite.Require().Nil(err)
+	defer c.Logout()
+	suite.Require().Nil(c.Login("move@example.com", "password"))
+	supported, err := c.Support("MOVE")
+	suite.Nil(err)
+	suite.True(supported, "Server should advertise MOVE")
+	mailbox, err := c.Select("INBOX", false)
+	suite.Require().Nil(err)
+	suite.Require().Equal(uint32(1), mailbox.Messages)
+	updates := make(chan client.Update, 20)
+	c.Updates = updates
+
+	seqSet, _ := imap.ParseSeqSet("1")
+	status, err := c.Execute(&commands.Uid{Cmd: &moveCommander{seqSet: seqSet, mailbox: "Archive"}}, nil)
+	suite.Require().Nil(err)
+	suite.Equal(imap.StatusRespOk, status.Type)
+	suite.Equal([]uint32{1}, expunged(updates), "Client should have received EXPUNGE for the moved mail before the response")
+	suite.Zero(suite.messages(c, "INBOX"))
+	suite.Equal(uint32(1), suite.messages(c, "Archive"))
+	keys := suite.mailStore.Keys()
+	suite.Require().Len(keys, 1)
+	suite.Equal(map[string][]string{"move@example.com": {"Archive"}}, suite.mailStore.Folders(keys[0]))
+
+	_, err = c.Select("Archive", false)
+	suite.Require().Nil(err)
+	suite.Require().Nil(c.Store(seqSet, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil))
+	other, _ := imap.ParseSeqSet("2:*")
+	_, err = c.Execute(&commands.Uid{Cmd: &expungeCommander{seqSet: other}}, nil)
+	suite.Require().Nil(err)
+	suite.Empty(expunged(updates), "UID EXPUNGE should only remove messages in the set")
+	_, err = c.Execute(&commands.Uid{Cmd: &expungeCommander{seqSet: seqSet}}, nil)
+	suite.Require().Nil(err)
+	suite.Equal([]uint32{1}, expunged(updates))
+	suite.Empty(suite.mailStore.Folders(keys[0]))
+}
+
+//expungeCommander is the client side of UID EXPUNGE
+type expungeCommander struct {
+	seqSet *imap.SeqSet
+}
+
+func (cmd *expungeCommander) Command() *imap.Command {
+	return &imap.Command{Name: "EXPUNGE", Arguments: []interface{}{cmd.seqSet}}
+}
+
+//continuationWatcher is the debug writer of a client, signalling once the server sent the continuation request
+type continuationWatcher struct {
+	lock     sync.Mutex
+	received bytes.Buffer
+	info     string
+	sent     chan struct{}
+}
+
+func (w *continuationWatcher) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.received.Write(p)
+	if w.sent != nil && bytes.Contains(w.received.Bytes(), []byte("+ "+w.info)) {
+		close(w.sent)
+		w.sent = nil
+	}
+	return len(p), nil
+}
+
+func (suite *ServerTestSuite) TestIdle_ReceivesNewMail() {
+	c, err := client.Dial(suite.serve(false))
+	suite.Require().Nil(err)
+	defer c.Logout()
+	idling := make(chan struct{})
+	c.SetDebug(&continuationWatcher{info: "idling", sent: idling})
+	suite.Require().Nil(c.Login("idle@example.com", "password"))
+	_, err = c.Select("INBOX", false)
+	suite.Require().Nil(err)
+
+	idleClient := idle.NewClient(c)
+	supported, err := idleClient.SupportIdle()
+	suite.Nil(err)
+	suite.True(supported, "Server should advertise IDLE")
+
+	updates := make(chan client.Update, 10)
+	c.Updates = updates
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- idleClient.Idle(stop)
+	}()
+	select {
+	case <-idling:
+	case <-time.After(5 * time.Second):
+		suite.FailNow("Server did not accept IDLE")
+	}
+
+	smtpAddr := suite.serveSMTP()
+	sent := time.Now()
+	suite.Require().Nil(smtp.SendMail(smtpAddr, nil, "alex@example.com", []string{"idle@example.com"}, rawMail))
+	received := false
+	timeout := time.After(5 * time.Second)
+	for !received {
+		select {
+		case update := <-updates:
+			//UIDNEXT and UIDVALIDITY arrive as status updates, EXISTS and RECENT as mailbox update
+			_, received = update.(*client.MailboxUpdate)
+		case <-timeout:
+			close(stop)
+			suite.FailNow("No update received while idling")
+		}
+	}
+	suite.Less(int64(time.Since(sent)), int64(500*time.Millisecond), "Idling clients should be notified right away")
+	close(stop)
+	suite.Require().Nil(<-done)
+	//read once IDLE ended, the client updates the mailbox status while it reads responses
+	mailbox := c.Mailbox()
+	suite.Equal(uint32(1), mailbox.Messages, "Expected EXISTS for the new mail")
+	suite.Equal(uint32(1), mailbox.Recent, "Expected RECENT for the new mail")
+}
+
+func (suite *ServerTestSuite) TestDrain_LogsOutIdleClients() {
+	addr := suite.serve(false)
+	selected, err := client.Dial(addr)
+	suite.Require().Nil(err)
+	suite.Require().Nil(selected.Login("bob@example.com", "password"))
+	_, err = selected.Select("INBOX", false)
+	suite.Require().Nil(err)
+
+	idling, err := client.Dial(addr)
+	suite.Require().Nil(err)
+	started := make(chan struct{})
+	idling.SetDebug(&continuationWatcher{info: "idling", sent: started})
+	suite.Require().Nil(idling.Login("idle@example.com", "password"))
+	done := make(chan error, 1)
+	go func() {
+		done <- idle.NewClient(idling).Idle(make(chan struct{}))
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		suite.FailNow("Server did not accept IDLE")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	suite.Nil(suite.server.Drain(ctx))
+	suite.Less(int64(time.Since(start)), int64(time.Second), "Idle clients should be logged out right away")
+	for _, c := range []*client.Client{selected, idling} {
+		select {
+		case <-c.LoggedOut():
+		case <-time.After(5 * time.Second):
+			suite.Fail("Client should be logged out")
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		suite.Fail("IDLE should end")
+	}
+}
+
+func (suite *ServerTestSuite) TestClose_StopsUpdates() {
+	suite.serve(false)
+	suite.Require().Nil(suite.server.Close())
+	select {
+	case <-suite.server.backend.subscription.Done():
+	case <-time.After(5 * time.Second):
+		suite.FailNow("Backend should stop handling the events of the MailStore")
+	}
+	notified := make(chan struct{})
+	go func() {
+		suite.server.backend.notify(&imapBackend.ExpungeUpdate{Update: imapBackend.NewUpdate("bob", "INBOX"), SeqNum: 1})
+		close(notified)
+	}()
+	select {
+	case <-notified:
+	case <-time.After(5 * time.Second):
+		suite.Fail("Updates should be discarded once the server is closed")
+	}
+}
+
+func TestServer(t *testing.T) {
+	suite.Run(t, new(ServerTestSuite))
+}
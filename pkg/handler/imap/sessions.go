@@ -0,0 +1,261 @@
+package imap
+
+import (
+	"context"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/server"
+	"github.com/pkg/errors"
+	"sync"
+)
+
+//sessions keeps track of the connections of the server and the commands they run, so that a shutdown closes the idle
+//connections right away and only waits for running commands. It wraps the handlers of all commands and has to be
+//enabled before the other extensions. IDLE is not counted as running command, idling clients are logged out too
+type sessions struct {
+	//extensions are the other extensions of the server, asked for a command before the built-in commands
+	extensions []server.Extension
+	//builtin is a server without extensions. go-imap v1.0.6 keeps the built-in commands private and Server.Command
+	//of the real server would ask the sessions again, so the built-in handlers are looked up here
+	builtin *server.Server
+
+	lock     sync.Mutex
+	open     map[*session]bool
+	draining bool
+	//changed is closed and replaced whenever a connection is opened or closed or a command ends, the IMAP and IMAPS
+	//listeners drain the same sessions
+	changed chan struct{}
+}
+
+//session is a connection which counts its running commands. UID commands run the command they wrap
+type session struct {
+	server.Conn
+	sessions *sessions
+	//running and closing are guarded by the lock of the sessions
+	running int
+	closing bool
+	once    sync.Once
+}
+
+func newSessions(extensions []server.Extension) *sessions {
+	builtin := server.New(nil)
+	return &sessions{extensions: extensions, builtin: builtin, open: make(map[*session]bool), changed: make(chan struct{})}
+}
+
+func (s *sessions) Capabilities(_ server.Conn) []string {
+	return nil
+}
+
+func (s *sessions) Command(name string) server.HandlerFactory {
+	newHandler := s.lookup(name)
+	if newHandler == nil || name == "IDLE" {
+		return newHandler
+	}
+	return func() server.Handler {
+		return s.wrap(newHandler())
+	}
+}
+
+//lookup returns the handler the server would run for the command without the sessions. Like go-imap, the extensions
+//override the built-in commands
+func (s *sessions) lookup(name string) server.HandlerFactory {
+	for _, extension := range s.extensions {
+		if newHandler := extension.Command(name); newHandler != nil {
+			return newHandler
+		}
+	}
+	return s.builtin.Command(name)
+}
+
+func (s *sessions) NewConn(conn server.Conn) server.Conn {
+	tracked := &session{Conn: conn, sessions: s}
+	s.lock.Lock()
+	s.open[tracked] = true
+	s.notify()
+	s.lock.Unlock()
+	return tracked
+}
+
+//wrap counts the command as running while it is handled, keeping the optional interfaces of the handler
+func (s *sessions) wrap(hdlr server.Handler) server.Handler {
+	cmd := &trackedCommand{Handler: hdlr}
+	if upgrader, ok := hdlr.(server.Upgrader); ok {
+		return &trackedUpgrader{trackedCommand: cmd, upgrader: upgrader}
+	}
+	if uidHandler, ok := hdlr.(server.UidHandler); ok {
+		return &trackedUidCommand{trackedCommand: cmd, uidHandler: uidHandler}
+	}
+	return cmd
+}
+
+//notify wakes up the drains, called with the lock held
+func (s *sessions) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+//drain logs out the idle connections and waits until the others finished their commands, which logs them out as
+//well. Once the context ends, the remaining connections are closed and an error is returned if a command was running
+func (s *sessions) drain(ctx context.Context) error {
+	for {
+		s.lock.Lock()
+		s.draining = true
+		var idle, running []*session
+		for conn := range s.open {
+			switch {
+			case conn.running > 0:
+				running = append(running, conn)
+			case !conn.closing:
+				conn.closing = true
+				idle = append(idle, conn)
+			}
+		}
+		remaining := len(s.open)
+		changed := s.changed
+		s.lock.Unlock()
+		for _, conn := range idle {
+			go conn.bye(ctx)
+		}
+		if remaining == 0 {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			s.lock.Lock()
+			open := make([]*session, 0, len(s.open))
+			for conn := range s.open {
+				open = append(open, conn)
+			}
+			s.lock.Unlock()
+			for _, conn := range open {
+				_ = conn.Close()
+			}
+			if len(running) > 0 {
+				return errors.Wrapf(ctx.Err(), "closed %d connections running a command", len(running))
+			}
+			return nil
+		}
+	}
+}
+
+//begin counts a command as running. Returns false if the server shuts down and the command should not run
+func (c *session) begin() bool {
+	c.sessions.lock.Lock()
+	defer c.sessions.lock.Unlock()
+	if c.sessions.draining && c.running == 0 {
+		c.closing = true
+		return false
+	}
+	c.running++
+	return true
+}
+
+//end counts a command as finished. Returns true if the server shuts down and the connection should log out
+func (c *session) end() bool {
+	c.sessions.lock.Lock()
+	defer c.sessions.lock.Unlock()
+	c.running--
+	c.sessions.notify()
+	if c.sessions.draining && c.running == 0 {
+		c.closing = true
+		return true
+	}
+	return false
+}
+
+//logout ends the session after the response of the current command, called from the goroutine of the connection
+func (c *session) logout() {
+	ctx := c.Context()
+	if ctx.State == imap.LogoutState {
+		return
+	}
+	_ = c.WriteResp(shutdownResponse())
+	ctx.State = imap.LogoutState
+}
+
+//bye tells an idle client that the server shuts down and closes the connection
+func (c *session) bye(ctx context.Context) {
+	defer c.Close()
+	done := make(chan struct{})
+	select {
+	case c.Context().Responses <- &writtenResponse{WriterTo: shutdownResponse(), done: done}:
+	case <-c.Context().LoggedOut:
+		return
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+func (c *session) Close() error {
+	c.once.Do(func() {
+		c.sessions.lock.Lock()
+		delete(c.sessions.open, c)
+		c.sessions.notify()
+		c.sessions.lock.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+func shutdownResponse() *imap.StatusResp {
+	return &imap.StatusResp{Type: imap.StatusRespBye, Info: "Server shutting down"}
+}
+
+//errShutdown is returned for commands sent after the shutdown started
+var errShutdown = errors.New("Server shutting down")
+
+//trackedCommand counts the command as running on its connection
+type trackedCommand struct {
+	server.Handler
+}
+
+func (cmd *trackedCommand) Handle(conn server.Conn) error {
+	return track(conn, func() error {
+		return cmd.Handler.Handle(conn)
+	})
+}
+
+//trackedUidCommand is a tracked command which can be run by UID
+type trackedUidCommand struct {
+	*trackedCommand
+	uidHandler server.UidHandler
+}
+
+func (cmd *trackedUidCommand) UidHandle(conn server.Conn) error {
+	return track(conn, func() error {
+		return cmd.uidHandler.UidHandle(conn)
+	})
+}
+
+//trackedUpgrader is a tracked command which upgrades the connection, like STARTTLS
+type trackedUpgrader struct {
+	*trackedCommand
+	upgrader server.Upgrader
+}
+
+func (cmd *trackedUpgrader) Upgrade(conn server.Conn) error {
+	return track(conn, func() error {
+		return cmd.upgrader.Upgrade(conn)
+	})
+}
+
+//track runs the handler of a command counted as running on the connection
+func track(conn server.Conn, handle func() error) error {
+	tracked, ok := conn.(*session)
+	if !ok {
+		return handle()
+	}
+	if !tracked.begin() {
+		tracked.logout()
+		return errShutdown
+	}
+	defer func() {
+		if tracked.end() {
+			tracked.logout()
+		}
+	}()
+	return handle()
+}
@@ -0,0 +1,55 @@
+package imap
+
+import (
+	"github.com/emersion/go-imap/server"
+)
+
+//Mailbox attributes of RFC 6154 marking the special use of a mailbox, so clients use them instead of creating their own
+const (
+	SentAttr    = "\\Sent"
+	DraftsAttr  = "\\Drafts"
+	JunkAttr    = "\\Junk"
+	TrashAttr   = "\\Trash"
+	ArchiveAttr = "\\Archive"
+)
+
+//Child attributes of RFC 3348, returned for every mailbox in LIST responses
+const (
+	HasChildrenAttr   = "\\HasChildren"
+	HasNoChildrenAttr = "\\HasNoChildren"
+)
+
+//defaultMailbox is a mailbox every user has
+type defaultMailbox struct {
+	name       string
+	specialUse string
+}
+
+var defaultMailboxes = []defaultMailbox{
+	{name: "INBOX"},
+	{name: "Sent Messages", specialUse: SentAttr},
+	{name: "Drafts", specialUse: DraftsAttr},
+	{name: "Junk", specialUse: JunkAttr},
+	{name: "Deleted Messages", specialUse: TrashAttr},
+	{name: "Archive", specialUse: ArchiveAttr},
+}
+
+func isDefaultMailbox(name string) bool {
+	for _, mb := range defaultMailboxes {
+		if mb.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+//specialUseExtension advertises the SPECIAL-USE capability. The attributes itself are part of the mailbox info
+type specialUseExtension struct{}
+
+func (ext *specialUseExtension) Capabilities(_ server.Conn) []string {
+	return []string{"SPECIAL-USE"}
+}
+
+func (ext *specialUseExtension) Command(_ string) server.HandlerFactory {
+	return nil
+}
@@ -0,0 +1,174 @@
+package imap
+
+import (
+	"errors"
+	"github.com/emersion/go-imap"
+	imapBackend "github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/server"
+)
+
+//Response codes of the UIDPLUS extension (RFC 4315)
+const (
+	CodeAppendUid imap.StatusRespCode = "APPENDUID"
+	CodeCopyUid   imap.StatusRespCode = "COPYUID"
+)
+
+//uidplusExtension implements UIDPLUS, which tells clients the UIDs of appended and copied messages and allows to expunge
+//only some of the deleted messages with UID EXPUNGE
+type uidplusExtension struct{}
+
+func (ext *uidplusExtension) Capabilities(_ server.Conn) []string {
+	return []string{"UIDPLUS"}
+}
+
+func (ext *uidplusExtension) Command(name string) server.HandlerFactory {
+	switch name {
+	case "APPEND":
+		return func() server.Handler { return &appendCommand{} }
+	case "COPY":
+		return func() server.Handler { return &copyCommand{} }
+	case "EXPUNGE":
+		return func() server.Handler { return &expungeCommand{} }
+	}
+	return nil
+}
+
+func uidSet(uids []uint32) *imap.SeqSet {
+	set := new(imap.SeqSet)
+	set.AddNum(uids...)
+	return set
+}
+
+func tryCreate(err error) error {
+	if err == imapBackend.ErrNoSuchMailbox {
+		return server.ErrStatusResp(&imap.StatusResp{
+			Type: imap.StatusRespNo,
+			Code: imap.CodeTryCreate,
+			Info: err.Error(),
+		})
+	}
+	return err
+}
+
+//appendCommand is APPEND responding with the APPENDUID code
+type appendCommand struct {
+	commands.Append
+}
+
+func (cmd *appendCommand) Handle(conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return server.ErrNotAuthenticated
+	}
+	mbox, err := ctx.User.GetMailbox(cmd.Mailbox)
+	if err != nil {
+		return tryCreate(err)
+	}
+	mb, ok := mbox.(*mailbox)
+	if !ok {
+		return mbox.CreateMessage(cmd.Flags, cmd.Date, cmd.Message)
+	}
+	uid, err := mb.createMessage(cmd.Flags, cmd.Date, cmd.Message)
+	if err != nil {
+		return err
+	}
+	return server.ErrStatusResp(&imap.StatusResp{
+		Type:      imap.StatusRespOk,
+		Code:      CodeAppendUid,
+		Arguments: []interface{}{mb.uidValidity, uid},
+		Info:      "APPEND completed",
+	})
+}
+
+//copyCommand is COPY and UID COPY responding with the COPYUID code
+type copyCommand struct {
+	commands.Copy
+}
+
+func (cmd *copyCommand) handle(uid bool, conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return server.ErrNoMailboxSelected
+	}
+	mb, ok := ctx.Mailbox.(*mailbox)
+	if !ok {
+		return ctx.Mailbox.CopyMessages(uid, cmd.SeqSet, cmd.Mailbox)
+	}
+	sourceUids, destUids, err := mb.copyMessages(uid, cmd.SeqSet, cmd.Mailbox)
+	if err != nil {
+		return tryCreate(err)
+	}
+	if len(sourceUids) == 0 {
+		return nil
+	}
+	dest, err := mb.user.getMailbox(cmd.Mailbox)
+	if err != nil {
+		return err
+	}
+	name := "COPY"
+	if uid {
+		name = "UID COPY"
+	}
+	return server.ErrStatusResp(&imap.StatusResp{
+		Type:      imap.StatusRespOk,
+		Code:      CodeCopyUid,
+		Arguments: []interface{}{dest.uidValidity, uidSet(sourceUids), uidSet(destUids)},
+		Info:      name + " completed",
+	})
+}
+
+func (cmd *copyCommand) Handle(conn server.Conn) error {
+	return cmd.handle(false, conn)
+}
+
+func (cmd *copyCommand) UidHandle(conn server.Conn) error {
+	return cmd.handle(true, conn)
+}
+
+//expungeCommand is EXPUNGE and UID EXPUNGE, which only removes deleted messages with an UID in the sequence set
+type expungeCommand struct {
+	SeqSet *imap.SeqSet
+}
+
+func (cmd *expungeCommand) Parse(fields []interface{}) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	seqSet, ok := fields[0].(string)
+	if !ok {
+		return errors.New("Invalid sequence set")
+	}
+	var err error
+	cmd.SeqSet, err = imap.ParseSeqSet(seqSet)
+	return err
+}
+
+func (cmd *expungeCommand) handle(uid bool, conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return server.ErrNoMailboxSelected
+	}
+	if ctx.MailboxReadOnly {
+		return server.ErrMailboxReadOnly
+	}
+	mb, ok := ctx.Mailbox.(*mailbox)
+	if !uid || !ok {
+		return ctx.Mailbox.Expunge()
+	}
+	if cmd.SeqSet == nil {
+		return errors.New("No sequence set given")
+	}
+	mb.expunge(func(msg *message) bool {
+		return hasFlag(msg.Flags, imap.DeletedFlag) && cmd.SeqSet.Contains(msg.Uid)
+	})
+	return nil
+}
+
+func (cmd *expungeCommand) Handle(conn server.Conn) error {
+	return cmd.handle(false, conn)
+}
+
+func (cmd *expungeCommand) UidHandle(conn server.Conn) error {
+	return cmd.handle(true, conn)
+}
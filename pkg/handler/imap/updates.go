@@ -0,0 +1,171 @@
+package imap
+
+import (
+	"github.com/emersion/go-imap"
+	imapBackend "github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/server"
+	"github.com/sirupsen/logrus"
+	"sync"
+)
+
+//updateDispatcher delivers the updates of the backend to the connections which selected the mailbox. go-imap reads
+//the selected mailbox of every connection from its own goroutine while the connection changes it, which races. The
+//dispatcher records the selections in SELECT, EXAMINE and CLOSE instead, which run on the goroutine of the connection
+type updateDispatcher struct {
+	server   *server.Server
+	lock     sync.Mutex
+	selected map[server.Conn]selection
+}
+
+//selection is the mailbox a connection selected
+type selection struct {
+	username string
+	mailbox  imapBackend.Mailbox
+}
+
+func newUpdateDispatcher(s *server.Server) *updateDispatcher {
+	return &updateDispatcher{server: s, selected: make(map[server.Conn]selection)}
+}
+
+func (d *updateDispatcher) Capabilities(_ server.Conn) []string {
+	return nil
+}
+
+func (d *updateDispatcher) Command(name string) server.HandlerFactory {
+	switch name {
+	case "SELECT":
+		return func() server.Handler { return &selectCommand{dispatcher: d} }
+	case "EXAMINE":
+		return func() server.Handler {
+			cmd := &selectCommand{dispatcher: d}
+			cmd.ReadOnly = true
+			return cmd
+		}
+	case "CLOSE":
+		return func() server.Handler { return &closeCommand{dispatcher: d} }
+	}
+	return nil
+}
+
+//record stores the mailbox the connection selected, called from the goroutine of the connection
+func (d *updateDispatcher) record(conn server.Conn) {
+	ctx := conn.Context()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if ctx.User == nil || ctx.Mailbox == nil {
+		delete(d.selected, conn)
+		return
+	}
+	d.selected[conn] = selection{username: ctx.User.Username(), mailbox: ctx.Mailbox}
+}
+
+//listen delivers the updates until stop is closed
+func (d *updateDispatcher) listen(updates <-chan imapBackend.Update, stop <-chan struct{}) {
+	for {
+		select {
+		case update := <-updates:
+			d.deliver(update)
+		case <-stop:
+			return
+		}
+	}
+}
+
+//deliver sends the update to every connection which selected the mailbox of the update and closes Done once all of
+//them have written it
+func (d *updateDispatcher) deliver(update imapBackend.Update) {
+	open := make(map[server.Conn]bool)
+	d.server.ForEachConn(func(conn server.Conn) {
+		open[conn] = true
+	})
+	var targets []server.Conn
+	d.lock.Lock()
+	for conn, selected := range d.selected {
+		if !open[conn] {
+			delete(d.selected, conn)
+			continue
+		}
+		if update.Username() != "" && selected.username != update.Username() {
+			continue
+		}
+		if update.Mailbox() != "" && selected.mailbox.Name() != update.Mailbox() {
+			continue
+		}
+		targets = append(targets, conn)
+	}
+	d.lock.Unlock()
+
+	var written sync.WaitGroup
+	for _, conn := range targets {
+		res := updateResponse(update)
+		if res == nil {
+			break
+		}
+		written.Add(1)
+		go func(conn server.Conn) {
+			defer written.Done()
+			done := make(chan struct{})
+			conn.Context().Responses <- &writtenResponse{WriterTo: res, done: done}
+			<-done
+		}(conn)
+	}
+	go func() {
+		written.Wait()
+		close(update.Done())
+	}()
+}
+
+//updateResponse creates the untagged response for the update. Every connection needs its own, since the responses of
+//go-imap read their values from channels
+func updateResponse(update imapBackend.Update) imap.WriterTo {
+	switch update := update.(type) {
+	case *imapBackend.StatusUpdate:
+		return update.StatusResp
+	case *imapBackend.MailboxUpdate:
+		return &responses.Select{Mailbox: update.MailboxStatus}
+	case *imapBackend.ExpungeUpdate:
+		seqNums := make(chan uint32, 1)
+		seqNums <- update.SeqNum
+		close(seqNums)
+		return &responses.Expunge{SeqNums: seqNums}
+	}
+	logrus.Errorf("Unhandled IMAP update %T", update)
+	return nil
+}
+
+//writtenResponse signals once the response is written, so that updates are written before the tagged response of the
+//command causing them
+type writtenResponse struct {
+	imap.WriterTo
+	done chan struct{}
+}
+
+func (r *writtenResponse) WriteTo(w *imap.Writer) error {
+	defer close(r.done)
+	return r.WriterTo.WriteTo(w)
+}
+
+//selectCommand is SELECT and EXAMINE, recording the selected mailbox for the updates
+type selectCommand struct {
+	server.Select
+	dispatcher *updateDispatcher
+}
+
+func (cmd *selectCommand) Handle(conn server.Conn) error {
+	err := cmd.Select.Handle(conn)
+	cmd.dispatcher.record(conn)
+	return err
+}
+
+//closeCommand is CLOSE, removing the selection so that the connection gets no further updates
+type closeCommand struct {
+	server.Close
+	dispatcher *updateDispatcher
+}
+
+func (cmd *closeCommand) Handle(conn server.Conn) error {
+	err := cmd.Close.Handle(conn)
+	cmd.dispatcher.record(conn)
+	return err
+}
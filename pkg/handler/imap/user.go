@@ -1,78 +1,229 @@
 package imap
 
 import (
+	"github.com/emersion/go-imap"
 	b "github.com/emersion/go-imap/backend"
-	"github.com/emersion/go-imap/backend/memory"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"sync"
 )
 
 type user struct {
-	mailboxes map[string]b.Mailbox
+	sync.RWMutex
+	mailboxes map[string]*mailbox
 	username  string
+	folders   *folderStore
+	//backend the user belongs to, nil for users created with NewUser
+	backend *backend
 }
 
+//NewUser creates a user with the default set of mailboxes. Called lazily by the backend on the first login of a user
 func NewUser(username string) b.User {
-	mailboxes := make(map[string]b.Mailbox)
-	user := &user{username: username, mailboxes: mailboxes}
-	_ = user.CreateMailbox("INBOX")
-	_ = user.CreateMailbox("Sent Messages")
-	_ = user.CreateMailbox("Drafts")
-	_ = user.CreateMailbox("Junk")
-	_ = user.CreateMailbox("Deleted Messages")
-	_ = user.CreateMailbox("Archive")
+	return newUser(username, nil)
+}
+
+//newUser creates a user with the default mailboxes and the folders persisted for the user in folders, which may be nil
+func newUser(username string, folders *folderStore) *user {
+	mailboxes := make(map[string]*mailbox)
+	user := &user{username: username, mailboxes: mailboxes, folders: folders}
+	for _, defaultMailbox := range defaultMailboxes {
+		mb := newMailbox(defaultMailbox.name, user)
+		mb.specialUse = defaultMailbox.specialUse
+		user.mailboxes[defaultMailbox.name] = mb
+	}
+	for _, folder := range folders.get(username) {
+		_ = user.createMailbox(folder)
+	}
 	return user
 }
 
-func (u user) Username() string {
+func (u *user) Username() string {
 	return u.username
 }
 
-func (u user) ListMailboxes(_ bool) ([]b.Mailbox, error) {
-	mailboxes := make([]b.Mailbox, 0, len(u.mailboxes))
-	for _, mailbox := range u.mailboxes {
-		mailboxes = append(mailboxes, mailbox)
+//ListMailboxes returns the mailboxes sorted by name with the INBOX first
+func (u *user) ListMailboxes(subscribed bool) ([]b.Mailbox, error) {
+	u.RLock()
+	defer u.RUnlock()
+	names := make([]string, 0, len(u.mailboxes))
+	for name, mailbox := range u.mailboxes {
+		if subscribed && !mailbox.Subscribed {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if names[i] == imap.InboxName || names[j] == imap.InboxName {
+			return names[i] == imap.InboxName
+		}
+		return names[i] < names[j]
+	})
+	mailboxes := make([]b.Mailbox, 0, len(names))
+	for _, name := range names {
+		mailboxes = append(mailboxes, u.mailboxes[name])
 	}
 	return mailboxes, nil
 }
 
-func (u user) GetMailbox(name string) (b.Mailbox, error) {
-	mailbox, ok := u.mailboxes[name]
+func (u *user) GetMailbox(name string) (b.Mailbox, error) {
+	return u.getMailbox(name)
+}
+
+func (u *user) getMailbox(name string) (*mailbox, error) {
+	u.RLock()
+	defer u.RUnlock()
+	mailbox, ok := u.mailboxes[imap.CanonicalMailboxName(name)]
 	if !ok {
 		return nil, b.ErrNoSuchMailbox
 	}
 	return mailbox, nil
 }
 
+//hasChildren reports whether there are mailboxes below name in the hierarchy
+func (u *user) hasChildren(name string) bool {
+	u.RLock()
+	defer u.RUnlock()
+	return u.hasChildrenLocked(name)
+}
+
+//hasChildrenLocked must be called while holding the lock
+func (u *user) hasChildrenLocked(name string) bool {
+	for other := range u.mailboxes {
+		if strings.HasPrefix(other, name+Delimiter) {
+			return true
+		}
+	}
+	return false
+}
+
+//CreateMailbox creates the mailbox and all missing parents in the hierarchy and persists them
 func (u *user) CreateMailbox(name string) error {
+	err := u.createMailbox(name)
+	if err != nil {
+		return err
+	}
+	u.persist()
+	return nil
+}
+
+//createMailbox creates the mailbox and all missing parents without persisting them
+func (u *user) createMailbox(name string) error {
+	name = imap.CanonicalMailboxName(strings.TrimSuffix(name, Delimiter))
+	if name == "" {
+		return errors.New("mailbox name must not be empty")
+	}
+	u.Lock()
+	defer u.Unlock()
 	_, ok := u.mailboxes[name]
 	if ok {
 		return b.ErrMailboxAlreadyExists
 	}
-	u.mailboxes[name] = &memory.Mailbox{
-		Subscribed: true,
-		Messages:   []*memory.Message{},
-	}
+	u.createParentsLocked(name)
+	u.mailboxes[name] = newMailbox(name, u)
 	return nil
 }
 
+//createParentsLocked creates all missing superior mailboxes of name. Must be called while holding the lock
+func (u *user) createParentsLocked(name string) {
+	parts := strings.Split(name, Delimiter)
+	for i := 1; i < len(parts); i++ {
+		parent := strings.Join(parts[:i], Delimiter)
+		if _, ok := u.mailboxes[parent]; !ok && parent != "" {
+			u.mailboxes[parent] = newMailbox(parent, u)
+		}
+	}
+}
+
+//DeleteMailbox deletes the mailbox. The INBOX and mailboxes with children can't be deleted
 func (u *user) DeleteMailbox(name string) error {
+	name = imap.CanonicalMailboxName(name)
+	if name == imap.InboxName {
+		return errors.New("cannot delete INBOX")
+	}
+	u.Lock()
+	_, ok := u.mailboxes[name]
+	if !ok {
+		u.Unlock()
+		return b.ErrNoSuchMailbox
+	}
+	if u.hasChildrenLocked(name) {
+		u.Unlock()
+		return errors.New("mailbox has children, delete them first")
+	}
+	mb := u.mailboxes[name]
 	delete(u.mailboxes, name)
+	u.Unlock()
+	for _, key := range mb.keys() {
+		u.backend.removeFromFolder(key, u.username, name)
+	}
+	u.persist()
 	return nil
 }
 
+//RenameMailbox renames the mailbox together with all its children and creates missing parents of the new name
 func (u *user) RenameMailbox(existingName, newName string) error {
-	mailbox, ok := u.mailboxes[existingName]
+	existingName = imap.CanonicalMailboxName(existingName)
+	newName = imap.CanonicalMailboxName(strings.TrimSuffix(newName, Delimiter))
+	if existingName == imap.InboxName {
+		return errors.New("renaming INBOX is not supported")
+	}
+	if newName == "" || strings.HasPrefix(newName, existingName+Delimiter) {
+		return errors.New("invalid new mailbox name")
+	}
+	u.Lock()
+	mb, ok := u.mailboxes[existingName]
 	if !ok {
+		u.Unlock()
 		return b.ErrNoSuchMailbox
 	}
-	_, ok = u.mailboxes[newName]
-	if ok {
+	if _, ok = u.mailboxes[newName]; ok {
+		u.Unlock()
 		return b.ErrMailboxAlreadyExists
 	}
-	u.mailboxes[newName] = mailbox
-	delete(u.mailboxes, existingName)
+	renamed := map[string]*mailbox{newName: mb}
+	for name, child := range u.mailboxes {
+		if strings.HasPrefix(name, existingName+Delimiter) {
+			renamed[newName+strings.TrimPrefix(name, existingName)] = child
+		}
+	}
+	for name := range renamed {
+		if _, ok = u.mailboxes[name]; ok && name != newName {
+			u.Unlock()
+			return b.ErrMailboxAlreadyExists
+		}
+	}
+	for name, renamedMailbox := range renamed {
+		delete(u.mailboxes, renamedMailbox.Name())
+		renamedMailbox.rename(name)
+	}
+	for name, renamedMailbox := range renamed {
+		u.mailboxes[name] = renamedMailbox
+	}
+	u.createParentsLocked(newName)
+	u.Unlock()
+	u.backend.renameFolder(u.username, existingName, newName)
+	u.persist()
 	return nil
 }
 
-func (u user) Logout() error {
+//persist saves all mailboxes except the default ones
+func (u *user) persist() {
+	u.RLock()
+	var folders []string
+	for name := range u.mailboxes {
+		if !isDefaultMailbox(name) {
+			folders = append(folders, name)
+		}
+	}
+	u.RUnlock()
+	err := u.folders.set(u.username, folders)
+	if err != nil {
+		logrus.WithError(err).WithField("user", u.username).Error("Unable to persist IMAP folders")
+	}
+}
+
+func (u *user) Logout() error {
 	return nil
 }
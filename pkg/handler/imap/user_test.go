@@ -0,0 +1,106 @@
+package imap
+
+import (
+	"github.com/emersion/go-imap"
+	b "github.com/emersion/go-imap/backend"
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+type UserUnitTestSuite struct {
+	suite.Suite
+}
+
+func mailboxNames(u *user) []string {
+	mailboxes, _ := u.ListMailboxes(false)
+	names := make([]string, 0, len(mailboxes))
+	for _, mb := range mailboxes {
+		names = append(names, mb.Name())
+	}
+	return names
+}
+
+func (suite *UserUnitTestSuite) TestDefaultMailboxes_SpecialUse() {
+	u := newUser("bob", nil)
+	suite.Equal([]string{"INBOX", "Archive", "Deleted Messages", "Drafts", "Junk", "Sent Messages"}, mailboxNames(u))
+	expected := map[string]string{"Sent Messages": SentAttr, "Drafts": DraftsAttr, "Junk": JunkAttr, "Deleted Messages": TrashAttr, "Archive": ArchiveAttr}
+	for name, attribute := range expected {
+		mb, err := u.GetMailbox(name)
+		suite.Require().Nil(err)
+		info, err := mb.Info()
+		suite.Nil(err)
+		suite.Contains(info.Attributes, attribute, "Mailbox %s should have special use %s", name, attribute)
+	}
+}
+
+func (suite *UserUnitTestSuite) TestCreateMailbox_CreatesParents() {
+	u := newUser("bob", nil)
+	suite.Nil(u.CreateMailbox("Projects/Mailpie/Bugs/"))
+	suite.Equal(b.ErrMailboxAlreadyExists, u.CreateMailbox("Projects"))
+	suite.Subset(mailboxNames(u), []string{"Projects", "Projects/Mailpie", "Projects/Mailpie/Bugs"})
+
+	parent, err := u.GetMailbox("Projects")
+	suite.Require().Nil(err)
+	info, err := parent.Info()
+	suite.Nil(err)
+	suite.Equal([]string{HasChildrenAttr}, info.Attributes)
+	child, err := u.GetMailbox("Projects/Mailpie")
+	suite.Require().Nil(err)
+	childInfo, err := child.Info()
+	suite.Nil(err)
+	suite.True(childInfo.Match("", "Projects/%"), "Hierarchy delimiter should be used for matching")
+	suite.False(childInfo.Match("", "%"), "Children should not match the top level")
+}
+
+func (suite *UserUnitTestSuite) TestRenameMailbox_RenamesChildren() {
+	u := newUser("bob", nil)
+	suite.Require().Nil(u.CreateMailbox("Projects/Mailpie/Bugs"))
+	suite.Require().Nil(u.CreateMailbox("Projects/Other"))
+	suite.Nil(u.RenameMailbox("Projects/Mailpie", "Archive/2021/Mailpie"))
+
+	names := mailboxNames(u)
+	suite.Subset(names, []string{"Archive/2021", "Archive/2021/Mailpie", "Archive/2021/Mailpie/Bugs", "Projects/Other"})
+	suite.NotContains(names, "Projects/Mailpie")
+	suite.NotContains(names, "Projects/Mailpie/Bugs")
+	mb, err := u.GetMailbox("Archive/2021/Mailpie/Bugs")
+	suite.Require().Nil(err)
+	suite.Equal("Archive/2021/Mailpie/Bugs", mb.Name())
+
+	suite.Error(u.RenameMailbox("INBOX", "Old"))
+	suite.Error(u.RenameMailbox("Archive/2021", "Archive/2021/Child"), "A mailbox can't be moved below itself")
+	suite.Equal(b.ErrNoSuchMailbox, u.RenameMailbox("Nope", "Still nope"))
+}
+
+func (suite *UserUnitTestSuite) TestDeleteMailbox() {
+	u := newUser("bob", nil)
+	suite.Require().Nil(u.CreateMailbox("Projects/Mailpie"))
+	suite.Error(u.DeleteMailbox("Projects"), "Mailboxes with children should not be deleted")
+	suite.Nil(u.DeleteMailbox("Projects/Mailpie"))
+	suite.Nil(u.DeleteMailbox("Projects"))
+	suite.Equal(b.ErrNoSuchMailbox, u.DeleteMailbox("Projects"))
+	suite.Error(u.DeleteMailbox("inbox"))
+}
+
+func (suite *UserUnitTestSuite) TestFolders_Persisted() {
+	dir := suite.T().TempDir()
+	folders, err := loadFolderStore(dir)
+	suite.Require().Nil(err)
+	u := newUser("bob", folders)
+	suite.Require().Nil(u.CreateMailbox("Projects/Mailpie"))
+	suite.Require().Nil(u.RenameMailbox("Projects", "Work"))
+
+	reloaded, err := loadFolderStore(dir)
+	suite.Require().Nil(err)
+	suite.Equal([]string{"Work", "Work/Mailpie"}, reloaded.get("bob"))
+	suite.Empty(reloaded.get("cora"))
+	restarted := newUser("bob", reloaded)
+	mb, err := restarted.GetMailbox("Work/Mailpie")
+	suite.Require().Nil(err)
+	status, err := mb.Status([]imap.StatusItem{imap.StatusMessages})
+	suite.Nil(err)
+	suite.Zero(status.Messages)
+}
+
+func TestUser(t *testing.T) {
+	suite.Run(t, new(UserUnitTestSuite))
+}
@@ -0,0 +1,250 @@
+package jmap
+
+import (
+	"encoding/json"
+	"github.com/da-coda/mailpie/internal/apiutil"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//request is the request object of RFC 8620 section 3.3
+type request struct {
+	Using       []string          `json:"using"`
+	MethodCalls []invocation      `json:"methodCalls"`
+	CreatedIDs  map[string]string `json:"createdIds,omitempty"`
+}
+
+type response struct {
+	MethodResponses []invocation      `json:"methodResponses"`
+	CreatedIDs      map[string]string `json:"createdIds,omitempty"`
+	SessionState    string            `json:"sessionState"`
+}
+
+//invocation is a method call or response, encoded as [name, arguments, call id]
+type invocation struct {
+	Name      string
+	Arguments json.RawMessage
+	CallID    string
+}
+
+func (i *invocation) UnmarshalJSON(data []byte) error {
+	var fields []json.RawMessage
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return err
+	}
+	if len(fields) != 3 {
+		return errors.New("invocation must have three elements")
+	}
+	err = json.Unmarshal(fields[0], &i.Name)
+	if err != nil {
+		return err
+	}
+	i.Arguments = fields[1]
+	return json.Unmarshal(fields[2], &i.CallID)
+}
+
+func (i invocation) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{i.Name, i.Arguments, i.CallID})
+}
+
+//methodError is the error response of a single method call
+type methodError struct {
+	Type        string   `json:"type"`
+	Description string   `json:"description,omitempty"`
+	Properties  []string `json:"properties,omitempty"`
+}
+
+func (e *methodError) Error() string {
+	return e.Type + ": " + e.Description
+}
+
+func invalidArguments(description string) *methodError {
+	return &methodError{Type: "invalidArguments", Description: description}
+}
+
+//method handles a method call for the user and returns the response arguments
+type method func(user string, arguments json.RawMessage) (interface{}, *methodError)
+
+func (h *Handler) methods() map[string]method {
+	return map[string]method{
+		"Core/echo": func(_ string, arguments json.RawMessage) (interface{}, *methodError) {
+			return arguments, nil
+		},
+		"Mailbox/get":   h.mailboxGet,
+		"Email/query":   h.emailQuery,
+		"Email/get":     h.emailGet,
+		"Email/changes": h.emailChanges,
+		"Email/set":     h.emailSet,
+	}
+}
+
+//api handles a JMAP request. Request level errors are answered with a problem, errors of method calls with an error
+//response for the call, so that the other calls still run
+func (h *Handler) api(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 10000000))
+	if err != nil || !json.Valid(body) {
+		writeProblem(w, http.StatusBadRequest, "urn:ietf:params:jmap:error:notJSON", "request is not valid JSON")
+		return
+	}
+	var req request
+	err = json.Unmarshal(body, &req)
+	if err != nil || req.Using == nil || req.MethodCalls == nil {
+		writeProblem(w, http.StatusBadRequest, "urn:ietf:params:jmap:error:notRequest", "request does not match the request object")
+		return
+	}
+	for _, capability := range req.Using {
+		if capability != CoreCapability && capability != MailCapability {
+			writeProblem(w, http.StatusBadRequest, "urn:ietf:params:jmap:error:unknownCapability", "unknown capability "+capability)
+			return
+		}
+	}
+
+	methods := h.methods()
+	resp := response{MethodResponses: []invocation{}, CreatedIDs: req.CreatedIDs}
+	for _, call := range req.MethodCalls {
+		arguments, resolveErr := resolveReferences(call.Arguments, resp.MethodResponses)
+		var result interface{}
+		var callErr *methodError
+		if resolveErr != nil {
+			callErr = resolveErr
+		} else if m, exists := methods[call.Name]; exists {
+			result, callErr = m(user, arguments)
+		} else {
+			callErr = &methodError{Type: "unknownMethod"}
+		}
+
+		name := call.Name
+		if callErr != nil {
+			name, result = "error", callErr
+		}
+		encoded, err := json.Marshal(result)
+		if err != nil {
+			name, encoded = "error", []byte(`{"type":"serverFail"}`)
+		}
+		resp.MethodResponses = append(resp.MethodResponses, invocation{Name: name, Arguments: encoded, CallID: call.CallID})
+	}
+	resp.SessionState = h.changes.current()
+	apiutil.WriteJSON(w, http.StatusOK, resp)
+}
+
+//resultReference references a value of a previous response (RFC 8620 section 3.7)
+type resultReference struct {
+	ResultOf string `json:"resultOf"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+}
+
+//resolveReferences replaces all arguments starting with # with the referenced values of previous responses
+func resolveReferences(arguments json.RawMessage, responses []invocation) (json.RawMessage, *methodError) {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(arguments, &fields) != nil {
+		return nil, invalidArguments("arguments must be an object")
+	}
+	resolved := false
+	for name, value := range fields {
+		if !strings.HasPrefix(name, "#") {
+			continue
+		}
+		if _, exists := fields[name[1:]]; exists {
+			return nil, invalidArguments("argument " + name[1:] + " is given directly and as reference")
+		}
+		var reference resultReference
+		err := json.Unmarshal(value, &reference)
+		if err != nil {
+			return nil, &methodError{Type: "invalidResultReference", Description: err.Error()}
+		}
+		result, err := reference.resolve(responses)
+		if err != nil {
+			return nil, &methodError{Type: "invalidResultReference", Description: err.Error()}
+		}
+		delete(fields, name)
+		fields[name[1:]] = result
+		resolved = true
+	}
+	if !resolved {
+		return arguments, nil
+	}
+	encoded, err := json.Marshal(fields)
+	if err != nil {
+		return nil, &methodError{Type: "serverFail", Description: err.Error()}
+	}
+	return encoded, nil
+}
+
+func (ref resultReference) resolve(responses []invocation) (json.RawMessage, error) {
+	for _, previous := range responses {
+		if previous.CallID != ref.ResultOf {
+			continue
+		}
+		if previous.Name != ref.Name {
+			return nil, errors.Errorf("response %s is %s and not %s", ref.ResultOf, previous.Name, ref.Name)
+		}
+		var value interface{}
+		err := json.Unmarshal(previous.Arguments, &value)
+		if err != nil {
+			return nil, err
+		}
+		value, err = evaluatePointer(value, ref.Path)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(value)
+	}
+	return nil, errors.Errorf("no response with call id %s", ref.ResultOf)
+}
+
+//evaluatePointer evaluates a JSON pointer (RFC 6901) with the JMAP extension that * maps over all array elements
+//and flattens the results
+func evaluatePointer(value interface{}, path string) (interface{}, error) {
+	if path == "" || path == "/" {
+		return value, nil
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, errors.Errorf("invalid path %s", path)
+	}
+	tokens := strings.SplitN(path[1:], "/", 2)
+	token := strings.ReplaceAll(strings.ReplaceAll(tokens[0], "~1", "/"), "~0", "~")
+	rest := ""
+	if len(tokens) == 2 {
+		rest = "/" + tokens[1]
+	}
+
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		next, exists := typed[token]
+		if !exists {
+			return nil, errors.Errorf("path element %s not found", token)
+		}
+		return evaluatePointer(next, rest)
+	case []interface{}:
+		if token == "*" {
+			results := []interface{}{}
+			for _, element := range typed {
+				result, err := evaluatePointer(element, rest)
+				if err != nil {
+					return nil, err
+				}
+				if list, isList := result.([]interface{}); isList {
+					results = append(results, list...)
+				} else {
+					results = append(results, result)
+				}
+			}
+			return results, nil
+		}
+		index, err := strconv.Atoi(token)
+		if err != nil || index < 0 || index >= len(typed) {
+			return nil, errors.Errorf("invalid array index %s", token)
+		}
+		return evaluatePointer(typed[index], rest)
+	}
+	return nil, errors.Errorf("path element %s not found", token)
+}
@@ -0,0 +1,294 @@
+package jmap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+//bodyPart is the EmailBodyPart of RFC 8621. Multipart parts have sub parts but no part id
+type bodyPart struct {
+	PartID      *string     `json:"partId"`
+	BlobID      *string     `json:"blobId"`
+	Size        int         `json:"size"`
+	Name        *string     `json:"name"`
+	Type        string      `json:"type"`
+	Charset     *string     `json:"charset"`
+	Disposition *string     `json:"disposition"`
+	CID         *string     `json:"cid"`
+	SubParts    []*bodyPart `json:"subParts,omitempty"`
+	//content is the part with the transfer encoding removed
+	content []byte
+}
+
+//bodyValue is the EmailBodyValue of RFC 8621, the decoded text of a text part
+type bodyValue struct {
+	Value             string `json:"value"`
+	IsEncodingProblem bool   `json:"isEncodingProblem"`
+	IsTruncated       bool   `json:"isTruncated"`
+}
+
+//bodyStructure is the parsed body of an email split into the parts to display and the attachments
+type bodyStructure struct {
+	root        *bodyPart
+	textBody    []*bodyPart
+	htmlBody    []*bodyPart
+	attachments []*bodyPart
+}
+
+var wordDecoder = mime.WordDecoder{CharsetReader: charsetReader}
+
+//parseBody parses the raw mail into its body parts. The blob ids of the parts are derived from the email id
+func parseBody(emailID string, raw []byte) *bodyStructure {
+	reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw)))
+	header, err := reader.ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		header = textproto.MIMEHeader{}
+	}
+	body, _ := io.ReadAll(reader.R)
+	root := parsePart(emailID, header, body, "")
+
+	structure := &bodyStructure{root: root}
+	textBody, htmlBody := []*bodyPart{}, []*bodyPart{}
+	structure.collect([]*bodyPart{root}, "mixed", false, &htmlBody, &textBody)
+	structure.textBody, structure.htmlBody = textBody, htmlBody
+	return structure
+}
+
+//parsePart parses a part and all its sub parts. Leaf parts get the part id of their position, the root leaf "1"
+func parsePart(emailID string, header textproto.MIMEHeader, body []byte, partID string) *bodyPart {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+	part := &bodyPart{Type: mediaType, Size: len(body)}
+	if disposition, dispositionParams, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		part.Disposition = &disposition
+		if name := dispositionParams["filename"]; name != "" {
+			part.Name = decodedString(name)
+		}
+	}
+	if part.Name == nil && params["name"] != "" {
+		part.Name = decodedString(params["name"])
+	}
+	if cid := strings.Trim(header.Get("Content-Id"), "<> "); cid != "" {
+		part.CID = &cid
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" {
+		reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for i := 1; ; i++ {
+			sub, err := reader.NextRawPart()
+			if err != nil {
+				break
+			}
+			content, _ := io.ReadAll(sub)
+			subID := strconv.Itoa(i)
+			if partID != "" {
+				subID = partID + "." + subID
+			}
+			part.SubParts = append(part.SubParts, parsePart(emailID, sub.Header, content, subID))
+		}
+		return part
+	}
+
+	if partID == "" {
+		partID = "1"
+	}
+	blobID := partBlobID(emailID, partID)
+	part.PartID, part.BlobID = &partID, &blobID
+	if strings.HasPrefix(mediaType, "text/") {
+		charset := strings.ToLower(params["charset"])
+		if charset == "" {
+			charset = "us-ascii"
+		}
+		part.Charset = &charset
+	}
+	part.content = decodeTransferEncoding(header.Get("Content-Transfer-Encoding"), body)
+	part.Size = len(part.content)
+	return part
+}
+
+func decodedString(value string) *string {
+	decoded, err := wordDecoder.DecodeHeader(value)
+	if err != nil {
+		decoded = value
+	}
+	return &decoded
+}
+
+func decodeTransferEncoding(encoding string, body []byte) []byte {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		decoded, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(removeWhitespace(body))))
+		if err == nil {
+			return decoded
+		}
+	case "quoted-printable":
+		decoded, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+		if err == nil {
+			return decoded
+		}
+	}
+	return body
+}
+
+func removeWhitespace(body []byte) []byte {
+	return bytes.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, body)
+}
+
+//isInlineMediaType reports whether clients can usually display the type inline
+func isInlineMediaType(mediaType string) bool {
+	return strings.HasPrefix(mediaType, "image/") || strings.HasPrefix(mediaType, "audio/") || strings.HasPrefix(mediaType, "video/")
+}
+
+//collect sorts the leaf parts into text body, html body and attachments following the algorithm of RFC 8621 section
+//4.1.4. A nil body means the body is not collected at the current level of a multipart/alternative
+func (s *bodyStructure) collect(parts []*bodyPart, multipartType string, inAlternative bool, htmlBody *[]*bodyPart, textBody *[]*bodyPart) {
+	textLength, htmlLength := -1, -1
+	if textBody != nil {
+		textLength = len(*textBody)
+	}
+	if htmlBody != nil {
+		htmlLength = len(*htmlBody)
+	}
+
+	for i, part := range parts {
+		isMultipart := strings.HasPrefix(part.Type, "multipart/")
+		isInline := (part.Disposition == nil || *part.Disposition != "attachment") &&
+			(part.Type == "text/plain" || part.Type == "text/html" || isInlineMediaType(part.Type)) &&
+			(i == 0 || (multipartType != "related" && (isInlineMediaType(part.Type) || part.Name == nil)))
+
+		switch {
+		case isMultipart:
+			subType := strings.TrimPrefix(part.Type, "multipart/")
+			s.collect(part.SubParts, subType, inAlternative || subType == "alternative", htmlBody, textBody)
+		case isInline && multipartType == "alternative":
+			switch part.Type {
+			case "text/plain":
+				if textBody != nil {
+					*textBody = append(*textBody, part)
+				}
+			case "text/html":
+				if htmlBody != nil {
+					*htmlBody = append(*htmlBody, part)
+				}
+			default:
+				s.attachments = append(s.attachments, part)
+			}
+		case isInline:
+			if inAlternative && part.Type == "text/plain" {
+				htmlBody = nil
+			}
+			if inAlternative && part.Type == "text/html" {
+				textBody = nil
+			}
+			if textBody != nil {
+				*textBody = append(*textBody, part)
+			}
+			if htmlBody != nil {
+				*htmlBody = append(*htmlBody, part)
+			}
+			if (textBody == nil || htmlBody == nil) && isInlineMediaType(part.Type) {
+				s.attachments = append(s.attachments, part)
+			}
+		default:
+			s.attachments = append(s.attachments, part)
+		}
+	}
+
+	//an alternative without a plain text or html version uses the parts of the other one
+	if multipartType == "alternative" && textBody != nil && htmlBody != nil {
+		if textLength == len(*textBody) && htmlLength != len(*htmlBody) {
+			*textBody = append(*textBody, (*htmlBody)[htmlLength:]...)
+		}
+		if htmlLength == len(*htmlBody) && textLength != len(*textBody) {
+			*htmlBody = append(*htmlBody, (*textBody)[textLength:]...)
+		}
+	}
+}
+
+//leaves returns all parts with a part id
+func (p *bodyPart) leaves() []*bodyPart {
+	if p.PartID != nil {
+		return []*bodyPart{p}
+	}
+	var leaves []*bodyPart
+	for _, sub := range p.SubParts {
+		leaves = append(leaves, sub.leaves()...)
+	}
+	return leaves
+}
+
+//find returns the leaf part with the part id
+func (p *bodyPart) find(partID string) *bodyPart {
+	for _, leaf := range p.leaves() {
+		if *leaf.PartID == partID {
+			return leaf
+		}
+	}
+	return nil
+}
+
+//value decodes the text of the part. Charsets other than UTF-8, US-ASCII and ISO-8859-1 are reported as encoding
+//problem. With maxBytes > 0 the value is truncated to at most maxBytes without splitting a character
+func (p *bodyPart) value(maxBytes int) bodyValue {
+	var result bodyValue
+	charset := ""
+	if p.Charset != nil {
+		charset = *p.Charset
+	}
+	reader, err := charsetReader(charset, bytes.NewReader(p.content))
+	if err != nil {
+		result.IsEncodingProblem = true
+		reader = bytes.NewReader(p.content)
+	}
+	content, _ := io.ReadAll(reader)
+	if !utf8.Valid(content) {
+		result.IsEncodingProblem = true
+		content = bytes.ToValidUTF8(content, []byte("�"))
+	}
+	text := strings.ReplaceAll(string(content), "\r\n", "\n")
+	if maxBytes > 0 && len(text) > maxBytes {
+		end := maxBytes
+		for end > 0 && !utf8.RuneStart(text[end]) {
+			end--
+		}
+		text = text[:end]
+		result.IsTruncated = true
+	}
+	result.Value = text
+	return result
+}
+
+//charsetReader converts the supported charsets to UTF-8
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return input, nil
+	case "iso-8859-1", "latin1":
+		content, err := io.ReadAll(input)
+		if err != nil {
+			return nil, err
+		}
+		runes := make([]rune, len(content))
+		for i, b := range content {
+			runes[i] = rune(b)
+		}
+		return strings.NewReader(string(runes)), nil
+	}
+	return nil, errUnsupportedCharset
+}
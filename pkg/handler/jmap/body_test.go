@@ -0,0 +1,56 @@
+package jmap
+
+import (
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+type BodyTestSuite struct {
+	suite.Suite
+}
+
+func partIDs(parts []*bodyPart) []string {
+	ids := []string{}
+	for _, part := range parts {
+		ids = append(ids, *part.PartID)
+	}
+	return ids
+}
+
+func (suite *BodyTestSuite) TestSinglePart() {
+	structure := parseBody("Mid", []byte("Subject: plain\r\nContent-Type: text/plain; charset=ISO-8859-1\r\n\r\nGr\xfc\xdfe\r\n"))
+	suite.Equal([]string{"1"}, partIDs(structure.textBody))
+	suite.Equal([]string{"1"}, partIDs(structure.htmlBody), "Without alternative the text part is used for both bodies")
+	suite.Empty(structure.attachments)
+	suite.Equal(bodyValue{Value: "Grüße\n"}, structure.textBody[0].value(0))
+	suite.Equal(bodyValue{Value: "Grü", IsTruncated: true}, structure.textBody[0].value(4), "Truncation must not split characters")
+}
+
+func (suite *BodyTestSuite) TestAlternativeWithoutPlainText() {
+	raw := "Content-Type: multipart/alternative; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/html\r\n\r\n<b>html only</b>\r\n" +
+		"--b--\r\n"
+	structure := parseBody("Mid", []byte(raw))
+	suite.Equal([]string{"1"}, partIDs(structure.htmlBody))
+	suite.Equal([]string{"1"}, partIDs(structure.textBody), "The html part is used if there is no plain text part")
+}
+
+func (suite *BodyTestSuite) TestRelatedInlineImage() {
+	raw := "Content-Type: multipart/related; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/html\r\n\r\n<img src=\"cid:logo\">\r\n" +
+		"--b\r\nContent-Type: image/png\r\nContent-Id: <logo>\r\nContent-Transfer-Encoding: base64\r\n\r\naGVsbG8=\r\n" +
+		"--b--\r\n"
+	structure := parseBody(emailID("key"), []byte(raw))
+	suite.Equal([]string{"1"}, partIDs(structure.htmlBody))
+	suite.Equal([]string{"2"}, partIDs(structure.attachments), "Related parts are attachments referenced by the html")
+	suite.Equal("logo", *structure.attachments[0].CID)
+	suite.Equal("hello", string(structure.root.find("2").content))
+	key, partID, ok := parseBlobID(*structure.attachments[0].BlobID)
+	suite.True(ok)
+	suite.Equal("2", partID)
+	suite.Equal("key", key)
+}
+
+func TestBody(t *testing.T) {
+	suite.Run(t, new(BodyTestSuite))
+}
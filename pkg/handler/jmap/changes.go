@@ -0,0 +1,119 @@
+package jmap
+
+import (
+	"strconv"
+	"sync"
+)
+
+//maxChangeEntries is the number of changes kept for Email/changes. Clients with an older state have to resync
+const maxChangeEntries = 10000
+
+type changeKind int
+
+const (
+	created changeKind = iota
+	updated
+	destroyed
+)
+
+//change is a single change of an email. Changes without user affect every account
+type change struct {
+	state int64
+	user  string
+	key   string
+	kind  changeKind
+}
+
+//changeLog assigns a new state to every change and remembers the latest changes, so that clients can ask what changed
+//since a state instead of fetching everything again
+type changeLog struct {
+	lock    sync.Mutex
+	state   int64
+	entries []change
+	//notify is called after every change with the affected user, which is empty if every account is affected
+	notify func(user string)
+}
+
+func newChangeLog(notify func(user string)) *changeLog {
+	return &changeLog{notify: notify}
+}
+
+//add records a change and returns the new state
+func (l *changeLog) add(user string, key string, kind changeKind) string {
+	l.lock.Lock()
+	l.state++
+	l.entries = append(l.entries, change{state: l.state, user: user, key: key, kind: kind})
+	if len(l.entries) > maxChangeEntries {
+		l.entries = append([]change{}, l.entries[len(l.entries)-maxChangeEntries:]...)
+	}
+	state := l.state
+	l.lock.Unlock()
+	if l.notify != nil {
+		l.notify(user)
+	}
+	return strconv.FormatInt(state, 10)
+}
+
+//current returns the current state
+func (l *changeLog) current() string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return strconv.FormatInt(l.state, 10)
+}
+
+//emailChanges is the result of changeLog.since with the store keys of the changed emails
+type emailChanges struct {
+	newState       string
+	hasMoreChanges bool
+	created        []string
+	updated        []string
+	destroyed      []string
+}
+
+//since returns the changes visible to the user after the state. Emails created and destroyed in between are left out,
+//an email created and updated is only reported as created. Returns false if the state is unknown or too old
+func (l *changeLog) since(user string, sinceState string, maxChanges int) (emailChanges, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	since, err := strconv.ParseInt(sinceState, 10, 64)
+	if err != nil || since < 0 || since > l.state {
+		return emailChanges{}, false
+	}
+	if len(l.entries) > 0 && since < l.entries[0].state-1 {
+		return emailChanges{}, false
+	}
+
+	result := emailChanges{newState: strconv.FormatInt(l.state, 10)}
+	first := make(map[string]changeKind)
+	last := make(map[string]changeKind)
+	var order []string
+	for _, entry := range l.entries {
+		if entry.state <= since || (entry.user != "" && entry.user != user) {
+			continue
+		}
+		if _, seen := first[entry.key]; !seen {
+			if maxChanges > 0 && len(order) == maxChanges {
+				result.hasMoreChanges = true
+				result.newState = strconv.FormatInt(entry.state-1, 10)
+				break
+			}
+			first[entry.key] = entry.kind
+			order = append(order, entry.key)
+		}
+		last[entry.key] = entry.kind
+	}
+
+	for _, key := range order {
+		switch {
+		case first[key] == created && last[key] == destroyed:
+			continue
+		case first[key] == created:
+			result.created = append(result.created, key)
+		case last[key] == destroyed:
+			result.destroyed = append(result.destroyed, key)
+		default:
+			result.updated = append(result.updated, key)
+		}
+	}
+	return result, true
+}
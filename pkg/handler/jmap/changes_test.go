@@ -0,0 +1,43 @@
+package jmap
+
+import (
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+type ChangesTestSuite struct {
+	suite.Suite
+}
+
+func (suite *ChangesTestSuite) TestSince() {
+	log := newChangeLog(nil)
+	log.add("", "kept", created)
+	state := log.current()
+	log.add("", "temporary", created)
+	log.add("bob", "kept", updated)
+	log.add("", "temporary", destroyed)
+	log.add("", "new", created)
+	log.add("bob", "new", updated)
+	log.add("cora", "other", updated)
+
+	changes, ok := log.since("bob", state, 0)
+	suite.True(ok)
+	suite.Equal([]string{"new"}, changes.created, "Created and updated emails are reported as created")
+	suite.Equal([]string{"kept"}, changes.updated)
+	suite.Empty(changes.destroyed, "Emails created and destroyed in between are left out")
+	suite.Equal(log.current(), changes.newState)
+
+	changes, ok = log.since("bob", state, 1)
+	suite.True(ok)
+	suite.True(changes.hasMoreChanges)
+	suite.Equal([]string{"temporary"}, changes.created, "The destruction of temporary is after the returned state")
+	suite.Empty(changes.updated)
+	suite.Equal("2", changes.newState)
+
+	_, ok = log.since("bob", "99", 0)
+	suite.False(ok, "Future states are unknown")
+}
+
+func TestChanges(t *testing.T) {
+	suite.Run(t, new(ChangesTestSuite))
+}
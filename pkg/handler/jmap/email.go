@@ -0,0 +1,729 @@
+package jmap
+
+import (
+	"encoding/json"
+	"github.com/da-coda/mailpie/pkg/instances"
+	"github.com/da-coda/mailpie/pkg/store"
+	gomail "net/mail"
+	"sort"
+	"strings"
+	"time"
+)
+
+//emailProperties are the properties returned by Email/get if the client doesn't ask for specific ones
+var emailProperties = []string{
+	"id", "blobId", "threadId", "mailboxIds", "keywords", "size", "receivedAt", "messageId", "inReplyTo", "references",
+	"sender", "from", "to", "cc", "bcc", "replyTo", "subject", "sentAt", "hasAttachment", "preview", "bodyValues",
+	"textBody", "htmlBody", "attachments",
+}
+
+//emailSortProperties are the properties Email/query can sort by
+var emailSortProperties = []string{"receivedAt", "sentAt", "size", "subject", "from", "to"}
+
+//previewLength is the maximum number of characters of the preview
+const previewLength = 256
+
+type emailAddress struct {
+	Name  *string `json:"name"`
+	Email string  `json:"email"`
+}
+
+//keywordsOf returns a copy of the keywords the user set for the mail
+func (h *Handler) keywordsOf(user string, key string) map[string]bool {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	keywords := make(map[string]bool, len(h.keywords[user][key]))
+	for keyword := range h.keywords[user][key] {
+		keywords[keyword] = true
+	}
+	return keywords
+}
+
+func addresses(mail instances.Mail, header string) []emailAddress {
+	if mail.Header.Get(header) == "" {
+		return nil
+	}
+	list, err := (&gomail.AddressParser{WordDecoder: &wordDecoder}).ParseList(mail.Header.Get(header))
+	if err != nil {
+		return []emailAddress{}
+	}
+	result := make([]emailAddress, 0, len(list))
+	for _, address := range list {
+		var name *string
+		if address.Name != "" {
+			name = &address.Name
+		}
+		result = append(result, emailAddress{Name: name, Email: address.Address})
+	}
+	return result
+}
+
+//messageIDs returns the message ids of a Message-ID, In-Reply-To or References header without angle brackets
+func messageIDs(mail instances.Mail, header string) []string {
+	value := mail.Header.Get(header)
+	if value == "" {
+		return nil
+	}
+	var ids []string
+	for _, field := range strings.Fields(strings.ReplaceAll(value, "><", "> <")) {
+		ids = append(ids, strings.Trim(field, "<>"))
+	}
+	return ids
+}
+
+//preview returns the start of the text body with collapsed white space
+func preview(structure *bodyStructure) string {
+	var text strings.Builder
+	for _, part := range structure.textBody {
+		if strings.HasPrefix(part.Type, "text/") {
+			text.WriteString(part.value(0).Value)
+			text.WriteString(" ")
+		}
+	}
+	runes := []rune(strings.Join(strings.Fields(text.String()), " "))
+	if len(runes) > previewLength {
+		runes = runes[:previewLength]
+	}
+	return string(runes)
+}
+
+type emailGetArguments struct {
+	getArguments
+	FetchTextBodyValues bool `json:"fetchTextBodyValues"`
+	FetchHTMLBodyValues bool `json:"fetchHTMLBodyValues"`
+	FetchAllBodyValues  bool `json:"fetchAllBodyValues"`
+	MaxBodyValueBytes   int  `json:"maxBodyValueBytes"`
+}
+
+//email builds the Email object of RFC 8621 with the properties
+func (h *Handler) email(user string, key string, mail instances.Mail, properties []string, args emailGetArguments) map[string]interface{} {
+	id := emailID(key)
+	structure := parseBody(id, mail.RawMessage)
+	object := map[string]interface{}{"id": id}
+	for _, property := range properties {
+		var value interface{}
+		switch property {
+		case "id", "blobId", "threadId":
+			value = id
+		case "mailboxIds":
+			mailboxIds := make(map[string]bool)
+			for _, folder := range h.folders(user, key) {
+				mailboxIds[mailboxID(folder)] = true
+			}
+			value = mailboxIds
+		case "keywords":
+			value = h.keywordsOf(user, key)
+		case "size":
+			value = len(mail.RawMessage)
+		case "receivedAt":
+			value = mail.Received.UTC().Format(time.RFC3339)
+		case "messageId":
+			value = messageIDs(mail, "Message-Id")
+		case "inReplyTo":
+			value = messageIDs(mail, "In-Reply-To")
+		case "references":
+			value = messageIDs(mail, "References")
+		case "sender":
+			value = addresses(mail, "Sender")
+		case "from":
+			value = addresses(mail, "From")
+		case "to":
+			value = addresses(mail, "To")
+		case "cc":
+			value = addresses(mail, "Cc")
+		case "bcc":
+			value = addresses(mail, "Bcc")
+		case "replyTo":
+			value = addresses(mail, "Reply-To")
+		case "subject":
+			if mail.Header.Get("Subject") != "" {
+				value = mail.Subject()
+			}
+		case "sentAt":
+			if date, err := mail.Header.Date(); err == nil {
+				value = date.Format(time.RFC3339)
+			}
+		case "hasAttachment":
+			value = len(structure.attachments) > 0
+		case "preview":
+			value = preview(structure)
+		case "bodyValues":
+			value = bodyValues(structure, args)
+		case "textBody":
+			value = structure.textBody
+		case "htmlBody":
+			value = structure.htmlBody
+		case "attachments":
+			value = append([]*bodyPart{}, structure.attachments...)
+		case "bodyStructure":
+			value = structure.root
+		}
+		object[property] = value
+	}
+	return object
+}
+
+//bodyValues returns the decoded text of the body parts the client asked for
+func bodyValues(structure *bodyStructure, args emailGetArguments) map[string]bodyValue {
+	values := make(map[string]bodyValue)
+	var parts []*bodyPart
+	switch {
+	case args.FetchAllBodyValues:
+		parts = structure.root.leaves()
+	default:
+		if args.FetchTextBodyValues {
+			parts = append(parts, structure.textBody...)
+		}
+		if args.FetchHTMLBodyValues {
+			parts = append(parts, structure.htmlBody...)
+		}
+	}
+	for _, part := range parts {
+		if strings.HasPrefix(part.Type, "text/") {
+			values[*part.PartID] = part.value(args.MaxBodyValueBytes)
+		}
+	}
+	return values
+}
+
+func isEmailProperty(property string) bool {
+	if property == "bodyStructure" {
+		return true
+	}
+	for _, known := range emailProperties {
+		if known == property {
+			return true
+		}
+	}
+	return false
+}
+
+//emailGet implements Email/get
+func (h *Handler) emailGet(user string, arguments json.RawMessage) (interface{}, *methodError) {
+	var args emailGetArguments
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, invalidArguments(err.Error())
+	}
+	if args.AccountID != accountID(user) {
+		return nil, &methodError{Type: "accountNotFound"}
+	}
+	properties := args.Properties
+	if properties == nil {
+		properties = emailProperties
+	}
+	for _, property := range properties {
+		if !isEmailProperty(property) {
+			return nil, &methodError{Type: "invalidArguments", Description: "unknown property " + property, Properties: []string{property}}
+		}
+	}
+
+	resp := getResponse{AccountID: args.AccountID, State: h.changes.current(), List: []interface{}{}, NotFound: []string{}}
+	var ids []string
+	if args.IDs != nil {
+		ids = *args.IDs
+	} else {
+		for _, key := range h.mailStore.KeysByArrival() {
+			ids = append(ids, emailID(key))
+		}
+	}
+	for _, id := range ids {
+		key, ok := decodeID("M", id)
+		if !ok {
+			resp.NotFound = append(resp.NotFound, id)
+			continue
+		}
+		mail, err := h.mailStore.GetSingle(key)
+		if err != nil {
+			resp.NotFound = append(resp.NotFound, id)
+			continue
+		}
+		resp.List = append(resp.List, h.email(user, key, mail, properties, args))
+	}
+	return resp, nil
+}
+
+//filter is a FilterCondition or FilterOperator of Email/query
+type filter struct {
+	Operator           string     `json:"operator"`
+	Conditions         []filter   `json:"conditions"`
+	InMailbox          string     `json:"inMailbox"`
+	InMailboxOtherThan []string   `json:"inMailboxOtherThan"`
+	Before             *time.Time `json:"before"`
+	After              *time.Time `json:"after"`
+	MinSize            *int       `json:"minSize"`
+	MaxSize            *int       `json:"maxSize"`
+	HasKeyword         string     `json:"hasKeyword"`
+	NotKeyword         string     `json:"notKeyword"`
+	HasAttachment      *bool      `json:"hasAttachment"`
+	Text               string     `json:"text"`
+	From               string     `json:"from"`
+	To                 string     `json:"to"`
+	Cc                 string     `json:"cc"`
+	Bcc                string     `json:"bcc"`
+	Subject            string     `json:"subject"`
+	Body               string     `json:"body"`
+}
+
+func containsFold(value string, search string) bool {
+	return strings.Contains(strings.ToLower(value), strings.ToLower(search))
+}
+
+//matches reports whether the mail of the user matches the filter. Text searches are case insensitive substring matches
+func (h *Handler) matches(user string, key string, mail instances.Mail, f *filter) bool {
+	if f == nil {
+		return true
+	}
+	switch f.Operator {
+	case "AND", "OR", "NOT":
+		for i := range f.Conditions {
+			matched := h.matches(user, key, mail, &f.Conditions[i])
+			if f.Operator == "AND" && !matched {
+				return false
+			}
+			if f.Operator == "OR" && matched {
+				return true
+			}
+			if f.Operator == "NOT" && matched {
+				return false
+			}
+		}
+		return f.Operator != "OR"
+	}
+
+	folders := h.folders(user, key)
+	if f.InMailbox != "" && !containsMailbox(folders, f.InMailbox) {
+		return false
+	}
+	for _, other := range f.InMailboxOtherThan {
+		if len(folders) == 1 && mailboxID(folders[0]) == other {
+			return false
+		}
+	}
+	received := mail.Received
+	if (f.Before != nil && !received.Before(*f.Before)) || (f.After != nil && received.Before(*f.After)) {
+		return false
+	}
+	size := len(mail.RawMessage)
+	if (f.MinSize != nil && size < *f.MinSize) || (f.MaxSize != nil && size >= *f.MaxSize) {
+		return false
+	}
+	keywords := h.keywordsOf(user, key)
+	if (f.HasKeyword != "" && !keywords[strings.ToLower(f.HasKeyword)]) || (f.NotKeyword != "" && keywords[strings.ToLower(f.NotKeyword)]) {
+		return false
+	}
+
+	needsBody := f.HasAttachment != nil || f.Body != "" || f.Text != ""
+	var body string
+	if needsBody {
+		structure := parseBody(emailID(key), mail.RawMessage)
+		if f.HasAttachment != nil && *f.HasAttachment != (len(structure.attachments) > 0) {
+			return false
+		}
+		for _, part := range structure.root.leaves() {
+			if strings.HasPrefix(part.Type, "text/") {
+				body += part.value(0).Value + "\n"
+			}
+		}
+	}
+	headers := map[string]string{
+		"From": f.From, "To": f.To, "Cc": f.Cc, "Bcc": f.Bcc,
+	}
+	for header, search := range headers {
+		if search != "" && !containsFold(*decodedString(mail.Header.Get(header)), search) {
+			return false
+		}
+	}
+	if f.Subject != "" && !containsFold(mail.Subject(), f.Subject) {
+		return false
+	}
+	if f.Body != "" && !containsFold(body, f.Body) {
+		return false
+	}
+	if f.Text != "" {
+		text := strings.Join([]string{mail.Header.Get("From"), mail.Header.Get("To"), mail.Header.Get("Cc"), mail.Header.Get("Bcc"), mail.Subject(), body}, "\n")
+		if !containsFold(*decodedString(text), f.Text) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsMailbox(folders []string, id string) bool {
+	for _, folder := range folders {
+		if mailboxID(folder) == id {
+			return true
+		}
+	}
+	return false
+}
+
+type comparator struct {
+	Property    string `json:"property"`
+	IsAscending *bool  `json:"isAscending"`
+}
+
+type queryArguments struct {
+	AccountID      string       `json:"accountId"`
+	Filter         *filter      `json:"filter"`
+	Sort           []comparator `json:"sort"`
+	Position       int          `json:"position"`
+	Anchor         *string      `json:"anchor"`
+	AnchorOffset   int          `json:"anchorOffset"`
+	Limit          *int         `json:"limit"`
+	CalculateTotal bool         `json:"calculateTotal"`
+}
+
+type queryResponse struct {
+	AccountID           string   `json:"accountId"`
+	QueryState          string   `json:"queryState"`
+	CanCalculateChanges bool     `json:"canCalculateChanges"`
+	Position            int      `json:"position"`
+	IDs                 []string `json:"ids"`
+	Total               *int     `json:"total,omitempty"`
+}
+
+//sortValue returns the value of the mail the comparator sorts by
+func (h *Handler) sortValue(key string, mail instances.Mail, property string) interface{} {
+	switch property {
+	case "receivedAt":
+		return mail.Received.UnixNano()
+	case "sentAt":
+		date, _ := mail.Header.Date()
+		return date.UnixNano()
+	case "size":
+		return int64(len(mail.RawMessage))
+	case "subject":
+		return strings.ToLower(mail.Subject())
+	default:
+		list := addresses(mail, map[string]string{"from": "From", "to": "To"}[property])
+		if len(list) == 0 {
+			return ""
+		}
+		return strings.ToLower(list[0].Email)
+	}
+}
+
+//emailQuery implements Email/query. Without sort the emails are returned in the order they arrived
+func (h *Handler) emailQuery(user string, arguments json.RawMessage) (interface{}, *methodError) {
+	var args queryArguments
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, invalidArguments(err.Error())
+	}
+	if args.AccountID != accountID(user) {
+		return nil, &methodError{Type: "accountNotFound"}
+	}
+	for _, c := range args.Sort {
+		supported := false
+		for _, property := range emailSortProperties {
+			supported = supported || property == c.Property
+		}
+		if !supported {
+			return nil, &methodError{Type: "unsupportedSort", Description: "cannot sort by " + c.Property}
+		}
+	}
+	if args.Limit != nil && *args.Limit < 0 {
+		return nil, invalidArguments("limit must not be negative")
+	}
+
+	state := h.changes.current()
+	type entry struct {
+		key  string
+		mail instances.Mail
+	}
+	var entries []entry
+	for _, key := range h.mailStore.KeysByArrival() {
+		mail, err := h.mailStore.GetSingle(key)
+		if err != nil || !h.matches(user, key, mail, args.Filter) {
+			continue
+		}
+		entries = append(entries, entry{key: key, mail: mail})
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		for _, c := range args.Sort {
+			left, right := h.sortValue(entries[i].key, entries[i].mail, c.Property), h.sortValue(entries[j].key, entries[j].mail, c.Property)
+			if left == right {
+				continue
+			}
+			less := false
+			switch typed := left.(type) {
+			case int64:
+				less = typed < right.(int64)
+			case string:
+				less = typed < right.(string)
+			}
+			if c.IsAscending != nil && !*c.IsAscending {
+				return !less
+			}
+			return less
+		}
+		return false
+	})
+
+	position := args.Position
+	if args.Anchor != nil {
+		found := false
+		for i, e := range entries {
+			if emailID(e.key) == *args.Anchor {
+				position, found = i+args.AnchorOffset, true
+				break
+			}
+		}
+		if !found {
+			return nil, &methodError{Type: "anchorNotFound"}
+		}
+	} else if position < 0 {
+		position += len(entries)
+	}
+	if position < 0 {
+		position = 0
+	}
+	if position > len(entries) {
+		position = len(entries)
+	}
+	end := len(entries)
+	if args.Limit != nil && position+*args.Limit < end {
+		end = position + *args.Limit
+	}
+
+	resp := queryResponse{AccountID: args.AccountID, QueryState: state, Position: position, IDs: []string{}}
+	for _, e := range entries[position:end] {
+		resp.IDs = append(resp.IDs, emailID(e.key))
+	}
+	if args.CalculateTotal {
+		total := len(entries)
+		resp.Total = &total
+	}
+	return resp, nil
+}
+
+type changesArguments struct {
+	AccountID  string `json:"accountId"`
+	SinceState string `json:"sinceState"`
+	MaxChanges int    `json:"maxChanges"`
+}
+
+type changesResponse struct {
+	AccountID      string   `json:"accountId"`
+	OldState       string   `json:"oldState"`
+	NewState       string   `json:"newState"`
+	HasMoreChanges bool     `json:"hasMoreChanges"`
+	Created        []string `json:"created"`
+	Updated        []string `json:"updated"`
+	Destroyed      []string `json:"destroyed"`
+}
+
+func emailIDs(keys []string) []string {
+	ids := make([]string, 0, len(keys))
+	for _, key := range keys {
+		ids = append(ids, emailID(key))
+	}
+	return ids
+}
+
+//emailChanges implements Email/changes
+func (h *Handler) emailChanges(user string, arguments json.RawMessage) (interface{}, *methodError) {
+	var args changesArguments
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, invalidArguments(err.Error())
+	}
+	if args.AccountID != accountID(user) {
+		return nil, &methodError{Type: "accountNotFound"}
+	}
+	if args.MaxChanges < 0 {
+		return nil, invalidArguments("maxChanges must be positive")
+	}
+	changes, ok := h.changes.since(user, args.SinceState, args.MaxChanges)
+	if !ok {
+		return nil, &methodError{Type: "cannotCalculateChanges", Description: "state is unknown or too old, fetch all emails again"}
+	}
+	return changesResponse{
+		AccountID:      args.AccountID,
+		OldState:       args.SinceState,
+		NewState:       changes.newState,
+		HasMoreChanges: changes.hasMoreChanges,
+		Created:        emailIDs(changes.created),
+		Updated:        emailIDs(changes.updated),
+		Destroyed:      emailIDs(changes.destroyed),
+	}, nil
+}
+
+type setArguments struct {
+	AccountID string                                `json:"accountId"`
+	IfInState *string                               `json:"ifInState"`
+	Create    map[string]json.RawMessage            `json:"create"`
+	Update    map[string]map[string]json.RawMessage `json:"update"`
+	Destroy   []string                              `json:"destroy"`
+}
+
+type setResponse struct {
+	AccountID    string                  `json:"accountId"`
+	OldState     string                  `json:"oldState"`
+	NewState     string                  `json:"newState"`
+	Created      map[string]interface{}  `json:"created"`
+	Updated      map[string]interface{}  `json:"updated"`
+	Destroyed    []string                `json:"destroyed"`
+	NotCreated   map[string]*methodError `json:"notCreated"`
+	NotUpdated   map[string]*methodError `json:"notUpdated"`
+	NotDestroyed map[string]*methodError `json:"notDestroyed"`
+}
+
+//emailSet implements Email/set. Emails can't be created, updates change the keywords and the mailboxes of the user,
+//destroying removes the mail from the MailStore for everyone
+func (h *Handler) emailSet(user string, arguments json.RawMessage) (interface{}, *methodError) {
+	var args setArguments
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, invalidArguments(err.Error())
+	}
+	if args.AccountID != accountID(user) {
+		return nil, &methodError{Type: "accountNotFound"}
+	}
+	oldState := h.changes.current()
+	if args.IfInState != nil && *args.IfInState != oldState {
+		return nil, &methodError{Type: "stateMismatch"}
+	}
+
+	resp := setResponse{
+		AccountID:    args.AccountID,
+		OldState:     oldState,
+		Created:      map[string]interface{}{},
+		Updated:      map[string]interface{}{},
+		Destroyed:    []string{},
+		NotCreated:   map[string]*methodError{},
+		NotUpdated:   map[string]*methodError{},
+		NotDestroyed: map[string]*methodError{},
+	}
+	for creationID := range args.Create {
+		resp.NotCreated[creationID] = &methodError{Type: "forbidden", Description: "creating emails is not supported, send them via SMTP"}
+	}
+	for id, patch := range args.Update {
+		key, ok := decodeID("M", id)
+		if ok {
+			_, err := h.mailStore.GetSingle(key)
+			ok = err == nil
+		}
+		if !ok {
+			resp.NotUpdated[id] = &methodError{Type: "notFound"}
+			continue
+		}
+		if err := h.update(user, key, patch); err != nil {
+			resp.NotUpdated[id] = err
+			continue
+		}
+		resp.Updated[id] = nil
+	}
+	for _, id := range args.Destroy {
+		key, ok := decodeID("M", id)
+		if !ok || h.mailStore.Delete(key) == store.KeyNotExistsError {
+			resp.NotDestroyed[id] = &methodError{Type: "notFound"}
+			continue
+		}
+		//the event of the store is delivered asynchronously, forget the mail right away so that newState includes it
+		h.forget(key)
+		resp.Destroyed = append(resp.Destroyed, id)
+	}
+	resp.NewState = h.changes.current()
+	return resp, nil
+}
+
+//update applies the patch to the keywords and mailboxes of the mail. The patch is validated completely before anything
+//is changed
+func (h *Handler) update(user string, key string, patch map[string]json.RawMessage) *methodError {
+	keywords := h.keywordsOf(user, key)
+	folders := make(map[string]bool)
+	for _, folder := range h.folders(user, key) {
+		folders[folder] = true
+	}
+	originalFolders := make(map[string]bool, len(folders))
+	for folder := range folders {
+		originalFolders[folder] = true
+	}
+
+	for property, value := range patch {
+		invalid := &methodError{Type: "invalidProperties", Properties: []string{property}}
+		switch {
+		case property == "keywords":
+			var full map[string]bool
+			if json.Unmarshal(value, &full) != nil {
+				return invalid
+			}
+			keywords = make(map[string]bool, len(full))
+			for keyword, set := range full {
+				if !set {
+					return invalid
+				}
+				keywords[strings.ToLower(keyword)] = true
+			}
+		case strings.HasPrefix(property, "keywords/"):
+			set, ok := patchValue(value)
+			if !ok {
+				return invalid
+			}
+			keyword := strings.ToLower(strings.TrimPrefix(property, "keywords/"))
+			if set {
+				keywords[keyword] = true
+			} else {
+				delete(keywords, keyword)
+			}
+		case property == "mailboxIds":
+			var full map[string]bool
+			if json.Unmarshal(value, &full) != nil {
+				return invalid
+			}
+			folders = make(map[string]bool, len(full))
+			for id, set := range full {
+				path, exists := h.mailboxPath(user, id)
+				if !set || !exists {
+					return invalid
+				}
+				folders[path] = true
+			}
+		case strings.HasPrefix(property, "mailboxIds/"):
+			set, ok := patchValue(value)
+			path, exists := h.mailboxPath(user, strings.TrimPrefix(property, "mailboxIds/"))
+			if !ok || !exists {
+				return invalid
+			}
+			if set {
+				folders[path] = true
+			} else {
+				delete(folders, path)
+			}
+		default:
+			return &methodError{Type: "invalidProperties", Description: "only keywords and mailboxIds can be changed", Properties: []string{property}}
+		}
+	}
+	if len(folders) == 0 {
+		return &methodError{Type: "invalidProperties", Description: "an email must be in at least one mailbox", Properties: []string{"mailboxIds"}}
+	}
+
+	h.lock.Lock()
+	if h.keywords[user] == nil {
+		h.keywords[user] = make(map[string]map[string]bool)
+	}
+	h.keywords[user][key] = keywords
+	h.lock.Unlock()
+	for folder := range folders {
+		if !originalFolders[folder] || len(h.mailStore.Folders(key)[user]) == 0 {
+			_ = h.mailStore.AddToFolder(key, user, folder)
+		}
+	}
+	for folder := range originalFolders {
+		if !folders[folder] {
+			h.mailStore.RemoveFromFolder(key, user, folder)
+		}
+	}
+	h.changes.add(user, key, updated)
+	return nil
+}
+
+//patchValue parses the value of a patch for a single keyword or mailbox, which is true to add and null to remove it
+func patchValue(value json.RawMessage) (bool, bool) {
+	if string(value) == "null" {
+		return false, true
+	}
+	var set bool
+	if json.Unmarshal(value, &set) != nil || !set {
+		return false, false
+	}
+	return true, true
+}
@@ -0,0 +1,139 @@
+package jmap
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//minPingInterval is the lowest ping interval in seconds a client can ask for
+const minPingInterval = 5
+
+//eventSources holds the connected event source clients
+type eventSources struct {
+	lock      sync.Mutex
+	listeners map[*listener]bool
+}
+
+//listener is an event source client of a user. Notifications are coalesced, so a slow client gets a single state
+//event for many changes
+type listener struct {
+	user    string
+	changed chan struct{}
+}
+
+func newEventSources() *eventSources {
+	return &eventSources{listeners: make(map[*listener]bool)}
+}
+
+func (e *eventSources) add(user string) *listener {
+	l := &listener{user: user, changed: make(chan struct{}, 1)}
+	e.lock.Lock()
+	e.listeners[l] = true
+	e.lock.Unlock()
+	return l
+}
+
+func (e *eventSources) remove(l *listener) {
+	e.lock.Lock()
+	delete(e.listeners, l)
+	e.lock.Unlock()
+}
+
+//broadcast notifies the listeners of the user, or all listeners if user is empty, without blocking
+func (e *eventSources) broadcast(user string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for l := range e.listeners {
+		if user != "" && l.user != user {
+			continue
+		}
+		select {
+		case l.changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+//stateChange is the StateChange object of RFC 8620 section 7.1
+type stateChange struct {
+	Type    string                       `json:"@type"`
+	Changed map[string]map[string]string `json:"changed"`
+}
+
+//eventSource pushes a state event whenever emails of the user change (RFC 8620 section 7.3). Mailboxes have the same
+//state as emails, because their counts change with every email
+func (h *Handler) eventSource(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeProblem(w, http.StatusInternalServerError, "about:blank", "streaming is not supported")
+		return
+	}
+	query := r.URL.Query()
+	types := map[string]bool{"Email": true, "Mailbox": true}
+	if requested := query.Get("types"); requested != "" && requested != "*" {
+		types = make(map[string]bool)
+		for _, t := range strings.Split(requested, ",") {
+			types[t] = t == "Email" || t == "Mailbox"
+		}
+	}
+	closeAfterState := query.Get("closeafter") == "state"
+	ping, _ := strconv.Atoi(query.Get("ping"))
+	if ping > 0 && ping < minPingInterval {
+		ping = minPingInterval
+	}
+
+	l := h.eventSources.add(user)
+	defer h.eventSources.remove(l)
+	var pings <-chan time.Time
+	if ping > 0 {
+		ticker := time.NewTicker(time.Duration(ping) * time.Second)
+		defer ticker.Stop()
+		pings = ticker.C
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-pings:
+			_, err := fmt.Fprintf(w, "event: ping\ndata: {\"@type\":\"Ping\",\"interval\":%d}\n\n", ping)
+			if err != nil {
+				return
+			}
+		case <-l.changed:
+			state := h.changes.current()
+			changed := make(map[string]string)
+			for t, wanted := range types {
+				if wanted {
+					changed[t] = state
+				}
+			}
+			if len(changed) == 0 {
+				continue
+			}
+			data, err := json.Marshal(stateChange{Type: "StateChange", Changed: map[string]map[string]string{accountID(user): changed}})
+			if err != nil {
+				return
+			}
+			_, err = fmt.Fprintf(w, "event: state\nid: %s\ndata: %s\n\n", state, data)
+			if err != nil || closeAfterState {
+				flusher.Flush()
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
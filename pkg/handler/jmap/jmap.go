@@ -0,0 +1,315 @@
+package jmap
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/da-coda/mailpie/internal/apiutil"
+	"github.com/da-coda/mailpie/pkg/auth"
+	"github.com/da-coda/mailpie/pkg/event"
+	"github.com/da-coda/mailpie/pkg/instances"
+	"github.com/da-coda/mailpie/pkg/store"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+//Capabilities of RFC 8620 and RFC 8621 supported by the handler
+const (
+	CoreCapability = "urn:ietf:params:jmap:core"
+	MailCapability = "urn:ietf:params:jmap:mail"
+)
+
+//anonymousUser is the account of requests without credentials when no users are configured
+const anonymousUser = "mailpie"
+
+var errUnsupportedCharset = errors.New("unsupported charset")
+
+//Handler serves the JMAP session resource, the API, blob downloads and the event source for push notifications. Emails
+//are the mails of the MailStore, mailboxes the folders recorded in the MailStore for the user
+type Handler struct {
+	mailStore     *store.MailStore
+	authenticator *auth.Authenticator
+	changes       *changeLog
+	eventSources  *eventSources
+
+	lock sync.RWMutex
+	//known are the keys of the mails whose creation is recorded, so that their destruction is recorded only once
+	known map[string]bool
+	//keywords holds the keywords per user and store key
+	keywords map[string]map[string]map[string]bool
+}
+
+//NewHandler creates the JMAP handler for the mails of the mailStore. The stored and deleted mails are recorded from the
+//events on the messageQueue, so that clients can fetch the changes since their last state
+func NewHandler(mailStore *store.MailStore, messageQueue event.Subscribable, authenticator *auth.Authenticator) *Handler {
+	h := &Handler{
+		mailStore:     mailStore,
+		authenticator: authenticator,
+		eventSources:  newEventSources(),
+		known:         make(map[string]bool),
+		keywords:      make(map[string]map[string]map[string]bool),
+	}
+	h.changes = newChangeLog(h.eventSources.broadcast)
+	for _, key := range mailStore.KeysByArrival() {
+		h.known[key] = true
+	}
+	messageQueue.SubscribeWithOptions(event.SubscribeOptions{Events: []event.Event{store.NewMailStoredEvent, store.MailDeletedEvent}}, h.mailEvent)
+	return h
+}
+
+//mailEvent records a stored or deleted mail. Both events share one subscription, so that a mail deleted right after it
+//arrived is never recorded as created afterwards
+func (h *Handler) mailEvent(_ string, data interface{}) {
+	switch e := data.(type) {
+	case store.MailStored:
+		h.mailStored(e.Mail)
+	case store.MailDeleted:
+		h.mailDeleted(e.Mail)
+	}
+}
+
+//Register adds the JMAP routes to the router
+func (h *Handler) Register(router *mux.Router) {
+	router.HandleFunc("/.well-known/jmap", h.session).Methods("GET")
+	router.HandleFunc("/jmap/api", h.api).Methods("POST")
+	router.HandleFunc("/jmap/download/{accountId}/{blobId}/{name}", h.download).Methods("GET")
+	router.HandleFunc("/jmap/upload/{accountId}/", h.upload).Methods("POST")
+	router.HandleFunc("/jmap/eventsource", h.eventSource).Methods("GET")
+}
+
+//mailStored records the arrival of a mail of the own store
+func (h *Handler) mailStored(mail instances.Mail) {
+	if _, err := h.mailStore.GetSingle(mail.Key); err != nil {
+		return
+	}
+	h.lock.Lock()
+	h.known[mail.Key] = true
+	h.lock.Unlock()
+	h.changes.add("", mail.Key, created)
+}
+
+//mailDeleted forgets a deleted mail of the own store
+func (h *Handler) mailDeleted(mail instances.Mail) {
+	h.forget(mail.Key)
+}
+
+//forget removes the mail with the key and records its destruction, unless it is already forgotten
+func (h *Handler) forget(key string) {
+	h.lock.Lock()
+	if !h.known[key] {
+		h.lock.Unlock()
+		return
+	}
+	delete(h.known, key)
+	for _, keywords := range h.keywords {
+		delete(keywords, key)
+	}
+	h.lock.Unlock()
+	h.changes.add("", key, destroyed)
+}
+
+//authenticate returns the user of the request. Requests without credentials use the anonymous account if no users
+//are configured. Writes a 401 response and returns false if the request is not authenticated
+func (h *Handler) authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	username, password, ok := r.BasicAuth()
+	if !ok && !h.authenticator.Enabled() {
+		return anonymousUser, true
+	}
+	if !ok || !h.authenticator.Authenticate(username, password) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Mailpie"`)
+		writeProblem(w, http.StatusUnauthorized, "about:blank", "invalid or missing credentials")
+		return "", false
+	}
+	return username, true
+}
+
+//encodeID turns a string into a JMAP id, which may only contain URL safe base64 characters
+func encodeID(prefix string, value string) string {
+	return prefix + base64.RawURLEncoding.EncodeToString([]byte(value))
+}
+
+func decodeID(prefix string, id string) (string, bool) {
+	if !strings.HasPrefix(id, prefix) {
+		return "", false
+	}
+	value, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(id, prefix))
+	if err != nil {
+		return "", false
+	}
+	return string(value), true
+}
+
+func accountID(user string) string {
+	return encodeID("A", user)
+}
+
+func emailID(key string) string {
+	return encodeID("M", key)
+}
+
+func mailboxID(name string) string {
+	return encodeID("F", name)
+}
+
+//partBlobID is the blob id of a body part. Part ids contain dots, which are not allowed in ids, so they are replaced
+//by x, which is neither a digit nor the prefix of the email id
+func partBlobID(emailID string, partID string) string {
+	return "B" + strings.ReplaceAll(partID, ".", "x") + emailID
+}
+
+//parseBlobID returns the store key and the part id of a blob. The part id is empty for the raw email
+func parseBlobID(blobID string) (string, string, bool) {
+	partID := ""
+	if strings.HasPrefix(blobID, "B") {
+		end := strings.Index(blobID, "M")
+		if end < 0 {
+			return "", "", false
+		}
+		partID = strings.ReplaceAll(blobID[1:end], "x", ".")
+		blobID = blobID[end:]
+	}
+	key, ok := decodeID("M", blobID)
+	return key, partID, ok
+}
+
+type accountCapabilities struct {
+	Name                string                 `json:"name"`
+	IsPersonal          bool                   `json:"isPersonal"`
+	IsReadOnly          bool                   `json:"isReadOnly"`
+	AccountCapabilities map[string]interface{} `json:"accountCapabilities"`
+}
+
+type sessionResource struct {
+	Capabilities    map[string]interface{}         `json:"capabilities"`
+	Accounts        map[string]accountCapabilities `json:"accounts"`
+	PrimaryAccounts map[string]string              `json:"primaryAccounts"`
+	Username        string                         `json:"username"`
+	APIURL          string                         `json:"apiUrl"`
+	DownloadURL     string                         `json:"downloadUrl"`
+	UploadURL       string                         `json:"uploadUrl"`
+	EventSourceURL  string                         `json:"eventSourceUrl"`
+	State           string                         `json:"state"`
+}
+
+//session serves the session resource (RFC 8620 section 2) describing the capabilities and the account of the user
+func (h *Handler) session(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	base := fmt.Sprintf("%s://%s", scheme, r.Host)
+	account := accountID(user)
+	apiutil.WriteJSON(w, http.StatusOK, sessionResource{
+		Capabilities: map[string]interface{}{
+			CoreCapability: map[string]interface{}{
+				"maxSizeUpload":         0,
+				"maxConcurrentUpload":   1,
+				"maxSizeRequest":        10000000,
+				"maxConcurrentRequests": 10,
+				"maxCallsInRequest":     32,
+				"maxObjectsInGet":       1000,
+				"maxObjectsInSet":       1000,
+				"collationAlgorithms":   []string{"i;ascii-casemap"},
+			},
+			MailCapability: struct{}{},
+		},
+		Accounts: map[string]accountCapabilities{
+			account: {
+				Name:       user,
+				IsPersonal: true,
+				AccountCapabilities: map[string]interface{}{
+					CoreCapability: struct{}{},
+					MailCapability: map[string]interface{}{
+						"maxMailboxesPerEmail":       nil,
+						"maxMailboxDepth":            nil,
+						"maxSizeMailboxName":         255,
+						"maxSizeAttachmentsPerEmail": 0,
+						"emailQuerySortOptions":      emailSortProperties,
+						"mayCreateTopLevelMailbox":   false,
+					},
+				},
+			},
+		},
+		PrimaryAccounts: map[string]string{CoreCapability: account, MailCapability: account},
+		Username:        user,
+		APIURL:          base + "/jmap/api",
+		DownloadURL:     base + "/jmap/download/{accountId}/{blobId}/{name}?type={type}",
+		UploadURL:       base + "/jmap/upload/{accountId}/",
+		EventSourceURL:  base + "/jmap/eventsource?types={types}&closeafter={closeafter}&ping={ping}",
+		State:           h.changes.current(),
+	})
+}
+
+//download serves the raw email or the decoded content of a body part
+func (h *Handler) download(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+	vars := mux.Vars(r)
+	if vars["accountId"] != accountID(user) {
+		writeProblem(w, http.StatusNotFound, "about:blank", "account not found")
+		return
+	}
+	key, partID, ok := parseBlobID(vars["blobId"])
+	if !ok {
+		writeProblem(w, http.StatusNotFound, "about:blank", "blob not found")
+		return
+	}
+	mail, err := h.mailStore.GetSingle(key)
+	if err != nil {
+		writeProblem(w, http.StatusNotFound, "about:blank", "blob not found")
+		return
+	}
+	content, contentType := mail.RawMessage, "message/rfc822"
+	if partID != "" {
+		part := parseBody(emailID(key), mail.RawMessage).root.find(partID)
+		if part == nil {
+			writeProblem(w, http.StatusNotFound, "about:blank", "blob not found")
+			return
+		}
+		content, contentType = part.content, part.Type
+	}
+	if requested := r.URL.Query().Get("type"); requested != "" {
+		contentType = requested
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", vars["name"]))
+	w.Header().Set("Cache-Control", "private, immutable, max-age=31536000")
+	_, err = w.Write(content)
+	if err != nil {
+		logrus.WithError(err).Error("Unable to write JMAP blob")
+	}
+}
+
+//upload is part of the core capability, but there is no method using uploaded blobs. Mails are sent via SMTP
+func (h *Handler) upload(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.authenticate(w, r); !ok {
+		return
+	}
+	writeProblem(w, http.StatusNotImplemented, "about:blank", "uploads are not supported, send mails via SMTP")
+}
+
+//problem is a problem details object of RFC 7807, used for request level errors
+type problem struct {
+	Type   string `json:"type"`
+	Status int    `json:"status"`
+	Detail string `json:"detail"`
+}
+
+func writeProblem(w http.ResponseWriter, status int, problemType string, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(problem{Type: problemType, Status: status, Detail: detail})
+	if err != nil {
+		logrus.WithError(err).Error("Unable to write JMAP problem")
+	}
+}
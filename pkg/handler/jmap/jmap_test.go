@@ -0,0 +1,281 @@
+package jmap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/da-coda/mailpie/pkg/auth"
+	"github.com/da-coda/mailpie/pkg/config"
+	"github.com/da-coda/mailpie/pkg/event"
+	"github.com/da-coda/mailpie/pkg/instances"
+	"github.com/da-coda/mailpie/pkg/store"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/suite"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var plainMail = "Message-ID: <plain@example.com>\r\nDate: Wed, 27 Jan 2021 17:00:48 +0100\r\nFrom: Alex <alex@example.com>\r\nTo: bob@example.com\r\nSubject: Hello Bob\r\n\r\nHello Bob, how are you?\r\n"
+
+var multipartMail = "Date: Thu, 28 Jan 2021 17:00:48 +0100\r\nFrom: cora@example.com\r\nTo: bob@example.com\r\nSubject: Report\r\nMIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n\r\n" +
+	"--outer\r\nContent-Type: multipart/alternative; boundary=inner\r\n\r\n" +
+	"--inner\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nThe report is attached =E2=9C=93\r\n" +
+	"--inner\r\nContent-Type: text/html; charset=utf-8\r\n\r\n<p>The report is attached</p>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\nContent-Type: application/pdf; name=report.pdf\r\nContent-Disposition: attachment; filename=report.pdf\r\nContent-Transfer-Encoding: base64\r\n\r\nJVBERi0xLjQ=\r\n" +
+	"--outer--\r\n"
+
+type HandlerTestSuite struct {
+	suite.Suite
+	mailStore *store.MailStore
+	handler   *Handler
+	server    *httptest.Server
+	account   string
+}
+
+func (suite *HandlerTestSuite) SetupTest() {
+	suite.mailStore = store.CreateMailStore(event.CreateOrGet())
+	suite.start(nil)
+}
+
+func (suite *HandlerTestSuite) TearDownTest() {
+	suite.server.Close()
+}
+
+func (suite *HandlerTestSuite) start(authenticator *auth.Authenticator) {
+	if suite.server != nil {
+		suite.server.Close()
+	}
+	suite.handler = NewHandler(suite.mailStore, event.CreateOrGet(), authenticator)
+	router := mux.NewRouter()
+	suite.handler.Register(router)
+	suite.server = httptest.NewServer(router)
+	suite.account = accountID(anonymousUser)
+}
+
+func (suite *HandlerTestSuite) addMail(key string, raw string) string {
+	mail, err := instances.ParseMail([]byte(raw))
+	suite.Require().Nil(err)
+	suite.Require().Nil(suite.mailStore.Add(key, *mail))
+	event.CreateOrGet().Flush()
+	return emailID(key)
+}
+
+//call sends a request with the method calls and returns the method responses
+func (suite *HandlerTestSuite) call(calls ...[]interface{}) []invocation {
+	body, err := json.Marshal(map[string]interface{}{"using": []string{CoreCapability, MailCapability}, "methodCalls": calls})
+	suite.Require().Nil(err)
+	resp, err := http.Post(suite.server.URL+"/jmap/api", "application/json", bytes.NewReader(body))
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+	suite.Require().Equal(http.StatusOK, resp.StatusCode)
+	var decoded response
+	suite.Require().Nil(json.NewDecoder(resp.Body).Decode(&decoded))
+	suite.Require().Len(decoded.MethodResponses, len(calls))
+	return decoded.MethodResponses
+}
+
+//result decodes the arguments of a response into a generic map and fails if the response is an error
+func (suite *HandlerTestSuite) result(response invocation, name string) map[string]interface{} {
+	suite.Require().Equal(name, response.Name, string(response.Arguments))
+	var args map[string]interface{}
+	suite.Require().Nil(json.Unmarshal(response.Arguments, &args))
+	return args
+}
+
+func (suite *HandlerTestSuite) TestSession() {
+	resp, err := http.Get(suite.server.URL + "/.well-known/jmap")
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+	var session map[string]interface{}
+	suite.Require().Nil(json.NewDecoder(resp.Body).Decode(&session))
+	suite.Contains(session["capabilities"], CoreCapability)
+	suite.Contains(session["capabilities"], MailCapability)
+	suite.Equal(suite.account, session["primaryAccounts"].(map[string]interface{})[MailCapability])
+	suite.Equal(suite.server.URL+"/jmap/api", session["apiUrl"])
+}
+
+func (suite *HandlerTestSuite) TestAuthentication() {
+	suite.start(auth.NewAuthenticator([]config.User{{Username: "bob", Password: "secret"}}))
+	resp, err := http.Get(suite.server.URL + "/.well-known/jmap")
+	suite.Require().Nil(err)
+	_ = resp.Body.Close()
+	suite.Equal(http.StatusUnauthorized, resp.StatusCode)
+
+	request, _ := http.NewRequest(http.MethodGet, suite.server.URL+"/.well-known/jmap", nil)
+	request.SetBasicAuth("bob", "secret")
+	resp, err = http.DefaultClient.Do(request)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+	suite.Equal(http.StatusOK, resp.StatusCode)
+	var session map[string]interface{}
+	suite.Require().Nil(json.NewDecoder(resp.Body).Decode(&session))
+	suite.Equal("bob", session["username"])
+	suite.Contains(session["accounts"], accountID("bob"))
+}
+
+func (suite *HandlerTestSuite) TestRequestErrors() {
+	resp, err := http.Post(suite.server.URL+"/jmap/api", "application/json", strings.NewReader("{"))
+	suite.Require().Nil(err)
+	_ = resp.Body.Close()
+	suite.Equal(http.StatusBadRequest, resp.StatusCode)
+
+	resp, err = http.Post(suite.server.URL+"/jmap/api", "application/json", strings.NewReader(`{"using":["urn:unknown"],"methodCalls":[]}`))
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+	suite.Equal(http.StatusBadRequest, resp.StatusCode)
+	var p problem
+	suite.Require().Nil(json.NewDecoder(resp.Body).Decode(&p))
+	suite.Equal("urn:ietf:params:jmap:error:unknownCapability", p.Type)
+
+	responses := suite.call([]interface{}{"Unknown/method", map[string]interface{}{}, "0"}, []interface{}{"Email/get", map[string]interface{}{"accountId": "other"}, "1"})
+	suite.Equal("unknownMethod", suite.result(responses[0], "error")["type"])
+	suite.Equal("accountNotFound", suite.result(responses[1], "error")["type"])
+}
+
+func (suite *HandlerTestSuite) TestMailboxGet() {
+	suite.addMail("plain", plainMail)
+	suite.addMail("report", multipartMail)
+	suite.Nil(suite.mailStore.AddToFolder("report", anonymousUser, "Projects/Reports"))
+
+	list := suite.result(suite.call([]interface{}{"Mailbox/get", map[string]interface{}{"accountId": suite.account}, "0"})[0], "Mailbox/get")["list"].([]interface{})
+	mailboxes := make(map[string]map[string]interface{})
+	for _, element := range list {
+		mb := element.(map[string]interface{})
+		mailboxes[mb["name"].(string)] = mb
+	}
+	suite.Equal("inbox", mailboxes["INBOX"]["role"])
+	suite.Equal(float64(1), mailboxes["INBOX"]["totalEmails"])
+	suite.Equal(float64(1), mailboxes["INBOX"]["unreadEmails"])
+	suite.Equal("trash", mailboxes["Deleted Messages"]["role"])
+	suite.Equal(mailboxID("Projects"), mailboxes["Reports"]["parentId"], "Parents are derived from the hierarchy")
+	suite.Equal(float64(1), mailboxes["Reports"]["totalEmails"])
+	suite.Nil(mailboxes["Projects"]["parentId"])
+}
+
+func (suite *HandlerTestSuite) TestEmailQueryAndGet() {
+	plain := suite.addMail("plain", plainMail)
+	report := suite.addMail("report", multipartMail)
+
+	responses := suite.call(
+		[]interface{}{"Email/query", map[string]interface{}{"accountId": suite.account, "filter": map[string]interface{}{"inMailbox": mailboxID(inbox), "text": "report"}, "calculateTotal": true}, "q"},
+		[]interface{}{"Email/get", map[string]interface{}{
+			"accountId":           suite.account,
+			"#ids":                map[string]interface{}{"resultOf": "q", "name": "Email/query", "path": "/ids"},
+			"fetchTextBodyValues": true,
+		}, "g"},
+	)
+	query := suite.result(responses[0], "Email/query")
+	suite.Equal([]interface{}{report}, query["ids"])
+	suite.Equal(float64(1), query["total"])
+
+	emails := suite.result(responses[1], "Email/get")["list"].([]interface{})
+	suite.Require().Len(emails, 1)
+	email := emails[0].(map[string]interface{})
+	suite.Equal("Report", email["subject"])
+	stored, err := suite.mailStore.GetSingle("report")
+	suite.Require().Nil(err)
+	suite.Equal(stored.Received.UTC().Format(time.RFC3339), email["receivedAt"], "receivedAt should be the time the store received the mail")
+	suite.Equal(true, email["hasAttachment"])
+	textBody := email["textBody"].([]interface{})
+	suite.Require().Len(textBody, 1)
+	partID := textBody[0].(map[string]interface{})["partId"].(string)
+	suite.Equal("1.1", partID)
+	suite.Equal("The report is attached ✓", email["bodyValues"].(map[string]interface{})[partID].(map[string]interface{})["value"])
+	attachment := email["attachments"].([]interface{})[0].(map[string]interface{})
+	suite.Equal("report.pdf", attachment["name"])
+
+	download := strings.NewReplacer("{accountId}", suite.account, "{blobId}", attachment["blobId"].(string), "{name}", "report.pdf", "{type}", "application/pdf").Replace("/jmap/download/{accountId}/{blobId}/{name}?type={type}")
+	resp, err := http.Get(suite.server.URL + download)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+	content, _ := io.ReadAll(resp.Body)
+	suite.Equal("%PDF-1.4", string(content))
+
+	sorted := suite.result(suite.call([]interface{}{"Email/query", map[string]interface{}{"accountId": suite.account, "sort": []interface{}{map[string]interface{}{"property": "sentAt", "isAscending": false}}, "limit": 1}, "0"})[0], "Email/query")
+	suite.Equal([]interface{}{report}, sorted["ids"])
+	anchored := suite.result(suite.call([]interface{}{"Email/query", map[string]interface{}{"accountId": suite.account, "anchor": report, "anchorOffset": -1}, "0"})[0], "Email/query")
+	suite.Equal([]interface{}{plain, report}, anchored["ids"])
+}
+
+func (suite *HandlerTestSuite) TestEmailSetAndChanges() {
+	plain := suite.addMail("plain", plainMail)
+	report := suite.addMail("report", multipartMail)
+	state := suite.handler.changes.current()
+
+	responses := suite.call(
+		[]interface{}{"Email/set", map[string]interface{}{
+			"accountId": suite.account,
+			"update": map[string]interface{}{
+				plain:  map[string]interface{}{"keywords/$seen": true, "mailboxIds": map[string]bool{mailboxID("Archive"): true}},
+				"Mxx":  map[string]interface{}{"keywords/$seen": true},
+				report: map[string]interface{}{"subject": "changed"},
+			},
+			"destroy": []string{report},
+			"create":  map[string]interface{}{"new": map[string]interface{}{}},
+		}, "0"},
+		[]interface{}{"Email/changes", map[string]interface{}{"accountId": suite.account, "sinceState": state}, "1"},
+	)
+	set := suite.result(responses[0], "Email/set")
+	suite.Contains(set["updated"], plain)
+	suite.Contains(set["notUpdated"], "Mxx")
+	suite.Contains(set["notUpdated"], report)
+	suite.Equal([]interface{}{report}, set["destroyed"])
+	suite.Contains(set["notCreated"], "new")
+	_, err := suite.mailStore.GetSingle("report")
+	suite.Equal(store.KeyNotExistsError, err, "Destroying an email deletes the mail")
+	suite.Equal(map[string][]string{anonymousUser: {"Archive"}}, suite.mailStore.Folders("plain"))
+
+	changes := suite.result(responses[1], "Email/changes")
+	suite.Equal([]interface{}{plain}, changes["updated"])
+	suite.Equal([]interface{}{report}, changes["destroyed"])
+	suite.Equal(set["newState"], changes["newState"])
+
+	email := suite.result(suite.call([]interface{}{"Email/get", map[string]interface{}{"accountId": suite.account, "ids": []string{plain}, "properties": []string{"keywords", "mailboxIds"}}, "0"})[0], "Email/get")["list"].([]interface{})[0].(map[string]interface{})
+	suite.Equal(map[string]interface{}{"$seen": true}, email["keywords"])
+	suite.Equal(map[string]interface{}{mailboxID("Archive"): true}, email["mailboxIds"])
+
+	mismatch := suite.call([]interface{}{"Email/set", map[string]interface{}{"accountId": suite.account, "ifInState": state}, "0"})
+	suite.Equal("stateMismatch", suite.result(mismatch[0], "error")["type"])
+	invalid := suite.call([]interface{}{"Email/changes", map[string]interface{}{"accountId": suite.account, "sinceState": "unknown"}, "0"})
+	suite.Equal("cannotCalculateChanges", suite.result(invalid[0], "error")["type"])
+}
+
+func (suite *HandlerTestSuite) TestEventSource() {
+	resp, err := http.Get(suite.server.URL + "/jmap/eventsource?types=Email&closeafter=state&ping=0")
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+	suite.Equal("text/event-stream", resp.Header.Get("Content-Type"))
+
+	go func() {
+		//wait until the listener is registered
+		for {
+			suite.handler.eventSources.lock.Lock()
+			listening := len(suite.handler.eventSources.listeners) > 0
+			suite.handler.eventSources.lock.Unlock()
+			if listening {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		suite.addMail("pushed", plainMail)
+	}()
+
+	var events []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		events = append(events, scanner.Text())
+	}
+	suite.Contains(events, "event: state")
+	suite.Contains(events, fmt.Sprintf(`data: {"@type":"StateChange","changed":{"%s":{"Email":"%s"}}}`, suite.account, suite.handler.changes.current()))
+}
+
+func TestHandler(t *testing.T) {
+	suite.Run(t, new(HandlerTestSuite))
+}
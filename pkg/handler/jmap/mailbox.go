@@ -0,0 +1,212 @@
+package jmap
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+//Delimiter separates the levels of the folder hierarchy, the same as in IMAP
+const Delimiter = "/"
+
+//inbox is the folder of mails without recorded folders
+const inbox = "INBOX"
+
+//defaultMailboxes are the mailboxes every IMAP user has, together with their JMAP role
+var defaultMailboxes = []struct {
+	name string
+	role string
+}{
+	{name: inbox, role: "inbox"},
+	{name: "Sent Messages", role: "sent"},
+	{name: "Drafts", role: "drafts"},
+	{name: "Junk", role: "junk"},
+	{name: "Deleted Messages", role: "trash"},
+	{name: "Archive", role: "archive"},
+}
+
+type mailboxRights struct {
+	MayReadItems   bool `json:"mayReadItems"`
+	MayAddItems    bool `json:"mayAddItems"`
+	MayRemoveItems bool `json:"mayRemoveItems"`
+	MaySetSeen     bool `json:"maySetSeen"`
+	MaySetKeywords bool `json:"maySetKeywords"`
+	MayCreateChild bool `json:"mayCreateChild"`
+	MayRename      bool `json:"mayRename"`
+	MayDelete      bool `json:"mayDelete"`
+	MaySubmit      bool `json:"maySubmit"`
+}
+
+//mailbox is the Mailbox object of RFC 8621. Threads are not supported, every email is its own thread
+type mailbox struct {
+	ID            string        `json:"id"`
+	Name          string        `json:"name"`
+	ParentID      *string       `json:"parentId"`
+	Role          *string       `json:"role"`
+	SortOrder     int           `json:"sortOrder"`
+	TotalEmails   int           `json:"totalEmails"`
+	UnreadEmails  int           `json:"unreadEmails"`
+	TotalThreads  int           `json:"totalThreads"`
+	UnreadThreads int           `json:"unreadThreads"`
+	MyRights      mailboxRights `json:"myRights"`
+	IsSubscribed  bool          `json:"isSubscribed"`
+}
+
+//folders returns the folders of the mail for the user. Mails without recorded folders are in the INBOX
+func (h *Handler) folders(user string, key string) []string {
+	folders := h.mailStore.Folders(key)[user]
+	if len(folders) == 0 {
+		return []string{inbox}
+	}
+	return folders
+}
+
+//mailboxes returns the default mailboxes and all folders the user has mails in, including their parents, by path
+func (h *Handler) mailboxes(user string) map[string]*mailbox {
+	paths := make(map[string]bool)
+	for _, defaultMailbox := range defaultMailboxes {
+		paths[defaultMailbox.name] = true
+	}
+	keys := h.mailStore.KeysByArrival()
+	//read once, IMAP clients may move mails to new folders while the mailboxes are built
+	folders := make([][]string, len(keys))
+	for i, key := range keys {
+		folders[i] = h.folders(user, key)
+		for _, folder := range folders[i] {
+			parts := strings.Split(folder, Delimiter)
+			for i := range parts {
+				paths[strings.Join(parts[:i+1], Delimiter)] = true
+			}
+		}
+	}
+
+	mailboxes := make(map[string]*mailbox, len(paths))
+	for path := range paths {
+		mb := &mailbox{
+			ID:           mailboxID(path),
+			Name:         path,
+			IsSubscribed: true,
+			MyRights:     mailboxRights{MayReadItems: true, MayAddItems: true, MayRemoveItems: true, MaySetSeen: true, MaySetKeywords: true},
+		}
+		if parent := strings.LastIndex(path, Delimiter); parent >= 0 {
+			parentID := mailboxID(path[:parent])
+			mb.ParentID = &parentID
+			mb.Name = path[parent+1:]
+		}
+		for i, defaultMailbox := range defaultMailboxes {
+			if defaultMailbox.name == path {
+				role := defaultMailbox.role
+				mb.Role = &role
+				mb.SortOrder = i + 1
+			}
+		}
+		if mb.Role == nil {
+			mb.SortOrder = len(defaultMailboxes) + 1
+		}
+		mailboxes[path] = mb
+	}
+
+	for i, key := range keys {
+		seen := h.keywordsOf(user, key)["$seen"]
+		for _, folder := range folders[i] {
+			mailboxes[folder].TotalEmails++
+			mailboxes[folder].TotalThreads++
+			if !seen {
+				mailboxes[folder].UnreadEmails++
+				mailboxes[folder].UnreadThreads++
+			}
+		}
+	}
+	return mailboxes
+}
+
+//mailboxPath returns the folder path of the mailbox id if the user has the mailbox
+func (h *Handler) mailboxPath(user string, id string) (string, bool) {
+	path, ok := decodeID("F", id)
+	if !ok {
+		return "", false
+	}
+	_, exists := h.mailboxes(user)[path]
+	return path, exists
+}
+
+type getArguments struct {
+	AccountID  string    `json:"accountId"`
+	IDs        *[]string `json:"ids"`
+	Properties []string  `json:"properties"`
+}
+
+type getResponse struct {
+	AccountID string        `json:"accountId"`
+	State     string        `json:"state"`
+	List      []interface{} `json:"list"`
+	NotFound  []string      `json:"notFound"`
+}
+
+//mailboxGet implements Mailbox/get. The state is the email state, because the counts change with every email
+func (h *Handler) mailboxGet(user string, arguments json.RawMessage) (interface{}, *methodError) {
+	var args getArguments
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, invalidArguments(err.Error())
+	}
+	if args.AccountID != accountID(user) {
+		return nil, &methodError{Type: "accountNotFound"}
+	}
+	state := h.changes.current()
+	mailboxes := h.mailboxes(user)
+	byID := make(map[string]*mailbox, len(mailboxes))
+	var ids []string
+	for _, mb := range mailboxes {
+		byID[mb.ID] = mb
+		ids = append(ids, mb.ID)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if byID[ids[i]].SortOrder != byID[ids[j]].SortOrder {
+			return byID[ids[i]].SortOrder < byID[ids[j]].SortOrder
+		}
+		return ids[i] < ids[j]
+	})
+	if args.IDs != nil {
+		ids = *args.IDs
+	}
+
+	resp := getResponse{AccountID: args.AccountID, State: state, List: []interface{}{}, NotFound: []string{}}
+	for _, id := range ids {
+		mb, exists := byID[id]
+		if !exists {
+			resp.NotFound = append(resp.NotFound, id)
+			continue
+		}
+		object, err := pick(mb, args.Properties)
+		if err != nil {
+			return nil, err
+		}
+		resp.List = append(resp.List, object)
+	}
+	return resp, nil
+}
+
+//pick returns the object with only the properties and the id. Without properties all properties are returned
+func pick(object interface{}, properties []string) (interface{}, *methodError) {
+	if properties == nil {
+		return object, nil
+	}
+	encoded, err := json.Marshal(object)
+	if err != nil {
+		return nil, &methodError{Type: "serverFail", Description: err.Error()}
+	}
+	var all map[string]interface{}
+	err = json.Unmarshal(encoded, &all)
+	if err != nil {
+		return nil, &methodError{Type: "serverFail", Description: err.Error()}
+	}
+	picked := map[string]interface{}{"id": all["id"]}
+	for _, property := range properties {
+		value, exists := all[property]
+		if !exists {
+			return nil, &methodError{Type: "invalidArguments", Description: "unknown property " + property, Properties: []string{property}}
+		}
+		picked[property] = value
+	}
+	return picked, nil
+}
@@ -0,0 +1,370 @@
+package mailcatcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/da-coda/mailpie/internal/apiutil"
+	"github.com/da-coda/mailpie/pkg/event"
+	"github.com/da-coda/mailpie/pkg/instances"
+	"github.com/da-coda/mailpie/pkg/store"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/websocket"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//updateBuffer is the number of updates buffered per WebSocket client before updates are dropped
+const updateBuffer = 64
+
+//Handler serves the HTTP API and the WebSocket update stream of MailCatcher. MailCatcher numbers messages, so every
+//mail gets an id in the order it arrived
+type Handler struct {
+	mailStore *store.MailStore
+
+	lock        sync.Mutex
+	ids         map[string]int
+	keys        map[int]string
+	lastID      int
+	subscribers map[chan []byte]bool
+}
+
+//summary is a message in the message list
+type summary struct {
+	ID         int      `json:"id"`
+	Sender     string   `json:"sender"`
+	Recipients []string `json:"recipients"`
+	Subject    string   `json:"subject"`
+	Size       string   `json:"size"`
+	CreatedAt  string   `json:"created_at"`
+}
+
+type attachment struct {
+	CID      string `json:"cid"`
+	Type     string `json:"type"`
+	Filename string `json:"filename"`
+	Size     int    `json:"size"`
+	Href     string `json:"href"`
+}
+
+//details is the message returned by /messages/:id.json
+type details struct {
+	summary
+	Type        string       `json:"type"`
+	Formats     []string     `json:"formats"`
+	Attachments []attachment `json:"attachments"`
+}
+
+//update is sent to WebSocket clients when messages are added, removed or cleared
+type update struct {
+	Type    string   `json:"type"`
+	Message *summary `json:"message,omitempty"`
+	ID      int      `json:"id,omitempty"`
+}
+
+//NewHandler creates the MailCatcher handler for the mails of the mailStore. The mails already stored get their ids
+//right away, later ones once their event arrives on the messageQueue
+func NewHandler(mailStore *store.MailStore, messageQueue event.Subscribable) *Handler {
+	h := &Handler{
+		mailStore:   mailStore,
+		ids:         make(map[string]int),
+		keys:        make(map[int]string),
+		subscribers: make(map[chan []byte]bool),
+	}
+	for _, key := range mailStore.KeysByArrival() {
+		h.assign(key)
+	}
+	messageQueue.SubscribeWithOptions(event.SubscribeOptions{Events: []event.Event{store.NewMailStoredEvent, store.MailDeletedEvent}}, h.mailEvent)
+	return h
+}
+
+//mailEvent assigns ids to stored mails and removes deleted ones. The WebSocket clients learn about both in the order
+//the store dispatched them, since they share one subscription
+func (h *Handler) mailEvent(_ string, data interface{}) {
+	switch e := data.(type) {
+	case store.MailStored:
+		h.mailStored(e.Mail)
+	case store.MailDeleted:
+		h.mailDeleted(e.Mail)
+	}
+}
+
+//Register adds the MailCatcher routes to the router
+func (h *Handler) Register(router *mux.Router) {
+	router.Handle("/messages", websocket.Server{Handler: h.stream}).Methods("GET").HeadersRegexp("Upgrade", "(?i)websocket")
+	router.HandleFunc("/messages", h.list).Methods("GET")
+	router.HandleFunc("/messages", h.clear).Methods("DELETE")
+	router.HandleFunc("/messages/{id:[0-9]+}", h.delete).Methods("DELETE")
+	router.HandleFunc("/messages/{id:[0-9]+}.json", h.details).Methods("GET")
+	router.HandleFunc("/messages/{id:[0-9]+}.html", h.part("text/html")).Methods("GET")
+	router.HandleFunc("/messages/{id:[0-9]+}.plain", h.part("text/plain")).Methods("GET")
+	router.HandleFunc("/messages/{id:[0-9]+}.source", h.source("text/plain")).Methods("GET")
+	router.HandleFunc("/messages/{id:[0-9]+}.eml", h.source("message/rfc822")).Methods("GET")
+	router.HandleFunc("/messages/{id:[0-9]+}/parts/{cid}", h.attachment).Methods("GET")
+}
+
+//assign gives the key the next id
+func (h *Handler) assign(key string) int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if id, exists := h.ids[key]; exists {
+		return id
+	}
+	h.lastID++
+	h.ids[key] = h.lastID
+	h.keys[h.lastID] = key
+	return h.lastID
+}
+
+func (h *Handler) mailStored(mail instances.Mail) {
+	if _, err := h.mailStore.GetSingle(mail.Key); err != nil {
+		return
+	}
+	message := newSummary(h.assign(mail.Key), mail)
+	h.broadcast(update{Type: "add", Message: &message})
+}
+
+func (h *Handler) mailDeleted(mail instances.Mail) {
+	h.lock.Lock()
+	id, exists := h.ids[mail.Key]
+	if exists {
+		delete(h.ids, mail.Key)
+		delete(h.keys, id)
+	}
+	h.lock.Unlock()
+	if exists {
+		h.broadcast(update{Type: "remove", ID: id})
+	}
+}
+
+//newSummary describes the mail the way MailCatcher does, with the envelope addresses in angle brackets
+func newSummary(id int, mail instances.Mail) summary {
+	recipients := make([]string, 0)
+	for _, recipient := range mail.Recipients() {
+		recipients = append(recipients, "<"+strings.Trim(recipient, "<>")+">")
+	}
+	return summary{
+		ID:         id,
+		Sender:     "<" + strings.Trim(mail.Sender(), "<>") + ">",
+		Recipients: recipients,
+		Subject:    mail.Subject(),
+		Size:       strconv.Itoa(len(mail.RawMessage)),
+		CreatedAt:  mail.Received.UTC().Format(time.RFC3339),
+	}
+}
+
+//mail returns the mail of the id in the URL. Writes a 404 response and returns false if it doesn't exist
+func (h *Handler) mail(w http.ResponseWriter, r *http.Request) (int, instances.Mail, bool) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	h.lock.Lock()
+	key, exists := h.keys[id]
+	h.lock.Unlock()
+	if exists {
+		mail, err := h.mailStore.GetSingle(key)
+		if err == nil {
+			return id, mail, true
+		}
+	}
+	http.NotFound(w, r)
+	return 0, instances.Mail{}, false
+}
+
+func (h *Handler) list(w http.ResponseWriter, _ *http.Request) {
+	messages := make([]summary, 0)
+	for _, key := range h.mailStore.KeysByArrival() {
+		mail, err := h.mailStore.GetSingle(key)
+		if err != nil {
+			continue
+		}
+		messages = append(messages, newSummary(h.assign(key), mail))
+	}
+	apiutil.WriteJSON(w, http.StatusOK, messages)
+}
+
+//clear deletes all mails and tells WebSocket clients to clear their list
+func (h *Handler) clear(w http.ResponseWriter, _ *http.Request) {
+	for _, key := range h.mailStore.KeysByArrival() {
+		err := h.mailStore.Delete(key)
+		if err != nil && err != store.KeyNotExistsError {
+			logrus.WithError(err).WithField("key", key).Error("Unable to delete mail in MailCatcher handler")
+		}
+	}
+	h.broadcast(update{Type: "clear"})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) delete(w http.ResponseWriter, r *http.Request) {
+	_, mail, ok := h.mail(w, r)
+	if !ok {
+		return
+	}
+	err := h.mailStore.Delete(mail.Key)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//cid returns the content id of an attachment. Attachments without Content-ID are numbered by their position
+func cid(part instances.Part, index int) string {
+	if part.ContentID != "" {
+		return part.ContentID
+	}
+	return "part" + strconv.Itoa(index+1)
+}
+
+func (h *Handler) details(w http.ResponseWriter, r *http.Request) {
+	id, mail, ok := h.mail(w, r)
+	if !ok {
+		return
+	}
+	contentType, _, err := mime.ParseMediaType(mail.Header.Get("Content-Type"))
+	if err != nil {
+		contentType = "text/plain"
+	}
+	message := details{summary: newSummary(id, mail), Type: contentType, Formats: []string{"source"}, Attachments: []attachment{}}
+	if _, found := mail.FindPart("text/html"); found {
+		message.Formats = append(message.Formats, "html")
+	}
+	if _, found := mail.FindPart("text/plain"); found {
+		message.Formats = append(message.Formats, "plain")
+	}
+	//inline parts with a content id are listed as well, the html references them
+	for i, part := range mail.Parts() {
+		if !part.IsAttachment() && part.ContentID == "" {
+			continue
+		}
+		partCID := cid(part, i)
+		message.Attachments = append(message.Attachments, attachment{
+			CID:      partCID,
+			Type:     part.ContentType,
+			Filename: part.Filename,
+			Size:     len(part.Content),
+			Href:     fmt.Sprintf("/messages/%d/parts/%s", id, partCID),
+		})
+	}
+	apiutil.WriteJSON(w, http.StatusOK, message)
+}
+
+//part serves the first part with the content type. Content id references in html are rewritten to the part URLs
+func (h *Handler) part(contentType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, mail, ok := h.mail(w, r)
+		if !ok {
+			return
+		}
+		part, found := mail.FindPart(contentType)
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		content := part.Content
+		if contentType == "text/html" {
+			content = []byte(strings.ReplaceAll(string(content), "cid:", fmt.Sprintf("/messages/%d/parts/", id)))
+		}
+		if part.Charset != "" {
+			contentType += "; charset=" + part.Charset
+		}
+		w.Header().Set("Content-Type", contentType)
+		write(w, content)
+	}
+}
+
+//source serves the raw mail with the content type
+func (h *Handler) source(contentType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, mail, ok := h.mail(w, r)
+		if !ok {
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		if contentType == "message/rfc822" {
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%d.eml\"", id))
+		}
+		write(w, mail.RawMessage)
+	}
+}
+
+//attachment serves the part with the content id
+func (h *Handler) attachment(w http.ResponseWriter, r *http.Request) {
+	_, mail, ok := h.mail(w, r)
+	if !ok {
+		return
+	}
+	for i, part := range mail.Parts() {
+		if cid(part, i) != mux.Vars(r)["cid"] {
+			continue
+		}
+		w.Header().Set("Content-Type", part.ContentType)
+		if part.Filename != "" {
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", part.Filename))
+		}
+		write(w, part.Content)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+//broadcast sends the update to all WebSocket clients. Clients which don't keep up miss updates instead of blocking
+//the MailStore
+func (h *Handler) broadcast(u update) {
+	encoded, err := json.Marshal(u)
+	if err != nil {
+		logrus.WithError(err).Error("Unable to encode MailCatcher update")
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for subscriber := range h.subscribers {
+		select {
+		case subscriber <- encoded:
+		default:
+		}
+	}
+}
+
+//stream sends the updates to a WebSocket client until it disconnects or the server shuts down
+func (h *Handler) stream(ws *websocket.Conn) {
+	updates := make(chan []byte, updateBuffer)
+	h.lock.Lock()
+	h.subscribers[updates] = true
+	h.lock.Unlock()
+	defer func() {
+		h.lock.Lock()
+		delete(h.subscribers, updates)
+		h.lock.Unlock()
+		_ = ws.Close()
+	}()
+
+	closed := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(io.Discard, ws)
+		close(closed)
+	}()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ws.Request().Context().Done():
+			return
+		case encoded := <-updates:
+			err := websocket.Message.Send(ws, string(encoded))
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func write(w http.ResponseWriter, content []byte) {
+	_, err := w.Write(content)
+	if err != nil {
+		logrus.WithError(err).Error("Unable to write MailCatcher response")
+	}
+}
@@ -0,0 +1,180 @@
+package mailcatcher
+
+import (
+	"encoding/json"
+	"github.com/da-coda/mailpie/pkg/event"
+	"github.com/da-coda/mailpie/pkg/instances"
+	"github.com/da-coda/mailpie/pkg/store"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/net/websocket"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var plainMail = "From: Alex <alex@example.com>\r\nTo: bob@example.com\r\nSubject: =?utf-8?q?Hello_B=C3=B6b?=\r\n\r\nHello Bob!\r\n"
+
+var richMail = "From: cora@example.com\r\nTo: dan@example.com\r\nSubject: Report\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n" +
+	"--b\r\nContent-Type: multipart/alternative; boundary=a\r\n\r\n" +
+	"--a\r\nContent-Type: text/plain; charset=utf-8\r\n\r\nThe report\r\n" +
+	"--a\r\nContent-Type: text/html; charset=utf-8\r\n\r\n<img src=\"cid:logo@example.com\">\r\n" +
+	"--a--\r\n" +
+	"--b\r\nContent-Type: image/png\r\nContent-ID: <logo@example.com>\r\nContent-Disposition: inline; filename=logo.png\r\n\r\nPNG\r\n" +
+	"--b\r\nContent-Type: application/pdf; name=report.pdf\r\nContent-Transfer-Encoding: base64\r\n\r\nJVBERi0xLjQ=\r\n" +
+	"--b--\r\n"
+
+type HandlerTestSuite struct {
+	suite.Suite
+	mailStore *store.MailStore
+	handler   *Handler
+	server    *httptest.Server
+}
+
+func (suite *HandlerTestSuite) SetupTest() {
+	suite.mailStore = store.CreateMailStore(event.CreateOrGet())
+	plain, err := instances.ParseMail([]byte(plainMail))
+	suite.Require().Nil(err)
+	plain.EnvelopeFrom = "bounce@example.com"
+	plain.EnvelopeTo = []string{"bob@example.com"}
+	suite.Require().Nil(suite.mailStore.Add("plain", *plain))
+
+	router := mux.NewRouter()
+	suite.handler = NewHandler(suite.mailStore, event.CreateOrGet())
+	suite.handler.Register(router)
+	suite.server = httptest.NewServer(router)
+
+	rich, err := instances.ParseMail([]byte(richMail))
+	suite.Require().Nil(err)
+	suite.Require().Nil(suite.mailStore.Add("rich", *rich))
+}
+
+func (suite *HandlerTestSuite) TearDownTest() {
+	suite.server.Close()
+}
+
+func (suite *HandlerTestSuite) request(method string, path string) (int, http.Header, string) {
+	request, err := http.NewRequest(method, suite.server.URL+path, nil)
+	suite.Require().Nil(err)
+	resp, err := http.DefaultClient.Do(request)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	suite.Require().Nil(err)
+	return resp.StatusCode, resp.Header, string(body)
+}
+
+func (suite *HandlerTestSuite) TestMessages() {
+	status, _, body := suite.request(http.MethodGet, "/messages")
+	suite.Equal(http.StatusOK, status)
+	var list []summary
+	suite.Require().Nil(json.Unmarshal([]byte(body), &list))
+	suite.Require().Len(list, 2)
+	suite.Equal(1, list[0].ID, "Mails stored before the handler was created get ids too")
+	suite.Equal("<bounce@example.com>", list[0].Sender)
+	suite.Equal([]string{"<bob@example.com>"}, list[0].Recipients)
+	suite.Equal("Hello Böb", list[0].Subject)
+	suite.Equal(strconv.Itoa(len(plainMail)), list[0].Size)
+	suite.Equal(2, list[1].ID)
+	suite.Equal("<cora@example.com>", list[1].Sender, "Without envelope the From header is used")
+}
+
+func (suite *HandlerTestSuite) TestMessageJSON() {
+	status, _, body := suite.request(http.MethodGet, "/messages/2.json")
+	suite.Equal(http.StatusOK, status)
+	var message details
+	suite.Require().Nil(json.Unmarshal([]byte(body), &message))
+	suite.Equal("multipart/mixed", message.Type)
+	suite.Equal([]string{"source", "html", "plain"}, message.Formats)
+	suite.Equal([]attachment{
+		{CID: "logo@example.com", Type: "image/png", Filename: "logo.png", Size: 3, Href: "/messages/2/parts/logo@example.com"},
+		{CID: "part4", Type: "application/pdf", Filename: "report.pdf", Size: 8, Href: "/messages/2/parts/part4"},
+	}, message.Attachments)
+
+	status, _, _ = suite.request(http.MethodGet, "/messages/9.json")
+	suite.Equal(http.StatusNotFound, status)
+}
+
+func (suite *HandlerTestSuite) TestFormats() {
+	status, header, body := suite.request(http.MethodGet, "/messages/2.html")
+	suite.Equal(http.StatusOK, status)
+	suite.Equal("text/html; charset=utf-8", header.Get("Content-Type"))
+	suite.Equal("<img src=\"/messages/2/parts/logo@example.com\">", body, "Content ids point to the parts")
+
+	status, _, body = suite.request(http.MethodGet, "/messages/2.plain")
+	suite.Equal(http.StatusOK, status)
+	suite.Equal("The report", body)
+
+	status, _, _ = suite.request(http.MethodGet, "/messages/1.html")
+	suite.Equal(http.StatusNotFound, status, "Plain mails have no html")
+
+	status, header, body = suite.request(http.MethodGet, "/messages/1.source")
+	suite.Equal(http.StatusOK, status)
+	suite.Equal("text/plain", header.Get("Content-Type"))
+	suite.Equal(plainMail, body)
+
+	status, header, body = suite.request(http.MethodGet, "/messages/1.eml")
+	suite.Equal(http.StatusOK, status)
+	suite.Equal("message/rfc822", header.Get("Content-Type"))
+	suite.Equal(plainMail, body)
+}
+
+func (suite *HandlerTestSuite) TestParts() {
+	status, header, body := suite.request(http.MethodGet, "/messages/2/parts/part4")
+	suite.Equal(http.StatusOK, status)
+	suite.Equal("application/pdf", header.Get("Content-Type"))
+	suite.Equal("%PDF-1.4", body)
+
+	status, _, _ = suite.request(http.MethodGet, "/messages/2/parts/missing")
+	suite.Equal(http.StatusNotFound, status)
+}
+
+func (suite *HandlerTestSuite) TestDelete() {
+	status, _, _ := suite.request(http.MethodDelete, "/messages/1")
+	suite.Equal(http.StatusNoContent, status)
+	_, err := suite.mailStore.GetSingle("plain")
+	suite.Equal(store.KeyNotExistsError, err)
+	status, _, _ = suite.request(http.MethodGet, "/messages/1.json")
+	suite.Equal(http.StatusNotFound, status)
+
+	status, _, _ = suite.request(http.MethodDelete, "/messages")
+	suite.Equal(http.StatusNoContent, status)
+	suite.Empty(suite.mailStore.KeysByArrival())
+}
+
+func (suite *HandlerTestSuite) TestWebSocket() {
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(suite.server.URL, "http")+"/messages", "", suite.server.URL)
+	suite.Require().Nil(err)
+	defer ws.Close()
+
+	//the client is subscribed after the upgrade, wait for it before storing the next mail
+	suite.Eventually(func() bool {
+		suite.handler.lock.Lock()
+		defer suite.handler.lock.Unlock()
+		return len(suite.handler.subscribers) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	mail, err := instances.ParseMail([]byte(plainMail))
+	suite.Require().Nil(err)
+	suite.Require().Nil(suite.mailStore.Add("new", *mail))
+	suite.Require().Nil(suite.mailStore.Delete("plain"))
+
+	var received update
+	suite.Require().Nil(ws.SetReadDeadline(time.Now().Add(time.Second)))
+	suite.Require().Nil(websocket.JSON.Receive(ws, &received))
+	suite.Equal("add", received.Type)
+	suite.Require().NotNil(received.Message)
+	suite.Equal(3, received.Message.ID)
+
+	received = update{}
+	suite.Require().Nil(websocket.JSON.Receive(ws, &received))
+	suite.Equal(update{Type: "remove", ID: 1}, received)
+}
+
+func TestHandlerTestSuite(t *testing.T) {
+	suite.Run(t, new(HandlerTestSuite))
+}
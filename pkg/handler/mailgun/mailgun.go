@@ -0,0 +1,208 @@
+//Package mailgun emulates the sending endpoints of the Mailgun messages API. Mails are stored like mails received via
+//SMTP, with the tags and custom variables of the request attached as metadata
+package mailgun
+
+import (
+	"fmt"
+	"github.com/da-coda/mailpie/internal/apiutil"
+	"github.com/da-coda/mailpie/pkg/handler"
+	"github.com/da-coda/mailpie/pkg/instances"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"io"
+	"mime/multipart"
+	"net/http"
+	gomail "net/mail"
+	"strings"
+	"time"
+)
+
+//maxMemory is the part of a multipart form kept in memory, larger attachments are written to temporary files
+const maxMemory = 32 << 20
+
+//maxBatchRecipients is the number of recipients Mailgun allows for batch sending with recipient-variables
+const maxBatchRecipients = 1000
+
+type Handler struct {
+	smtpHandler *handler.SmtpHandler
+}
+
+func NewHandler(smtpHandler *handler.SmtpHandler) *Handler {
+	return &Handler{smtpHandler: smtpHandler}
+}
+
+//Register adds the Mailgun routes to the router
+func (h *Handler) Register(router *mux.Router) {
+	router.HandleFunc("/v3/{domain}/messages", h.authenticated(h.messages)).Methods("POST")
+	router.HandleFunc("/v3/{domain}/messages.mime", h.authenticated(h.mime)).Methods("POST")
+}
+
+//authenticated requires basic auth with the user api like Mailgun. Any API key is accepted
+func (h *Handler) authenticated(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, _, ok := r.BasicAuth()
+		if !ok || user != "api" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = io.WriteString(w, "Forbidden")
+			return
+		}
+		next(w, r)
+	}
+}
+
+//parseForm parses multipart and url encoded forms, Mailgun accepts both as long as no files are sent
+func parseForm(r *http.Request) error {
+	err := r.ParseMultipartForm(maxMemory)
+	if err == http.ErrNotMultipart {
+		return r.ParseForm()
+	}
+	return err
+}
+
+//messages handles POST /v3/{domain}/messages, which builds the mail from its fields. With recipient-variables every
+//recipient of to gets an individual mail
+func (h *Handler) messages(w http.ResponseWriter, r *http.Request) {
+	if err := parseForm(r); err != nil {
+		writeMessage(w, http.StatusBadRequest, "Invalid form data")
+		return
+	}
+	request, problem := parseRequest(r)
+	if problem != "" {
+		writeMessage(w, http.StatusBadRequest, problem)
+		return
+	}
+
+	id := newMessageID(mux.Vars(r)["domain"])
+	recipients := [][]*gomail.Address{request.to}
+	if request.recipientVariables != nil {
+		recipients = nil
+		for _, recipient := range request.to {
+			recipients = append(recipients, []*gomail.Address{recipient})
+		}
+	}
+	for i, to := range recipients {
+		messageID := id
+		if len(recipients) > 1 {
+			messageID = fmt.Sprintf("%d.%s", i, id)
+		}
+		mail, err := request.build(to, messageID)
+		if err == nil {
+			err = h.smtpHandler.StoreEnvelope(mail)
+		}
+		if err != nil {
+			logrus.WithError(err).Error("Unable to store mail in Mailgun handler")
+			writeMessage(w, http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+	}
+	writeQueued(w, id)
+}
+
+//mime handles POST /v3/{domain}/messages.mime, which stores the uploaded MIME message as is for the recipients in to
+func (h *Handler) mime(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(maxMemory); err != nil {
+		writeMessage(w, http.StatusBadRequest, "Invalid form data")
+		return
+	}
+	to, problem := parseAddresses(r.MultipartForm.Value["to"], "to")
+	if problem == "" && len(to) == 0 {
+		problem = "to parameter is missing"
+	}
+	if problem != "" {
+		writeMessage(w, http.StatusBadRequest, problem)
+		return
+	}
+	files := r.MultipartForm.File["message"]
+	if len(files) == 0 {
+		writeMessage(w, http.StatusBadRequest, "message parameter is missing")
+		return
+	}
+	data, err := readFile(files[0])
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, "message parameter is missing")
+		return
+	}
+	mail, err := instances.ParseMail(data)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, "message is not a valid MIME message")
+		return
+	}
+	metadata := parseMetadata(r.MultipartForm.Value, nil)
+	err = h.smtpHandler.StoreWithMetadata(mail.Sender(), emails(to), data, metadata)
+	if err != nil {
+		logrus.WithError(err).Error("Unable to store mail in Mailgun handler")
+		writeMessage(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	id := mail.Header.Get("Message-Id")
+	if id == "" {
+		id = newMessageID(mux.Vars(r)["domain"])
+	}
+	writeQueued(w, strings.Trim(id, "<>"))
+}
+
+//parseAddresses parses all values of a field, every value can hold a comma separated list of addresses
+func parseAddresses(values []string, field string) ([]*gomail.Address, string) {
+	var addresses []*gomail.Address
+	for _, value := range values {
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		parsed, err := gomail.ParseAddressList(value)
+		if err != nil {
+			return nil, fmt.Sprintf("%s parameter is not a valid address. please check documentation", field)
+		}
+		addresses = append(addresses, parsed...)
+	}
+	return addresses, ""
+}
+
+func emails(addresses []*gomail.Address) []string {
+	var emails []string
+	for _, address := range addresses {
+		emails = append(emails, address.Address)
+	}
+	return emails
+}
+
+//parseMetadata reads the tags from o:tag and the custom variables from the v: fields. The substitute function, if set,
+//replaces the recipient variables in the values of custom variables
+func parseMetadata(form map[string][]string, substitute func(string) string) instances.Metadata {
+	metadata := instances.Metadata{Provider: "mailgun", Tags: form["o:tag"], Variables: make(map[string]string)}
+	for name, values := range form {
+		if !strings.HasPrefix(name, "v:") || len(values) == 0 {
+			continue
+		}
+		value := values[0]
+		if substitute != nil {
+			value = substitute(value)
+		}
+		metadata.Variables[strings.TrimPrefix(name, "v:")] = value
+	}
+	if len(metadata.Variables) == 0 {
+		metadata.Variables = nil
+	}
+	return metadata
+}
+
+func readFile(header *multipart.FileHeader) ([]byte, error) {
+	file, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+//newMessageID returns an id in the format of Mailgun, which is also used as Message-ID of the mail
+func newMessageID(domain string) string {
+	return fmt.Sprintf("%s.%s@%s", time.Now().UTC().Format("20060102150405"), apiutil.NewHexToken(8), domain)
+}
+
+func writeQueued(w http.ResponseWriter, id string) {
+	apiutil.WriteJSON(w, http.StatusOK, map[string]string{"id": "<" + id + ">", "message": "Queued. Thank you."})
+}
+
+func writeMessage(w http.ResponseWriter, status int, message string) {
+	apiutil.WriteJSON(w, status, map[string]string{"message": message})
+}
@@ -0,0 +1,208 @@
+package mailgun
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/da-coda/mailpie/pkg/event"
+	"github.com/da-coda/mailpie/pkg/handler"
+	"github.com/da-coda/mailpie/pkg/instances"
+	"github.com/da-coda/mailpie/pkg/store"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/suite"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+type HandlerTestSuite struct {
+	suite.Suite
+	mailStore *store.MailStore
+	server    *httptest.Server
+}
+
+func (suite *HandlerTestSuite) SetupTest() {
+	suite.mailStore = store.CreateMailStore(event.CreateOrGet())
+	smtpHandler := handler.CreateSmtpHandler(suite.mailStore)
+	router := mux.NewRouter()
+	NewHandler(&smtpHandler).Register(router)
+	suite.server = httptest.NewServer(router)
+}
+
+func (suite *HandlerTestSuite) TearDownTest() {
+	suite.server.Close()
+}
+
+//file is an upload of a multipart form
+type file struct {
+	field       string
+	name        string
+	contentType string
+	content     string
+}
+
+//post sends the fields and files as multipart form and returns the status and the decoded response
+func (suite *HandlerTestSuite) post(path string, fields [][2]string, files ...file) (int, map[string]string) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for _, field := range fields {
+		suite.Require().Nil(writer.WriteField(field[0], field[1]))
+	}
+	for _, f := range files {
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", `form-data; name="`+f.field+`"; filename="`+f.name+`"`)
+		header.Set("Content-Type", f.contentType)
+		part, err := writer.CreatePart(header)
+		suite.Require().Nil(err)
+		_, err = part.Write([]byte(f.content))
+		suite.Require().Nil(err)
+	}
+	suite.Require().Nil(writer.Close())
+	return suite.do(path, writer.FormDataContentType(), &body)
+}
+
+func (suite *HandlerTestSuite) do(path string, contentType string, body *bytes.Buffer) (int, map[string]string) {
+	request, err := http.NewRequest(http.MethodPost, suite.server.URL+path, body)
+	suite.Require().Nil(err)
+	request.Header.Set("Content-Type", contentType)
+	request.SetBasicAuth("api", "key-test")
+	resp, err := http.DefaultClient.Do(request)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+	var response map[string]string
+	_ = json.NewDecoder(resp.Body).Decode(&response)
+	return resp.StatusCode, response
+}
+
+func (suite *HandlerTestSuite) mails() []instances.Mail {
+	var mails []instances.Mail
+	for _, key := range suite.mailStore.KeysByArrival() {
+		mail, err := suite.mailStore.GetSingle(key)
+		suite.Require().Nil(err)
+		mails = append(mails, mail)
+	}
+	return mails
+}
+
+func (suite *HandlerTestSuite) TestMessages() {
+	status, response := suite.post("/v3/mg.example.com/messages", [][2]string{
+		{"from", "Alex <alex@example.com>"},
+		{"to", "Bob <bob@example.com>, cora@example.com"},
+		{"bcc", "dan@example.com"},
+		{"subject", "Invoice"},
+		{"text", "Your invoice"},
+		{"html", "<p>Your invoice</p><img src=\"cid:logo.png\">"},
+		{"o:tag", "billing"},
+		{"o:tag", "monthly"},
+		{"v:customer-id", "42"},
+		{"h:X-Priority", "1"},
+	}, file{"attachment", "invoice.pdf", "application/pdf", "%PDF-1.4"}, file{"inline", "logo.png", "image/png", "PNG"})
+	suite.Equal(http.StatusOK, status)
+	suite.Equal("Queued. Thank you.", response["message"])
+	suite.True(strings.HasSuffix(response["id"], "@mg.example.com>"))
+
+	mails := suite.mails()
+	suite.Require().Len(mails, 1)
+	mail := mails[0]
+	suite.Equal("alex@example.com", mail.EnvelopeFrom)
+	suite.Equal([]string{"bob@example.com", "cora@example.com", "dan@example.com"}, mail.EnvelopeTo)
+	suite.Equal(`"Bob" <bob@example.com>, cora@example.com`, mail.Header.Get("To"))
+	suite.Empty(mail.Header.Get("Bcc"))
+	suite.Equal(response["id"], mail.Header.Get("Message-Id"))
+	suite.Equal("1", mail.Header.Get("X-Priority"))
+	suite.Equal("billing, monthly", mail.Header.Get("X-Mailgun-Tag"))
+	suite.JSONEq(`{"customer-id": "42"}`, mail.Header.Get("X-Mailgun-Variables"))
+	suite.Equal(instances.Metadata{Provider: "mailgun", Tags: []string{"billing", "monthly"}, Variables: map[string]string{"customer-id": "42"}}, mail.Metadata)
+
+	parts := mail.Parts()
+	suite.Require().Len(parts, 4)
+	suite.Equal("Your invoice", string(parts[0].Content))
+	suite.Equal("text/html", parts[1].ContentType)
+	suite.Equal("logo.png", parts[2].ContentID)
+	suite.Equal("image/png", parts[2].ContentType)
+	suite.Equal("invoice.pdf", parts[3].Filename)
+	suite.True(parts[3].IsAttachment())
+	suite.Equal("%PDF-1.4", string(parts[3].Content))
+}
+
+func (suite *HandlerTestSuite) TestMessages_BatchSending() {
+	status, _ := suite.post("/v3/mg.example.com/messages", [][2]string{
+		{"from", "alex@example.com"},
+		{"to", "bob@example.com"},
+		{"to", "cora@example.com"},
+		{"subject", "Hello %recipient.first%"},
+		{"text", "Your id is %recipient.id%%recipient.missing%"},
+		{"v:user-id", "%recipient.id%"},
+		{"recipient-variables", `{"bob@example.com": {"first": "Bob", "id": 1}, "cora@example.com": {"first": "Cora", "id": 2}}`},
+	})
+	suite.Equal(http.StatusOK, status)
+
+	mails := suite.mails()
+	suite.Require().Len(mails, 2, "Every recipient gets an own mail")
+	for i, expected := range []struct{ to, subject, text, id string }{
+		{"bob@example.com", "Hello Bob", "Your id is 1", "1"},
+		{"cora@example.com", "Hello Cora", "Your id is 2", "2"},
+	} {
+		suite.Equal([]string{expected.to}, mails[i].EnvelopeTo)
+		suite.Equal(expected.to, mails[i].Header.Get("To"))
+		suite.Equal(expected.subject, mails[i].Header.Get("Subject"))
+		suite.Equal(expected.text, string(mails[i].Parts()[0].Content))
+		suite.Equal(map[string]string{"user-id": expected.id}, mails[i].Metadata.Variables)
+	}
+}
+
+func (suite *HandlerTestSuite) TestMessages_URLEncoded() {
+	form := url.Values{"from": {"alex@example.com"}, "to": {"bob@example.com"}, "subject": {"Hi"}, "text": {"Hi Bob"}}
+	status, _ := suite.do("/v3/mg.example.com/messages", "application/x-www-form-urlencoded", bytes.NewBufferString(form.Encode()))
+	suite.Equal(http.StatusOK, status)
+	suite.Len(suite.mails(), 1)
+}
+
+func (suite *HandlerTestSuite) TestMessages_Invalid() {
+	for _, test := range []struct {
+		fields  [][2]string
+		message string
+	}{
+		{[][2]string{{"to", "bob@example.com"}, {"text", "Hi"}}, "from parameter is missing"},
+		{[][2]string{{"from", "alex@example.com"}, {"text", "Hi"}}, "to parameter is missing"},
+		{[][2]string{{"from", "alex@example.com"}, {"to", "not an address"}, {"text", "Hi"}}, "to parameter is not a valid address. please check documentation"},
+		{[][2]string{{"from", "alex@example.com"}, {"to", "bob@example.com"}}, "Need at least one of 'text' or 'html' parameters specified"},
+		{[][2]string{{"from", "alex@example.com"}, {"to", "bob@example.com"}, {"text", "Hi"}, {"recipient-variables", "{"}}, "recipient-variables parameter is not a valid JSON"},
+	} {
+		status, response := suite.post("/v3/mg.example.com/messages", test.fields)
+		suite.Equal(http.StatusBadRequest, status)
+		suite.Equal(test.message, response["message"])
+	}
+	suite.Empty(suite.mails())
+
+	resp, err := http.Post(suite.server.URL+"/v3/mg.example.com/messages", "application/x-www-form-urlencoded", nil)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+	suite.Equal(http.StatusUnauthorized, resp.StatusCode)
+}
+
+func (suite *HandlerTestSuite) TestMIME() {
+	raw := "Message-ID: <raw@example.com>\r\nFrom: Alex <alex@example.com>\r\nTo: bob@example.com\r\nSubject: Raw\r\n\r\nRaw body\r\n"
+	status, response := suite.post("/v3/mg.example.com/messages.mime", [][2]string{{"to", "bob@example.com"}, {"o:tag", "raw"}},
+		file{"message", "message.mime", "message/rfc822", raw})
+	suite.Equal(http.StatusOK, status)
+	suite.Equal("<raw@example.com>", response["id"])
+
+	mails := suite.mails()
+	suite.Require().Len(mails, 1)
+	suite.Equal(raw, string(mails[0].RawMessage), "The message is stored as is")
+	suite.Equal("alex@example.com", mails[0].EnvelopeFrom)
+	suite.Equal([]string{"bob@example.com"}, mails[0].EnvelopeTo)
+	suite.Equal([]string{"raw"}, mails[0].Metadata.Tags)
+
+	status, response = suite.post("/v3/mg.example.com/messages.mime", [][2]string{{"to", "bob@example.com"}})
+	suite.Equal(http.StatusBadRequest, status)
+	suite.Equal("message parameter is missing", response["message"])
+}
+
+func TestHandlerTestSuite(t *testing.T) {
+	suite.Run(t, new(HandlerTestSuite))
+}
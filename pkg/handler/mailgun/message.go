@@ -0,0 +1,203 @@
+package mailgun
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/da-coda/mailpie/pkg/handler"
+	"github.com/pkg/errors"
+	"gopkg.in/mail.v2"
+	"io"
+	"mime/multipart"
+	"net/http"
+	gomail "net/mail"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//recipientVariable matches the placeholders which are replaced by the recipient variables in batch sending
+var recipientVariable = regexp.MustCompile(`%recipient\.([^%\s]+)%`)
+
+//request is a validated request to /v3/{domain}/messages
+type request struct {
+	form        map[string][]string
+	from        *gomail.Address
+	to          []*gomail.Address
+	cc          []*gomail.Address
+	bcc         []*gomail.Address
+	attachments []*multipart.FileHeader
+	inline      []*multipart.FileHeader
+	//recipientVariables holds the variables of every recipient by address. If set, every recipient of to gets an
+	//individual mail
+	recipientVariables map[string]map[string]interface{}
+}
+
+//parseRequest validates the form like Mailgun and returns the message Mailgun responds with if it is invalid
+func parseRequest(r *http.Request) (*request, string) {
+	req := &request{form: r.Form}
+	if r.MultipartForm != nil {
+		req.attachments = r.MultipartForm.File["attachment"]
+		req.inline = r.MultipartForm.File["inline"]
+	}
+	if r.Form.Get("from") == "" {
+		return nil, "from parameter is missing"
+	}
+	from, err := gomail.ParseAddress(r.Form.Get("from"))
+	if err != nil {
+		return nil, "from parameter is not a valid address. please check documentation"
+	}
+	req.from = from
+	var problem string
+	for _, field := range []struct {
+		name      string
+		addresses *[]*gomail.Address
+	}{{"to", &req.to}, {"cc", &req.cc}, {"bcc", &req.bcc}} {
+		*field.addresses, problem = parseAddresses(r.Form[field.name], field.name)
+		if problem != "" {
+			return nil, problem
+		}
+	}
+	if len(req.to) == 0 {
+		return nil, "to parameter is missing"
+	}
+	if r.Form.Get("text") == "" && r.Form.Get("html") == "" {
+		return nil, "Need at least one of 'text' or 'html' parameters specified"
+	}
+	if variables := r.Form.Get("recipient-variables"); variables != "" {
+		err = json.Unmarshal([]byte(variables), &req.recipientVariables)
+		if err != nil {
+			return nil, "recipient-variables parameter is not a valid JSON"
+		}
+		if len(req.to) > maxBatchRecipients {
+			return nil, fmt.Sprintf("Too many recipients, batch sending is limited to %d recipients", maxBatchRecipients)
+		}
+	}
+	return req, ""
+}
+
+//substitution returns the function replacing the recipient variables of the recipient. Without recipient-variables
+//nothing is replaced
+func (req *request) substitution(to []*gomail.Address) func(string) string {
+	if req.recipientVariables == nil || len(to) != 1 {
+		return func(text string) string { return text }
+	}
+	variables := req.recipientVariables[to[0].Address]
+	return func(text string) string {
+		return recipientVariable.ReplaceAllStringFunc(text, func(placeholder string) string {
+			name := recipientVariable.FindStringSubmatch(placeholder)[1]
+			switch value := variables[name].(type) {
+			case nil:
+				return ""
+			case string:
+				return value
+			case float64:
+				return strconv.FormatFloat(value, 'f', -1, 64)
+			default:
+				encoded, _ := json.Marshal(value)
+				return string(encoded)
+			}
+		})
+	}
+}
+
+//build creates the mail for the recipients in to. Tags and custom variables are added as X-Mailgun-Tag and
+//X-Mailgun-Variables headers like Mailgun does, in addition to the metadata
+func (req *request) build(to []*gomail.Address, messageID string) (handler.Envelope, error) {
+	substitute := req.substitution(to)
+	metadata := parseMetadata(req.form, substitute)
+
+	m := mail.NewMessage()
+	m.SetAddressHeader("From", req.from.Address, req.from.Name)
+	m.SetHeader("To", formatAddresses(m, to)...)
+	if len(req.cc) > 0 {
+		m.SetHeader("Cc", formatAddresses(m, req.cc)...)
+	}
+	m.SetHeader("Subject", substitute(first(req.form["subject"])))
+	m.SetHeader("Message-ID", "<"+messageID+">")
+	names := make([]string, 0, len(req.form))
+	for name := range req.form {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if strings.HasPrefix(name, "h:") {
+			m.SetHeader(strings.TrimPrefix(name, "h:"), req.form[name]...)
+		}
+	}
+	if len(metadata.Tags) > 0 {
+		m.SetHeader("X-Mailgun-Tag", metadata.Tags...)
+	}
+	if len(metadata.Variables) > 0 {
+		encoded, err := json.Marshal(metadata.Variables)
+		if err != nil {
+			return handler.Envelope{}, errors.Wrap(err, "unable to encode X-Mailgun-Variables header")
+		}
+		m.SetHeader("X-Mailgun-Variables", string(encoded))
+	}
+
+	//the AMP part has to be between the text and the html part
+	hasBody := false
+	for _, part := range []struct{ field, contentType string }{{"text", "text/plain"}, {"amp-html", "text/x-amp-html"}, {"html", "text/html"}} {
+		value := first(req.form[part.field])
+		if value == "" {
+			continue
+		}
+		if hasBody {
+			m.AddAlternative(part.contentType, substitute(value))
+		} else {
+			m.SetBody(part.contentType, substitute(value))
+			hasBody = true
+		}
+	}
+	for _, file := range req.inline {
+		m.Embed(file.Filename, fileSettings(file)...)
+	}
+	for _, file := range req.attachments {
+		m.Attach(file.Filename, fileSettings(file)...)
+	}
+
+	var buffer bytes.Buffer
+	_, err := m.WriteTo(&buffer)
+	if err != nil {
+		return handler.Envelope{}, errors.Wrap(err, "unable to write mail")
+	}
+	recipients := emails(to)
+	recipients = append(recipients, emails(req.cc)...)
+	recipients = append(recipients, emails(req.bcc)...)
+	return handler.Envelope{From: req.from.Address, To: recipients, Data: buffer.Bytes(), Metadata: metadata}, nil
+}
+
+//first returns the first value of a form field or an empty string
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func formatAddresses(m *mail.Message, addresses []*gomail.Address) []string {
+	formatted := make([]string, len(addresses))
+	for i, address := range addresses {
+		formatted[i] = m.FormatAddress(address.Address, address.Name)
+	}
+	return formatted
+}
+
+//fileSettings copies the uploaded file into the mail, keeping the content type given by the client
+func fileSettings(file *multipart.FileHeader) []mail.FileSetting {
+	settings := []mail.FileSetting{mail.SetCopyFunc(func(w io.Writer) error {
+		content, err := file.Open()
+		if err != nil {
+			return err
+		}
+		defer content.Close()
+		_, err = io.Copy(w, content)
+		return err
+	})}
+	if contentType := file.Header.Get("Content-Type"); contentType != "" && contentType != "application/octet-stream" {
+		settings = append(settings, mail.SetHeader(map[string][]string{"Content-Type": {fmt.Sprintf("%s; name=%q", contentType, file.Filename)}}))
+	}
+	return settings
+}
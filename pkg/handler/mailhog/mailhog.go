@@ -0,0 +1,352 @@
+package mailhog
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/da-coda/mailpie/internal/apiutil"
+	"github.com/da-coda/mailpie/pkg/instances"
+	"github.com/da-coda/mailpie/pkg/store"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//defaultLimit is the page size of the v2 API if the client doesn't ask for one, the same as in Mailhog
+const defaultLimit = 50
+
+//Handler serves the v1 and v2 message API of Mailhog, so that tests written against Mailhog run against Mailpie
+type Handler struct {
+	mailStore *store.MailStore
+}
+
+//path is an SMTP path the way Mailhog splits addresses
+type path struct {
+	Relays  []string `json:"Relays"`
+	Mailbox string   `json:"Mailbox"`
+	Domain  string   `json:"Domain"`
+	Params  string   `json:"Params"`
+}
+
+//content is a message or a MIME part with its headers and the undecoded body
+type content struct {
+	Headers map[string][]string `json:"Headers"`
+	Body    string              `json:"Body"`
+	Size    int                 `json:"Size"`
+	MIME    *mimeBody           `json:"MIME"`
+}
+
+type mimeBody struct {
+	Parts []*content `json:"Parts"`
+}
+
+//raw is the message as received via SMTP
+type raw struct {
+	From string   `json:"From"`
+	To   []string `json:"To"`
+	Data string   `json:"Data"`
+	Helo string   `json:"Helo"`
+}
+
+type message struct {
+	ID      string    `json:"ID"`
+	From    *path     `json:"From"`
+	To      []*path   `json:"To"`
+	Content *content  `json:"Content"`
+	Created time.Time `json:"Created"`
+	MIME    *mimeBody `json:"MIME"`
+	Raw     *raw      `json:"Raw"`
+}
+
+//messages is the response of the v2 API
+type messages struct {
+	Total int        `json:"total"`
+	Count int        `json:"count"`
+	Start int        `json:"start"`
+	Items []*message `json:"items"`
+}
+
+func NewHandler(mailStore *store.MailStore) *Handler {
+	return &Handler{mailStore: mailStore}
+}
+
+//Register adds the Mailhog routes to the router
+func (h *Handler) Register(router *mux.Router) {
+	router.HandleFunc("/api/v1/messages", h.listV1).Methods("GET")
+	router.HandleFunc("/api/v1/messages", h.deleteAll).Methods("DELETE")
+	router.HandleFunc("/api/v1/messages/{id}", h.get).Methods("GET")
+	router.HandleFunc("/api/v1/messages/{id}", h.deleteOne).Methods("DELETE")
+	router.HandleFunc("/api/v1/messages/{id}/download", h.download).Methods("GET")
+	router.HandleFunc("/api/v1/messages/{id}/mime/part/{part}/download", h.downloadPart).Methods("GET")
+	router.HandleFunc("/api/v2/messages", h.listV2).Methods("GET")
+	router.HandleFunc("/api/v2/search", h.search).Methods("GET")
+}
+
+//messageID turns the store key into an id which can be used in URLs
+func messageID(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+func messageKey(id string) (string, bool) {
+	key, err := base64.RawURLEncoding.DecodeString(id)
+	return string(key), err == nil
+}
+
+//parsePath splits an address into mailbox and domain
+func parsePath(address string) *path {
+	address = strings.Trim(strings.TrimSpace(address), "<>")
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return &path{Mailbox: address}
+	}
+	return &path{Mailbox: address[:at], Domain: address[at+1:]}
+}
+
+//parseContent splits a message or part into headers and body and parses multipart bodies into their parts. Header
+//names keep their case, like in Mailhog
+func parseContent(data string) *content {
+	c := &content{Headers: make(map[string][]string), Size: len(data)}
+	head, body := data, ""
+	for _, separator := range []string{"\r\n\r\n", "\n\n"} {
+		if end := strings.Index(data, separator); end >= 0 {
+			head, body = data[:end], data[end+len(separator):]
+			break
+		}
+	}
+	c.Body = body
+	var name string
+	for _, line := range strings.Split(strings.ReplaceAll(head, "\r\n", "\n"), "\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && name != "" {
+			values := c.Headers[name]
+			values[len(values)-1] += " " + strings.TrimSpace(line)
+			continue
+		}
+		colon := strings.Index(line, ":")
+		if colon <= 0 {
+			continue
+		}
+		name = strings.TrimSpace(line[:colon])
+		c.Headers[name] = append(c.Headers[name], strings.TrimSpace(line[colon+1:]))
+	}
+
+	mediaType, params, err := mime.ParseMediaType(c.header("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return c
+	}
+	c.MIME = &mimeBody{Parts: []*content{}}
+	segments := strings.Split(body, "--"+params["boundary"])
+	for _, segment := range segments[1:] {
+		if strings.HasPrefix(segment, "--") {
+			break
+		}
+		segment = strings.TrimPrefix(strings.TrimPrefix(segment, "\r\n"), "\n")
+		segment = strings.TrimSuffix(strings.TrimSuffix(segment, "\n"), "\r")
+		c.MIME.Parts = append(c.MIME.Parts, parseContent(segment))
+	}
+	return c
+}
+
+//header returns the first value of the header, ignoring the case of the name
+func (c *content) header(name string) string {
+	for key, values := range c.Headers {
+		if strings.EqualFold(key, name) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+//newMessage converts a stored mail into the JSON shape of Mailhog
+func newMessage(mail instances.Mail) *message {
+	recipients := mail.Recipients()
+	msg := &message{
+		ID:      messageID(mail.Key),
+		From:    parsePath(mail.Sender()),
+		To:      make([]*path, 0, len(recipients)),
+		Content: parseContent(string(mail.RawMessage)),
+		Created: mail.Received,
+		Raw:     &raw{From: mail.Sender(), To: append([]string{}, recipients...), Data: string(mail.RawMessage)},
+	}
+	for _, recipient := range recipients {
+		msg.To = append(msg.To, parsePath(recipient))
+	}
+	//Mailhog keeps the parts at the message and only the headers and the raw body in the content
+	msg.MIME, msg.Content.MIME = msg.Content.MIME, nil
+	return msg
+}
+
+//all returns all mails converted to messages, newest first like Mailhog
+func (h *Handler) all() []*message {
+	keys := h.mailStore.KeysByArrival()
+	result := make([]*message, 0, len(keys))
+	for i := len(keys) - 1; i >= 0; i-- {
+		mail, err := h.mailStore.GetSingle(keys[i])
+		if err != nil {
+			continue
+		}
+		result = append(result, newMessage(mail))
+	}
+	return result
+}
+
+func (h *Handler) listV1(w http.ResponseWriter, _ *http.Request) {
+	apiutil.WriteJSON(w, http.StatusOK, h.all())
+}
+
+//page returns the messages between start and start + limit given as query parameters
+func page(r *http.Request, all []*message) messages {
+	start, err := strconv.Atoi(r.URL.Query().Get("start"))
+	if err != nil || start < 0 {
+		start = 0
+	}
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultLimit
+	}
+	if start > len(all) {
+		start = len(all)
+	}
+	end := start + limit
+	if end > len(all) {
+		end = len(all)
+	}
+	return messages{Total: len(all), Count: end - start, Start: start, Items: all[start:end]}
+}
+
+func (h *Handler) listV2(w http.ResponseWriter, r *http.Request) {
+	apiutil.WriteJSON(w, http.StatusOK, page(r, h.all()))
+}
+
+//search filters by kind from, to or containing with a case insensitive match of the query, like Mailhog does
+func (h *Handler) search(w http.ResponseWriter, r *http.Request) {
+	kind := r.URL.Query().Get("kind")
+	query := strings.ToLower(r.URL.Query().Get("query"))
+	if kind != "from" && kind != "to" && kind != "containing" {
+		http.Error(w, "kind must be from, to or containing", http.StatusBadRequest)
+		return
+	}
+	matches := func(values ...string) bool {
+		for _, value := range values {
+			if strings.Contains(strings.ToLower(value), query) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var found []*message
+	for _, msg := range h.all() {
+		var matched bool
+		switch kind {
+		case "from":
+			matched = matches(msg.Raw.From, msg.Content.header("From"))
+		case "to":
+			matched = matches(append([]string{msg.Content.header("To")}, msg.Raw.To...)...)
+		case "containing":
+			values := []string{msg.Content.Body}
+			for _, header := range msg.Content.Headers {
+				values = append(values, header...)
+			}
+			matched = matches(values...)
+		}
+		if matched {
+			found = append(found, msg)
+		}
+	}
+	if found == nil {
+		found = []*message{}
+	}
+	apiutil.WriteJSON(w, http.StatusOK, page(r, found))
+}
+
+//mail returns the mail of the id in the URL. Writes a 404 response and returns false if it doesn't exist
+func (h *Handler) mail(w http.ResponseWriter, r *http.Request) (instances.Mail, bool) {
+	key, ok := messageKey(mux.Vars(r)["id"])
+	if ok {
+		mail, err := h.mailStore.GetSingle(key)
+		if err == nil {
+			return mail, true
+		}
+	}
+	http.Error(w, "message not found", http.StatusNotFound)
+	return instances.Mail{}, false
+}
+
+func (h *Handler) get(w http.ResponseWriter, r *http.Request) {
+	mail, ok := h.mail(w, r)
+	if !ok {
+		return
+	}
+	apiutil.WriteJSON(w, http.StatusOK, newMessage(mail))
+}
+
+func (h *Handler) deleteAll(w http.ResponseWriter, _ *http.Request) {
+	for _, key := range h.mailStore.KeysByArrival() {
+		err := h.mailStore.Delete(key)
+		if err != nil && err != store.KeyNotExistsError {
+			logrus.WithError(err).WithField("key", key).Error("Unable to delete mail in Mailhog handler")
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handler) deleteOne(w http.ResponseWriter, r *http.Request) {
+	mail, ok := h.mail(w, r)
+	if !ok {
+		return
+	}
+	err := h.mailStore.Delete(mail.Key)
+	if err != nil {
+		http.Error(w, "message not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+//download serves the raw message
+func (h *Handler) download(w http.ResponseWriter, r *http.Request) {
+	mail, ok := h.mail(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "message/rfc822")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.eml\"", mux.Vars(r)["id"]))
+	_, err := w.Write(mail.RawMessage)
+	if err != nil {
+		logrus.WithError(err).Error("Unable to write message in Mailhog handler")
+	}
+}
+
+//downloadPart serves the body of a top level MIME part by index. Base64 encoded parts are decoded
+func (h *Handler) downloadPart(w http.ResponseWriter, r *http.Request) {
+	mail, ok := h.mail(w, r)
+	if !ok {
+		return
+	}
+	msg := newMessage(mail)
+	index, err := strconv.Atoi(mux.Vars(r)["part"])
+	if msg.MIME == nil || err != nil || index < 0 || index >= len(msg.MIME.Parts) {
+		http.Error(w, "part not found", http.StatusNotFound)
+		return
+	}
+	part := msg.MIME.Parts[index]
+	body := []byte(part.Body)
+	if strings.EqualFold(part.header("Content-Transfer-Encoding"), "base64") {
+		decoded, err := base64.StdEncoding.DecodeString(strings.NewReplacer("\r", "", "\n", "", " ", "").Replace(part.Body))
+		if err == nil {
+			body = decoded
+		}
+	}
+	for _, name := range []string{"Content-Type", "Content-Disposition"} {
+		if value := part.header(name); value != "" {
+			w.Header().Set(name, value)
+		}
+	}
+	_, err = w.Write(body)
+	if err != nil {
+		logrus.WithError(err).Error("Unable to write part in Mailhog handler")
+	}
+}
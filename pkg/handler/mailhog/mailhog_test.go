@@ -0,0 +1,135 @@
+package mailhog
+
+import (
+	"encoding/json"
+	"github.com/da-coda/mailpie/pkg/event"
+	"github.com/da-coda/mailpie/pkg/instances"
+	"github.com/da-coda/mailpie/pkg/store"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/suite"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var plainMail = "Message-ID: <plain@example.com>\r\nFrom: Alex <alex@example.com>\r\nTo: bob@example.com\r\nSubject: Hello Bob\r\n\r\nHello Bob!\r\n"
+
+var multipartMail = "From: cora@example.com\r\nTo: dan@example.com\r\nSubject: Report\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n" +
+	"--b\r\nContent-Type: text/plain\r\n\r\nThe report\r\n" +
+	"--b\r\nContent-Type: application/pdf\r\nContent-Transfer-Encoding: base64\r\n\r\nJVBERi0xLjQ=\r\n" +
+	"--b--\r\n"
+
+type HandlerTestSuite struct {
+	suite.Suite
+	mailStore *store.MailStore
+	server    *httptest.Server
+}
+
+func (suite *HandlerTestSuite) SetupTest() {
+	suite.mailStore = store.CreateMailStore(event.CreateOrGet())
+	router := mux.NewRouter()
+	NewHandler(suite.mailStore).Register(router)
+	suite.server = httptest.NewServer(router)
+
+	plain, err := instances.ParseMail([]byte(plainMail))
+	suite.Require().Nil(err)
+	plain.EnvelopeFrom = "bounce@example.com"
+	plain.EnvelopeTo = []string{"bob@example.com"}
+	suite.Require().Nil(suite.mailStore.Add("plain", *plain))
+	report, err := instances.ParseMail([]byte(multipartMail))
+	suite.Require().Nil(err)
+	suite.Require().Nil(suite.mailStore.Add("report", *report))
+}
+
+func (suite *HandlerTestSuite) TearDownTest() {
+	suite.server.Close()
+}
+
+func (suite *HandlerTestSuite) request(method string, path string, body interface{}) int {
+	request, err := http.NewRequest(method, suite.server.URL+path, nil)
+	suite.Require().Nil(err)
+	resp, err := http.DefaultClient.Do(request)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+	if body != nil {
+		suite.Require().Nil(json.NewDecoder(resp.Body).Decode(body))
+	}
+	return resp.StatusCode
+}
+
+func (suite *HandlerTestSuite) TestV1Messages() {
+	var list []message
+	suite.Equal(http.StatusOK, suite.request(http.MethodGet, "/api/v1/messages", &list))
+	suite.Require().Len(list, 2)
+	suite.Equal(messageID("report"), list[0].ID, "Newest messages come first")
+
+	plain := list[1]
+	suite.Equal(&path{Mailbox: "bounce", Domain: "example.com"}, plain.From, "The envelope is used for the paths")
+	suite.Equal("bounce@example.com", plain.Raw.From)
+	suite.Equal([]string{"bob@example.com"}, plain.Raw.To)
+	suite.Equal([]string{"<plain@example.com>"}, plain.Content.Headers["Message-ID"], "Header names keep their case")
+	suite.Equal("Hello Bob!\r\n", plain.Content.Body)
+	suite.Nil(plain.MIME)
+	suite.False(plain.Created.IsZero())
+
+	report := list[0]
+	suite.Equal(&path{Mailbox: "cora", Domain: "example.com"}, report.From, "Without envelope the headers are used")
+	suite.Require().NotNil(report.MIME)
+	suite.Require().Len(report.MIME.Parts, 2)
+	suite.Equal("The report", report.MIME.Parts[0].Body)
+	suite.Equal([]string{"application/pdf"}, report.MIME.Parts[1].Headers["Content-Type"])
+
+	var single message
+	suite.Equal(http.StatusOK, suite.request(http.MethodGet, "/api/v1/messages/"+messageID("plain"), &single))
+	suite.Equal(messageID("plain"), single.ID)
+	suite.Equal(http.StatusNotFound, suite.request(http.MethodGet, "/api/v1/messages/unknown", nil))
+}
+
+func (suite *HandlerTestSuite) TestV2MessagesAndSearch() {
+	var result messages
+	suite.Equal(http.StatusOK, suite.request(http.MethodGet, "/api/v2/messages?start=1&limit=5", &result))
+	suite.Equal(2, result.Total)
+	suite.Equal(1, result.Count)
+	suite.Equal(1, result.Start)
+	suite.Equal(messageID("plain"), result.Items[0].ID)
+
+	suite.Equal(http.StatusOK, suite.request(http.MethodGet, "/api/v2/search?kind=to&query=DAN@", &result))
+	suite.Equal(1, result.Total)
+	suite.Equal(messageID("report"), result.Items[0].ID)
+	suite.Equal(http.StatusOK, suite.request(http.MethodGet, "/api/v2/search?kind=containing&query=hello%20bob", &result))
+	suite.Equal(1, result.Total)
+	suite.Equal(messageID("plain"), result.Items[0].ID)
+	suite.Equal(http.StatusOK, suite.request(http.MethodGet, "/api/v2/search?kind=from&query=nobody", &result))
+	suite.Equal(0, result.Total)
+	suite.NotNil(result.Items)
+	suite.Equal(http.StatusBadRequest, suite.request(http.MethodGet, "/api/v2/search?kind=subject&query=x", nil))
+}
+
+func (suite *HandlerTestSuite) TestDownload() {
+	resp, err := http.Get(suite.server.URL + "/api/v1/messages/" + messageID("report") + "/mime/part/1/download")
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+	content, _ := io.ReadAll(resp.Body)
+	suite.Equal("%PDF-1.4", string(content))
+	suite.Equal("application/pdf", resp.Header.Get("Content-Type"))
+
+	resp, err = http.Get(suite.server.URL + "/api/v1/messages/" + messageID("plain") + "/download")
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+	content, _ = io.ReadAll(resp.Body)
+	suite.Equal(plainMail, string(content))
+}
+
+func (suite *HandlerTestSuite) TestDelete() {
+	suite.Equal(http.StatusOK, suite.request(http.MethodDelete, "/api/v1/messages/"+messageID("plain"), nil))
+	suite.Equal([]string{"report"}, suite.mailStore.KeysByArrival())
+	suite.Equal(http.StatusNotFound, suite.request(http.MethodDelete, "/api/v1/messages/"+messageID("plain"), nil))
+
+	suite.Equal(http.StatusOK, suite.request(http.MethodDelete, "/api/v1/messages", nil))
+	suite.Empty(suite.mailStore.KeysByArrival())
+}
+
+func TestHandler(t *testing.T) {
+	suite.Run(t, new(HandlerTestSuite))
+}
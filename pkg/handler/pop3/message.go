@@ -0,0 +1,53 @@
+package pop3
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+)
+
+//message is a mail of the maildrop of a session. DELE only marks it as deleted, it is removed when the session quits
+type message struct {
+	key     string
+	content []byte
+	deleted bool
+}
+
+//newMessage creates a message with CRLF line endings, which POP3 requires and which the octet counts are based on
+func newMessage(key string, raw []byte) *message {
+	content := bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+	content = bytes.ReplaceAll(content, []byte("\n"), []byte("\r\n"))
+	if !bytes.HasSuffix(content, []byte("\r\n")) {
+		content = append(content, '\r', '\n')
+	}
+	return &message{key: key, content: content}
+}
+
+func (m *message) size() int {
+	return len(m.content)
+}
+
+//uid is the unique id for UIDL. Store keys can contain spaces, so the hash of the key is used
+func (m *message) uid() string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(m.key)))
+}
+
+//top returns the headers, the empty line separating them from the body and the first lines of the body
+func (m *message) top(lines int) []byte {
+	end := bytes.Index(m.content, []byte("\r\n\r\n"))
+	if end < 0 {
+		return m.content
+	}
+	end += 4
+	body := m.content[end:]
+	for i := 0; i < lines && len(body) > 0; i++ {
+		next := bytes.Index(body, []byte("\r\n"))
+		if next < 0 {
+			end += len(body)
+			break
+		}
+		end += next + 2
+		body = body[next+2:]
+	}
+	return m.content[:end]
+}
@@ -0,0 +1,239 @@
+package pop3
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/da-coda/mailpie/pkg/auth"
+	"github.com/da-coda/mailpie/pkg/store"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"net"
+	"sync"
+	"time"
+)
+
+//Timeout is the inactivity autologout timer, RFC 1939 requires at least 10 minutes
+const Timeout = 10 * time.Minute
+
+//Options configures the POP3 server
+type Options struct {
+	//MailStore is the maildrop of every user
+	MailStore *store.MailStore
+	//Authenticator checks USER/PASS and APOP logins. Without configured users every login is accepted
+	Authenticator *auth.Authenticator
+	//TLSConfig enables STLS. Without a config STLS is not offered
+	TLSConfig *tls.Config
+	//DeletePerUser only hides deleted mails from the user who deleted them instead of removing them from the MailStore
+	DeletePerUser bool
+	//Hostname is used in the greeting and the APOP timestamp
+	Hostname string
+}
+
+//Server is a POP3 server (RFC 1939) serving the mails of a MailStore
+type Server struct {
+	options Options
+
+	lock sync.Mutex
+	//inUse holds the users which have an open session, RFC 1939 requires an exclusive lock of the maildrop
+	inUse map[string]bool
+	//deleted holds the keys deleted per user if DeletePerUser is set
+	deleted   map[string]map[string]bool
+	listeners map[net.Listener]bool
+	//sessions holds the open sessions and whether they run a command
+	sessions map[*session]bool
+	draining bool
+	//changed is signalled whenever a session ends or finishes a command
+	changed chan struct{}
+}
+
+func NewServer(options Options) *Server {
+	if options.Hostname == "" {
+		options.Hostname = "localhost"
+	}
+	return &Server{
+		options:   options,
+		inUse:     make(map[string]bool),
+		deleted:   make(map[string]map[string]bool),
+		listeners: make(map[net.Listener]bool),
+		sessions:  make(map[*session]bool),
+		changed:   make(chan struct{}, 1),
+	}
+}
+
+//ListenAndServe listens on the TCP address and then calls Serve
+func (s *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+//Serve accepts connections on the listener until it is closed. Every connection is handled in its own goroutine
+func (s *Server) Serve(listener net.Listener) error {
+	s.lock.Lock()
+	s.listeners[listener] = true
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.listeners, listener)
+		s.lock.Unlock()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			session := newSession(s, conn)
+			s.lock.Lock()
+			s.sessions[session] = false
+			s.lock.Unlock()
+			defer s.forget(session)
+			err := session.serve()
+			if err != nil {
+				logrus.WithError(err).WithField("ip", conn.RemoteAddr().String()).Debug("POP3 session ended with error")
+			}
+		}()
+	}
+}
+
+//Close stops all listeners. Open sessions are not interrupted
+func (s *Server) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var err error
+	for listener := range s.listeners {
+		if closeErr := listener.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+//Drain closes the sessions waiting for a command and waits until the others finished their command, which ends them
+//as well. Marked deletions of closed sessions are not applied, like if the connection broke. Once the context ends,
+//the remaining sessions are closed and an error is returned. The listeners are not closed
+func (s *Server) Drain(ctx context.Context) error {
+	for {
+		s.lock.Lock()
+		s.draining = true
+		var running int
+		for session, busy := range s.sessions {
+			if busy {
+				running++
+			} else {
+				_ = session.accepted.Close()
+			}
+		}
+		s.lock.Unlock()
+		if running == 0 {
+			return nil
+		}
+		select {
+		case <-s.changed:
+		case <-ctx.Done():
+			s.lock.Lock()
+			for session := range s.sessions {
+				_ = session.accepted.Close()
+			}
+			s.lock.Unlock()
+			return errors.Wrapf(ctx.Err(), "closed %d sessions running a command", running)
+		}
+	}
+}
+
+//begin marks the session as running a command. Returns false if the server shuts down and the session should end
+func (s *Server) begin(session *session) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.draining {
+		return false
+	}
+	s.sessions[session] = true
+	return true
+}
+
+//end marks the command of the session as finished. Returns false if the server shuts down and the session should end
+func (s *Server) end(session *session) bool {
+	s.lock.Lock()
+	s.sessions[session] = false
+	draining := s.draining
+	s.lock.Unlock()
+	s.signal()
+	return !draining
+}
+
+func (s *Server) forget(session *session) {
+	s.lock.Lock()
+	delete(s.sessions, session)
+	s.lock.Unlock()
+	s.signal()
+}
+
+func (s *Server) signal() {
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+//lockMaildrop acquires the exclusive lock of the users maildrop. Returns false if another session holds it
+func (s *Server) lockMaildrop(user string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.inUse[user] {
+		return false
+	}
+	s.inUse[user] = true
+	return true
+}
+
+func (s *Server) unlockMaildrop(user string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.inUse, user)
+}
+
+//maildrop returns the mails of the user in the order they arrived
+func (s *Server) maildrop(user string) []*message {
+	s.lock.Lock()
+	deleted := s.deleted[user]
+	s.lock.Unlock()
+
+	var messages []*message
+	for _, key := range s.options.MailStore.KeysByArrival() {
+		if deleted[key] {
+			continue
+		}
+		mail, err := s.options.MailStore.GetSingle(key)
+		if err != nil {
+			//deleted in the meantime
+			continue
+		}
+		messages = append(messages, newMessage(key, mail.RawMessage))
+	}
+	return messages
+}
+
+//remove deletes the mails for everyone or, with DeletePerUser, only for the user
+func (s *Server) remove(user string, keys []string) {
+	if s.options.DeletePerUser {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.deleted[user] == nil {
+			s.deleted[user] = make(map[string]bool)
+		}
+		for _, key := range keys {
+			s.deleted[user][key] = true
+		}
+		return
+	}
+	for _, key := range keys {
+		err := s.options.MailStore.Delete(key)
+		if err != nil && err != store.KeyNotExistsError {
+			logrus.WithError(err).WithField("key", key).Error("Unable to delete mail in POP3 handler")
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package pop3
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"fmt"
+	"github.com/da-coda/mailpie/pkg/auth"
+	"github.com/da-coda/mailpie/pkg/certs"
+	"github.com/da-coda/mailpie/pkg/config"
+	"github.com/da-coda/mailpie/pkg/event"
+	"github.com/da-coda/mailpie/pkg/instances"
+	"github.com/da-coda/mailpie/pkg/store"
+	"github.com/stretchr/testify/suite"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+var rawMail = []byte("From: alex@example.com\nTo: bob@example.com\nSubject: Hello!\n\nHello Bob!\n.hidden line\nBye\n")
+
+type ServerTestSuite struct {
+	suite.Suite
+	server    *Server
+	mailStore *store.MailStore
+	listener  net.Listener
+}
+
+func (suite *ServerTestSuite) SetupTest() {
+	suite.mailStore = store.CreateMailStore(event.CreateOrGet())
+	for _, key := range []string{"first", "second"} {
+		mail, err := instances.ParseMail(rawMail)
+		suite.Require().Nil(err)
+		suite.Require().Nil(suite.mailStore.Add(key, *mail))
+	}
+}
+
+func (suite *ServerTestSuite) TearDownTest() {
+	if suite.server != nil {
+		_ = suite.server.Close()
+	}
+}
+
+//serve starts a server with the options on a random local port and returns a connected client which already read the
+//greeting
+func (suite *ServerTestSuite) serve(options Options) (*textproto.Conn, string) {
+	options.MailStore = suite.mailStore
+	suite.server = NewServer(options)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	suite.Require().Nil(err)
+	suite.listener = listener
+	go func() {
+		_ = suite.server.Serve(listener)
+	}()
+	return suite.dial()
+}
+
+func (suite *ServerTestSuite) dial() (*textproto.Conn, string) {
+	conn, err := textproto.Dial("tcp", suite.listener.Addr().String())
+	suite.Require().Nil(err)
+	greeting, err := conn.ReadLine()
+	suite.Require().Nil(err)
+	suite.Require().True(strings.HasPrefix(greeting, "+OK"), greeting)
+	return conn, greeting
+}
+
+//cmd sends the command and returns the first line of the response
+func (suite *ServerTestSuite) cmd(conn *textproto.Conn, format string, args ...interface{}) string {
+	_, err := conn.Cmd(format, args...)
+	suite.Require().Nil(err)
+	line, err := conn.ReadLine()
+	suite.Require().Nil(err)
+	return line
+}
+
+//multiline sends the command, expects a positive response and returns the lines of the multi-line response
+func (suite *ServerTestSuite) multiline(conn *textproto.Conn, format string, args ...interface{}) []string {
+	line := suite.cmd(conn, format, args...)
+	suite.Require().True(strings.HasPrefix(line, "+OK"), line)
+	lines, err := conn.ReadDotLines()
+	suite.Require().Nil(err)
+	return lines
+}
+
+func (suite *ServerTestSuite) login(conn *textproto.Conn, username string) {
+	suite.Require().True(strings.HasPrefix(suite.cmd(conn, "USER %s", username), "+OK"))
+	line := suite.cmd(conn, "PASS secret")
+	suite.Require().True(strings.HasPrefix(line, "+OK"), line)
+}
+
+func (suite *ServerTestSuite) TestTransaction_StatListRetr() {
+	conn, _ := suite.serve(Options{})
+	defer conn.Close()
+	suite.True(strings.HasPrefix(suite.cmd(conn, "STAT"), "-ERR"), "Commands of the transaction state need a login")
+	suite.login(conn, "bob@example.com")
+
+	size := newMessage("first", rawMail).size()
+	suite.Equal(fmt.Sprintf("+OK 2 %d", 2*size), suite.cmd(conn, "STAT"))
+	suite.Equal([]string{fmt.Sprintf("1 %d", size), fmt.Sprintf("2 %d", size)}, suite.multiline(conn, "LIST"))
+	suite.Equal(fmt.Sprintf("+OK 2 %d", size), suite.cmd(conn, "LIST 2"))
+	suite.True(strings.HasPrefix(suite.cmd(conn, "LIST 3"), "-ERR"))
+
+	uids := suite.multiline(conn, "UIDL")
+	suite.Len(uids, 2)
+	suite.NotEqual(strings.Fields(uids[0])[1], strings.Fields(uids[1])[1], "Unique ids must differ")
+
+	lines := suite.multiline(conn, "RETR 1")
+	suite.Contains(lines, "Subject: Hello!")
+	suite.Contains(lines, ".hidden line", "Dot stuffing should be undone by the client")
+	suite.Equal("+OK Mailpie POP3 server signing off (2 messages left)", suite.cmd(conn, "QUIT"))
+}
+
+func (suite *ServerTestSuite) TestTop() {
+	conn, _ := suite.serve(Options{})
+	defer conn.Close()
+	suite.login(conn, "bob@example.com")
+	suite.Equal([]string{"From: alex@example.com", "To: bob@example.com", "Subject: Hello!", ""}, suite.multiline(conn, "TOP 1 0"))
+	suite.Equal([]string{"From: alex@example.com", "To: bob@example.com", "Subject: Hello!", "", "Hello Bob!"}, suite.multiline(conn, "TOP 1 1"))
+	suite.Len(suite.multiline(conn, "TOP 1 100"), 7)
+}
+
+func (suite *ServerTestSuite) TestDele_RemovesFromStore() {
+	conn, _ := suite.serve(Options{})
+	suite.login(conn, "bob@example.com")
+	suite.True(strings.HasPrefix(suite.cmd(conn, "DELE 1"), "+OK"))
+	suite.True(strings.HasPrefix(suite.cmd(conn, "RETR 1"), "-ERR"), "Deleted messages can't be retrieved")
+	suite.True(strings.HasPrefix(suite.cmd(conn, "STAT"), "+OK 1 "))
+	_, err := suite.mailStore.GetSingle("first")
+	suite.Nil(err, "Mails are only removed when the session quits")
+	suite.True(strings.HasPrefix(suite.cmd(conn, "QUIT"), "+OK"))
+	_ = conn.Close()
+
+	_, err = suite.mailStore.GetSingle("first")
+	suite.Equal(store.KeyNotExistsError, err)
+	other, _ := suite.dial()
+	defer other.Close()
+	suite.login(other, "cora@example.com")
+	suite.True(strings.HasPrefix(suite.cmd(other, "STAT"), "+OK 1 "), "Mails are deleted for everyone")
+}
+
+func (suite *ServerTestSuite) TestDrain_ClosesIdleSessions() {
+	conn, _ := suite.serve(Options{})
+	defer conn.Close()
+	suite.login(conn, "bob@example.com")
+	suite.True(strings.HasPrefix(suite.cmd(conn, "DELE 1"), "+OK"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	suite.Nil(suite.server.Drain(ctx))
+	_, err := conn.ReadLine()
+	suite.NotNil(err, "The idle session should be closed")
+	_, err = suite.mailStore.GetSingle("first")
+	suite.Nil(err, "Deletions of closed sessions should not be applied")
+}
+
+func (suite *ServerTestSuite) TestRset() {
+	conn, _ := suite.serve(Options{})
+	suite.login(conn, "bob@example.com")
+	suite.True(strings.HasPrefix(suite.cmd(conn, "DELE 2"), "+OK"))
+	suite.True(strings.HasPrefix(suite.cmd(conn, "RSET"), "+OK maildrop has 2 messages"))
+	suite.True(strings.HasPrefix(suite.cmd(conn, "QUIT"), "+OK"))
+	_ = conn.Close()
+	suite.Len(suite.mailStore.KeysByArrival(), 2)
+}
+
+func (suite *ServerTestSuite) TestDele_PerUser() {
+	conn, _ := suite.serve(Options{DeletePerUser: true})
+	suite.login(conn, "bob@example.com")
+	suite.True(strings.HasPrefix(suite.cmd(conn, "DELE 1"), "+OK"))
+	suite.True(strings.HasPrefix(suite.cmd(conn, "QUIT"), "+OK"))
+	_ = conn.Close()
+	suite.Len(suite.mailStore.KeysByArrival(), 2, "Mails stay in the store")
+
+	conn, _ = suite.dial()
+	suite.login(conn, "bob@example.com")
+	suite.True(strings.HasPrefix(suite.cmd(conn, "STAT"), "+OK 1 "), "Deleted mails are hidden from the deleting user")
+	suite.True(strings.HasPrefix(suite.cmd(conn, "QUIT"), "+OK"))
+	_ = conn.Close()
+
+	conn, _ = suite.dial()
+	defer conn.Close()
+	suite.login(conn, "cora@example.com")
+	suite.True(strings.HasPrefix(suite.cmd(conn, "STAT"), "+OK 2 "), "Other users still see the mails")
+}
+
+func (suite *ServerTestSuite) TestInUse() {
+	conn, _ := suite.serve(Options{})
+	suite.login(conn, "bob@example.com")
+
+	other, _ := suite.dial()
+	defer other.Close()
+	suite.True(strings.HasPrefix(suite.cmd(other, "USER bob@example.com"), "+OK"))
+	suite.True(strings.HasPrefix(suite.cmd(other, "PASS secret"), "-ERR [IN-USE]"), "Maildrop should be locked")
+
+	suite.True(strings.HasPrefix(suite.cmd(conn, "QUIT"), "+OK"))
+	_ = conn.Close()
+	suite.True(strings.HasPrefix(suite.cmd(other, "USER bob@example.com"), "+OK"))
+	suite.True(strings.HasPrefix(suite.cmd(other, "PASS secret"), "+OK"), "Lock should be released after QUIT")
+}
+
+func (suite *ServerTestSuite) TestAuthentication() {
+	authenticator := auth.NewAuthenticator([]config.User{{Username: "bob", Password: "secret"}})
+	conn, greeting := suite.serve(Options{Authenticator: authenticator})
+	defer conn.Close()
+	suite.True(strings.HasPrefix(suite.cmd(conn, "USER bob"), "+OK"))
+	suite.True(strings.HasPrefix(suite.cmd(conn, "PASS wrong"), "-ERR [AUTH]"))
+	suite.True(strings.HasPrefix(suite.cmd(conn, "APOP bob 0123456789abcdef0123456789abcdef"), "-ERR [AUTH]"))
+
+	timestamp := greeting[strings.Index(greeting, "<"):]
+	digest := fmt.Sprintf("%x", md5.Sum([]byte(timestamp+"secret")))
+	suite.True(strings.HasPrefix(suite.cmd(conn, "APOP bob %s", digest), "+OK bob has 2 messages"))
+}
+
+func (suite *ServerTestSuite) TestStls() {
+	tlsConfig, err := certs.Load("", "")
+	suite.Require().Nil(err)
+	conn, _ := suite.serve(Options{TLSConfig: tlsConfig})
+	suite.Contains(suite.multiline(conn, "CAPA"), "STLS")
+	_ = conn.Close()
+
+	//textproto doesn't expose the connection, so the TLS client is created on a raw connection
+	raw, err := net.Dial("tcp", suite.listener.Addr().String())
+	suite.Require().Nil(err)
+	plain := textproto.NewConn(raw)
+	_, err = plain.ReadLine()
+	suite.Require().Nil(err)
+	suite.True(strings.HasPrefix(suite.cmd(plain, "STLS"), "+OK"))
+	tlsConn := tls.Client(raw, &tls.Config{InsecureSkipVerify: true})
+	suite.Require().Nil(tlsConn.Handshake())
+	secure := textproto.NewConn(tlsConn)
+	defer secure.Close()
+	suite.NotContains(suite.multiline(secure, "CAPA"), "STLS", "STLS is not offered on encrypted connections")
+	suite.login(secure, "bob@example.com")
+	suite.True(strings.HasPrefix(suite.cmd(secure, "STAT"), "+OK 2 "))
+}
+
+func (suite *ServerTestSuite) TestStls_WithoutTLSConfig() {
+	conn, _ := suite.serve(Options{})
+	defer conn.Close()
+	suite.NotContains(suite.multiline(conn, "CAPA"), "STLS")
+	suite.True(strings.HasPrefix(suite.cmd(conn, "STLS"), "-ERR"))
+}
+
+func TestServer(t *testing.T) {
+	suite.Run(t, new(ServerTestSuite))
+}
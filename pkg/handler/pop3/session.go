@@ -0,0 +1,389 @@
+package pop3
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type state int
+
+const (
+	authorizationState state = iota
+	transactionState
+)
+
+//session is a single POP3 connection
+type session struct {
+	server *Server
+	conn   net.Conn
+	//accepted is the connection before STLS, closed on shutdown
+	accepted net.Conn
+	reader   *bufio.Reader
+	writer   *bufio.Writer
+	state    state
+	isTLS    bool
+	//timestamp is sent in the greeting and used as challenge for APOP
+	timestamp string
+	//username is the name given with USER, user the authenticated user
+	username string
+	user     string
+	messages []*message
+}
+
+func newSession(server *Server, conn net.Conn) *session {
+	_, isTLS := conn.(*tls.Conn)
+	return &session{
+		server:    server,
+		conn:      conn,
+		accepted:  conn,
+		reader:    bufio.NewReader(conn),
+		writer:    bufio.NewWriter(conn),
+		isTLS:     isTLS,
+		timestamp: fmt.Sprintf("<%d.%d@%s>", os.Getpid(), time.Now().UnixNano(), server.options.Hostname),
+	}
+}
+
+//serve reads and handles commands until the client quits or the connection breaks
+func (s *session) serve() error {
+	defer func() {
+		if s.state == transactionState {
+			s.server.unlockMaildrop(s.user)
+		}
+		_ = s.conn.Close()
+	}()
+
+	err := s.ok("Mailpie POP3 server ready " + s.timestamp)
+	if err != nil {
+		return err
+	}
+	for {
+		_ = s.conn.SetDeadline(time.Now().Add(Timeout))
+		line, err := s.reader.ReadString('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		command, argument := parseCommand(line)
+		logrus.WithField("ip", s.conn.RemoteAddr().String()).WithField("verb", command).Debug("POP3 command")
+		if !s.server.begin(s) {
+			return nil
+		}
+		quit, err := s.handle(command, argument)
+		if !s.server.end(s) {
+			return err
+		}
+		if err != nil || quit {
+			return err
+		}
+	}
+}
+
+//parseCommand splits a line in the upper case command keyword and the rest of the line as argument
+func parseCommand(line string) (string, string) {
+	line = strings.TrimRight(line, "\r\n")
+	command, argument := line, ""
+	if space := strings.Index(line, " "); space >= 0 {
+		command, argument = line[:space], line[space+1:]
+	}
+	return strings.ToUpper(command), argument
+}
+
+//handle runs the command and returns true if the session should end
+func (s *session) handle(command string, argument string) (bool, error) {
+	switch command {
+	case "QUIT":
+		return true, s.quit()
+	case "CAPA":
+		return false, s.capa()
+	}
+
+	if s.state == authorizationState {
+		switch command {
+		case "USER":
+			return false, s.userCommand(argument)
+		case "PASS":
+			return false, s.pass(argument)
+		case "APOP":
+			return false, s.apop(argument)
+		case "STLS":
+			return false, s.stls()
+		}
+		return false, s.err("command not valid before login")
+	}
+
+	switch command {
+	case "STAT":
+		return false, s.stat()
+	case "LIST":
+		return false, s.list(argument)
+	case "UIDL":
+		return false, s.uidl(argument)
+	case "RETR":
+		return false, s.retr(argument)
+	case "TOP":
+		return false, s.top(argument)
+	case "DELE":
+		return false, s.dele(argument)
+	case "RSET":
+		return false, s.rset()
+	case "NOOP":
+		return false, s.ok("")
+	}
+	return false, s.err("unknown command")
+}
+
+func (s *session) capa() error {
+	capabilities := []string{"USER", "TOP", "UIDL", "RESP-CODES", "AUTH-RESP-CODE", "PIPELINING", "IMPLEMENTATION Mailpie"}
+	if s.server.options.TLSConfig != nil && !s.isTLS && s.state == authorizationState {
+		capabilities = append(capabilities, "STLS")
+	}
+	return s.multiline("Capability list follows", []byte(strings.Join(capabilities, "\r\n")+"\r\n"))
+}
+
+func (s *session) userCommand(argument string) error {
+	if argument == "" {
+		return s.err("missing user name")
+	}
+	s.username = argument
+	return s.ok("send PASS")
+}
+
+func (s *session) pass(argument string) error {
+	if s.username == "" {
+		return s.err("send USER first")
+	}
+	username := s.username
+	s.username = ""
+	if !s.server.options.Authenticator.Authenticate(username, argument) {
+		return s.err("[AUTH] invalid user name or password")
+	}
+	return s.login(username)
+}
+
+//apop checks the MD5 digest of the greeting timestamp and the password of the user
+func (s *session) apop(argument string) error {
+	fields := strings.Fields(argument)
+	if len(fields) != 2 {
+		return s.err("APOP needs a user name and a digest")
+	}
+	username, digest := fields[0], strings.ToLower(fields[1])
+	if s.server.options.Authenticator.Enabled() {
+		password, exists := s.server.options.Authenticator.Password(username)
+		expected := fmt.Sprintf("%x", md5.Sum([]byte(s.timestamp+password)))
+		if !exists || subtle.ConstantTimeCompare([]byte(expected), []byte(digest)) != 1 {
+			return s.err("[AUTH] invalid user name or digest")
+		}
+	}
+	return s.login(username)
+}
+
+//login locks the maildrop of the user and enters the transaction state
+func (s *session) login(username string) error {
+	if !s.server.lockMaildrop(username) {
+		return s.err("[IN-USE] maildrop already locked")
+	}
+	s.user = username
+	s.state = transactionState
+	s.messages = s.server.maildrop(username)
+	count, size := s.stats()
+	return s.ok(fmt.Sprintf("%s has %d messages (%d octets)", username, count, size))
+}
+
+func (s *session) stls() error {
+	if s.server.options.TLSConfig == nil || s.isTLS {
+		return s.err("STLS not available")
+	}
+	err := s.ok("Begin TLS negotiation")
+	if err != nil {
+		return err
+	}
+	tlsConn := tls.Server(s.conn, s.server.options.TLSConfig)
+	err = tlsConn.Handshake()
+	if err != nil {
+		return errors.Wrap(err, "TLS handshake failed")
+	}
+	s.conn = tlsConn
+	s.reader = bufio.NewReader(tlsConn)
+	s.writer = bufio.NewWriter(tlsConn)
+	s.isTLS = true
+	return nil
+}
+
+//stats returns the count and the size of all messages which are not deleted
+func (s *session) stats() (int, int) {
+	count, size := 0, 0
+	for _, msg := range s.messages {
+		if !msg.deleted {
+			count++
+			size += msg.size()
+		}
+	}
+	return count, size
+}
+
+func (s *session) stat() error {
+	count, size := s.stats()
+	return s.ok(fmt.Sprintf("%d %d", count, size))
+}
+
+//message returns the message with the number given as argument
+func (s *session) message(argument string) (*message, int, error) {
+	number, err := strconv.Atoi(strings.TrimSpace(argument))
+	if err != nil || number < 1 || number > len(s.messages) {
+		return nil, 0, errors.New("no such message")
+	}
+	msg := s.messages[number-1]
+	if msg.deleted {
+		return nil, 0, errors.Errorf("message %d already deleted", number)
+	}
+	return msg, number, nil
+}
+
+//listing writes the line for a single message if a number is given, otherwise the lines of all messages
+func (s *session) listing(argument string, line func(number int, msg *message) string) error {
+	if argument != "" {
+		msg, number, err := s.message(argument)
+		if err != nil {
+			return s.err(err.Error())
+		}
+		return s.ok(line(number, msg))
+	}
+	var lines strings.Builder
+	for i, msg := range s.messages {
+		if !msg.deleted {
+			lines.WriteString(line(i+1, msg) + "\r\n")
+		}
+	}
+	count, size := s.stats()
+	return s.multiline(fmt.Sprintf("%d messages (%d octets)", count, size), []byte(lines.String()))
+}
+
+func (s *session) list(argument string) error {
+	return s.listing(argument, func(number int, msg *message) string {
+		return fmt.Sprintf("%d %d", number, msg.size())
+	})
+}
+
+func (s *session) uidl(argument string) error {
+	return s.listing(argument, func(number int, msg *message) string {
+		return fmt.Sprintf("%d %s", number, msg.uid())
+	})
+}
+
+func (s *session) retr(argument string) error {
+	msg, _, err := s.message(argument)
+	if err != nil {
+		return s.err(err.Error())
+	}
+	return s.multiline(fmt.Sprintf("%d octets", msg.size()), msg.content)
+}
+
+func (s *session) top(argument string) error {
+	fields := strings.Fields(argument)
+	if len(fields) != 2 {
+		return s.err("TOP needs a message number and a line count")
+	}
+	msg, _, err := s.message(fields[0])
+	if err != nil {
+		return s.err(err.Error())
+	}
+	lines, err := strconv.Atoi(fields[1])
+	if err != nil || lines < 0 {
+		return s.err("invalid line count")
+	}
+	return s.multiline("top of message follows", msg.top(lines))
+}
+
+func (s *session) dele(argument string) error {
+	msg, number, err := s.message(argument)
+	if err != nil {
+		return s.err(err.Error())
+	}
+	msg.deleted = true
+	return s.ok(fmt.Sprintf("message %d deleted", number))
+}
+
+func (s *session) rset() error {
+	for _, msg := range s.messages {
+		msg.deleted = false
+	}
+	count, size := s.stats()
+	return s.ok(fmt.Sprintf("maildrop has %d messages (%d octets)", count, size))
+}
+
+//quit removes the deleted messages if the session is in the transaction state
+func (s *session) quit() error {
+	if s.state != transactionState {
+		return s.ok("Mailpie POP3 server signing off")
+	}
+	var deleted []string
+	for _, msg := range s.messages {
+		if msg.deleted {
+			deleted = append(deleted, msg.key)
+		}
+	}
+	s.server.remove(s.user, deleted)
+	count, _ := s.stats()
+	return s.ok(fmt.Sprintf("Mailpie POP3 server signing off (%d messages left)", count))
+}
+
+func (s *session) ok(text string) error {
+	return s.write("+OK " + text + "\r\n")
+}
+
+func (s *session) err(text string) error {
+	return s.write("-ERR " + text + "\r\n")
+}
+
+func (s *session) write(line string) error {
+	_, err := s.writer.WriteString(line)
+	if err != nil {
+		return err
+	}
+	return s.writer.Flush()
+}
+
+//multiline writes a positive response followed by the CRLF terminated content with dot stuffing and the termination line
+func (s *session) multiline(text string, content []byte) error {
+	_, err := s.writer.WriteString("+OK " + text + "\r\n")
+	if err != nil {
+		return err
+	}
+	for len(content) > 0 {
+		end := bytes.Index(content, []byte("\r\n"))
+		line := content
+		if end >= 0 {
+			line = content[:end]
+			content = content[end+2:]
+		} else {
+			content = nil
+		}
+		if len(line) > 0 && line[0] == '.' {
+			_ = s.writer.WriteByte('.')
+		}
+		_, _ = s.writer.Write(line)
+		_, err = s.writer.WriteString("\r\n")
+		if err != nil {
+			return err
+		}
+	}
+	_, err = s.writer.WriteString(".\r\n")
+	if err != nil {
+		return err
+	}
+	return s.writer.Flush()
+}
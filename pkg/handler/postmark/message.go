@@ -0,0 +1,190 @@
+package postmark
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"github.com/da-coda/mailpie/pkg/handler"
+	"github.com/da-coda/mailpie/pkg/instances"
+	"github.com/pkg/errors"
+	"gopkg.in/mail.v2"
+	"io"
+	gomail "net/mail"
+	"sort"
+	"strings"
+)
+
+//maxRecipients is the number of recipients Postmark allows in To, Cc and Bcc together
+const maxRecipients = 50
+
+type header struct {
+	Name  string
+	Value string
+}
+
+type attachment struct {
+	Name        string
+	Content     string
+	ContentType string
+	//ContentID embeds the attachment, it is referenced in the HtmlBody like cid:image.png
+	ContentID string
+}
+
+//email is a message of /email and /email/batch. Addresses are comma separated lists
+type email struct {
+	From          string
+	To            string
+	Cc            string
+	Bcc           string
+	Subject       string
+	Tag           string
+	HtmlBody      string
+	TextBody      string
+	ReplyTo       string
+	Headers       []header
+	Metadata      map[string]string
+	Attachments   []attachment
+	MessageStream string
+}
+
+//templatedEmail is a message of /email/withTemplate, either TemplateId or TemplateAlias is required
+type templatedEmail struct {
+	email
+	TemplateID    int `json:"TemplateId"`
+	TemplateAlias string
+	TemplateModel map[string]interface{}
+}
+
+//validate checks the message like Postmark and returns the problem if it is invalid. Otherwise, the recipients are
+//returned as listed in To of the response
+func (e *email) validate() (string, string) {
+	if _, err := gomail.ParseAddress(e.From); err != nil {
+		return "", fmt.Sprintf("Invalid 'From' address: '%s'.", e.From)
+	}
+	count := 0
+	for name, list := range map[string]string{"To": e.To, "Cc": e.Cc, "Bcc": e.Bcc, "ReplyTo": e.ReplyTo} {
+		addresses, err := parseAddresses(list)
+		if err != nil {
+			return "", fmt.Sprintf("Invalid '%s' address: '%s'.", name, list)
+		}
+		if name != "ReplyTo" {
+			count += len(addresses)
+		}
+	}
+	if count == 0 {
+		return "", "Zero recipients specified"
+	}
+	if count > maxRecipients {
+		return "", fmt.Sprintf("Maximum of %d recipients allowed", maxRecipients)
+	}
+	if e.TextBody == "" && e.HtmlBody == "" {
+		return "", "Provide either email TextBody or HtmlBody or both."
+	}
+	for _, a := range e.Attachments {
+		if _, err := base64.StdEncoding.DecodeString(a.Content); err != nil || a.Name == "" {
+			return "", fmt.Sprintf("Invalid attachment '%s'.", a.Name)
+		}
+	}
+	return e.To, ""
+}
+
+//build converts the validated message into a MIME mail. Like the SMTP API of Postmark, the tag and metadata are added
+//as X-PM-Tag and X-PM-Metadata-* headers
+func (e *email) build(messageID string) (handler.Envelope, error) {
+	from, _ := gomail.ParseAddress(e.From)
+	m := mail.NewMessage()
+	m.SetAddressHeader("From", from.Address, from.Name)
+	var recipients []string
+	for _, field := range []struct{ header, list string }{{"To", e.To}, {"Cc", e.Cc}, {"Bcc", e.Bcc}, {"Reply-To", e.ReplyTo}} {
+		addresses, _ := parseAddresses(field.list)
+		if len(addresses) == 0 {
+			continue
+		}
+		if field.header != "Reply-To" {
+			for _, address := range addresses {
+				recipients = append(recipients, address.Address)
+			}
+		}
+		//Bcc is only part of the envelope
+		if field.header != "Bcc" {
+			m.SetHeader(field.header, formatAddresses(m, addresses)...)
+		}
+	}
+	m.SetHeader("Subject", e.Subject)
+	m.SetHeader("Message-ID", "<"+messageID+"@postmark.mailpie>")
+	for _, h := range e.Headers {
+		m.SetHeader(h.Name, h.Value)
+	}
+	if e.Tag != "" {
+		m.SetHeader("X-PM-Tag", e.Tag)
+	}
+	keys := make([]string, 0, len(e.Metadata))
+	for key := range e.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		m.SetHeader("X-PM-Metadata-"+key, e.Metadata[key])
+	}
+
+	if e.TextBody != "" {
+		m.SetBody("text/plain", e.TextBody)
+	}
+	if e.HtmlBody != "" {
+		if e.TextBody != "" {
+			m.AddAlternative("text/html", e.HtmlBody)
+		} else {
+			m.SetBody("text/html", e.HtmlBody)
+		}
+	}
+	for _, a := range e.Attachments {
+		addAttachment(m, a)
+	}
+
+	var buffer bytes.Buffer
+	if _, err := m.WriteTo(&buffer); err != nil {
+		return handler.Envelope{}, errors.Wrap(err, "unable to write mail")
+	}
+	metadata := instances.Metadata{Provider: "postmark", MessageID: messageID}
+	if e.Tag != "" {
+		metadata.Tags = []string{e.Tag}
+	}
+	if len(e.Metadata) > 0 {
+		metadata.Variables = e.Metadata
+	}
+	return handler.Envelope{From: from.Address, To: recipients, Data: buffer.Bytes(), Metadata: metadata}, nil
+}
+
+func parseAddresses(list string) ([]*gomail.Address, error) {
+	if strings.TrimSpace(list) == "" {
+		return nil, nil
+	}
+	return gomail.ParseAddressList(list)
+}
+
+func formatAddresses(m *mail.Message, addresses []*gomail.Address) []string {
+	formatted := make([]string, len(addresses))
+	for i, address := range addresses {
+		formatted[i] = m.FormatAddress(address.Address, address.Name)
+	}
+	return formatted
+}
+
+//addAttachment attaches or, with a ContentID, embeds the attachment. The content was validated to be base64
+func addAttachment(m *mail.Message, a attachment) {
+	decoded, _ := base64.StdEncoding.DecodeString(a.Content)
+	header := make(map[string][]string)
+	if a.ContentType != "" {
+		header["Content-Type"] = []string{fmt.Sprintf("%s; name=%q", a.ContentType, a.Name)}
+	}
+	copyFunc := mail.SetCopyFunc(func(w io.Writer) error {
+		_, err := w.Write(decoded)
+		return err
+	})
+	if a.ContentID != "" {
+		header["Content-ID"] = []string{"<" + strings.TrimPrefix(a.ContentID, "cid:") + ">"}
+		m.Embed(a.Name, copyFunc, mail.SetHeader(header))
+		return
+	}
+	m.Attach(a.Name, copyFunc, mail.SetHeader(header))
+}
@@ -0,0 +1,159 @@
+//Package postmark emulates the sending endpoints of the Postmark email API. Mails are stored like mails received via
+//SMTP, with the tag and metadata of the request attached as metadata
+package postmark
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/da-coda/mailpie/internal/apiutil"
+	"github.com/da-coda/mailpie/pkg/handler"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+//error codes of the Postmark API
+const (
+	codeOK                  = 0
+	codeInvalidToken        = 10
+	codeInvalidEmailRequest = 300
+	codeInvalidJSON         = 402
+	codeTemplateNotFound    = 1101
+)
+
+//maxBatchSize is the number of messages Postmark allows in a batch
+const maxBatchSize = 500
+
+type Handler struct {
+	smtpHandler  *handler.SmtpHandler
+	templateDir  string
+	serverTokens map[string]bool
+}
+
+//NewHandler creates the Postmark API which stores mails via the smtpHandler. Only the serverTokens are accepted, every
+//token if there are none. Templates are loaded from templateDir, see loadTemplate
+func NewHandler(smtpHandler *handler.SmtpHandler, templateDir string, serverTokens []string) *Handler {
+	h := &Handler{smtpHandler: smtpHandler, templateDir: templateDir, serverTokens: make(map[string]bool)}
+	for _, token := range serverTokens {
+		h.serverTokens[token] = true
+	}
+	return h
+}
+
+//Register adds the Postmark routes to the router
+func (h *Handler) Register(router *mux.Router) {
+	router.HandleFunc("/email", h.authenticated(h.email)).Methods("POST")
+	router.HandleFunc("/email/batch", h.authenticated(h.batch)).Methods("POST")
+	router.HandleFunc("/email/withTemplate", h.authenticated(h.withTemplate)).Methods("POST")
+}
+
+//result is the response to a message, also for every message of a batch
+type result struct {
+	To          string `json:",omitempty"`
+	SubmittedAt string `json:",omitempty"`
+	MessageID   string `json:",omitempty"`
+	ErrorCode   int
+	Message     string
+	//status is the HTTP status if the message is sent alone, by default 200 without and 422 with ErrorCode
+	status int
+}
+
+func newError(code int, message string) result {
+	return result{ErrorCode: code, Message: message}
+}
+
+//authenticated requires the X-Postmark-Server-Token header with one of the configured tokens
+func (h *Handler) authenticated(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get("X-Postmark-Server-Token")
+		if token == "" {
+			apiutil.WriteJSON(w, http.StatusUnauthorized, newError(codeInvalidToken, "No Account or Server API tokens were supplied in the HTTP headers. Please add a header for either X-Postmark-Server-Token or X-Postmark-Account-Token."))
+			return
+		}
+		if len(h.serverTokens) > 0 && !h.serverTokens[token] {
+			apiutil.WriteJSON(w, http.StatusUnauthorized, newError(codeInvalidToken, "The Server Token you provided in the X-Postmark-Server-Token request header was invalid. Please verify that you are using a valid token."))
+			return
+		}
+		next(w, r)
+	}
+}
+
+//email handles POST /email
+func (h *Handler) email(w http.ResponseWriter, r *http.Request) {
+	var request email
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		apiutil.WriteJSON(w, http.StatusUnprocessableEntity, newError(codeInvalidJSON, "Received invalid JSON input."))
+		return
+	}
+	h.writeResult(w, h.send(request))
+}
+
+//batch handles POST /email/batch. Like Postmark, the messages are processed independently and the response holds a
+//result for every message, even if some failed
+func (h *Handler) batch(w http.ResponseWriter, r *http.Request) {
+	var requests []email
+	if err := json.NewDecoder(r.Body).Decode(&requests); err != nil {
+		apiutil.WriteJSON(w, http.StatusUnprocessableEntity, newError(codeInvalidJSON, "Received invalid JSON input."))
+		return
+	}
+	if len(requests) > maxBatchSize {
+		apiutil.WriteJSON(w, http.StatusUnprocessableEntity, newError(codeInvalidEmailRequest, fmt.Sprintf("Batch messages are limited to %d messages.", maxBatchSize)))
+		return
+	}
+	results := make([]result, len(requests))
+	for i, request := range requests {
+		results[i] = h.send(request)
+	}
+	apiutil.WriteJSON(w, http.StatusOK, results)
+}
+
+//withTemplate handles POST /email/withTemplate, which renders the subject and bodies of a template with the model
+func (h *Handler) withTemplate(w http.ResponseWriter, r *http.Request) {
+	var request templatedEmail
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		apiutil.WriteJSON(w, http.StatusUnprocessableEntity, newError(codeInvalidJSON, "Received invalid JSON input."))
+		return
+	}
+	name := request.TemplateAlias
+	if name == "" && request.TemplateID != 0 {
+		name = fmt.Sprint(request.TemplateID)
+	}
+	t, err := loadTemplate(h.templateDir, name)
+	if err != nil {
+		if err != templateNotFoundError {
+			logrus.WithError(err).WithField("templateDir", h.templateDir).WithField("template", name).Warn("Unable to load Postmark template")
+		}
+		h.writeResult(w, newError(codeTemplateNotFound, "The 'TemplateId' associated with this request is not valid or was not found."))
+		return
+	}
+	h.writeResult(w, h.send(t.render(request.email, request.TemplateModel)))
+}
+
+//send validates, builds and stores the message
+func (h *Handler) send(request email) result {
+	to, problem := request.validate()
+	if problem != "" {
+		return newError(codeInvalidEmailRequest, problem)
+	}
+	messageID := apiutil.NewUUID()
+	mail, err := request.build(messageID)
+	if err == nil {
+		err = h.smtpHandler.StoreEnvelope(mail)
+	}
+	if err != nil {
+		logrus.WithError(err).Error("Unable to store mail in Postmark handler")
+		return result{ErrorCode: codeInvalidEmailRequest, Message: "Unable to store the message", status: http.StatusInternalServerError}
+	}
+	return result{To: to, SubmittedAt: time.Now().Format(time.RFC3339Nano), MessageID: messageID, ErrorCode: codeOK, Message: "OK"}
+}
+
+func (h *Handler) writeResult(w http.ResponseWriter, r result) {
+	status := r.status
+	if status == 0 && r.ErrorCode != codeOK {
+		status = http.StatusUnprocessableEntity
+	} else if status == 0 {
+		status = http.StatusOK
+	}
+	apiutil.WriteJSON(w, status, r)
+}
@@ -0,0 +1,186 @@
+package postmark
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/da-coda/mailpie/pkg/event"
+	"github.com/da-coda/mailpie/pkg/handler"
+	"github.com/da-coda/mailpie/pkg/instances"
+	"github.com/da-coda/mailpie/pkg/store"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/suite"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type HandlerTestSuite struct {
+	suite.Suite
+	mailStore   *store.MailStore
+	templateDir string
+	server      *httptest.Server
+}
+
+func (suite *HandlerTestSuite) SetupTest() {
+	suite.mailStore = store.CreateMailStore(event.CreateOrGet())
+	suite.templateDir = suite.T().TempDir()
+	smtpHandler := handler.CreateSmtpHandler(suite.mailStore)
+	router := mux.NewRouter()
+	NewHandler(&smtpHandler, suite.templateDir, []string{"server-token"}).Register(router)
+	suite.server = httptest.NewServer(router)
+}
+
+func (suite *HandlerTestSuite) TearDownTest() {
+	suite.server.Close()
+}
+
+//post sends the body with the token and decodes the response into response
+func (suite *HandlerTestSuite) post(path string, token string, body string, response interface{}) int {
+	request, err := http.NewRequest(http.MethodPost, suite.server.URL+path, bytes.NewBufferString(body))
+	suite.Require().Nil(err)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Accept", "application/json")
+	if token != "" {
+		request.Header.Set("X-Postmark-Server-Token", token)
+	}
+	resp, err := http.DefaultClient.Do(request)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+	suite.Require().Nil(json.NewDecoder(resp.Body).Decode(response))
+	return resp.StatusCode
+}
+
+func (suite *HandlerTestSuite) mails() []instances.Mail {
+	var mails []instances.Mail
+	for _, key := range suite.mailStore.KeysByArrival() {
+		mail, err := suite.mailStore.GetSingle(key)
+		suite.Require().Nil(err)
+		mails = append(mails, mail)
+	}
+	return mails
+}
+
+func (suite *HandlerTestSuite) TestEmail() {
+	var response map[string]interface{}
+	status := suite.post("/email", "server-token", `{
+		"From": "Alex <alex@example.com>",
+		"To": "Bob <bob@example.com>, cora@example.com",
+		"Bcc": "dan@example.com",
+		"Subject": "Invoice",
+		"Tag": "billing",
+		"HtmlBody": "<p>Your invoice</p><img src=\"cid:logo.png\">",
+		"TextBody": "Your invoice",
+		"Headers": [{"Name": "X-Priority", "Value": "1"}],
+		"Metadata": {"customer-id": "42"},
+		"Attachments": [
+			{"Name": "invoice.pdf", "Content": "JVBERi0xLjQ=", "ContentType": "application/pdf"},
+			{"Name": "logo.png", "Content": "UE5H", "ContentType": "image/png", "ContentID": "cid:logo.png"}
+		],
+		"MessageStream": "outbound"
+	}`, &response)
+	suite.Equal(http.StatusOK, status)
+	suite.Equal(float64(0), response["ErrorCode"])
+	suite.Equal("OK", response["Message"])
+	suite.Equal("Bob <bob@example.com>, cora@example.com", response["To"])
+	suite.NotEmpty(response["SubmittedAt"])
+	messageID, _ := response["MessageID"].(string)
+	suite.NotEmpty(messageID)
+
+	mails := suite.mails()
+	suite.Require().Len(mails, 1)
+	mail := mails[0]
+	suite.Equal("alex@example.com", mail.EnvelopeFrom)
+	suite.Equal([]string{"bob@example.com", "cora@example.com", "dan@example.com"}, mail.EnvelopeTo)
+	suite.Equal(`"Bob" <bob@example.com>, cora@example.com`, mail.Header.Get("To"))
+	suite.Empty(mail.Header.Get("Bcc"))
+	suite.Equal("1", mail.Header.Get("X-Priority"))
+	suite.Equal("billing", mail.Header.Get("X-PM-Tag"))
+	suite.Equal("42", mail.Header.Get("X-PM-Metadata-customer-id"))
+	suite.Equal(instances.Metadata{Provider: "postmark", Tags: []string{"billing"}, Variables: map[string]string{"customer-id": "42"}, MessageID: messageID}, mail.Metadata)
+
+	parts := mail.Parts()
+	suite.Require().Len(parts, 4)
+	suite.Equal("Your invoice", string(parts[0].Content))
+	suite.Equal("text/html", parts[1].ContentType)
+	suite.Equal("logo.png", parts[2].ContentID)
+	suite.Equal("invoice.pdf", parts[3].Filename)
+	suite.Equal("%PDF-1.4", string(parts[3].Content))
+}
+
+func (suite *HandlerTestSuite) TestEmail_Invalid() {
+	for _, test := range []struct {
+		body    string
+		code    float64
+		message string
+	}{
+		{`{"From": "alex@example.com", "TextBody": "Hi"}`, codeInvalidEmailRequest, "Zero recipients specified"},
+		{`{"From": "alex", "To": "bob@example.com", "TextBody": "Hi"}`, codeInvalidEmailRequest, "Invalid 'From' address: 'alex'."},
+		{`{"From": "alex@example.com", "To": "bob@example.com"}`, codeInvalidEmailRequest, "Provide either email TextBody or HtmlBody or both."},
+		{`{"From": `, codeInvalidJSON, "Received invalid JSON input."},
+	} {
+		var response map[string]interface{}
+		status := suite.post("/email", "server-token", test.body, &response)
+		suite.Equal(http.StatusUnprocessableEntity, status)
+		suite.Equal(test.code, response["ErrorCode"])
+		suite.Equal(test.message, response["Message"])
+	}
+
+	var response map[string]interface{}
+	suite.Equal(http.StatusUnauthorized, suite.post("/email", "", `{}`, &response))
+	suite.Equal(float64(codeInvalidToken), response["ErrorCode"])
+	suite.Equal(http.StatusUnauthorized, suite.post("/email", "wrong-token", `{}`, &response))
+	suite.Empty(suite.mails())
+}
+
+func (suite *HandlerTestSuite) TestBatch() {
+	var response []map[string]interface{}
+	status := suite.post("/email/batch", "server-token", `[
+		{"From": "alex@example.com", "To": "bob@example.com", "Subject": "First", "TextBody": "Hi Bob"},
+		{"From": "alex@example.com", "TextBody": "No recipient"},
+		{"From": "alex@example.com", "To": "cora@example.com", "Subject": "Third", "TextBody": "Hi Cora"}
+	]`, &response)
+	suite.Equal(http.StatusOK, status)
+	suite.Require().Len(response, 3)
+	suite.Equal(float64(0), response[0]["ErrorCode"])
+	suite.Equal(float64(codeInvalidEmailRequest), response[1]["ErrorCode"])
+	suite.Nil(response[1]["MessageID"])
+	suite.Equal("cora@example.com", response[2]["To"])
+
+	mails := suite.mails()
+	suite.Require().Len(mails, 2, "Failed messages don't stop the others")
+	suite.Equal("First", mails[0].Header.Get("Subject"))
+	suite.Equal("Third", mails[1].Header.Get("Subject"))
+}
+
+func (suite *HandlerTestSuite) TestWithTemplate() {
+	template := `{"Subject": "Welcome {{name}}", "HtmlBody": "<p>Hello {{name}}</p>", "TextBody": "Hello {{name}}{{#each items}}, {{this}}{{/each}}"}`
+	suite.Require().Nil(os.WriteFile(filepath.Join(suite.templateDir, "welcome.json"), []byte(template), 0644))
+	suite.Require().Nil(os.WriteFile(filepath.Join(suite.templateDir, "1234.json"), []byte(template), 0644))
+
+	for _, reference := range []string{`"TemplateAlias": "welcome"`, `"TemplateId": 1234`} {
+		var response map[string]interface{}
+		status := suite.post("/email/withTemplate", "server-token", `{
+			`+reference+`,
+			"TemplateModel": {"name": "Bob", "items": ["a", "b"]},
+			"From": "alex@example.com",
+			"To": "bob@example.com"
+		}`, &response)
+		suite.Equal(http.StatusOK, status, response["Message"])
+	}
+	mails := suite.mails()
+	suite.Require().Len(mails, 2)
+	suite.Equal("Welcome Bob", mails[0].Header.Get("Subject"))
+	suite.Equal("Hello Bob, a, b", string(mails[0].Parts()[0].Content))
+	suite.Equal("<p>Hello Bob</p>", string(mails[1].Parts()[1].Content))
+
+	var response map[string]interface{}
+	status := suite.post("/email/withTemplate", "server-token", `{"TemplateAlias": "missing", "From": "alex@example.com", "To": "bob@example.com"}`, &response)
+	suite.Equal(http.StatusUnprocessableEntity, status)
+	suite.Equal(float64(codeTemplateNotFound), response["ErrorCode"])
+}
+
+func TestHandlerTestSuite(t *testing.T) {
+	suite.Run(t, new(HandlerTestSuite))
+}
@@ -0,0 +1,72 @@
+package postmark
+
+import (
+	"encoding/json"
+	"github.com/da-coda/mailpie/pkg/handlebars"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//template is a template of the template directory. Every template is a JSON file named like the template id or alias,
+//with the fields Subject, HtmlBody and TextBody like the templates API of Postmark
+type template struct {
+	subject *handlebars.Template
+	html    *handlebars.Template
+	text    *handlebars.Template
+}
+
+//templateNotFoundError is returned by loadTemplate if the template directory has no template with the name
+var templateNotFoundError = errors.New("template not found")
+
+//loadTemplate reads the template on every request, so that templates can be edited without restarting Mailpie
+func loadTemplate(dir string, name string) (*template, error) {
+	if dir == "" || name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return nil, templateNotFoundError
+	}
+	source, err := os.ReadFile(filepath.Join(dir, name+".json"))
+	if os.IsNotExist(err) {
+		return nil, templateNotFoundError
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read template %s", name)
+	}
+	var file struct {
+		Subject  string
+		HtmlBody string
+		TextBody string
+	}
+	if err := json.Unmarshal(source, &file); err != nil {
+		return nil, errors.Wrapf(err, "unable to parse template %s", name)
+	}
+	t := &template{}
+	parts := []struct {
+		source string
+		parsed **handlebars.Template
+	}{{file.Subject, &t.subject}, {file.HtmlBody, &t.html}, {file.TextBody, &t.text}}
+	for _, part := range parts {
+		if part.source == "" {
+			continue
+		}
+		*part.parsed, err = handlebars.Parse(part.source)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to parse template %s", name)
+		}
+	}
+	return t, nil
+}
+
+//render fills the subject and bodies of the message with the model
+func (t *template) render(e email, model map[string]interface{}) email {
+	for _, part := range []struct {
+		parsed   *handlebars.Template
+		rendered *string
+	}{{t.subject, &e.Subject}, {t.html, &e.HtmlBody}, {t.text, &e.TextBody}} {
+		if part.parsed != nil {
+			*part.rendered = part.parsed.Execute(model)
+		}
+	}
+	e.Subject = strings.TrimSpace(e.Subject)
+	return e
+}
@@ -0,0 +1,162 @@
+package sendgrid
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/da-coda/mailpie/pkg/handler"
+	"github.com/pkg/errors"
+	"gopkg.in/mail.v2"
+	"io"
+	"sort"
+	"strings"
+)
+
+//build converts a personalization of the request into a MIME mail. Only dynamic templates (ids starting with d-)
+//ignore substitutions, they use dynamic_template_data instead
+func build(request *mailSend, p personalization, t *template, messageID string) (handler.Envelope, error) {
+	m := mail.NewMessage()
+	from := request.From
+	if p.From != nil {
+		from = p.From
+	}
+	m.SetAddressHeader("From", from.Email, from.Name)
+	m.SetHeader("To", formatAddresses(m, p.To)...)
+	if len(p.Cc) > 0 {
+		m.SetHeader("Cc", formatAddresses(m, p.Cc)...)
+	}
+	if request.ReplyTo != nil {
+		m.SetAddressHeader("Reply-To", request.ReplyTo.Email, request.ReplyTo.Name)
+	} else if len(request.ReplyToList) > 0 {
+		m.SetHeader("Reply-To", formatAddresses(m, request.ReplyToList)...)
+	}
+	m.SetHeader("Message-ID", "<"+messageID+">")
+
+	subject := p.Subject
+	if subject == "" {
+		subject = request.Subject
+	}
+	contents := request.Content
+	if t != nil {
+		templateSubject, templateContents := t.render(p.DynamicTemplateData)
+		if subject == "" {
+			subject = templateSubject
+		}
+		contents = templateContents
+	}
+	if !strings.HasPrefix(request.TemplateID, "d-") {
+		subject = substitute(subject, p.Substitutions)
+		substituted := make([]content, len(contents))
+		for i, c := range contents {
+			substituted[i] = content{Type: c.Type, Value: substitute(c.Value, p.Substitutions)}
+		}
+		contents = substituted
+	}
+	m.SetHeader("Subject", subject)
+
+	for _, headers := range []map[string]string{request.Headers, p.Headers} {
+		for name, value := range headers {
+			m.SetHeader(name, value)
+		}
+	}
+	smtpAPI, err := smtpAPIHeader(request, p)
+	if err != nil {
+		return handler.Envelope{}, err
+	}
+	if smtpAPI != "" {
+		m.SetHeader("X-SMTPAPI", smtpAPI)
+	}
+
+	for i, c := range contents {
+		if i == 0 {
+			m.SetBody(c.Type, c.Value)
+		} else {
+			m.AddAlternative(c.Type, c.Value)
+		}
+	}
+	for _, a := range request.Attachments {
+		addAttachment(m, a)
+	}
+
+	var buffer bytes.Buffer
+	_, err = m.WriteTo(&buffer)
+	if err != nil {
+		return handler.Envelope{}, errors.Wrap(err, "unable to write mail")
+	}
+	var to []string
+	for _, list := range [][]address{p.To, p.Cc, p.Bcc} {
+		for _, recipient := range list {
+			to = append(to, recipient.Email)
+		}
+	}
+	return handler.Envelope{From: from.Email, To: to, Data: buffer.Bytes()}, nil
+}
+
+func formatAddresses(m *mail.Message, addresses []address) []string {
+	formatted := make([]string, len(addresses))
+	for i, a := range addresses {
+		formatted[i] = m.FormatAddress(a.Email, a.Name)
+	}
+	return formatted
+}
+
+//substitute replaces the keys of the substitutions with their values. Longer keys are replaced first, so that a key
+//which is the prefix of another one doesn't break it
+func substitute(text string, substitutions map[string]string) string {
+	if len(substitutions) == 0 {
+		return text
+	}
+	keys := make([]string, 0, len(substitutions))
+	for key := range substitutions {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return len(keys[i]) > len(keys[j]) })
+	pairs := make([]string, 0, 2*len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key, substitutions[key])
+	}
+	return strings.NewReplacer(pairs...).Replace(text)
+}
+
+//smtpAPIHeader returns the categories and custom arguments in the format of the X-SMTPAPI header, which SendGrid uses
+//to pass them via SMTP. Custom arguments of the personalization override those of the message
+func smtpAPIHeader(request *mailSend, p personalization) (string, error) {
+	uniqueArgs := make(map[string]interface{})
+	for _, customArgs := range []map[string]interface{}{request.CustomArgs, p.CustomArgs} {
+		for name, value := range customArgs {
+			uniqueArgs[name] = value
+		}
+	}
+	if len(request.Categories) == 0 && len(uniqueArgs) == 0 {
+		return "", nil
+	}
+	header := struct {
+		Category   []string               `json:"category,omitempty"`
+		UniqueArgs map[string]interface{} `json:"unique_args,omitempty"`
+	}{request.Categories, uniqueArgs}
+	encoded, err := json.Marshal(header)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to encode X-SMTPAPI header")
+	}
+	return string(encoded), nil
+}
+
+//addAttachment attaches or, with disposition inline, embeds the attachment. The content was validated to be base64
+func addAttachment(m *mail.Message, a attachment) {
+	decoded, _ := base64.StdEncoding.DecodeString(a.Content)
+	header := make(map[string][]string)
+	if a.Type != "" {
+		header["Content-Type"] = []string{fmt.Sprintf("%s; name=%q", a.Type, a.Filename)}
+	}
+	copyFunc := mail.SetCopyFunc(func(w io.Writer) error {
+		_, err := w.Write(decoded)
+		return err
+	})
+	if a.Disposition == "inline" {
+		header["Content-ID"] = []string{"<" + a.ContentID + ">"}
+		m.Embed(a.Filename, copyFunc, mail.SetHeader(header))
+		return
+	}
+	m.Attach(a.Filename, copyFunc, mail.SetHeader(header))
+}
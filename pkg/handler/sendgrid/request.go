@@ -0,0 +1,294 @@
+package sendgrid
+
+import (
+	"encoding/base64"
+	"fmt"
+	gomail "net/mail"
+	"sort"
+	"strings"
+)
+
+//helpURL is the documentation of the validation errors, SendGrid links the section of the field in every error
+const helpURL = "http://sendgrid.com/docs/API_Reference/Web_API_v3/Mail/errors.html#"
+
+const maxPersonalizations = 1000
+const maxRecipients = 1000
+const maxCategories = 10
+const maxCategoryLength = 255
+
+//reservedHeaders can't be set with the headers of a message or personalization
+var reservedHeaders = map[string]bool{"x-sg-id": true, "x-sg-eid": true, "received": true, "dkim-signature": true,
+	"content-type": true, "content-transfer-encoding": true, "to": true, "from": true, "subject": true, "reply-to": true,
+	"cc": true, "bcc": true}
+
+type address struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+type personalization struct {
+	To                  []address              `json:"to"`
+	Cc                  []address              `json:"cc"`
+	Bcc                 []address              `json:"bcc"`
+	From                *address               `json:"from"`
+	Subject             string                 `json:"subject"`
+	Headers             map[string]string      `json:"headers"`
+	Substitutions       map[string]string      `json:"substitutions"`
+	DynamicTemplateData map[string]interface{} `json:"dynamic_template_data"`
+	CustomArgs          map[string]interface{} `json:"custom_args"`
+	SendAt              int64                  `json:"send_at"`
+}
+
+type content struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type attachment struct {
+	Content     string `json:"content"`
+	Type        string `json:"type"`
+	Filename    string `json:"filename"`
+	Disposition string `json:"disposition"`
+	ContentID   string `json:"content_id"`
+}
+
+//mailSend is the body of POST /v3/mail/send
+type mailSend struct {
+	Personalizations []personalization      `json:"personalizations"`
+	From             *address               `json:"from"`
+	ReplyTo          *address               `json:"reply_to"`
+	ReplyToList      []address              `json:"reply_to_list"`
+	Subject          string                 `json:"subject"`
+	Content          []content              `json:"content"`
+	Attachments      []attachment           `json:"attachments"`
+	TemplateID       string                 `json:"template_id"`
+	Headers          map[string]string      `json:"headers"`
+	Categories       []string               `json:"categories"`
+	CustomArgs       map[string]interface{} `json:"custom_args"`
+	SendAt           int64                  `json:"send_at"`
+	BatchID          string                 `json:"batch_id"`
+	MailSettings     struct {
+		SandboxMode struct {
+			Enable bool `json:"enable"`
+		} `json:"sandbox_mode"`
+	} `json:"mail_settings"`
+}
+
+//apiError is an entry of the errors list SendGrid responds with. Field and help are null for errors of the request
+//as a whole
+type apiError struct {
+	Message string  `json:"message"`
+	Field   *string `json:"field"`
+	Help    *string `json:"help"`
+}
+
+func newAPIError(message string) apiError {
+	return apiError{Message: message}
+}
+
+//validation collects the errors of a request, SendGrid reports all of them at once
+type validation struct {
+	errors []apiError
+}
+
+//add adds an error for the field. The topic is the section of the field in the documentation
+func (v *validation) add(field string, topic string, format string, args ...interface{}) {
+	help := helpURL + topic
+	v.errors = append(v.errors, apiError{Message: fmt.Sprintf(format, args...), Field: &field, Help: &help})
+}
+
+func validAddress(email string) bool {
+	parsed, err := gomail.ParseAddress(email)
+	return err == nil && parsed.Address == email
+}
+
+//validate checks the request like SendGrid does. The template is nil if the request has no template_id or it could
+//not be loaded, in which case an error is reported
+func (v *validation) validate(request *mailSend, template *template) {
+	v.validatePersonalizations(request)
+	if request.From == nil || request.From.Email == "" {
+		v.add("from.email", "message.from", "The from object must be provided for every email send. It is an object that requires the email parameter, but may also contain a name parameter.  e.g. {\"email\" : \"example@example.com\"}  or {\"email\" : \"example@example.com\", \"name\" : \"Example Recipient\"}.")
+	} else if !validAddress(request.From.Email) {
+		v.add("from.email", "message.from", "The from email does not contain a valid address.")
+	}
+	if request.ReplyTo != nil && !validAddress(request.ReplyTo.Email) {
+		v.add("reply_to.email", "message.reply_to", "The reply_to email does not contain a valid address.")
+	}
+	if request.ReplyTo != nil && len(request.ReplyToList) > 0 {
+		v.add("reply_to", "message.reply_to", "The reply_to and reply_to_list fields are mutually exclusive. Please use only one of them.")
+	}
+	for i, replyTo := range request.ReplyToList {
+		if !validAddress(replyTo.Email) {
+			v.add(fmt.Sprintf("reply_to_list.%d.email", i), "message.reply_to_list", "Does not contain a valid address.")
+		}
+	}
+
+	templateSubject := template != nil && template.subject != nil
+	if request.Subject == "" && !templateSubject {
+		for _, p := range request.Personalizations {
+			if p.Subject == "" {
+				v.add("subject", "message.subject", "The subject is required. You can get around this requirement if you use a template with a subject defined or if every personalization has a subject defined.")
+				break
+			}
+		}
+	}
+	if request.TemplateID == "" {
+		v.validateContent(request.Content)
+	}
+	v.validateAttachments(request.Attachments)
+	v.validateCategories(request.Categories)
+	v.validateHeaders("headers", request.Headers)
+	v.validateCustomArgs("custom_args", request.CustomArgs)
+}
+
+func (v *validation) validatePersonalizations(request *mailSend) {
+	if len(request.Personalizations) == 0 {
+		v.add("personalizations", "message.personalizations", "The personalizations field is required and must have at least one personalization.")
+		return
+	}
+	if len(request.Personalizations) > maxPersonalizations {
+		v.add("personalizations", "message.personalizations", "The personalizations field is limited to %d personalizations per API request. You have included %d personalizations.", maxPersonalizations, len(request.Personalizations))
+	}
+	recipients := 0
+	for i, p := range request.Personalizations {
+		field := fmt.Sprintf("personalizations.%d", i)
+		if len(p.To) == 0 {
+			v.add(field+".to", "message.personalizations.to", "The to array is required for all personalization objects, and must have at least one email object with a valid email address.")
+		}
+		seen := make(map[string]bool)
+		duplicate := false
+		for _, list := range []struct {
+			name      string
+			addresses []address
+		}{{"to", p.To}, {"cc", p.Cc}, {"bcc", p.Bcc}} {
+			for j, recipient := range list.addresses {
+				recipients++
+				if !validAddress(recipient.Email) {
+					v.add(fmt.Sprintf("%s.%s.%d.email", field, list.name, j), "message.personalizations."+list.name, "Does not contain a valid address.")
+					continue
+				}
+				email := strings.ToLower(recipient.Email)
+				if seen[email] && !duplicate {
+					duplicate = true
+					v.add(field+"."+list.name, "message.personalizations", "Each email address in the personalization block should be unique between to, cc, and bcc. We found the first duplicate instance of [%s] in the %s.%s field.", recipient.Email, field, list.name)
+				}
+				seen[email] = true
+			}
+		}
+		if p.From != nil && !validAddress(p.From.Email) {
+			v.add(field+".from.email", "message.personalizations.from", "The from email does not contain a valid address.")
+		}
+		v.validateHeaders(field+".headers", p.Headers)
+		v.validateCustomArgs(field+".custom_args", p.CustomArgs)
+	}
+	if recipients > maxRecipients {
+		v.add("personalizations", "message.personalizations", "The total number of recipients must be less than %d. This includes all recipients defined within the to, cc, and bcc parameters, across each object that you include in the personalizations array.", maxRecipients)
+	}
+}
+
+func (v *validation) validateContent(contents []content) {
+	if len(contents) == 0 {
+		v.add("content", "message.content", "Unless a valid template_id is provided, the content parameter is required. There must be at least one defined content block. We typically suggest both text/plain and text/html blocks are included, but only one block is required.")
+		return
+	}
+	ordered := true
+	for i, c := range contents {
+		if c.Type == "" {
+			v.add(fmt.Sprintf("content.%d.type", i), "message.content.type", "The content type cannot contain ';', or CRLF characters. The content type should be a MIME type, e.g. text/plain or text/html.")
+		}
+		if c.Value == "" {
+			v.add(fmt.Sprintf("content.%d.value", i), "message.content.value", "The content value must be a string at least one character in length.")
+		}
+		switch strings.ToLower(c.Type) {
+		case "text/plain":
+			ordered = ordered && i == 0
+		case "text/html":
+			ordered = ordered && (i == 0 || (i == 1 && strings.ToLower(contents[0].Type) == "text/plain"))
+		}
+	}
+	if !ordered {
+		v.add("content", "message.content", "If present, text/plain content must be first, followed by text/html, followed by any other content.")
+	}
+}
+
+func (v *validation) validateAttachments(attachments []attachment) {
+	for i, a := range attachments {
+		field := fmt.Sprintf("attachments.%d", i)
+		if a.Content == "" {
+			v.add(field+".content", "message.attachments.content", "The attachment content is required.")
+		} else if _, err := base64.StdEncoding.DecodeString(a.Content); err != nil {
+			v.add(field+".content", "message.attachments.content", "The attachment content must be base64 encoded.")
+		}
+		if a.Filename == "" {
+			v.add(field+".filename", "message.attachments.filename", "The attachment filename parameter is required.")
+		}
+		switch a.Disposition {
+		case "", "attachment":
+		case "inline":
+			if a.ContentID == "" {
+				v.add(field+".content_id", "message.attachments.content_id", "The content_id parameter is required if your attachment disposition is \"inline\".")
+			}
+		default:
+			v.add(field+".disposition", "message.attachments.disposition", "The disposition of your attachment can be either \"inline\" or \"attachment\". Supported values are \"inline\" or \"attachment\".")
+		}
+	}
+}
+
+func (v *validation) validateCategories(categories []string) {
+	if len(categories) > maxCategories {
+		v.add("categories", "message.categories", "Too many categories on this message. The maximum number is %d.", maxCategories)
+	}
+	seen := make(map[string]bool)
+	for i, category := range categories {
+		if len(category) > maxCategoryLength {
+			v.add(fmt.Sprintf("categories.%d", i), "message.categories", "A category cannot have more than %d characters.", maxCategoryLength)
+		}
+		if seen[category] {
+			v.add("categories", "message.categories", "The categories on this message must be unique.")
+		}
+		seen[category] = true
+	}
+}
+
+func (v *validation) validateHeaders(field string, headers map[string]string) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if reservedHeaders[strings.ToLower(name)] {
+			v.add(field, "message.headers", "The header %s is reserved and cannot be set with the headers parameter.", name)
+		}
+	}
+}
+
+//validateCustomArgs checks that all values are strings, SendGrid refuses numbers and other JSON types
+func (v *validation) validateCustomArgs(field string, customArgs map[string]interface{}) {
+	names := make([]string, 0, len(customArgs))
+	for name := range customArgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := customArgs[name]
+		if _, isString := value.(string); isString {
+			continue
+		}
+		given := "object"
+		switch value := value.(type) {
+		case nil:
+			given = "null"
+		case bool:
+			given = "boolean"
+		case float64:
+			given = "number"
+			if value == float64(int64(value)) {
+				given = "integer"
+			}
+		case []interface{}:
+			given = "array"
+		}
+		v.add(field+"."+name, "message.custom_args", "Invalid type. Expected: string, given: %s.", given)
+	}
+}
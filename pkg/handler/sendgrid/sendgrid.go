@@ -0,0 +1,86 @@
+//Package sendgrid emulates the Mail Send endpoint of the SendGrid v3 API. Accepted requests are converted to MIME mails,
+//one per personalization, and stored like mails received via SMTP
+package sendgrid
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/da-coda/mailpie/internal/apiutil"
+	"github.com/da-coda/mailpie/pkg/handler"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+)
+
+type Handler struct {
+	smtpHandler *handler.SmtpHandler
+	templateDir string
+}
+
+//NewHandler creates the SendGrid API which stores mails via the smtpHandler. Dynamic templates are loaded from
+//templateDir, see template for the layout
+func NewHandler(smtpHandler *handler.SmtpHandler, templateDir string) *Handler {
+	return &Handler{smtpHandler: smtpHandler, templateDir: templateDir}
+}
+
+//Register adds the SendGrid routes to the router
+func (h *Handler) Register(router *mux.Router) {
+	router.HandleFunc("/v3/mail/send", h.send).Methods("POST")
+}
+
+//send handles POST /v3/mail/send. Any API key is accepted, but like SendGrid a key is required
+func (h *Handler) send(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		writeErrors(w, http.StatusUnauthorized, []apiError{newAPIError("authorization required")})
+		return
+	}
+	var request mailSend
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		writeErrors(w, http.StatusBadRequest, []apiError{newAPIError("Bad Request")})
+		return
+	}
+
+	v := &validation{}
+	var t *template
+	if request.TemplateID != "" {
+		t, err = loadTemplate(h.templateDir, request.TemplateID)
+		if err != nil {
+			logrus.WithError(err).WithField("templateDir", h.templateDir).WithField("templateID", request.TemplateID).Warn("Unable to load SendGrid template")
+			v.add("template_id", "message.template_id", "The template_id must be a valid GUID or a valid legacy template id")
+		}
+	}
+	v.validate(&request, t)
+	if len(v.errors) > 0 {
+		writeErrors(w, http.StatusBadRequest, v.errors)
+		return
+	}
+	//like SendGrid, the sandbox mode validates the request without sending it
+	if request.MailSettings.SandboxMode.Enable {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	//the id of the X-Message-Id header, the Message-ID of every personalization is derived from it
+	messageID := apiutil.NewToken(16)
+	for i, p := range request.Personalizations {
+		mail, err := build(&request, p, t, fmt.Sprintf("%s.%d@sendgrid.mailpie", messageID, i))
+		if err == nil {
+			err = h.smtpHandler.StoreEnvelope(mail)
+		}
+		if err != nil {
+			logrus.WithError(err).Error("Unable to store mail in SendGrid handler")
+			writeErrors(w, http.StatusInternalServerError, []apiError{newAPIError("internal error")})
+			return
+		}
+	}
+	w.Header().Set("X-Message-Id", messageID)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func writeErrors(w http.ResponseWriter, status int, errors []apiError) {
+	apiutil.WriteJSON(w, status, struct {
+		Errors []apiError `json:"errors"`
+	}{errors})
+}
@@ -0,0 +1,221 @@
+package sendgrid
+
+import (
+	"encoding/json"
+	"github.com/da-coda/mailpie/pkg/event"
+	"github.com/da-coda/mailpie/pkg/handler"
+	"github.com/da-coda/mailpie/pkg/instances"
+	"github.com/da-coda/mailpie/pkg/store"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/suite"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type HandlerTestSuite struct {
+	suite.Suite
+	mailStore   *store.MailStore
+	templateDir string
+	server      *httptest.Server
+}
+
+func (suite *HandlerTestSuite) SetupTest() {
+	suite.mailStore = store.CreateMailStore(event.CreateOrGet())
+	smtpHandler := handler.CreateSmtpHandler(suite.mailStore)
+	suite.templateDir = suite.T().TempDir()
+	router := mux.NewRouter()
+	NewHandler(&smtpHandler, suite.templateDir).Register(router)
+	suite.server = httptest.NewServer(router)
+}
+
+func (suite *HandlerTestSuite) TearDownTest() {
+	suite.server.Close()
+}
+
+func (suite *HandlerTestSuite) send(body string) (*http.Response, []apiError) {
+	request, err := http.NewRequest(http.MethodPost, suite.server.URL+"/v3/mail/send", strings.NewReader(body))
+	suite.Require().Nil(err)
+	request.Header.Set("Authorization", "Bearer SG.test")
+	resp, err := http.DefaultClient.Do(request)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+	var response struct {
+		Errors []apiError `json:"errors"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&response)
+	return resp, response.Errors
+}
+
+//mails returns the stored mails in the order they were sent
+func (suite *HandlerTestSuite) mails() []instances.Mail {
+	var mails []instances.Mail
+	for _, key := range suite.mailStore.KeysByArrival() {
+		mail, err := suite.mailStore.GetSingle(key)
+		suite.Require().Nil(err)
+		mails = append(mails, mail)
+	}
+	return mails
+}
+
+func fields(errors []apiError) []string {
+	var fields []string
+	for _, e := range errors {
+		if e.Field != nil {
+			fields = append(fields, *e.Field)
+		}
+	}
+	return fields
+}
+
+func (suite *HandlerTestSuite) TestSend() {
+	resp, errors := suite.send(`{
+		"personalizations": [
+			{"to": [{"email": "bob@example.com", "name": "Bob"}], "cc": [{"email": "cora@example.com"}], "bcc": [{"email": "dan@example.com"}],
+			 "substitutions": {"-name-": "Bob"}, "custom_args": {"order": "42"}},
+			{"to": [{"email": "eve@example.com"}], "subject": "Own subject", "substitutions": {"-name-": "Eve"}}
+		],
+		"from": {"email": "alex@example.com", "name": "Alex"},
+		"reply_to": {"email": "support@example.com"},
+		"subject": "Hello -name-",
+		"content": [{"type": "text/plain", "value": "Hi -name-"}, {"type": "text/html", "value": "<p>Hi -name-</p>"}],
+		"attachments": [{"content": "JVBERi0xLjQ=", "type": "application/pdf", "filename": "invoice.pdf"}],
+		"headers": {"X-Campaign": "welcome"},
+		"categories": ["welcome"]
+	}`)
+	suite.Nil(errors)
+	suite.Equal(http.StatusAccepted, resp.StatusCode)
+	suite.Len(resp.Header.Get("X-Message-Id"), 22)
+
+	mails := suite.mails()
+	suite.Require().Len(mails, 2, "Every personalization is a mail")
+	bob := mails[0]
+	suite.Equal("alex@example.com", bob.EnvelopeFrom)
+	suite.Equal([]string{"bob@example.com", "cora@example.com", "dan@example.com"}, bob.EnvelopeTo)
+	suite.Equal(`"Alex" <alex@example.com>`, bob.Header.Get("From"))
+	suite.Equal(`"Bob" <bob@example.com>`, bob.Header.Get("To"))
+	suite.Equal("cora@example.com", bob.Header.Get("Cc"))
+	suite.Empty(bob.Header.Get("Bcc"))
+	suite.Equal("support@example.com", bob.Header.Get("Reply-To"))
+	suite.Equal("Hello Bob", bob.Header.Get("Subject"))
+	suite.Equal("welcome", bob.Header.Get("X-Campaign"))
+	suite.JSONEq(`{"category": ["welcome"], "unique_args": {"order": "42"}}`, bob.Header.Get("X-SMTPAPI"))
+	plain, found := bob.FindPart("text/plain")
+	suite.True(found)
+	suite.Equal("Hi Bob", string(plain.Content))
+	html, found := bob.FindPart("text/html")
+	suite.True(found)
+	suite.Equal("<p>Hi Bob</p>", string(html.Content))
+	parts := bob.Parts()
+	suite.Require().Len(parts, 3)
+	suite.True(parts[2].IsAttachment())
+	suite.Equal("invoice.pdf", parts[2].Filename)
+	suite.Equal("%PDF-1.4", string(parts[2].Content))
+
+	eve := mails[1]
+	suite.Equal("Own subject", eve.Header.Get("Subject"))
+	plain, _ = eve.FindPart("text/plain")
+	suite.Equal("Hi Eve", string(plain.Content))
+}
+
+func (suite *HandlerTestSuite) TestSend_InlineAttachment() {
+	resp, errors := suite.send(`{
+		"personalizations": [{"to": [{"email": "bob@example.com"}]}],
+		"from": {"email": "alex@example.com"}, "subject": "Logo",
+		"content": [{"type": "text/html", "value": "<img src=\"cid:logo\">"}],
+		"attachments": [{"content": "UE5H", "type": "image/png", "filename": "logo.png", "disposition": "inline", "content_id": "logo"}]
+	}`)
+	suite.Nil(errors)
+	suite.Equal(http.StatusAccepted, resp.StatusCode)
+	parts := suite.mails()[0].Parts()
+	suite.Require().Len(parts, 2)
+	suite.Equal("logo", parts[1].ContentID)
+	suite.Equal("inline", parts[1].Disposition)
+	suite.Equal("PNG", string(parts[1].Content))
+}
+
+func (suite *HandlerTestSuite) TestSend_DynamicTemplate() {
+	dir := filepath.Join(suite.templateDir, "d-welcome")
+	suite.Require().Nil(os.Mkdir(dir, 0700))
+	suite.Require().Nil(os.WriteFile(filepath.Join(dir, "subject.hbs"), []byte("Welcome {{user.name}}\n"), 0600))
+	suite.Require().Nil(os.WriteFile(filepath.Join(dir, "html.hbs"), []byte("<ul>{{#each items}}<li>{{this}}</li>{{/each}}</ul>"), 0600))
+	suite.Require().Nil(os.WriteFile(filepath.Join(dir, "text.hbs"), []byte("{{#if user.premium}}Premium{{else}}Free{{/if}}"), 0600))
+
+	resp, errors := suite.send(`{
+		"personalizations": [{"to": [{"email": "bob@example.com"}], "dynamic_template_data": {"user": {"name": "Bob", "premium": true}, "items": ["a", "<b>"]}}],
+		"from": {"email": "alex@example.com"},
+		"template_id": "d-welcome"
+	}`)
+	suite.Nil(errors)
+	suite.Equal(http.StatusAccepted, resp.StatusCode)
+	mail := suite.mails()[0]
+	suite.Equal("Welcome Bob", mail.Header.Get("Subject"))
+	plain, _ := mail.FindPart("text/plain")
+	suite.Equal("Premium", string(plain.Content))
+	html, _ := mail.FindPart("text/html")
+	suite.Equal("<ul><li>a</li><li>&lt;b&gt;</li></ul>", string(html.Content))
+
+	resp, errors = suite.send(`{"personalizations": [{"to": [{"email": "bob@example.com"}]}], "from": {"email": "alex@example.com"}, "template_id": "d-missing"}`)
+	suite.Equal(http.StatusBadRequest, resp.StatusCode)
+	suite.Contains(fields(errors), "template_id")
+}
+
+func (suite *HandlerTestSuite) TestSend_Validation() {
+	resp, errors := suite.send(`{
+		"personalizations": [{"to": [{"email": "bob@example.com"}], "cc": [{"email": "BOB@example.com"}, {"email": "not an address"}], "custom_args": {"order": 42}}],
+		"from": {"name": "Alex"},
+		"content": [{"type": "text/html", "value": "<p>Hi</p>"}, {"type": "text/plain", "value": ""}],
+		"attachments": [{"content": "not base64!", "type": "application/pdf"}],
+		"headers": {"Subject": "Reserved"},
+		"categories": ["a", "a"]
+	}`)
+	suite.Equal(http.StatusBadRequest, resp.StatusCode)
+	suite.Equal([]string{
+		"personalizations.0.cc",
+		"personalizations.0.cc.1.email",
+		"personalizations.0.custom_args.order",
+		"from.email",
+		"subject",
+		"content.1.value",
+		"content",
+		"attachments.0.content",
+		"attachments.0.filename",
+		"categories",
+		"headers",
+	}, fields(errors))
+	suite.Equal("Invalid type. Expected: string, given: integer.", errors[2].Message)
+	suite.Equal(helpURL+"message.subject", *errors[4].Help)
+	suite.Empty(suite.mails(), "Invalid requests are not stored")
+
+	resp, errors = suite.send(`{"personalizations": []}`)
+	suite.Equal(http.StatusBadRequest, resp.StatusCode)
+	suite.Contains(fields(errors), "personalizations")
+
+	resp, errors = suite.send(`{"personalizations": `)
+	suite.Equal(http.StatusBadRequest, resp.StatusCode)
+	suite.Equal([]apiError{{Message: "Bad Request"}}, errors)
+}
+
+func (suite *HandlerTestSuite) TestSend_SandboxMode() {
+	resp, errors := suite.send(`{
+		"personalizations": [{"to": [{"email": "bob@example.com"}]}], "from": {"email": "alex@example.com"}, "subject": "Test",
+		"content": [{"type": "text/plain", "value": "Hi"}], "mail_settings": {"sandbox_mode": {"enable": true}}
+	}`)
+	suite.Nil(errors)
+	suite.Equal(http.StatusOK, resp.StatusCode)
+	suite.Empty(suite.mails())
+}
+
+func (suite *HandlerTestSuite) TestSend_Unauthorized() {
+	resp, err := http.Post(suite.server.URL+"/v3/mail/send", "application/json", strings.NewReader("{}"))
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+	suite.Equal(http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestHandlerTestSuite(t *testing.T) {
+	suite.Run(t, new(HandlerTestSuite))
+}
@@ -0,0 +1,62 @@
+package sendgrid
+
+import (
+	"github.com/da-coda/mailpie/pkg/handlebars"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//template is a dynamic template of the template directory. Every template is a directory named like the template id
+//with the files subject.hbs, html.hbs and text.hbs, of which either html.hbs or text.hbs is required
+type template struct {
+	subject *handlebars.Template
+	html    *handlebars.Template
+	text    *handlebars.Template
+}
+
+//templateNotFoundError is returned by loadTemplate if the template directory has no template with the id
+var templateNotFoundError = errors.New("template not found")
+
+//loadTemplate reads the template on every request, so that templates can be edited without restarting Mailpie
+func loadTemplate(dir string, id string) (*template, error) {
+	if dir == "" || id == "" || id != filepath.Base(id) || strings.HasPrefix(id, ".") {
+		return nil, templateNotFoundError
+	}
+	t := &template{}
+	files := map[string]**handlebars.Template{"subject.hbs": &t.subject, "html.hbs": &t.html, "text.hbs": &t.text}
+	for name, parsed := range files {
+		source, err := os.ReadFile(filepath.Join(dir, id, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read %s of template %s", name, id)
+		}
+		*parsed, err = handlebars.Parse(string(source))
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to parse %s of template %s", name, id)
+		}
+	}
+	if t.html == nil && t.text == nil {
+		return nil, templateNotFoundError
+	}
+	return t, nil
+}
+
+//render returns the subject, which is empty if the template has none, and the content blocks of the template
+func (t *template) render(data map[string]interface{}) (string, []content) {
+	var subject string
+	if t.subject != nil {
+		subject = strings.TrimSpace(t.subject.Execute(data))
+	}
+	var contents []content
+	if t.text != nil {
+		contents = append(contents, content{Type: "text/plain", Value: t.text.Execute(data)})
+	}
+	if t.html != nil {
+		contents = append(contents, content{Type: "text/html", Value: t.html.Execute(data)})
+	}
+	return subject, contents
+}
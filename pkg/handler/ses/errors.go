@@ -0,0 +1,110 @@
+package ses
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/da-coda/mailpie/internal/apiutil"
+	"github.com/sirupsen/logrus"
+	"net/http"
+)
+
+//error codes of the SES v1 query API
+const (
+	codeValidationError            = "ValidationError"
+	codeInvalidParameterValue      = "InvalidParameterValue"
+	codeMessageRejected            = "MessageRejected"
+	codeTemplateDoesNotExist       = "TemplateDoesNotExist"
+	codeInvalidAction              = "InvalidAction"
+	codeMissingAuthenticationToken = "MissingAuthenticationToken"
+	codeIncompleteSignature        = "IncompleteSignature"
+	codeInvalidClientTokenID       = "InvalidClientTokenId"
+	codeSignatureDoesNotMatch      = "SignatureDoesNotMatch"
+	codeInternalFailure            = "InternalFailure"
+)
+
+//v2Errors maps the error codes to the status and exception type of SESv2
+var v2Errors = map[string]struct {
+	status        int
+	exceptionType string
+}{
+	codeValidationError:            {http.StatusBadRequest, "BadRequestException"},
+	codeInvalidParameterValue:      {http.StatusBadRequest, "BadRequestException"},
+	codeMessageRejected:            {http.StatusBadRequest, "MessageRejected"},
+	codeTemplateDoesNotExist:       {http.StatusNotFound, "NotFoundException"},
+	codeMissingAuthenticationToken: {http.StatusForbidden, "MissingAuthenticationTokenException"},
+	codeIncompleteSignature:        {http.StatusForbidden, "IncompleteSignatureException"},
+	codeInvalidClientTokenID:       {http.StatusForbidden, "UnrecognizedClientException"},
+	codeSignatureDoesNotMatch:      {http.StatusForbidden, "InvalidSignatureException"},
+	codeInternalFailure:            {http.StatusInternalServerError, "InternalFailure"},
+}
+
+//apiError is an error in the terms of the SES API. It is written as XML by the v1 query API and as JSON by SESv2
+type apiError struct {
+	code    string
+	message string
+}
+
+func newError(code string, message string) *apiError {
+	return &apiError{code: code, message: message}
+}
+
+func newErrorf(code string, format string, args ...interface{}) *apiError {
+	return newError(code, fmt.Sprintf(format, args...))
+}
+
+//status is the HTTP status of the v1 query API, which only differentiates client and server errors
+func (e *apiError) status() int {
+	switch e.code {
+	case codeMissingAuthenticationToken, codeIncompleteSignature, codeInvalidClientTokenID, codeSignatureDoesNotMatch:
+		return http.StatusForbidden
+	case codeInternalFailure:
+		return http.StatusInternalServerError
+	}
+	return http.StatusBadRequest
+}
+
+type xmlError struct {
+	XMLName   xml.Name `xml:"ErrorResponse"`
+	Namespace string   `xml:"xmlns,attr"`
+	Error     struct {
+		Type    string
+		Code    string
+		Message string
+	}
+	RequestID string `xml:"RequestId"`
+}
+
+func writeXMLError(w http.ResponseWriter, e *apiError) {
+	response := xmlError{Namespace: namespace, RequestID: apiutil.NewUUID()}
+	response.Error.Type = "Sender"
+	if e.status() >= http.StatusInternalServerError {
+		response.Error.Type = "Receiver"
+	}
+	response.Error.Code = e.code
+	response.Error.Message = e.message
+	writeXML(w, e.status(), response.RequestID, response)
+}
+
+//writeXML writes the response with the request id, which is also part of the body
+func writeXML(w http.ResponseWriter, status int, requestID string, body interface{}) {
+	w.Header().Set("Content-Type", "text/xml")
+	w.Header().Set("X-Amzn-RequestId", requestID)
+	w.WriteHeader(status)
+	_, err := w.Write([]byte(xml.Header))
+	if err == nil {
+		err = xml.NewEncoder(w).Encode(body)
+	}
+	if err != nil {
+		logrus.WithError(err).Error("Unable to write SES response")
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, e *apiError) {
+	v2Error, exists := v2Errors[e.code]
+	if !exists {
+		v2Error = v2Errors[codeValidationError]
+	}
+	w.Header().Set("X-Amzn-ErrorType", v2Error.exceptionType)
+	w.Header().Set("X-Amzn-RequestId", apiutil.NewUUID())
+	apiutil.WriteJSON(w, v2Error.status, map[string]string{"message": e.message})
+}
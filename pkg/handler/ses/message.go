@@ -0,0 +1,156 @@
+package ses
+
+import (
+	"bytes"
+	"github.com/da-coda/mailpie/pkg/handler"
+	"github.com/da-coda/mailpie/pkg/instances"
+	"gopkg.in/mail.v2"
+	gomail "net/mail"
+	"strings"
+)
+
+//message is what SendEmail, SendTemplatedEmail and the simple and template content of SESv2 have in common
+type message struct {
+	source     string
+	returnPath string
+	to         []string
+	cc         []string
+	bcc        []string
+	replyTo    []string
+	subject    string
+	text       string
+	html       string
+	//headers are only supported by SESv2
+	headers [][2]string
+}
+
+//build converts the message into a MIME mail with the message id of SES. The envelope sender is the return path if set
+func (msg message) build(messageID string) (handler.Envelope, *apiError) {
+	if msg.source == "" {
+		return handler.Envelope{}, newError(codeMessageRejected, "Missing required header 'From'.")
+	}
+	source, err := gomail.ParseAddress(msg.source)
+	if err != nil {
+		return handler.Envelope{}, newErrorf(codeInvalidParameterValue, "Illegal address: %s", msg.source)
+	}
+	lists := map[string][]*gomail.Address{}
+	for name, list := range map[string][]string{"To": msg.to, "Cc": msg.cc, "Bcc": msg.bcc, "Reply-To": msg.replyTo} {
+		var problem *apiError
+		lists[name], problem = parseAddresses(list)
+		if problem != nil {
+			return handler.Envelope{}, problem
+		}
+	}
+	recipients := append(append(emails(lists["To"]), emails(lists["Cc"])...), emails(lists["Bcc"])...)
+	if len(recipients) == 0 {
+		return handler.Envelope{}, newError(codeValidationError, "Destination must contain at least one of ToAddresses, CcAddresses or BccAddresses")
+	}
+	if msg.text == "" && msg.html == "" {
+		return handler.Envelope{}, newError(codeValidationError, "Message body must contain either Text or Html")
+	}
+	from := source.Address
+	if msg.returnPath != "" {
+		returnPath, err := gomail.ParseAddress(msg.returnPath)
+		if err != nil {
+			return handler.Envelope{}, newErrorf(codeInvalidParameterValue, "Illegal address: %s", msg.returnPath)
+		}
+		from = returnPath.Address
+	}
+
+	m := mail.NewMessage()
+	m.SetAddressHeader("From", source.Address, source.Name)
+	//Bcc is only part of the envelope, like SES removes it from the mail
+	for _, name := range []string{"To", "Cc", "Reply-To"} {
+		if len(lists[name]) > 0 {
+			m.SetHeader(name, formatAddresses(m, lists[name])...)
+		}
+	}
+	m.SetHeader("Subject", msg.subject)
+	for _, header := range msg.headers {
+		m.SetHeader(header[0], header[1])
+	}
+	m.SetHeader("Message-ID", "<"+messageID+"@email.amazonses.com>")
+	if msg.text != "" {
+		m.SetBody("text/plain", msg.text)
+	}
+	if msg.html != "" {
+		if msg.text != "" {
+			m.AddAlternative("text/html", msg.html)
+		} else {
+			m.SetBody("text/html", msg.html)
+		}
+	}
+	var buffer bytes.Buffer
+	if _, err := m.WriteTo(&buffer); err != nil {
+		return handler.Envelope{}, newError(codeInternalFailure, "Unable to build the message")
+	}
+	return handler.Envelope{From: from, To: recipients, Data: buffer.Bytes()}, nil
+}
+
+//buildRaw uses the raw mail as is. Without source and destinations, the envelope is taken from the headers of the mail
+func buildRaw(data []byte, source string, destinations []string) (handler.Envelope, *apiError) {
+	if len(data) == 0 {
+		return handler.Envelope{}, newError(codeValidationError, "RawMessage.Data must not be empty")
+	}
+	parsed, err := instances.ParseMail(data)
+	if err != nil {
+		return handler.Envelope{}, newError(codeInvalidParameterValue, "Unable to parse the raw message")
+	}
+	if source == "" {
+		source = parsed.Header.Get("From")
+	}
+	if source == "" {
+		return handler.Envelope{}, newError(codeMessageRejected, "Missing required header 'From'.")
+	}
+	from, err := gomail.ParseAddress(source)
+	if err != nil {
+		return handler.Envelope{}, newErrorf(codeInvalidParameterValue, "Illegal address: %s", source)
+	}
+	to, problem := parseAddresses(destinations)
+	if problem != nil {
+		return handler.Envelope{}, problem
+	}
+	if len(destinations) == 0 {
+		for _, name := range []string{"To", "Cc", "Bcc"} {
+			list, err := parsed.Header.AddressList(name)
+			if err == nil {
+				to = append(to, list...)
+			}
+		}
+	}
+	if len(to) == 0 {
+		return handler.Envelope{}, newError(codeMessageRejected, "Missing required header 'To'.")
+	}
+	return handler.Envelope{From: from.Address, To: emails(to), Data: data}, nil
+}
+
+func parseAddresses(values []string) ([]*gomail.Address, *apiError) {
+	var addresses []*gomail.Address
+	for _, value := range values {
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		address, err := gomail.ParseAddress(value)
+		if err != nil {
+			return nil, newErrorf(codeInvalidParameterValue, "Illegal address: %s", value)
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, nil
+}
+
+func emails(addresses []*gomail.Address) []string {
+	var emails []string
+	for _, address := range addresses {
+		emails = append(emails, address.Address)
+	}
+	return emails
+}
+
+func formatAddresses(m *mail.Message, addresses []*gomail.Address) []string {
+	formatted := make([]string, len(addresses))
+	for i, a := range addresses {
+		formatted[i] = m.FormatAddress(a.Address, a.Name)
+	}
+	return formatted
+}
@@ -0,0 +1,128 @@
+package ses
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"github.com/da-coda/mailpie/internal/apiutil"
+	"github.com/da-coda/mailpie/pkg/handler"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+type sendResult struct {
+	XMLName   xml.Name
+	MessageID string `xml:"MessageId"`
+}
+
+//sendResponse is the response of the send actions, which are named after the action like SendEmailResponse
+type sendResponse struct {
+	XMLName   xml.Name
+	Namespace string `xml:"xmlns,attr"`
+	Result    sendResult
+	RequestID string `xml:"ResponseMetadata>RequestId"`
+}
+
+//query handles the v1 query API, whose actions are sent as form, usually in the body of a POST
+func (h *Handler) query(w http.ResponseWriter, r *http.Request) {
+	if _, problem := h.readBody(r); problem != nil {
+		writeXMLError(w, problem)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeXMLError(w, newError(codeValidationError, "Unable to parse the request parameters"))
+		return
+	}
+	action := r.Form.Get("Action")
+	var mail handler.Envelope
+	var problem *apiError
+	messageID := newMessageID()
+	switch action {
+	case "SendEmail":
+		mail, problem = queryMessage(r.Form).build(messageID)
+	case "SendTemplatedEmail":
+		mail, problem = h.sendTemplatedEmail(r.Form, messageID)
+	case "SendRawEmail":
+		mail, problem = sendRawEmail(r.Form)
+	default:
+		problem = newErrorf(codeInvalidAction, "The action %s is not valid for this web service.", action)
+	}
+	if problem == nil {
+		problem = h.store(mail, messageID, tags(r.Form))
+	}
+	if problem != nil {
+		writeXMLError(w, problem)
+		return
+	}
+	response := sendResponse{
+		XMLName:   xml.Name{Local: action + "Response"},
+		Namespace: namespace,
+		Result:    sendResult{XMLName: xml.Name{Local: action + "Result"}, MessageID: messageID},
+		RequestID: apiutil.NewUUID(),
+	}
+	writeXML(w, http.StatusOK, response.RequestID, response)
+}
+
+//queryMessage reads the source, destination and reply addresses, which are shared by all send actions, and the
+//subject and body of SendEmail
+func queryMessage(form url.Values) message {
+	return message{
+		source:     form.Get("Source"),
+		returnPath: form.Get("ReturnPath"),
+		to:         members(form, "Destination.ToAddresses"),
+		cc:         members(form, "Destination.CcAddresses"),
+		bcc:        members(form, "Destination.BccAddresses"),
+		replyTo:    members(form, "ReplyToAddresses"),
+		subject:    form.Get("Message.Subject.Data"),
+		text:       form.Get("Message.Body.Text.Data"),
+		html:       form.Get("Message.Body.Html.Data"),
+	}
+}
+
+func (h *Handler) sendTemplatedEmail(form url.Values, messageID string) (handler.Envelope, *apiError) {
+	t, problem := loadTemplate(h.options.TemplateDir, form.Get("Template"))
+	if problem != nil {
+		return handler.Envelope{}, problem
+	}
+	msg := queryMessage(form)
+	if problem := t.render(&msg, form.Get("TemplateData")); problem != nil {
+		return handler.Envelope{}, problem
+	}
+	return msg.build(messageID)
+}
+
+func sendRawEmail(form url.Values) (handler.Envelope, *apiError) {
+	data, err := base64.StdEncoding.DecodeString(form.Get("RawMessage.Data"))
+	if err != nil {
+		return handler.Envelope{}, newError(codeInvalidParameterValue, "RawMessage.Data must be base64 encoded")
+	}
+	return buildRaw(data, form.Get("Source"), members(form, "Destinations"))
+}
+
+//members reads a list of the query API, which is sent as <prefix>.member.1, <prefix>.member.2 and so on
+func members(form url.Values, prefix string) []string {
+	var values []string
+	for i := 1; ; i++ {
+		value, exists := form[prefix+".member."+strconv.Itoa(i)]
+		if !exists {
+			return values
+		}
+		values = append(values, value...)
+	}
+}
+
+//tags reads the message tags, which are sent as Tags.member.N.Name and Tags.member.N.Value
+func tags(form url.Values) map[string]string {
+	var tags map[string]string
+	for i := 1; ; i++ {
+		prefix := "Tags.member." + strconv.Itoa(i)
+		name := form.Get(prefix + ".Name")
+		if name == "" {
+			return tags
+		}
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		tags[name] = form.Get(prefix + ".Value")
+	}
+}
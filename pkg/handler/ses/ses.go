@@ -0,0 +1,82 @@
+//Package ses emulates sending mails with Amazon SES, both with the v1 query API used by the SES clients of the AWS SDKs
+//and with the outbound-emails endpoint of SESv2. Mails are stored like mails received via SMTP, with the MessageId
+//returned to the client recorded in their metadata
+package ses
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/da-coda/mailpie/internal/apiutil"
+	"github.com/da-coda/mailpie/pkg/handler"
+	"github.com/da-coda/mailpie/pkg/instances"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"time"
+)
+
+//namespace of the XML responses of the v1 query API
+const namespace = "http://ses.amazonaws.com/doc/2010-12-01/"
+
+//maxRequestSize allows raw mails of the 10 MB SES allows after base64 and form encoding
+const maxRequestSize = 40 << 20
+
+type Options struct {
+	SmtpHandler *handler.SmtpHandler
+	//TemplateDir holds the templates for SendTemplatedEmail, see loadTemplate
+	TemplateDir string
+	//VerifySignatures rejects requests which are not signed by one of the Credentials. Otherwise, signatures are ignored
+	VerifySignatures bool
+	//Credentials maps access key ids to secret access keys
+	Credentials map[string]string
+}
+
+//Handler serves the SES APIs on their own port, like the SES endpoint of the AWS SDKs expects
+type Handler struct {
+	options Options
+	router  *mux.Router
+}
+
+func NewHandler(options Options) *Handler {
+	h := &Handler{options: options, router: mux.NewRouter()}
+	h.router.HandleFunc("/v2/email/outbound-emails", h.sendEmailV2).Methods("POST")
+	h.router.HandleFunc("/", h.query).Methods("GET", "POST")
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.router.ServeHTTP(w, r)
+}
+
+//readBody reads the body, which is needed for the signature, and restores it for parsing. Returns an error if the
+//signature is verified and invalid
+func (h *Handler) readBody(r *http.Request) ([]byte, *apiError) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestSize))
+	if err != nil {
+		return nil, newError(codeValidationError, "Unable to read request body")
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if h.options.VerifySignatures {
+		if err := verifySignature(r, body, h.options.Credentials); err != nil {
+			return nil, err
+		}
+	}
+	return body, nil
+}
+
+//store stores the mail with the message id and the tags of the request as metadata
+func (h *Handler) store(mail handler.Envelope, messageID string, tags map[string]string) *apiError {
+	mail.Metadata = instances.Metadata{Provider: "ses", MessageID: messageID, Variables: tags}
+	err := h.options.SmtpHandler.StoreEnvelope(mail)
+	if err != nil {
+		logrus.WithError(err).Error("Unable to store mail in SES handler")
+		return newError(codeInternalFailure, "Unable to store the message")
+	}
+	return nil
+}
+
+//newMessageID returns an id in the format of SES, which starts with the time in milliseconds
+func newMessageID() string {
+	return fmt.Sprintf("0100%012x-%s-000000", time.Now().UnixNano()/int64(time.Millisecond), apiutil.NewUUID())
+}
@@ -0,0 +1,305 @@
+package ses
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"github.com/da-coda/mailpie/pkg/event"
+	"github.com/da-coda/mailpie/pkg/handler"
+	"github.com/da-coda/mailpie/pkg/instances"
+	"github.com/da-coda/mailpie/pkg/store"
+	"github.com/stretchr/testify/suite"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	accessKeyID     = "AKIDEXAMPLE"
+	secretAccessKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+)
+
+type HandlerTestSuite struct {
+	suite.Suite
+	mailStore *store.MailStore
+	options   Options
+	server    *httptest.Server
+}
+
+func (suite *HandlerTestSuite) SetupTest() {
+	suite.mailStore = store.CreateMailStore(event.CreateOrGet())
+	smtpHandler := handler.CreateSmtpHandler(suite.mailStore)
+	suite.options = Options{SmtpHandler: &smtpHandler, TemplateDir: suite.T().TempDir()}
+	suite.server = httptest.NewServer(NewHandler(suite.options))
+}
+
+func (suite *HandlerTestSuite) TearDownTest() {
+	suite.server.Close()
+}
+
+//restart serves a handler with the changed options
+func (suite *HandlerTestSuite) restart() {
+	suite.server.Close()
+	suite.server = httptest.NewServer(NewHandler(suite.options))
+}
+
+//query sends the form to the v1 query API, signed if secret is set, and returns the status and response body
+func (suite *HandlerTestSuite) query(form url.Values, secret string) (int, string) {
+	request, err := http.NewRequest(http.MethodPost, suite.server.URL+"/", strings.NewReader(form.Encode()))
+	suite.Require().Nil(err)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	return suite.do(request, []byte(form.Encode()), secret)
+}
+
+func (suite *HandlerTestSuite) v2(body string, secret string) (int, string) {
+	request, err := http.NewRequest(http.MethodPost, suite.server.URL+"/v2/email/outbound-emails", strings.NewReader(body))
+	suite.Require().Nil(err)
+	request.Header.Set("Content-Type", "application/json")
+	return suite.do(request, []byte(body), secret)
+}
+
+func (suite *HandlerTestSuite) do(request *http.Request, body []byte, secret string) (int, string) {
+	if secret != "" {
+		sign(request, body, secret)
+	}
+	resp, err := http.DefaultClient.Do(request)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+	response, err := io.ReadAll(resp.Body)
+	suite.Require().Nil(err)
+	return resp.StatusCode, string(response)
+}
+
+//sign signs the request like the AWS SDKs with Signature Version 4
+func sign(r *http.Request, body []byte, secret string) {
+	r.Header.Set("X-Amz-Date", "20240101T120000Z")
+	auth := authorization{
+		accessKeyID:   accessKeyID,
+		scope:         "20240101/us-east-1/ses/aws4_request",
+		date:          "20240101",
+		region:        "us-east-1",
+		service:       "ses",
+		signedHeaders: []string{"content-type", "host", "x-amz-date"},
+	}
+	auth.signature = signature(secret, auth, "20240101T120000Z", canonicalRequest(r, body, auth.signedHeaders))
+	r.Header.Set("Authorization", signatureAlgorithm+" Credential="+accessKeyID+"/"+auth.scope+", SignedHeaders=content-type;host;x-amz-date, Signature="+auth.signature)
+}
+
+func (suite *HandlerTestSuite) mails() []instances.Mail {
+	var mails []instances.Mail
+	for _, key := range suite.mailStore.KeysByArrival() {
+		mail, err := suite.mailStore.GetSingle(key)
+		suite.Require().Nil(err)
+		mails = append(mails, mail)
+	}
+	return mails
+}
+
+func (suite *HandlerTestSuite) messageID(response string) string {
+	var parsed struct {
+		MessageID string `xml:"SendEmailResult>MessageId"`
+		RequestID string `xml:"ResponseMetadata>RequestId"`
+	}
+	suite.Require().Nil(xml.Unmarshal([]byte(response), &parsed))
+	suite.NotEmpty(parsed.RequestID)
+	return parsed.MessageID
+}
+
+func (suite *HandlerTestSuite) TestSignature_AWSTestVector() {
+	request, err := http.NewRequest(http.MethodGet, "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	suite.Require().Nil(err)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	request.Header.Set("X-Amz-Date", "20150830T123600Z")
+	auth, problem := parseAuthorization("AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7")
+	suite.Require().Nil(problem)
+
+	canonical := canonicalRequest(request, nil, auth.signedHeaders)
+	suite.Equal("f536975d06c0309214f805bb90ccff089219ecd68b2577efef23edd43b7e1a59", hashHex([]byte(canonical)))
+	suite.Equal(auth.signature, signature(secretAccessKey, auth, "20150830T123600Z", canonical))
+}
+
+func (suite *HandlerTestSuite) TestSendEmail() {
+	status, response := suite.query(url.Values{
+		"Action":                            {"SendEmail"},
+		"Source":                            {"Alex <alex@example.com>"},
+		"ReturnPath":                        {"bounces@example.com"},
+		"Destination.ToAddresses.member.1":  {"bob@example.com"},
+		"Destination.ToAddresses.member.2":  {"Cora <cora@example.com>"},
+		"Destination.BccAddresses.member.1": {"dan@example.com"},
+		"ReplyToAddresses.member.1":         {"support@example.com"},
+		"Message.Subject.Data":              {"Invoice"},
+		"Message.Body.Text.Data":            {"Your invoice"},
+		"Message.Body.Html.Data":            {"<p>Your invoice</p>"},
+		"Tags.member.1.Name":                {"campaign"},
+		"Tags.member.1.Value":               {"billing"},
+	}, "")
+	suite.Require().Equal(http.StatusOK, status, response)
+	messageID := suite.messageID(response)
+	suite.NotEmpty(messageID)
+
+	mails := suite.mails()
+	suite.Require().Len(mails, 1)
+	mail := mails[0]
+	suite.Equal("bounces@example.com", mail.EnvelopeFrom)
+	suite.Equal([]string{"bob@example.com", "cora@example.com", "dan@example.com"}, mail.EnvelopeTo)
+	suite.Equal(`"Alex" <alex@example.com>`, mail.Header.Get("From"))
+	suite.Equal(`bob@example.com, "Cora" <cora@example.com>`, mail.Header.Get("To"))
+	suite.Empty(mail.Header.Get("Bcc"))
+	suite.Equal("support@example.com", mail.Header.Get("Reply-To"))
+	suite.Equal("<"+messageID+"@email.amazonses.com>", mail.Header.Get("Message-Id"))
+	suite.Equal(instances.Metadata{Provider: "ses", Variables: map[string]string{"campaign": "billing"}, MessageID: messageID}, mail.Metadata)
+	parts := mail.Parts()
+	suite.Require().Len(parts, 2)
+	suite.Equal("Your invoice", string(parts[0].Content))
+	suite.Equal("text/html", parts[1].ContentType)
+}
+
+func (suite *HandlerTestSuite) TestSendRawEmail() {
+	raw := "From: Alex <alex@example.com>\r\nTo: bob@example.com\r\nCc: cora@example.com\r\nSubject: Raw\r\n\r\nRaw body\r\n"
+	status, response := suite.query(url.Values{
+		"Action":                {"SendRawEmail"},
+		"RawMessage.Data":       {base64.StdEncoding.EncodeToString([]byte(raw))},
+		"Destinations.member.1": {"dan@example.com"},
+	}, "")
+	suite.Require().Equal(http.StatusOK, status, response)
+	suite.Contains(response, "<SendRawEmailResult><MessageId>")
+
+	status, _ = suite.query(url.Values{"Action": {"SendRawEmail"}, "RawMessage.Data": {base64.StdEncoding.EncodeToString([]byte(raw))}}, "")
+	suite.Equal(http.StatusOK, status)
+
+	mails := suite.mails()
+	suite.Require().Len(mails, 2)
+	suite.Equal(raw, string(mails[0].RawMessage), "The message is stored as is")
+	suite.Equal("alex@example.com", mails[0].EnvelopeFrom)
+	suite.Equal([]string{"dan@example.com"}, mails[0].EnvelopeTo)
+	suite.Equal([]string{"bob@example.com", "cora@example.com"}, mails[1].EnvelopeTo, "Without destinations the recipients of the headers are used")
+}
+
+func (suite *HandlerTestSuite) TestSendTemplatedEmail() {
+	template := `{"Template": {"TemplateName": "welcome", "SubjectPart": "Welcome {{name}}", "TextPart": "Hello {{name}}{{#if admin}}, admin{{/if}}"}}`
+	suite.Require().Nil(os.WriteFile(filepath.Join(suite.options.TemplateDir, "welcome.json"), []byte(template), 0644))
+	form := url.Values{
+		"Action":                           {"SendTemplatedEmail"},
+		"Source":                           {"alex@example.com"},
+		"Destination.ToAddresses.member.1": {"bob@example.com"},
+		"Template":                         {"welcome"},
+		"TemplateData":                     {`{"name": "Bob", "admin": true}`},
+	}
+	status, response := suite.query(form, "")
+	suite.Require().Equal(http.StatusOK, status, response)
+
+	mails := suite.mails()
+	suite.Require().Len(mails, 1)
+	suite.Equal("Welcome Bob", mails[0].Header.Get("Subject"))
+	suite.Equal("Hello Bob, admin", string(mails[0].Parts()[0].Content))
+
+	form.Set("Template", "missing")
+	status, response = suite.query(form, "")
+	suite.Equal(http.StatusBadRequest, status)
+	suite.Contains(response, "<Code>TemplateDoesNotExist</Code>")
+}
+
+func (suite *HandlerTestSuite) TestQuery_Invalid() {
+	for _, test := range []struct {
+		form url.Values
+		code string
+	}{
+		{url.Values{"Action": {"ListIdentities"}}, codeInvalidAction},
+		{url.Values{"Action": {"SendEmail"}, "Destination.ToAddresses.member.1": {"bob@example.com"}, "Message.Body.Text.Data": {"Hi"}}, codeMessageRejected},
+		{url.Values{"Action": {"SendEmail"}, "Source": {"alex"}, "Destination.ToAddresses.member.1": {"bob@example.com"}, "Message.Body.Text.Data": {"Hi"}}, codeInvalidParameterValue},
+		{url.Values{"Action": {"SendEmail"}, "Source": {"alex@example.com"}, "Message.Body.Text.Data": {"Hi"}}, codeValidationError},
+		{url.Values{"Action": {"SendRawEmail"}, "RawMessage.Data": {"not base64!"}}, codeInvalidParameterValue},
+	} {
+		status, response := suite.query(test.form, "")
+		suite.Equal(http.StatusBadRequest, status)
+		suite.Contains(response, "<Code>"+test.code+"</Code>")
+		suite.Contains(response, "<Type>Sender</Type>")
+	}
+	suite.Empty(suite.mails())
+}
+
+func (suite *HandlerTestSuite) TestSendEmailV2() {
+	status, response := suite.v2(`{
+		"FromEmailAddress": "alex@example.com",
+		"Destination": {"ToAddresses": ["bob@example.com"], "CcAddresses": ["cora@example.com"]},
+		"Content": {"Simple": {
+			"Subject": {"Data": "Hi"},
+			"Body": {"Html": {"Data": "<p>Hi Bob</p>"}},
+			"Headers": [{"Name": "X-Priority", "Value": "1"}]
+		}},
+		"EmailTags": [{"Name": "campaign", "Value": "welcome"}]
+	}`, "")
+	suite.Require().Equal(http.StatusOK, status, response)
+	var parsed map[string]string
+	suite.Require().Nil(json.Unmarshal([]byte(response), &parsed))
+	suite.NotEmpty(parsed["MessageId"])
+
+	mails := suite.mails()
+	suite.Require().Len(mails, 1)
+	suite.Equal([]string{"bob@example.com", "cora@example.com"}, mails[0].EnvelopeTo)
+	suite.Equal("1", mails[0].Header.Get("X-Priority"))
+	suite.Equal(instances.Metadata{Provider: "ses", Variables: map[string]string{"campaign": "welcome"}, MessageID: parsed["MessageId"]}, mails[0].Metadata)
+	suite.Equal("text/html", mails[0].Parts()[0].ContentType)
+}
+
+func (suite *HandlerTestSuite) TestSendEmailV2_RawAndTemplate() {
+	raw := base64.StdEncoding.EncodeToString([]byte("From: alex@example.com\r\nTo: bob@example.com\r\nSubject: Raw\r\n\r\nRaw body\r\n"))
+	status, response := suite.v2(`{"Content": {"Raw": {"Data": "`+raw+`"}}}`, "")
+	suite.Require().Equal(http.StatusOK, status, response)
+
+	status, response = suite.v2(`{
+		"FromEmailAddress": "alex@example.com",
+		"Destination": {"ToAddresses": ["bob@example.com"]},
+		"Content": {"Template": {
+			"TemplateContent": {"Subject": "Hi {{name}}", "Text": "Hello {{name}}"},
+			"TemplateData": "{\"name\": \"Bob\"}"
+		}}
+	}`, "")
+	suite.Require().Equal(http.StatusOK, status, response)
+
+	mails := suite.mails()
+	suite.Require().Len(mails, 2)
+	suite.Equal("Raw", mails[0].Header.Get("Subject"))
+	suite.Equal("Hi Bob", mails[1].Header.Get("Subject"))
+	suite.Equal("Hello Bob", string(mails[1].Parts()[0].Content))
+
+	status, response = suite.v2(`{"FromEmailAddress": "alex@example.com", "Destination": {"ToAddresses": ["bob@example.com"]}, "Content": {"Template": {"TemplateName": "missing"}}}`, "")
+	suite.Equal(http.StatusNotFound, status)
+	suite.JSONEq(`{"message": "Template missing does not exist."}`, response)
+}
+
+func (suite *HandlerTestSuite) TestVerifySignatures() {
+	suite.options.VerifySignatures = true
+	suite.options.Credentials = map[string]string{accessKeyID: secretAccessKey}
+	suite.restart()
+	form := url.Values{
+		"Action":                           {"SendEmail"},
+		"Source":                           {"alex@example.com"},
+		"Destination.ToAddresses.member.1": {"bob@example.com"},
+		"Message.Body.Text.Data":           {"Hi"},
+	}
+
+	status, response := suite.query(form, "")
+	suite.Equal(http.StatusForbidden, status)
+	suite.Contains(response, "<Code>MissingAuthenticationToken</Code>")
+	status, response = suite.query(form, "wrong secret")
+	suite.Equal(http.StatusForbidden, status)
+	suite.Contains(response, "<Code>SignatureDoesNotMatch</Code>")
+	status, response = suite.v2(`{}`, "wrong secret")
+	suite.Equal(http.StatusForbidden, status)
+	suite.JSONEq(`{"message": "The request signature we calculated does not match the signature you provided. Check your AWS Secret Access Key and signing method. Consult the service documentation for details."}`, response)
+	suite.Empty(suite.mails())
+
+	status, response = suite.query(form, secretAccessKey)
+	suite.Equal(http.StatusOK, status, response)
+	suite.Len(suite.mails(), 1)
+}
+
+func TestHandlerTestSuite(t *testing.T) {
+	suite.Run(t, new(HandlerTestSuite))
+}
@@ -0,0 +1,160 @@
+package ses
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const signatureAlgorithm = "AWS4-HMAC-SHA256"
+
+//authorization holds the parts of an Authorization header of Signature Version 4
+type authorization struct {
+	accessKeyID   string
+	scope         string
+	date          string
+	region        string
+	service       string
+	signedHeaders []string
+	signature     string
+}
+
+//parseAuthorization parses a header like
+//AWS4-HMAC-SHA256 Credential=AKID/20150830/us-east-1/ses/aws4_request, SignedHeaders=host;x-amz-date, Signature=5d67...
+func parseAuthorization(header string) (authorization, *apiError) {
+	if !strings.HasPrefix(header, signatureAlgorithm+" ") {
+		return authorization{}, newError(codeMissingAuthenticationToken, "Request is missing Authentication Token")
+	}
+	var auth authorization
+	for _, parameter := range strings.Split(strings.TrimPrefix(header, signatureAlgorithm+" "), ",") {
+		name, value, _ := cut(strings.TrimSpace(parameter), "=")
+		switch name {
+		case "Credential":
+			parts := strings.Split(value, "/")
+			if len(parts) != 5 || parts[4] != "aws4_request" {
+				return authorization{}, newError(codeIncompleteSignature, "Credential should be scoped to a valid region.")
+			}
+			auth.accessKeyID, auth.date, auth.region, auth.service = parts[0], parts[1], parts[2], parts[3]
+			auth.scope = strings.Join(parts[1:], "/")
+		case "SignedHeaders":
+			auth.signedHeaders = strings.Split(value, ";")
+		case "Signature":
+			auth.signature = value
+		}
+	}
+	if auth.accessKeyID == "" || len(auth.signedHeaders) == 0 || auth.signature == "" {
+		return authorization{}, newError(codeIncompleteSignature, "Authorization header requires 'Credential', 'Signature' and 'SignedHeaders' parameters.")
+	}
+	return auth, nil
+}
+
+//verifySignature checks the Signature Version 4 of the request against the secret of its access key. The body is
+//passed separately, because it was already read from the request
+func verifySignature(r *http.Request, body []byte, credentials map[string]string) *apiError {
+	auth, err := parseAuthorization(r.Header.Get("Authorization"))
+	if err != nil {
+		return err
+	}
+	secret, exists := credentials[auth.accessKeyID]
+	if !exists {
+		return newError(codeInvalidClientTokenID, "The security token included in the request is invalid.")
+	}
+	amzDate := r.Header.Get("X-Amz-Date")
+	if amzDate == "" {
+		return newError(codeIncompleteSignature, "Authorization header requires existence of either a 'X-Amz-Date' or a 'Date' header.")
+	}
+	expected := signature(secret, auth, amzDate, canonicalRequest(r, body, auth.signedHeaders))
+	if !hmac.Equal([]byte(expected), []byte(auth.signature)) {
+		return newError(codeSignatureDoesNotMatch, "The request signature we calculated does not match the signature you provided. Check your AWS Secret Access Key and signing method. Consult the service documentation for details.")
+	}
+	return nil
+}
+
+//canonicalRequest builds the canonical request of Signature Version 4 out of the method, path, query, signed headers
+//and the hash of the body
+func canonicalRequest(r *http.Request, body []byte, signedHeaders []string) string {
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = hashHex(body)
+	}
+	path := r.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	var headers strings.Builder
+	for _, name := range signedHeaders {
+		value := strings.Join(r.Header.Values(name), ",")
+		if name == "host" {
+			value = r.Host
+		}
+		headers.WriteString(name + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+	return strings.Join([]string{
+		r.Method,
+		uriEncode(path, false),
+		canonicalQuery(r.URL.Query()),
+		headers.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+func canonicalQuery(query url.Values) string {
+	var pairs []string
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+//signature derives the signing key of the scope from the secret and signs the canonical request with it
+func signature(secret string, auth authorization, amzDate string, canonicalRequest string) string {
+	stringToSign := strings.Join([]string{signatureAlgorithm, amzDate, auth.scope, hashHex([]byte(canonicalRequest))}, "\n")
+	key := []byte("AWS4" + secret)
+	for _, part := range []string{auth.date, auth.region, auth.service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hashHex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+//uriEncode percent encodes everything except the unreserved characters of RFC 3986. Slashes are kept in paths
+func uriEncode(value string, encodeSlash bool) string {
+	var encoded strings.Builder
+	for _, b := range []byte(value) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', b == '-', b == '_', b == '.', b == '~':
+			encoded.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			encoded.WriteByte(b)
+		default:
+			encoded.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{b})))
+		}
+	}
+	return encoded.String()
+}
+
+//cut is strings.Cut, which is not available in Go 1.16
+func cut(s string, separator string) (string, string, bool) {
+	if i := strings.Index(s, separator); i >= 0 {
+		return s[:i], s[i+len(separator):], true
+	}
+	return s, "", false
+}
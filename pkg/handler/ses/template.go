@@ -0,0 +1,100 @@
+package ses
+
+import (
+	"encoding/json"
+	"github.com/da-coda/mailpie/pkg/handlebars"
+	"github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//templateContent is a template like it is created with CreateTemplate of SES
+type templateContent struct {
+	TemplateName string
+	SubjectPart  string
+	TextPart     string
+	HtmlPart     string
+}
+
+//templateFile is the content of a template file, either the input of CreateTemplate, which wraps the template, or
+//the template itself
+type templateFile struct {
+	Template *templateContent
+	templateContent
+}
+
+type template struct {
+	subject *handlebars.Template
+	text    *handlebars.Template
+	html    *handlebars.Template
+}
+
+//loadTemplate reads the template <dir>/<name>.json on every request, so that templates can be edited without
+//restarting Mailpie
+func loadTemplate(dir string, name string) (*template, *apiError) {
+	notFound := newErrorf(codeTemplateDoesNotExist, "Template %s does not exist.", name)
+	if dir == "" || name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return nil, notFound
+	}
+	source, err := os.ReadFile(filepath.Join(dir, name+".json"))
+	if os.IsNotExist(err) {
+		return nil, notFound
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("template", name).Error("Unable to read SES template")
+		return nil, newErrorf(codeInternalFailure, "Unable to read template %s", name)
+	}
+	var file templateFile
+	if err := json.Unmarshal(source, &file); err != nil {
+		return nil, newErrorf(codeInvalidParameterValue, "Template %s is not valid JSON", name)
+	}
+	content := file.templateContent
+	if file.Template != nil {
+		content = *file.Template
+	}
+	return parseTemplate(content.SubjectPart, content.TextPart, content.HtmlPart)
+}
+
+//parseTemplate parses the parts of a template, of which the text or html part is required
+func parseTemplate(subject string, text string, html string) (*template, *apiError) {
+	if text == "" && html == "" {
+		return nil, newError(codeInvalidParameterValue, "The template must contain either TextPart or HtmlPart")
+	}
+	t := &template{}
+	parts := []struct {
+		source string
+		parsed **handlebars.Template
+	}{{subject, &t.subject}, {text, &t.text}, {html, &t.html}}
+	for _, part := range parts {
+		if part.source == "" {
+			continue
+		}
+		var err error
+		*part.parsed, err = handlebars.Parse(part.source)
+		if err != nil {
+			return nil, newError(codeInvalidParameterValue, err.Error())
+		}
+	}
+	return t, nil
+}
+
+//render fills the subject and body of the message with the template data, which has to be a JSON object
+func (t *template) render(msg *message, templateData string) *apiError {
+	data := make(map[string]interface{})
+	if templateData != "" {
+		if err := json.Unmarshal([]byte(templateData), &data); err != nil {
+			return newError(codeInvalidParameterValue, "Template data must be a valid JSON object")
+		}
+	}
+	for _, part := range []struct {
+		parsed   *handlebars.Template
+		rendered *string
+	}{{t.subject, &msg.subject}, {t.text, &msg.text}, {t.html, &msg.html}} {
+		if part.parsed != nil {
+			*part.rendered = part.parsed.Execute(data)
+		}
+	}
+	msg.subject = strings.TrimSpace(msg.subject)
+	return nil
+}
@@ -0,0 +1,144 @@
+package ses
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/da-coda/mailpie/internal/apiutil"
+	"github.com/da-coda/mailpie/pkg/handler"
+	"net/http"
+)
+
+type data struct {
+	Data string
+}
+
+type messageTag struct {
+	Name  string
+	Value string
+}
+
+//outboundEmail is the request of SendEmail of SESv2, which has either simple, raw or template content
+type outboundEmail struct {
+	FromEmailAddress string
+	Destination      struct {
+		ToAddresses  []string
+		CcAddresses  []string
+		BccAddresses []string
+	}
+	ReplyToAddresses               []string
+	FeedbackForwardingEmailAddress string
+	Content                        struct {
+		Simple *struct {
+			Subject data
+			Body    struct {
+				Text *data
+				Html *data
+			}
+			Headers []messageTag
+		}
+		//Raw.Data is base64 encoded, which the JSON decoder decodes into the byte slice
+		Raw *struct {
+			Data []byte
+		}
+		Template *struct {
+			TemplateName    string
+			TemplateContent *struct {
+				Subject string
+				Text    string
+				Html    string
+			}
+			TemplateData string
+			Headers      []messageTag
+		}
+	}
+	EmailTags []messageTag
+}
+
+//sendEmailV2 handles POST /v2/email/outbound-emails
+func (h *Handler) sendEmailV2(w http.ResponseWriter, r *http.Request) {
+	body, problem := h.readBody(r)
+	if problem != nil {
+		writeJSONError(w, problem)
+		return
+	}
+	var request outboundEmail
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&request); err != nil {
+		writeJSONError(w, newError(codeValidationError, "Unable to parse the request body"))
+		return
+	}
+	messageID := newMessageID()
+	mail, problem := h.buildV2(&request, messageID)
+	if problem == nil {
+		var tags map[string]string
+		for _, tag := range request.EmailTags {
+			if tags == nil {
+				tags = make(map[string]string)
+			}
+			tags[tag.Name] = tag.Value
+		}
+		problem = h.store(mail, messageID, tags)
+	}
+	if problem != nil {
+		writeJSONError(w, problem)
+		return
+	}
+	//SES adds a request id to every response
+	w.Header().Set("X-Amzn-RequestId", apiutil.NewUUID())
+	apiutil.WriteJSON(w, http.StatusOK, map[string]string{"MessageId": messageID})
+}
+
+func (h *Handler) buildV2(request *outboundEmail, messageID string) (handler.Envelope, *apiError) {
+	content := request.Content
+	if content.Raw != nil {
+		var destinations []string
+		for _, list := range [][]string{request.Destination.ToAddresses, request.Destination.CcAddresses, request.Destination.BccAddresses} {
+			destinations = append(destinations, list...)
+		}
+		return buildRaw(content.Raw.Data, request.FromEmailAddress, destinations)
+	}
+	msg := message{
+		source:     request.FromEmailAddress,
+		returnPath: request.FeedbackForwardingEmailAddress,
+		to:         request.Destination.ToAddresses,
+		cc:         request.Destination.CcAddresses,
+		bcc:        request.Destination.BccAddresses,
+		replyTo:    request.ReplyToAddresses,
+	}
+	switch {
+	case content.Simple != nil:
+		msg.subject = content.Simple.Subject.Data
+		if content.Simple.Body.Text != nil {
+			msg.text = content.Simple.Body.Text.Data
+		}
+		if content.Simple.Body.Html != nil {
+			msg.html = content.Simple.Body.Html.Data
+		}
+		msg.headers = headers(content.Simple.Headers)
+	case content.Template != nil:
+		var t *template
+		var problem *apiError
+		if inline := content.Template.TemplateContent; inline != nil {
+			t, problem = parseTemplate(inline.Subject, inline.Text, inline.Html)
+		} else {
+			t, problem = loadTemplate(h.options.TemplateDir, content.Template.TemplateName)
+		}
+		if problem != nil {
+			return handler.Envelope{}, problem
+		}
+		if problem := t.render(&msg, content.Template.TemplateData); problem != nil {
+			return handler.Envelope{}, problem
+		}
+		msg.headers = headers(content.Template.Headers)
+	default:
+		return handler.Envelope{}, newError(codeValidationError, "Content must contain either Simple, Raw or Template")
+	}
+	return msg.build(messageID)
+}
+
+func headers(list []messageTag) [][2]string {
+	var headers [][2]string
+	for _, header := range list {
+		headers = append(headers, [2]string{header.Name, header.Value})
+	}
+	return headers
+}
@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"github.com/da-coda/mailpie/internal/apiutil"
+	"github.com/da-coda/mailpie/pkg/sieve"
+	"github.com/da-coda/mailpie/pkg/store"
+	"io"
+	"net/http"
+)
+
+//SieveHandler shows which actions a sieve script would take for stored mails, without placing them anywhere
+type SieveHandler struct {
+	mailStore *store.MailStore
+	script    *sieve.Script
+}
+
+type sieveDryRun struct {
+	Key     string         `json:"key"`
+	Actions []sieve.Action `json:"actions"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func NewSieveHandler(mailStore *store.MailStore, script *sieve.Script) *SieveHandler {
+	return &SieveHandler{mailStore: mailStore, script: script}
+}
+
+//ServeHTTP evaluates the configured script, or on POST the script sent as request body. With the key query parameter
+//only the mail with this key is evaluated, otherwise all stored mails are
+func (h SieveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	script := h.script
+	if r.Method == http.MethodPost {
+		source, err := io.ReadAll(r.Body)
+		if err != nil {
+			apiutil.WriteJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+		script, err = sieve.Parse(string(source))
+		if err != nil {
+			apiutil.WriteJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+	}
+	if script == nil {
+		apiutil.WriteJSON(w, http.StatusBadRequest, errorResponse{Error: "no sieve script configured"})
+		return
+	}
+
+	keys := h.mailStore.Keys()
+	key := r.URL.Query().Get("key")
+	if key != "" {
+		keys = []string{key}
+	}
+	results := make([]sieveDryRun, 0, len(keys))
+	for _, key := range keys {
+		mail, err := h.mailStore.GetSingle(key)
+		if err != nil {
+			apiutil.WriteJSON(w, http.StatusNotFound, errorResponse{Error: err.Error()})
+			return
+		}
+		result, err := script.Evaluate(mail)
+		if err != nil {
+			apiutil.WriteJSON(w, http.StatusUnprocessableEntity, errorResponse{Error: err.Error()})
+			return
+		}
+		results = append(results, sieveDryRun{Key: key, Actions: result.Actions})
+	}
+	if r.URL.Query().Get("key") != "" {
+		apiutil.WriteJSON(w, http.StatusOK, results[0])
+		return
+	}
+	apiutil.WriteJSON(w, http.StatusOK, results)
+}
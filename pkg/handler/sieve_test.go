@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"encoding/json"
+	"github.com/da-coda/mailpie/pkg/event"
+	"github.com/da-coda/mailpie/pkg/instances"
+	"github.com/da-coda/mailpie/pkg/sieve"
+	"github.com/da-coda/mailpie/pkg/store"
+	"github.com/stretchr/testify/suite"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+var rawMail = []byte(`MIME-Version: 1.0
+Date: Wed, 27 Jan 2021 17:00:48 +0100
+From: alex@example.com
+To: bob@example.com
+Subject: [SPAM] Hello!
+Content-Type: text/plain; charset=UTF-8
+
+Hello Bob!
+`)
+
+type nopDispatcher struct{}
+
+func (nopDispatcher) Dispatch(_ event.Event, _ string, _ interface{}) {}
+
+type SieveHandlerTestSuite struct {
+	suite.Suite
+	mailStore *store.MailStore
+}
+
+func (suite *SieveHandlerTestSuite) SetupTest() {
+	suite.mailStore = store.CreateMailStore(nopDispatcher{})
+	mail, err := instances.ParseMail(rawMail)
+	suite.Require().Nil(err)
+	suite.Require().Nil(suite.mailStore.Add("spam", *mail))
+}
+
+func (suite *SieveHandlerTestSuite) TestDryRun_ConfiguredScript() {
+	script, err := sieve.Parse(`require "fileinto"; if header :contains "subject" "[SPAM]" { fileinto "Junk"; }`)
+	suite.Require().Nil(err)
+	handler := NewSieveHandler(suite.mailStore, script)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/sieve/dry-run", nil))
+	suite.Equal(http.StatusOK, recorder.Code)
+	var results []sieveDryRun
+	suite.Nil(json.Unmarshal(recorder.Body.Bytes(), &results))
+	suite.Require().Len(results, 1)
+	suite.Equal("spam", results[0].Key)
+	suite.Equal([]sieve.Action{{Type: sieve.ActionFileInto, Mailbox: "Junk", Line: 1}}, results[0].Actions)
+}
+
+func (suite *SieveHandlerTestSuite) TestDryRun_PostedScript() {
+	handler := NewSieveHandler(suite.mailStore, nil)
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/api/sieve/dry-run?key="+url.QueryEscape("spam"), strings.NewReader(`discard;`))
+	handler.ServeHTTP(recorder, request)
+	suite.Equal(http.StatusOK, recorder.Code)
+	var result sieveDryRun
+	suite.Nil(json.Unmarshal(recorder.Body.Bytes(), &result))
+	suite.Equal([]sieve.Action{{Type: sieve.ActionDiscard, Line: 1}}, result.Actions)
+}
+
+func (suite *SieveHandlerTestSuite) TestDryRun_Errors() {
+	handler := NewSieveHandler(suite.mailStore, nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/sieve/dry-run", nil))
+	suite.Equal(http.StatusBadRequest, recorder.Code, "Missing script should be a bad request")
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/sieve/dry-run", strings.NewReader(`fileinto "x";`)))
+	suite.Equal(http.StatusBadRequest, recorder.Code, "Invalid script should be a bad request")
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/sieve/dry-run?key=unknown", strings.NewReader(`keep;`)))
+	suite.Equal(http.StatusNotFound, recorder.Code, "Unknown key should not be found")
+}
+
+func TestSieveHandler(t *testing.T) {
+	suite.Run(t, new(SieveHandlerTestSuite))
+}
@@ -4,34 +4,67 @@ import (
 	"fmt"
 	"github.com/da-coda/mailpie/pkg/instances"
 	"github.com/da-coda/mailpie/pkg/store"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"net"
 	"time"
 )
 
 type SmtpHandler struct {
-	mailStore store.MailStore
+	mailStore *store.MailStore
 }
 
-func CreateSmtpHandler(mailStore store.MailStore) SmtpHandler {
+func CreateSmtpHandler(mailStore *store.MailStore) SmtpHandler {
 	return SmtpHandler{mailStore: mailStore}
 }
 
 //Handle incoming emails. Parses the incoming mail into instances.Mail and then writes the mail into the mailStore with the key format
 // from_to_2006-01-02T15:04:05Z07:00
 func (handler *SmtpHandler) Handle(_ net.Addr, from string, to []string, data []byte) {
+	err := handler.Store(from, to, data)
+	if err != nil {
+		logrus.WithError(err).Error("Unable to store mail in SMTP handler")
+	}
+}
+
+//Store parses the mail and adds it with its envelope to the mailStore like Handle does for mails received via SMTP. The
+//HTTP APIs of mail providers store the mails they build through here. If several mails with the same sender, recipients
+//and date arrive, a counter is appended to the key
+func (handler *SmtpHandler) Store(from string, to []string, data []byte) error {
+	return handler.StoreWithMetadata(from, to, data, instances.Metadata{})
+}
+
+//Envelope is a mail the HTTP API of a mail provider built from a request, with the SMTP envelope and the metadata the
+//mail is stored with
+type Envelope struct {
+	From     string
+	To       []string
+	Data     []byte
+	Metadata instances.Metadata
+}
+
+//StoreEnvelope stores the mail of the envelope like StoreWithMetadata
+func (handler *SmtpHandler) StoreEnvelope(envelope Envelope) error {
+	return handler.StoreWithMetadata(envelope.From, envelope.To, envelope.Data, envelope.Metadata)
+}
+
+//StoreWithMetadata is like Store, but attaches the metadata given by the API the mail was sent with
+func (handler *SmtpHandler) StoreWithMetadata(from string, to []string, data []byte, metadata instances.Metadata) error {
 	mail, err := instances.ParseMail(data)
 	if err != nil {
-		logrus.WithError(err).Error("Unable to parse mail in SMTP handler")
+		return errors.Wrap(err, "unable to parse mail")
 	}
+	mail.EnvelopeFrom = from
+	mail.EnvelopeTo = to
+	mail.Metadata = metadata
 	date, err := mail.Header.Date()
 	if err != nil {
 		logrus.WithError(err).Error("Unable to get date from mail in SMTP handler")
 	}
-	key := "%s_%s_%s"
-	dateString := date.Format(time.RFC3339)
-	err = handler.mailStore.Add(fmt.Sprintf(key, from, to, dateString), *mail)
-	if err != nil {
-		logrus.WithError(err).Error("Unable to add mail to store in SMTP handler")
+	key := fmt.Sprintf("%s_%s_%s", from, to, date.Format(time.RFC3339))
+	err = handler.mailStore.Add(key, *mail)
+	for i := 2; err == store.AlreadyExistsError; i++ {
+		err = handler.mailStore.Add(fmt.Sprintf("%s_%d", key, i), *mail)
 	}
+	return errors.Wrap(err, "unable to add mail to store")
 }
@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"github.com/da-coda/mailpie/pkg/event"
+	"github.com/da-coda/mailpie/pkg/instances"
+	"github.com/da-coda/mailpie/pkg/store"
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+type SmtpHandlerTestSuite struct {
+	suite.Suite
+}
+
+var smtpTestMail = []byte("From: alex@example.com\r\nTo: bob@example.com\r\nDate: Mon, 01 Mar 2021 10:00:00 +0000\r\nSubject: Hi\r\n\r\nHi Bob\r\n")
+
+func (suite *SmtpHandlerTestSuite) TestStore() {
+	mailStore := store.CreateMailStore(event.CreateOrGet())
+	smtpHandler := CreateSmtpHandler(mailStore)
+	suite.Nil(smtpHandler.Store("alex@example.com", []string{"bob@example.com"}, smtpTestMail))
+	suite.Nil(smtpHandler.Store("alex@example.com", []string{"bob@example.com"}, smtpTestMail))
+
+	keys := mailStore.KeysByArrival()
+	suite.Equal([]string{
+		"alex@example.com_[bob@example.com]_2021-03-01T10:00:00Z",
+		"alex@example.com_[bob@example.com]_2021-03-01T10:00:00Z_2",
+	}, keys, "Mails with the same key are not dropped")
+	mail, err := mailStore.GetSingle(keys[0])
+	suite.Nil(err)
+	suite.Equal("alex@example.com", mail.EnvelopeFrom)
+	suite.Equal([]string{"bob@example.com"}, mail.EnvelopeTo)
+}
+
+func (suite *SmtpHandlerTestSuite) TestStoreEnvelope() {
+	mailStore := store.CreateMailStore(event.CreateOrGet())
+	smtpHandler := CreateSmtpHandler(mailStore)
+	metadata := instances.Metadata{Provider: "mailgun", Tags: []string{"welcome"}}
+	suite.Nil(smtpHandler.StoreEnvelope(Envelope{From: "alex@example.com", To: []string{"bob@example.com"}, Data: smtpTestMail, Metadata: metadata}))
+
+	keys := mailStore.KeysByArrival()
+	suite.Require().Len(keys, 1)
+	mail, err := mailStore.GetSingle(keys[0])
+	suite.Nil(err)
+	suite.Equal("alex@example.com", mail.EnvelopeFrom)
+	suite.Equal([]string{"bob@example.com"}, mail.EnvelopeTo)
+	suite.Equal(metadata, mail.Metadata)
+}
+
+func (suite *SmtpHandlerTestSuite) TestStore_Invalid() {
+	smtpHandler := CreateSmtpHandler(store.CreateMailStore(event.CreateOrGet()))
+	suite.NotNil(smtpHandler.Store("alex@example.com", nil, []byte("no header")))
+}
+
+func TestSmtpHandlerTestSuite(t *testing.T) {
+	suite.Run(t, new(SmtpHandlerTestSuite))
+}
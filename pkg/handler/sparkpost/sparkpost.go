@@ -0,0 +1,90 @@
+//Package sparkpost emulates the transmissions endpoint of the SparkPost API. Every recipient of a transmission gets an
+//own mail, stored like mails received via SMTP with the tags and metadata of the recipient attached as metadata
+package sparkpost
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"github.com/da-coda/mailpie/internal/apiutil"
+	"github.com/da-coda/mailpie/pkg/handler"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"math/big"
+	"net/http"
+)
+
+type Handler struct {
+	smtpHandler *handler.SmtpHandler
+	apiKeys     map[string]bool
+}
+
+//NewHandler creates the SparkPost API which stores mails via the smtpHandler. Only the apiKeys are accepted, every key
+//if there are none
+func NewHandler(smtpHandler *handler.SmtpHandler, apiKeys []string) *Handler {
+	h := &Handler{smtpHandler: smtpHandler, apiKeys: make(map[string]bool)}
+	for _, key := range apiKeys {
+		h.apiKeys[key] = true
+	}
+	return h
+}
+
+//Register adds the SparkPost routes to the router
+func (h *Handler) Register(router *mux.Router) {
+	router.HandleFunc("/api/v1/transmissions", h.transmissions).Methods("POST")
+}
+
+//apiError is an entry of the errors SparkPost responds with
+type apiError struct {
+	Message     string `json:"message"`
+	Description string `json:"description,omitempty"`
+	Code        string `json:"code,omitempty"`
+}
+
+//transmissions handles POST /api/v1/transmissions. The API key is sent as is in the Authorization header
+func (h *Handler) transmissions(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Authorization")
+	if key == "" || (len(h.apiKeys) > 0 && !h.apiKeys[key]) {
+		writeErrors(w, http.StatusUnauthorized, apiError{Message: "Unauthorized."})
+		return
+	}
+	var request transmission
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeErrors(w, http.StatusBadRequest, apiError{Message: "invalid data format/type", Description: "Problems parsing request as json", Code: "1300"})
+		return
+	}
+	recipients, problem := request.validate()
+	if problem != nil {
+		writeErrors(w, http.StatusUnprocessableEntity, *problem)
+		return
+	}
+	id := newTransmissionID()
+	mails, problem := request.build(recipients, id)
+	if problem != nil {
+		writeErrors(w, http.StatusUnprocessableEntity, *problem)
+		return
+	}
+	for _, mail := range mails {
+		err := h.smtpHandler.StoreEnvelope(mail)
+		if err != nil {
+			logrus.WithError(err).Error("Unable to store mail in SparkPost handler")
+			writeErrors(w, http.StatusInternalServerError, apiError{Message: "Internal Server Error"})
+			return
+		}
+	}
+	apiutil.WriteJSON(w, http.StatusOK, map[string]interface{}{"results": map[string]interface{}{
+		"total_rejected_recipients": 0,
+		"total_accepted_recipients": len(mails),
+		"id":                        id,
+	}})
+}
+
+//newTransmissionID returns a random decimal id like the transmission ids of SparkPost
+func newTransmissionID() string {
+	id, _ := rand.Int(rand.Reader, big.NewInt(1e17))
+	return fmt.Sprintf("%017d", id)
+}
+
+func writeErrors(w http.ResponseWriter, status int, errors ...apiError) {
+	apiutil.WriteJSON(w, status, map[string][]apiError{"errors": errors})
+}
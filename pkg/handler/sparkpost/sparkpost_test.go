@@ -0,0 +1,158 @@
+package sparkpost
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/da-coda/mailpie/pkg/event"
+	"github.com/da-coda/mailpie/pkg/handler"
+	"github.com/da-coda/mailpie/pkg/instances"
+	"github.com/da-coda/mailpie/pkg/store"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/suite"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type HandlerTestSuite struct {
+	suite.Suite
+	mailStore *store.MailStore
+	server    *httptest.Server
+}
+
+func (suite *HandlerTestSuite) SetupTest() {
+	suite.mailStore = store.CreateMailStore(event.CreateOrGet())
+	smtpHandler := handler.CreateSmtpHandler(suite.mailStore)
+	router := mux.NewRouter()
+	NewHandler(&smtpHandler, []string{"api-key"}).Register(router)
+	suite.server = httptest.NewServer(router)
+}
+
+func (suite *HandlerTestSuite) TearDownTest() {
+	suite.server.Close()
+}
+
+type response struct {
+	Results struct {
+		TotalRejectedRecipients int    `json:"total_rejected_recipients"`
+		TotalAcceptedRecipients int    `json:"total_accepted_recipients"`
+		ID                      string `json:"id"`
+	} `json:"results"`
+	Errors []apiError `json:"errors"`
+}
+
+func (suite *HandlerTestSuite) post(key string, body string) (int, response) {
+	request, err := http.NewRequest(http.MethodPost, suite.server.URL+"/api/v1/transmissions", bytes.NewBufferString(body))
+	suite.Require().Nil(err)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", key)
+	resp, err := http.DefaultClient.Do(request)
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+	var decoded response
+	suite.Require().Nil(json.NewDecoder(resp.Body).Decode(&decoded))
+	return resp.StatusCode, decoded
+}
+
+func (suite *HandlerTestSuite) mails() []instances.Mail {
+	var mails []instances.Mail
+	for _, key := range suite.mailStore.KeysByArrival() {
+		mail, err := suite.mailStore.GetSingle(key)
+		suite.Require().Nil(err)
+		mails = append(mails, mail)
+	}
+	return mails
+}
+
+func (suite *HandlerTestSuite) TestTransmissions() {
+	status, response := suite.post("api-key", `{
+		"campaign_id": "welcome",
+		"metadata": {"user_type": "student", "plan": "free"},
+		"substitution_data": {"sender": "Alex", "plan": "free"},
+		"recipients": [
+			{"address": {"email": "bob@example.com", "name": "Bob"}, "tags": ["new"], "substitution_data": {"name": "Bob"}, "metadata": {"plan": "pro", "seats": 3}},
+			{"address": {"email": "cora@example.com", "header_to": "bob@example.com"}, "substitution_data": {"name": "Cora"}}
+		],
+		"content": {
+			"from": "Alex <alex@example.com>",
+			"subject": "Hi {{name}}",
+			"text": "Hello {{name}}, {{sender}} here",
+			"html": "<p>Hello {{name}}</p>",
+			"headers": {"X-Priority": "1"},
+			"attachments": [{"name": "invoice.pdf", "type": "application/pdf", "data": "JVBERi0xLjQ="}]
+		}
+	}`)
+	suite.Equal(http.StatusOK, status)
+	suite.Equal(2, response.Results.TotalAcceptedRecipients)
+	suite.Equal(0, response.Results.TotalRejectedRecipients)
+	suite.Len(response.Results.ID, 17)
+
+	mails := suite.mails()
+	suite.Require().Len(mails, 2, "Every recipient gets an own mail")
+	bob, cora := mails[0], mails[1]
+	suite.Equal("alex@example.com", bob.EnvelopeFrom)
+	suite.Equal([]string{"bob@example.com"}, bob.EnvelopeTo)
+	suite.Equal(`"Bob" <bob@example.com>`, bob.Header.Get("To"))
+	suite.Equal("Hi Bob", bob.Header.Get("Subject"))
+	suite.Equal("1", bob.Header.Get("X-Priority"))
+	suite.JSONEq(`{"campaign_id": "welcome", "metadata": {"user_type": "student", "plan": "pro", "seats": "3"}, "tags": ["new"]}`, bob.Header.Get("X-MSYS-API"))
+	suite.Equal(instances.Metadata{
+		Provider:  "sparkpost",
+		Tags:      []string{"new"},
+		Variables: map[string]string{"user_type": "student", "plan": "pro", "seats": "3"},
+		MessageID: response.Results.ID,
+	}, bob.Metadata)
+	parts := bob.Parts()
+	suite.Require().Len(parts, 3)
+	suite.Equal("Hello Bob, Alex here", string(parts[0].Content))
+	suite.Equal("<p>Hello Bob</p>", string(parts[1].Content))
+	suite.Equal("invoice.pdf", parts[2].Filename)
+
+	suite.Equal([]string{"cora@example.com"}, cora.EnvelopeTo)
+	suite.Equal("bob@example.com", cora.Header.Get("To"), "header_to sends Cora a copy of the mail to Bob")
+	suite.Equal("Hi Cora", cora.Header.Get("Subject"))
+}
+
+func (suite *HandlerTestSuite) TestTransmissions_RFC822() {
+	raw := "From: alex@example.com\r\nTo: bob@example.com\r\nSubject: Raw\r\n\r\nRaw body\r\n"
+	body, err := json.Marshal(map[string]interface{}{
+		"recipients": []map[string]string{{"address": "bob@example.com"}},
+		"content":    map[string]string{"email_rfc822": raw},
+	})
+	suite.Require().Nil(err)
+	status, _ := suite.post("api-key", string(body))
+	suite.Equal(http.StatusOK, status)
+
+	mails := suite.mails()
+	suite.Require().Len(mails, 1)
+	suite.Equal(raw, string(mails[0].RawMessage))
+	suite.Equal("alex@example.com", mails[0].EnvelopeFrom)
+}
+
+func (suite *HandlerTestSuite) TestTransmissions_Invalid() {
+	for _, test := range []struct {
+		body   string
+		status int
+		code   string
+	}{
+		{`{"content": {"from": "alex@example.com", "text": "Hi"}}`, http.StatusUnprocessableEntity, "1400"},
+		{`{"recipients": {"list_id": "customers"}, "content": {"from": "alex@example.com", "text": "Hi"}}`, http.StatusUnprocessableEntity, "1603"},
+		{`{"recipients": [{"address": "bob@example.com"}], "content": {"text": "Hi"}}`, http.StatusUnprocessableEntity, "1400"},
+		{`{"recipients": [{"address": "bob@example.com"}], "content": {"from": "alex@example.com", "text": "Hi {{#if}}"}}`, http.StatusUnprocessableEntity, "3000"},
+		{`{"recipients": [{"address": "bob"}], "content": {"from": "alex@example.com", "text": "Hi"}}`, http.StatusUnprocessableEntity, "1300"},
+		{`{"recipients": `, http.StatusBadRequest, "1300"},
+	} {
+		status, response := suite.post("api-key", test.body)
+		suite.Equal(test.status, status, test.body)
+		suite.Require().Len(response.Errors, 1)
+		suite.Equal(test.code, response.Errors[0].Code, test.body)
+	}
+	status, response := suite.post("wrong-key", `{}`)
+	suite.Equal(http.StatusUnauthorized, status)
+	suite.Equal("Unauthorized.", response.Errors[0].Message)
+	suite.Empty(suite.mails())
+}
+
+func TestHandlerTestSuite(t *testing.T) {
+	suite.Run(t, new(HandlerTestSuite))
+}
@@ -0,0 +1,252 @@
+package sparkpost
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/da-coda/mailpie/pkg/handlebars"
+	"github.com/da-coda/mailpie/pkg/handler"
+	"github.com/da-coda/mailpie/pkg/instances"
+	"gopkg.in/mail.v2"
+	"io"
+	gomail "net/mail"
+	"strings"
+)
+
+//address is an address object of SparkPost. Senders and recipients can also be given as a string, which is parsed
+//into the email and name
+type address struct {
+	Email string `json:"email"`
+	Name  string `json:"name"`
+	//HeaderTo is shown in the To header instead of the recipient, which is used to send copies as Cc or Bcc
+	HeaderTo string `json:"header_to"`
+}
+
+func (a *address) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		parsed, err := gomail.ParseAddress(text)
+		if err != nil {
+			a.Email = text
+			return nil
+		}
+		a.Email, a.Name = parsed.Address, parsed.Name
+		return nil
+	}
+	type plain address
+	return json.Unmarshal(data, (*plain)(a))
+}
+
+type recipient struct {
+	Address          address                `json:"address"`
+	Tags             []string               `json:"tags"`
+	Metadata         map[string]interface{} `json:"metadata"`
+	SubstitutionData map[string]interface{} `json:"substitution_data"`
+}
+
+type file struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	//Data is base64 encoded
+	Data string `json:"data"`
+}
+
+type content struct {
+	From         *address          `json:"from"`
+	Subject      string            `json:"subject"`
+	Text         string            `json:"text"`
+	HTML         string            `json:"html"`
+	ReplyTo      string            `json:"reply_to"`
+	Headers      map[string]string `json:"headers"`
+	Attachments  []file            `json:"attachments"`
+	InlineImages []file            `json:"inline_images"`
+	//TemplateID refers to a stored template, which is not supported
+	TemplateID string `json:"template_id"`
+	//EmailRFC822 is a complete mail, which is used instead of the other fields
+	EmailRFC822 string `json:"email_rfc822"`
+}
+
+//transmission is the request of POST /api/v1/transmissions. Recipients are either a list or a stored recipient list
+type transmission struct {
+	CampaignID       string                 `json:"campaign_id"`
+	Description      string                 `json:"description"`
+	Metadata         map[string]interface{} `json:"metadata"`
+	SubstitutionData map[string]interface{} `json:"substitution_data"`
+	Recipients       json.RawMessage        `json:"recipients"`
+	Content          content                `json:"content"`
+}
+
+func missingField(description string) *apiError {
+	return &apiError{Message: "required field is missing", Description: description, Code: "1400"}
+}
+
+func invalidField(description string) *apiError {
+	return &apiError{Message: "invalid data format/type", Description: description, Code: "1300"}
+}
+
+//validate checks the transmission like SparkPost and returns its recipients
+func (t *transmission) validate() ([]recipient, *apiError) {
+	var listID struct {
+		ListID string `json:"list_id"`
+	}
+	if json.Unmarshal(t.Recipients, &listID) == nil && listID.ListID != "" {
+		return nil, &apiError{Message: "Subresource not found", Description: fmt.Sprintf("recipient list '%s' does not exist", listID.ListID), Code: "1603"}
+	}
+	var recipients []recipient
+	if len(t.Recipients) > 0 {
+		if err := json.Unmarshal(t.Recipients, &recipients); err != nil {
+			return nil, invalidField("recipients must be an array or an object with list_id")
+		}
+	}
+	if len(recipients) == 0 {
+		return nil, missingField("recipients or list_id required")
+	}
+	for _, r := range recipients {
+		if _, err := gomail.ParseAddress(r.Address.Email); err != nil {
+			return nil, invalidField(fmt.Sprintf("Invalid recipient address.email: %s", r.Address.Email))
+		}
+	}
+	c := t.Content
+	switch {
+	case c.TemplateID != "":
+		return nil, &apiError{Message: "Subresource not found", Description: fmt.Sprintf("template '%s' does not exist", c.TemplateID), Code: "1603"}
+	case c.EmailRFC822 != "":
+		return recipients, nil
+	case c.From == nil || c.From.Email == "":
+		return nil, missingField("content.from is a required field")
+	case c.Text == "" && c.HTML == "":
+		return nil, missingField("At least one of text or html needs to exist in content")
+	}
+	for _, f := range append(append([]file{}, c.Attachments...), c.InlineImages...) {
+		if _, err := base64.StdEncoding.DecodeString(f.Data); err != nil || f.Name == "" || f.Type == "" {
+			return nil, invalidField(fmt.Sprintf("attachment '%s' requires name, type and base64 encoded data", f.Name))
+		}
+	}
+	return recipients, nil
+}
+
+//build creates a mail per recipient. The substitution data and metadata of the recipient override those of the
+//transmission
+func (t *transmission) build(recipients []recipient, id string) ([]handler.Envelope, *apiError) {
+	var parts [3]*handlebars.Template
+	for i, source := range []string{t.Content.Subject, t.Content.Text, t.Content.HTML} {
+		var err error
+		parts[i], err = handlebars.Parse(source)
+		if err != nil {
+			return nil, &apiError{Message: "substitution language syntax error in template content", Description: err.Error(), Code: "3000"}
+		}
+	}
+	//the complete mail is sent as is to every recipient
+	var raw []byte
+	var rawFrom string
+	if t.Content.EmailRFC822 != "" {
+		raw = []byte(t.Content.EmailRFC822)
+		parsed, err := instances.ParseMail(raw)
+		if err != nil {
+			return nil, invalidField("content.email_rfc822 is not a valid message")
+		}
+		if sender, err := parsed.Header.AddressList("From"); err == nil && len(sender) > 0 {
+			rawFrom = sender[0].Address
+		}
+	}
+	mails := make([]handler.Envelope, 0, len(recipients))
+	for _, r := range recipients {
+		metadata := instances.Metadata{Provider: "sparkpost", Tags: r.Tags, MessageID: id, Variables: variables(t.Metadata, r.Metadata)}
+		if raw != nil {
+			mails = append(mails, handler.Envelope{From: rawFrom, To: []string{r.Address.Email}, Data: raw, Metadata: metadata})
+			continue
+		}
+		data := merge(t.SubstitutionData, r.SubstitutionData)
+		m := mail.NewMessage()
+		m.SetAddressHeader("From", t.Content.From.Email, t.Content.From.Name)
+		if r.Address.HeaderTo != "" {
+			m.SetHeader("To", r.Address.HeaderTo)
+		} else {
+			m.SetAddressHeader("To", r.Address.Email, r.Address.Name)
+		}
+		if t.Content.ReplyTo != "" {
+			m.SetHeader("Reply-To", t.Content.ReplyTo)
+		}
+		m.SetHeader("Subject", strings.TrimSpace(parts[0].Execute(data)))
+		m.SetHeader("Message-ID", fmt.Sprintf("<%s.%d@sparkpost.mailpie>", id, len(mails)))
+		for name, value := range t.Content.Headers {
+			m.SetHeader(name, value)
+		}
+		msysAPI, err := json.Marshal(struct {
+			CampaignID string            `json:"campaign_id,omitempty"`
+			Metadata   map[string]string `json:"metadata,omitempty"`
+			Tags       []string          `json:"tags,omitempty"`
+		}{t.CampaignID, metadata.Variables, r.Tags})
+		if err == nil && string(msysAPI) != "{}" {
+			m.SetHeader("X-MSYS-API", string(msysAPI))
+		}
+		if t.Content.Text != "" {
+			m.SetBody("text/plain", parts[1].Execute(data))
+		}
+		if t.Content.HTML != "" {
+			if t.Content.Text != "" {
+				m.AddAlternative("text/html", parts[2].Execute(data))
+			} else {
+				m.SetBody("text/html", parts[2].Execute(data))
+			}
+		}
+		for _, f := range t.Content.InlineImages {
+			addFile(m, f, true)
+		}
+		for _, f := range t.Content.Attachments {
+			addFile(m, f, false)
+		}
+		var buffer bytes.Buffer
+		if _, err := m.WriteTo(&buffer); err != nil {
+			return nil, &apiError{Message: "Internal Server Error"}
+		}
+		mails = append(mails, handler.Envelope{From: t.Content.From.Email, To: []string{r.Address.Email}, Data: buffer.Bytes(), Metadata: metadata})
+	}
+	return mails, nil
+}
+
+func merge(maps ...map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{})
+	for _, m := range maps {
+		for key, value := range m {
+			merged[key] = value
+		}
+	}
+	return merged
+}
+
+//variables merges the metadata into the string variables of the stored metadata. Values which aren't strings are
+//JSON encoded
+func variables(maps ...map[string]interface{}) map[string]string {
+	merged := merge(maps...)
+	if len(merged) == 0 {
+		return nil
+	}
+	variables := make(map[string]string, len(merged))
+	for key, value := range merged {
+		if text, ok := value.(string); ok {
+			variables[key] = text
+			continue
+		}
+		encoded, _ := json.Marshal(value)
+		variables[key] = string(encoded)
+	}
+	return variables
+}
+
+//addFile attaches the file or embeds it as inline image, which is referenced in the html like cid:<name>
+func addFile(m *mail.Message, f file, inline bool) {
+	decoded, _ := base64.StdEncoding.DecodeString(f.Data)
+	header := map[string][]string{"Content-Type": {fmt.Sprintf("%s; name=%q", f.Type, f.Name)}}
+	copyFunc := mail.SetCopyFunc(func(w io.Writer) error {
+		_, err := w.Write(decoded)
+		return err
+	})
+	if inline {
+		header["Content-ID"] = []string{"<" + f.Name + ">"}
+		m.Embed(f.Name, copyFunc, mail.SetHeader(header))
+		return
+	}
+	m.Attach(f.Name, copyFunc, mail.SetHeader(header))
+}
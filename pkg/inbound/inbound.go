@@ -0,0 +1,296 @@
+//Package inbound simulates the inbound parsing of mail providers, which post received mails to an application. Stored
+//mails are forwarded to the configured routes as multipart form, like SendGrid Inbound Parse or a Mailgun route with a
+//forward action
+package inbound
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/da-coda/mailpie/internal/apiutil"
+	"github.com/da-coda/mailpie/pkg/config"
+	"github.com/da-coda/mailpie/pkg/event"
+	"github.com/da-coda/mailpie/pkg/instances"
+	"github.com/da-coda/mailpie/pkg/store"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+//provider writes the form fields of the mail for the recipients the route matched
+type provider interface {
+	form(writer *multipart.Writer, mail instances.Mail, recipient string) error
+	//perRecipient reports whether the provider posts the mail once per recipient instead of once for all
+	perRecipient() bool
+}
+
+//route is a configured inbound route
+type route struct {
+	config.InboundRoute
+	provider  provider
+	recipient *regexp.Regexp
+}
+
+//recipients returns the recipients of the mail the route forwards automatically
+func (r *route) recipients(mail instances.Mail) []string {
+	if r.recipient == nil {
+		return nil
+	}
+	var matched []string
+	for _, recipient := range mail.Recipients() {
+		if r.recipient.MatchString(recipient) {
+			matched = append(matched, recipient)
+		}
+	}
+	return matched
+}
+
+//Forwarder posts stored mails to the routes
+type Forwarder struct {
+	mailStore *store.MailStore
+	routes    []*route
+	client    *http.Client
+
+	lock sync.Mutex
+	//stopped is cancelled on Close, stored mails are not forwarded afterwards
+	stopped context.Context
+	stop    context.CancelFunc
+	running sync.WaitGroup
+}
+
+//NewForwarder validates the routes. The mails stored afterwards are posted to the matching routes once the
+//messageQueue announces them, unless they were deleted from the mailStore in the meantime
+func NewForwarder(mailStore *store.MailStore, messageQueue event.Subscribable, routes []config.InboundRoute) (*Forwarder, error) {
+	f := &Forwarder{mailStore: mailStore, client: &http.Client{Timeout: 30 * time.Second}}
+	f.stopped, f.stop = context.WithCancel(context.Background())
+	for i, inboundRoute := range routes {
+		r := &route{InboundRoute: inboundRoute}
+		switch inboundRoute.Provider {
+		case "sendgrid":
+			r.provider = sendGrid{}
+		case "mailgun":
+			r.provider = mailgun{signingKey: inboundRoute.SigningKey}
+		default:
+			return nil, errors.Errorf("invalid inbound route %d: unknown provider '%s'", i, inboundRoute.Provider)
+		}
+		if inboundRoute.Recipient != "" {
+			recipient, err := regexp.Compile(inboundRoute.Recipient)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid recipient of inbound route %d", i)
+			}
+			r.recipient = recipient
+		}
+		f.routes = append(f.routes, r)
+	}
+	messageQueue.Subscribe(store.NewMailStoredEvent, f.mailStored)
+	return f, nil
+}
+
+func (f *Forwarder) mailStored(_ string, data interface{}) {
+	mail := data.(store.MailStored).Mail
+	if _, err := f.mailStore.GetSingle(mail.Key); err != nil {
+		return
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.stopped.Err() != nil {
+		return
+	}
+	for _, r := range f.routes {
+		recipients := r.recipients(mail)
+		if len(recipients) == 0 {
+			continue
+		}
+		f.running.Add(1)
+		go func(r *route) {
+			defer f.running.Done()
+			for _, result := range f.forward(r, mail, recipients) {
+				if result.Error != "" {
+					logrus.WithField("url", r.URL).WithField("key", mail.Key).WithField("error", result.Error).Warn("Unable to forward mail to inbound route")
+				}
+			}
+		}(r)
+	}
+}
+
+//Close stops forwarding stored mails and waits for the running posts
+func (f *Forwarder) Close() {
+	f.lock.Lock()
+	f.stop()
+	f.lock.Unlock()
+	f.running.Wait()
+}
+
+//result is the outcome of a post to a route
+type result struct {
+	URL       string `json:"url"`
+	Recipient string `json:"recipient,omitempty"`
+	Status    int    `json:"status,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+//forward posts the mail to the route, once or once per recipient depending on the provider
+func (f *Forwarder) forward(r *route, mail instances.Mail, recipients []string) []result {
+	if !r.provider.perRecipient() {
+		recipients = []string{""}
+	}
+	results := make([]result, 0, len(recipients))
+	for _, recipient := range recipients {
+		status, err := f.post(r, mail, recipient)
+		res := result{URL: r.URL, Recipient: recipient, Status: status}
+		if err != nil {
+			res.Error = err.Error()
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+func (f *Forwarder) post(r *route, mail instances.Mail, recipient string) (int, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	if err := r.provider.form(writer, mail, recipient); err != nil {
+		return 0, errors.Wrap(err, "unable to write form")
+	}
+	if err := writer.Close(); err != nil {
+		return 0, errors.Wrap(err, "unable to write form")
+	}
+	request, err := http.NewRequest(http.MethodPost, r.URL, &body)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to create request")
+	}
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	request.Header.Set("User-Agent", "Mailpie-Inbound")
+	resp, err := f.client.Do(request)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to post mail")
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
+
+//Register adds the route to forward stored mails on demand
+func (f *Forwarder) Register(router *mux.Router) {
+	router.HandleFunc("/api/inbound/forward", f.serveForward).Methods("POST")
+}
+
+//forwardRequest forwards a stored mail to a route. Without route, it is forwarded to all routes. Routes posting once
+//per recipient post it for all recipients of the mail, regardless of their recipient rule
+type forwardRequest struct {
+	Key   string `json:"key"`
+	Route *int   `json:"route"`
+}
+
+//serveForward handles POST /api/inbound/forward, the response holds the result of every post
+func (f *Forwarder) serveForward(w http.ResponseWriter, r *http.Request) {
+	var request forwardRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	routes := f.routes
+	if request.Route != nil {
+		if *request.Route < 0 || *request.Route >= len(f.routes) {
+			http.Error(w, "Route not found", http.StatusNotFound)
+			return
+		}
+		routes = []*route{f.routes[*request.Route]}
+	}
+	mail, err := f.mailStore.GetSingle(request.Key)
+	if err != nil {
+		http.Error(w, "Mail not found", http.StatusNotFound)
+		return
+	}
+	results := make([]result, 0, len(routes))
+	for _, rt := range routes {
+		results = append(results, f.forward(rt, mail, mail.Recipients())...)
+	}
+	apiutil.WriteJSON(w, http.StatusOK, results)
+}
+
+//content holds what the providers post of a mail: the text and html body and the attachments, which includes inline
+//images referenced by a Content-ID
+type content struct {
+	text, html  instances.Part
+	attachments []instances.Part
+}
+
+func parseContent(mail instances.Mail) content {
+	var c content
+	for _, part := range mail.Parts() {
+		switch {
+		case part.IsAttachment() || part.ContentID != "":
+			c.attachments = append(c.attachments, part)
+		case part.ContentType == "text/plain" && c.text.Content == nil:
+			c.text = part
+		case part.ContentType == "text/html" && c.html.Content == nil:
+			c.html = part
+		default:
+			c.attachments = append(c.attachments, part)
+		}
+	}
+	return c
+}
+
+//filename is the name of the attachment, derived from its position if the part has none
+func filename(part instances.Part, index int) string {
+	if part.Filename != "" {
+		return part.Filename
+	}
+	return fmt.Sprintf("attachment%d", index)
+}
+
+//rawHeader returns the header block of the mail as received
+func rawHeader(mail instances.Mail) string {
+	raw := mail.RawMessage
+	for _, separator := range []string{"\r\n\r\n", "\n\n"} {
+		if i := bytes.Index(raw, []byte(separator)); i >= 0 {
+			return string(raw[:i+len(separator)/2])
+		}
+	}
+	return string(raw)
+}
+
+//writeFile adds the part as file field of the form
+func writeFile(writer *multipart.Writer, field string, part instances.Part, name string) error {
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, field, strings.ReplaceAll(name, `"`, "")))
+	header.Set("Content-Type", part.ContentType)
+	w, err := writer.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(part.Content)
+	return err
+}
+
+//writeFields adds the fields of the form in the given order, a multipart.Writer does not fail unless its writer does
+func writeFields(writer *multipart.Writer, fields [][2]string) error {
+	for _, field := range fields {
+		if err := writer.WriteField(field[0], field[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//marshal encodes the value of a JSON field without escaping HTML characters, which the providers do not escape either
+func marshal(value interface{}) (string, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buffer.String(), "\n"), nil
+}
@@ -0,0 +1,214 @@
+package inbound
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/da-coda/mailpie/pkg/config"
+	"github.com/da-coda/mailpie/pkg/event"
+	"github.com/da-coda/mailpie/pkg/instances"
+	"github.com/da-coda/mailpie/pkg/store"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/suite"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+)
+
+const rawReply = "From: Alex <alex@example.com>\r\n" +
+	"To: support@example.com, sales@example.com\r\n" +
+	"Subject: =?UTF-8?Q?Re:_Gr=C3=BC=C3=9Fe?=\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n\r\n" +
+	"--outer\r\nContent-Type: multipart/alternative; boundary=inner\r\n\r\n" +
+	"--inner\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\nThanks!\r\n\r\n-- \r\nAlex\r\n\r\nOn Mon, Jan 1, 2024, Bob wrote:\r\n> Hello\r\n" +
+	"--inner\r\nContent-Type: text/html\r\n\r\n<p>Thanks!</p><blockquote>Hello</blockquote>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\nContent-Type: image/png\r\nContent-ID: <logo@example.com>\r\nContent-Disposition: inline\r\nContent-Transfer-Encoding: base64\r\n\r\naGVsbG8=\r\n" +
+	"--outer\r\nContent-Type: text/csv\r\nContent-Disposition: attachment; filename=report.csv\r\n\r\na,b\r\n" +
+	"--outer--\r\n"
+
+//form is a form posted to the application
+type form struct {
+	path   string
+	values map[string][]string
+	files  map[string]string
+}
+
+type ForwarderTestSuite struct {
+	suite.Suite
+	mailStore *store.MailStore
+	app       *httptest.Server
+	received  chan form
+	forwarder *Forwarder
+	api       *httptest.Server
+}
+
+func (suite *ForwarderTestSuite) SetupTest() {
+	suite.mailStore = store.CreateMailStore(event.CreateOrGet())
+	suite.received = make(chan form, 16)
+	suite.app = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f := form{path: r.URL.Path, values: r.MultipartForm.Value, files: make(map[string]string)}
+		for field, headers := range r.MultipartForm.File {
+			file, _ := headers[0].Open()
+			content, _ := io.ReadAll(file)
+			file.Close()
+			f.files[field] = headers[0].Filename + ":" + headers[0].Header.Get("Content-Type") + ":" + string(content)
+		}
+		suite.received <- f
+	}))
+	var err error
+	suite.forwarder, err = NewForwarder(suite.mailStore, event.CreateOrGet(), []config.InboundRoute{
+		{Provider: "sendgrid", URL: suite.app.URL + "/sendgrid", Recipient: "^support@"},
+		{Provider: "mailgun", URL: suite.app.URL + "/mailgun", Recipient: "@example\\.com$", SigningKey: "key-test"},
+		{Provider: "sendgrid", URL: suite.app.URL + "/manual"},
+	})
+	suite.Require().Nil(err)
+	router := mux.NewRouter()
+	suite.forwarder.Register(router)
+	suite.api = httptest.NewServer(router)
+}
+
+func (suite *ForwarderTestSuite) TearDownTest() {
+	suite.api.Close()
+	suite.app.Close()
+}
+
+func (suite *ForwarderTestSuite) store(key string) {
+	mail, err := instances.ParseMail([]byte(rawReply))
+	suite.Require().Nil(err)
+	mail.EnvelopeFrom = "alex@example.com"
+	mail.EnvelopeTo = []string{"support@example.com", "sales@example.com"}
+	suite.Require().Nil(suite.mailStore.Add(key, *mail))
+}
+
+//receive waits for count forms and returns them sorted by path and recipient, since they are posted concurrently
+func (suite *ForwarderTestSuite) receive(count int) []form {
+	var forms []form
+	for len(forms) < count {
+		select {
+		case f := <-suite.received:
+			forms = append(forms, f)
+		case <-time.After(5 * time.Second):
+			suite.FailNow("Forms not received")
+		}
+	}
+	sort.Slice(forms, func(i, j int) bool {
+		if forms[i].path != forms[j].path {
+			return forms[i].path < forms[j].path
+		}
+		return forms[i].value("recipient") < forms[j].value("recipient")
+	})
+	return forms
+}
+
+func (f form) value(name string) string {
+	if len(f.values[name]) == 0 {
+		return ""
+	}
+	return f.values[name][0]
+}
+
+func (suite *ForwarderTestSuite) TestMailStored() {
+	suite.store("reply")
+	forms := suite.receive(3)
+
+	for i, recipient := range []string{"sales@example.com", "support@example.com"} {
+		mg := forms[i]
+		suite.Equal("/mailgun", mg.path)
+		suite.Equal(recipient, mg.value("recipient"))
+		suite.Equal("alex@example.com", mg.value("sender"))
+		suite.Equal("Thanks!", mg.value("stripped-text"))
+		suite.Equal("Alex", mg.value("stripped-signature"))
+		suite.Equal("<p>Thanks!</p>", mg.value("stripped-html"))
+		suite.Equal("2", mg.value("attachment-count"))
+		suite.Equal(`{"<logo@example.com>":"attachment-1"}`, mg.value("content-id-map"))
+		suite.Equal("attachment1:image/png:hello", mg.files["attachment-1"])
+		suite.Equal("report.csv:text/csv:a,b", mg.files["attachment-2"])
+		suite.Contains(mg.value("message-headers"), `["X-Mailgun-Sscore","0.0"]`)
+		mac := hmac.New(sha256.New, []byte("key-test"))
+		mac.Write([]byte(mg.value("timestamp") + mg.value("token")))
+		suite.Equal(hex.EncodeToString(mac.Sum(nil)), mg.value("signature"), "Mailgun signature is invalid")
+	}
+
+	sg := forms[2]
+	suite.Equal("/sendgrid", sg.path, "The manual route has no recipient rule")
+	suite.Equal("Re: Grüße", sg.value("subject"))
+	suite.Equal("Alex <alex@example.com>", sg.value("from"))
+	suite.Contains(sg.value("headers"), "Subject: =?UTF-8?Q?Re:_Gr=C3=BC=C3=9Fe?=\r\n")
+	suite.Contains(sg.value("text"), "Thanks!")
+	suite.Equal("<p>Thanks!</p><blockquote>Hello</blockquote>", sg.value("html"))
+	suite.Equal("0.0", sg.value("spam_score"))
+	suite.Equal("2", sg.value("attachments"))
+	suite.Equal(`{"logo@example.com":"attachment1"}`, sg.value("content-ids"))
+	suite.Equal("report.csv:text/csv:a,b", sg.files["attachment2"])
+	var envelope struct {
+		To   []string
+		From string
+	}
+	suite.Require().Nil(json.Unmarshal([]byte(sg.value("envelope")), &envelope))
+	suite.Equal([]string{"support@example.com", "sales@example.com"}, envelope.To)
+	suite.Equal("alex@example.com", envelope.From)
+	var charsets map[string]string
+	suite.Require().Nil(json.Unmarshal([]byte(sg.value("charsets")), &charsets))
+	suite.Equal("UTF-8", charsets["text"])
+}
+
+func (suite *ForwarderTestSuite) TestForward() {
+	suite.store("manual")
+	suite.receive(3)
+
+	resp, err := http.Post(suite.api.URL+"/api/inbound/forward", "application/json", bytes.NewBufferString(`{"key": "manual", "route": 2}`))
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+	suite.Equal(http.StatusOK, resp.StatusCode)
+	var results []result
+	suite.Require().Nil(json.NewDecoder(resp.Body).Decode(&results))
+	suite.Equal([]result{{URL: suite.app.URL + "/manual", Status: http.StatusOK}}, results)
+	suite.Equal("/manual", suite.receive(1)[0].path)
+
+	for body, status := range map[string]int{
+		`{"key": "manual", "route": 3}`: http.StatusNotFound,
+		`{"key": "missing"}`:            http.StatusNotFound,
+		`{"key": `:                      http.StatusBadRequest,
+	} {
+		resp, err := http.Post(suite.api.URL+"/api/inbound/forward", "application/json", bytes.NewBufferString(body))
+		suite.Require().Nil(err)
+		resp.Body.Close()
+		suite.Equal(status, resp.StatusCode, body)
+	}
+}
+
+func (suite *ForwarderTestSuite) TestClose() {
+	suite.store("closing")
+	event.CreateOrGet().Flush()
+	suite.forwarder.Close()
+	suite.Len(suite.received, 3, "Close should wait for the running posts")
+	suite.receive(3)
+
+	suite.store("closed")
+	event.CreateOrGet().Flush()
+	suite.Empty(suite.received, "Stored mails should not be forwarded after Close")
+}
+
+func (suite *ForwarderTestSuite) TestNewForwarder_Invalid() {
+	for _, route := range []config.InboundRoute{
+		{Provider: "postmark", URL: "http://localhost"},
+		{Provider: "mailgun", URL: "http://localhost", Recipient: "("},
+	} {
+		_, err := NewForwarder(suite.mailStore, event.CreateOrGet(), []config.InboundRoute{route})
+		suite.NotNil(err, route)
+	}
+}
+
+func TestForwarderTestSuite(t *testing.T) {
+	suite.Run(t, new(ForwarderTestSuite))
+}
@@ -0,0 +1,124 @@
+package inbound
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/da-coda/mailpie/internal/apiutil"
+	"github.com/da-coda/mailpie/pkg/instances"
+	"mime/multipart"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//mailgun posts the mail like a Mailgun route with a forward action: once per recipient, with the quotes and the
+//signature stripped from the text. The post is signed with the HMAC of the timestamp followed by the token, keyed with
+//the signing key
+type mailgun struct {
+	signingKey string
+}
+
+func (mailgun) perRecipient() bool {
+	return true
+}
+
+//quoteIntroduction matches the line introducing a quoted reply, like "On Mon, Jan 1, 2024, Alex wrote:"
+var quoteIntroduction = regexp.MustCompile(`(?m)^On .*wrote:\s*$`)
+
+//quotedHTML matches the quotes of html replies
+var quotedHTML = regexp.MustCompile(`(?s)<blockquote.*</blockquote>`)
+
+func (mg mailgun) form(writer *multipart.Writer, mail instances.Mail, recipient string) error {
+	c := parseContent(mail)
+	text := string(c.text.Content)
+	stripped, signature := stripText(text)
+	html := string(c.html.Content)
+
+	//message-headers is a list of name and value pairs, sorted by name since the parsed header has no order
+	headers := make([][2]string, 0, len(mail.Header)+2)
+	names := make([]string, 0, len(mail.Header))
+	for name := range mail.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range mail.Header[name] {
+			headers = append(headers, [2]string{name, value})
+		}
+	}
+	headers = append(headers, [2]string{"X-Mailgun-Sscore", spamScore}, [2]string{"X-Mailgun-Spf", "Pass"})
+	headersJSON, err := marshal(headers)
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	token := apiutil.NewHexToken(25)
+	mac := hmac.New(sha256.New, []byte(mg.signingKey))
+	mac.Write([]byte(timestamp + token))
+
+	fields := [][2]string{
+		{"recipient", recipient},
+		{"sender", mail.EnvelopeFrom},
+		{"from", mail.Header.Get("From")},
+		{"subject", mail.Header.Get("Subject")},
+		{"body-plain", text},
+		{"stripped-text", stripped},
+		{"stripped-signature", signature},
+		{"body-html", html},
+		{"stripped-html", quotedHTML.ReplaceAllString(html, "")},
+		{"attachment-count", fmt.Sprint(len(c.attachments))},
+		{"message-headers", headersJSON},
+		{"timestamp", timestamp},
+		{"token", token},
+		{"signature", hex.EncodeToString(mac.Sum(nil))},
+	}
+	contentIDs := make(map[string]string)
+	for i, part := range c.attachments {
+		if part.ContentID != "" {
+			contentIDs["<"+part.ContentID+">"] = fmt.Sprintf("attachment-%d", i+1)
+		}
+	}
+	if len(contentIDs) > 0 {
+		contentIDsJSON, err := marshal(contentIDs)
+		if err != nil {
+			return err
+		}
+		fields = append(fields, [2]string{"content-id-map", contentIDsJSON})
+	}
+	if err := writeFields(writer, fields); err != nil {
+		return err
+	}
+	for i, part := range c.attachments {
+		if err := writeFile(writer, fmt.Sprintf("attachment-%d", i+1), part, filename(part, i+1)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//stripText splits the text of a reply into the new text, without quoted lines, and the signature following the "-- "
+//delimiter
+func stripText(text string) (stripped, signature string) {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	if loc := quoteIntroduction.FindStringIndex(text); loc != nil {
+		text = text[:loc[0]]
+	}
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(line, ">") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	text = strings.Join(lines, "\n")
+	if i := strings.Index(text, "\n-- \n"); i >= 0 {
+		signature = strings.TrimSpace(text[i+len("\n-- \n"):])
+		text = text[:i]
+	}
+	return strings.TrimSpace(text), signature
+}
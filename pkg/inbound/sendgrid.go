@@ -0,0 +1,116 @@
+package inbound
+
+import (
+	"fmt"
+	"github.com/da-coda/mailpie/pkg/instances"
+	"mime"
+	"mime/multipart"
+)
+
+//the results of the checks SendGrid and Mailgun post with a mail. Mails are not checked, they always pass
+const (
+	spamScore = "0.0"
+	spf       = "pass"
+	senderIP  = "127.0.0.1"
+)
+
+//sendGrid posts the mail like SendGrid Inbound Parse with the raw option disabled: once for all recipients, with the
+//bodies and attachments as separate fields
+type sendGrid struct{}
+
+func (sendGrid) perRecipient() bool {
+	return false
+}
+
+type sendGridAttachment struct {
+	Filename  string `json:"filename"`
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	ContentID string `json:"content-id,omitempty"`
+}
+
+func (sendGrid) form(writer *multipart.Writer, mail instances.Mail, _ string) error {
+	c := parseContent(mail)
+	decoder := new(mime.WordDecoder)
+	decode := func(name string) string {
+		value, err := decoder.DecodeHeader(mail.Header.Get(name))
+		if err != nil {
+			return mail.Header.Get(name)
+		}
+		return value
+	}
+	envelope, err := marshal(map[string]interface{}{"to": mail.Recipients(), "from": mail.EnvelopeFrom})
+	if err != nil {
+		return err
+	}
+	charsets := map[string]string{"to": "UTF-8", "from": "UTF-8", "subject": "UTF-8", "cc": "UTF-8"}
+	fields := [][2]string{
+		{"headers", rawHeader(mail)},
+		{"dkim", "none"},
+		{"to", decode("To")},
+		{"from", decode("From")},
+		{"subject", decode("Subject")},
+		{"sender_ip", senderIP},
+		{"spam_report", "Spam detection software has not identified this message as spam.\n"},
+		{"envelope", envelope},
+		{"spam_score", spamScore},
+		{"SPF", spf},
+	}
+	if cc := decode("Cc"); cc != "" {
+		fields = append(fields, [2]string{"cc", cc})
+	}
+	if c.text.Content != nil {
+		fields = append(fields, [2]string{"text", string(c.text.Content)})
+		charsets["text"] = charset(c.text)
+	}
+	if c.html.Content != nil {
+		fields = append(fields, [2]string{"html", string(c.html.Content)})
+		charsets["html"] = charset(c.html)
+	}
+	charsetsJSON, err := marshal(charsets)
+	if err != nil {
+		return err
+	}
+	fields = append(fields, [2]string{"charsets", charsetsJSON}, [2]string{"attachments", fmt.Sprint(len(c.attachments))})
+	if len(c.attachments) > 0 {
+		info := make(map[string]sendGridAttachment)
+		contentIDs := make(map[string]string)
+		for i, part := range c.attachments {
+			field := fmt.Sprintf("attachment%d", i+1)
+			name := filename(part, i+1)
+			info[field] = sendGridAttachment{Filename: name, Name: name, Type: part.ContentType, ContentID: part.ContentID}
+			if part.ContentID != "" {
+				contentIDs[part.ContentID] = field
+			}
+		}
+		infoJSON, err := marshal(info)
+		if err != nil {
+			return err
+		}
+		fields = append(fields, [2]string{"attachment-info", infoJSON})
+		if len(contentIDs) > 0 {
+			contentIDsJSON, err := marshal(contentIDs)
+			if err != nil {
+				return err
+			}
+			fields = append(fields, [2]string{"content-ids", contentIDsJSON})
+		}
+	}
+	if err := writeFields(writer, fields); err != nil {
+		return err
+	}
+	for i, part := range c.attachments {
+		if err := writeFile(writer, fmt.Sprintf("attachment%d", i+1), part, filename(part, i+1)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//charset is the charset of a body, SendGrid reports bodies without charset as UTF-8
+func charset(part instances.Part) string {
+	if part.Charset == "" {
+		return "UTF-8"
+	}
+	return part.Charset
+}
@@ -3,14 +3,49 @@ package instances
 import (
 	"bytes"
 	"io"
+	"mime"
 	gomail "net/mail"
+	"time"
 )
 
 //Mail is a wrapper struct around the go net/mail.Message struct. This allows us to throw it into the imap handler without magic stuff
 type Mail struct {
 	gomail.Message
 	RawMessage []byte
-	readIndex  int64
+	//Key is the key the mail is stored with in the MailStore
+	Key string
+	//EnvelopeFrom and EnvelopeTo hold the SMTP envelope (MAIL FROM and RCPT TO), which can differ from the headers
+	EnvelopeFrom string
+	EnvelopeTo   []string
+	//Received is the time the mail was stored, set by the MailStore if empty
+	Received time.Time
+	//Metadata is given by the HTTP API the mail was sent with and is not part of the mail itself
+	Metadata Metadata
+	//Annotations are added to the stored mail by hooks, like the output of exec hooks
+	Annotations []Annotation
+	readIndex   int64
+}
+
+//Metadata holds what the HTTP APIs of mail providers attach to a mail for tracking, like the tags and custom variables
+//of Mailgun, and the id the mail got from the provider if it differs from the Message-ID
+type Metadata struct {
+	//Provider is the name of the emulated API, e.g. mailgun
+	Provider  string
+	Tags      []string
+	Variables map[string]string
+	MessageID string
+}
+
+//Annotation is the result of a command run for the mail
+type Annotation struct {
+	//Source names what added the annotation, e.g. the command of an exec hook
+	Source   string
+	Time     time.Time
+	ExitCode int
+	Stdout   string
+	Stderr   string
+	//Error is set if the command could not be run or timed out
+	Error string
 }
 
 func (m *Mail) Read(p []byte) (n int, err error) {
@@ -29,6 +64,48 @@ func (m *Mail) Len() int {
 	return len(m.RawMessage)
 }
 
+//Recipients returns the envelope recipients of the mail. If the mail has no envelope, the addresses from the To, Cc and
+//Bcc headers are used instead
+func (m *Mail) Recipients() []string {
+	if len(m.EnvelopeTo) > 0 {
+		return m.EnvelopeTo
+	}
+	var recipients []string
+	for _, header := range []string{"To", "Cc", "Bcc"} {
+		addresses, err := m.Header.AddressList(header)
+		if err != nil {
+			continue
+		}
+		for _, address := range addresses {
+			recipients = append(recipients, address.Address)
+		}
+	}
+	return recipients
+}
+
+//Sender returns the envelope sender of the mail. If the mail has no envelope, the address of the From header is used
+//instead
+func (m *Mail) Sender() string {
+	if m.EnvelopeFrom != "" {
+		return m.EnvelopeFrom
+	}
+	from, err := m.Header.AddressList("From")
+	if err != nil || len(from) == 0 {
+		return ""
+	}
+	return from[0].Address
+}
+
+//Subject returns the decoded Subject header, or the header as it is if it can't be decoded
+func (m *Mail) Subject() string {
+	subject := m.Header.Get("Subject")
+	decoded, err := new(mime.WordDecoder).DecodeHeader(subject)
+	if err != nil {
+		return subject
+	}
+	return decoded
+}
+
 //ParseMail creates a Mail instance for a valid email. Calls net/mail.ReadMessage and returns any error occurring there
 func ParseMail(data []byte) (*Mail, error) {
 	parsedMail, err := gomail.ReadMessage(bytes.NewReader(data))
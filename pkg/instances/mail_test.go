@@ -61,6 +61,70 @@ func (suite *MailUnitTestSuite) TestLen() {
 	assert.Equal(suite.T(), len(mail), parsed.Len(), "Length of parsed mail should be the Same as length of original mail")
 }
 
+func (suite *MailUnitTestSuite) TestRecipients_Envelope() {
+	parsed, err := ParseMail(mail)
+	assert.Nil(suite.T(), err, "No error expected")
+	parsed.EnvelopeTo = []string{"bob@example.com"}
+	assert.Equal(suite.T(), []string{"bob@example.com"}, parsed.Recipients(), "Envelope recipients should be preferred")
+}
+
+func (suite *MailUnitTestSuite) TestRecipients_Headers() {
+	parsed, err := ParseMail(mail)
+	assert.Nil(suite.T(), err, "No error expected")
+	assert.Equal(suite.T(), []string{"bob@example.com", "cora@example.com", "dan@example.com"}, parsed.Recipients())
+}
+
+func (suite *MailUnitTestSuite) TestSender() {
+	parsed, err := ParseMail(mail)
+	assert.Nil(suite.T(), err, "No error expected")
+	assert.Equal(suite.T(), "alex@example.com", parsed.Sender())
+	parsed.EnvelopeFrom = "bounces@example.com"
+	assert.Equal(suite.T(), "bounces@example.com", parsed.Sender(), "The envelope sender should be preferred")
+}
+
+func (suite *MailUnitTestSuite) TestSubject() {
+	parsed, err := ParseMail([]byte("Subject: =?UTF-8?Q?Gr=C3=BC=C3=9Fe?=\r\n\r\nHello\r\n"))
+	assert.Nil(suite.T(), err, "No error expected")
+	assert.Equal(suite.T(), "Grüße", parsed.Subject())
+	parsed, err = ParseMail([]byte("Subject: =?x-unknown?Q?Hi?=\r\n\r\nHello\r\n"))
+	assert.Nil(suite.T(), err, "No error expected")
+	assert.Equal(suite.T(), "=?x-unknown?Q?Hi?=", parsed.Subject(), "Undecodable subjects should be kept")
+}
+
+func (suite *MailUnitTestSuite) TestParts_SinglePart() {
+	parsed, err := ParseMail(mail)
+	assert.Nil(suite.T(), err, "No error expected")
+	parts := parsed.Parts()
+	assert.Len(suite.T(), parts, 1)
+	assert.Equal(suite.T(), "text/html", parts[0].ContentType)
+	assert.Equal(suite.T(), "UTF-8", parts[0].Charset)
+	assert.Equal(suite.T(), "Hello <b>Bob</b> and <i>Cora</i>!\n", string(parts[0].Content))
+}
+
+func (suite *MailUnitTestSuite) TestParts_Multipart() {
+	raw := "Content-Type: multipart/mixed; boundary=outer\r\n\r\n" +
+		"--outer\r\nContent-Type: multipart/alternative; boundary=inner\r\n\r\n" +
+		"--inner\r\nContent-Type: text/plain\r\n\r\nplain\r\n" +
+		"--inner\r\nContent-Type: text/html\r\n\r\n<p>html</p>\r\n" +
+		"--inner--\r\n" +
+		"--outer\r\nContent-Type: image/png\r\nContent-ID: <logo@example.com>\r\nContent-Disposition: attachment; filename=logo.png\r\nContent-Transfer-Encoding: base64\r\n\r\naGVs\r\nbG8=\r\n" +
+		"--outer--\r\n"
+	parsed, err := ParseMail([]byte(raw))
+	assert.Nil(suite.T(), err, "No error expected")
+	parts := parsed.Parts()
+	assert.Len(suite.T(), parts, 3, "Nested multiparts should be flattened")
+	assert.Equal(suite.T(), "hello", string(parts[2].Content), "Transfer encoding should be removed")
+	assert.Equal(suite.T(), "logo@example.com", parts[2].ContentID)
+	assert.Equal(suite.T(), "logo.png", parts[2].Filename)
+	assert.True(suite.T(), parts[2].IsAttachment())
+
+	html, found := parsed.FindPart("text/html")
+	assert.True(suite.T(), found)
+	assert.Equal(suite.T(), "<p>html</p>", string(html.Content))
+	_, found = parsed.FindPart("image/png")
+	assert.False(suite.T(), found, "Attachments should not be found")
+}
+
 func TestMailUnitTestSuite(t *testing.T) {
 	suite.Run(t, new(MailUnitTestSuite))
 }
@@ -0,0 +1,112 @@
+package instances
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	gomail "net/mail"
+	"net/textproto"
+	"strings"
+)
+
+//Part is a single, non multipart, MIME part of a mail with the transfer encoding removed
+type Part struct {
+	//ContentType is the media type without parameters, text/plain if the part has none
+	ContentType string
+	Charset     string
+	//Disposition is inline or attachment, empty if the part has no Content-Disposition
+	Disposition string
+	Filename    string
+	//ContentID is the Content-ID without angle brackets
+	ContentID string
+	Content   []byte
+}
+
+//IsAttachment reports whether the part is meant to be saved instead of displayed
+func (p Part) IsAttachment() bool {
+	return p.Disposition == "attachment" || (p.Filename != "" && p.Disposition != "inline")
+}
+
+//Parts returns all parts of the mail in the order they appear, with nested multiparts flattened. A mail without
+//multipart body has a single part
+func (m *Mail) Parts() []Part {
+	message, err := gomail.ReadMessage(bytes.NewReader(m.RawMessage))
+	if err != nil {
+		return nil
+	}
+	body, _ := io.ReadAll(message.Body)
+	return parseParts(textproto.MIMEHeader(message.Header), body)
+}
+
+//FindPart returns the first part which is not an attachment and has the content type
+func (m *Mail) FindPart(contentType string) (Part, bool) {
+	for _, part := range m.Parts() {
+		if part.ContentType == contentType && !part.IsAttachment() {
+			return part, true
+		}
+	}
+	return Part{}, false
+}
+
+func parseParts(header textproto.MIMEHeader, body []byte) []Part {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" {
+		var parts []Part
+		reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for {
+			sub, err := reader.NextRawPart()
+			if err != nil {
+				break
+			}
+			content, _ := io.ReadAll(sub)
+			parts = append(parts, parseParts(sub.Header, content)...)
+		}
+		return parts
+	}
+
+	part := Part{
+		ContentType: mediaType,
+		Charset:     params["charset"],
+		ContentID:   strings.Trim(header.Get("Content-Id"), "<> "),
+		Filename:    params["name"],
+		Content:     decodeTransferEncoding(header.Get("Content-Transfer-Encoding"), body),
+	}
+	if disposition, dispositionParams, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		part.Disposition = disposition
+		if dispositionParams["filename"] != "" {
+			part.Filename = dispositionParams["filename"]
+		}
+	}
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(part.Filename); err == nil {
+		part.Filename = decoded
+	}
+	return []Part{part}
+}
+
+func decodeTransferEncoding(encoding string, body []byte) []byte {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		cleaned := bytes.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+				return -1
+			}
+			return r
+		}, body)
+		decoded, err := base64.StdEncoding.DecodeString(string(cleaned))
+		if err == nil {
+			return decoded
+		}
+	case "quoted-printable":
+		decoded, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+		if err == nil {
+			return decoded
+		}
+	}
+	return body
+}
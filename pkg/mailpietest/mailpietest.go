@@ -0,0 +1,333 @@
+//Package mailpietest runs Mailpie inside Go tests. New starts a server on free ports which is shut down with the test,
+//the code under test sends mails to its SMTP address and the test checks them with the assertion helpers:
+//
+//	server := mailpietest.New(t)
+//	sendWelcomeMail(server.SMTPAddr(), "bob@example.com")
+//	mail := server.AssertReceived(t, mailpietest.Match{To: "bob@example.com", Subject: "Welcome"})
+//	links := mailpietest.ExtractLinks(mail)
+package mailpietest
+
+import (
+	"bytes"
+	"context"
+	"github.com/da-coda/mailpie"
+	"github.com/da-coda/mailpie/pkg/config"
+	"github.com/da-coda/mailpie/pkg/instances"
+	"github.com/da-coda/mailpie/pkg/store"
+	"golang.org/x/net/html"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+//credentials of the user every server is configured with. Logging in via SMTP is optional, IMAP, POP3 and JMAP
+//require them
+const (
+	username = "mailpie"
+	password = "mailpie"
+)
+
+//shutdownTimeout limits how long the cleanup waits for running mail transactions and commands. Connections the test
+//left open without anything running are closed right away
+const shutdownTimeout = 5 * time.Second
+
+//Server is a Mailpie server started for a test
+type Server struct {
+	*mailpie.Server
+}
+
+//New starts a server with all services on free ports of the loopback interface. The server is shut down when the test
+//and its subtests are finished, clients the test left connected are disconnected. The configure functions can change
+//the config before the server is created, e.g. to disable services or to add exec hooks
+func New(t testing.TB, configure ...func(conf *config.Config)) *Server {
+	t.Helper()
+	conf, err := config.Default()
+	if err != nil {
+		t.Fatalf("mailpietest: unable to create config: %s", err)
+	}
+	conf.NetworkConfigs.SMTP.Host, conf.NetworkConfigs.SMTP.Port = "127.0.0.1", 0
+	conf.NetworkConfigs.IMAP.Host, conf.NetworkConfigs.IMAP.Port = "127.0.0.1", 0
+	conf.NetworkConfigs.HTTP.Host, conf.NetworkConfigs.HTTP.Port = "127.0.0.1", 0
+	conf.NetworkConfigs.POP3.Host, conf.NetworkConfigs.POP3.Port = "127.0.0.1", 0
+	conf.NetworkConfigs.SES.Host, conf.NetworkConfigs.SES.Port = "127.0.0.1", 0
+	conf.IMAP.TLSPort = 0
+	//nothing is persisted, so that tests don't affect each other
+	conf.DataDir = ""
+	conf.Users = []config.User{{Username: username, Password: password}}
+	for _, c := range configure {
+		c(&conf)
+	}
+	server, err := mailpie.NewServer(mailpie.Options{Config: conf})
+	if err != nil {
+		t.Fatalf("mailpietest: unable to set up server: %s", err)
+	}
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatalf("mailpietest: unable to start server: %s", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			t.Errorf("mailpietest: unable to shut down server: %s", err)
+		}
+	})
+	return &Server{Server: server}
+}
+
+//SMTPAddr returns the host:port the SMTP server listens on
+func (s *Server) SMTPAddr() string {
+	return s.Addr(mailpie.SMTP)
+}
+
+//SMTPHost returns the host the SMTP server listens on
+func (s *Server) SMTPHost() string {
+	host, _, _ := net.SplitHostPort(s.SMTPAddr())
+	return host
+}
+
+//SMTPPort returns the port the SMTP server listens on
+func (s *Server) SMTPPort() int {
+	_, port, _ := net.SplitHostPort(s.SMTPAddr())
+	number, _ := strconv.Atoi(port)
+	return number
+}
+
+//HTTPURL returns the base URL of the HTTP server with the web interface and the APIs, e.g. http://127.0.0.1:34567
+func (s *Server) HTTPURL() string {
+	return "http://" + s.Addr(mailpie.SPA)
+}
+
+//Username returns the login of the configured user
+func (s *Server) Username() string {
+	return username
+}
+
+//Password returns the password of the configured user
+func (s *Server) Password() string {
+	return password
+}
+
+//Mails returns the received mails in the order they arrived. The SMTP server confirms mails before they are stored,
+//so Mails waits for the mails confirmed so far
+func (s *Server) Mails() []instances.Mail {
+	s.Flush()
+	mailStore := s.MailStore()
+	var mails []instances.Mail
+	for _, key := range mailStore.KeysByArrival() {
+		mail, err := mailStore.GetSingle(key)
+		if err != nil {
+			//deleted in the meantime
+			continue
+		}
+		mails = append(mails, mail)
+	}
+	return mails
+}
+
+//Find returns the first received mail the match applies to
+func (s *Server) Find(match Match) (instances.Mail, bool) {
+	for _, mail := range s.Mails() {
+		if match.Matches(mail) {
+			return mail, true
+		}
+	}
+	return instances.Mail{}, false
+}
+
+//AssertReceived fails the test if no received mail matches and returns the first mail which does. The mails confirmed
+//by the SMTP server are waited for, so the mail has to be sent completely before the call. Use WaitFor for mails sent
+//in the background
+func (s *Server) AssertReceived(t testing.TB, match Match) instances.Mail {
+	t.Helper()
+	mail, found := s.Find(match)
+	if !found {
+		t.Errorf("mailpietest: no mail matching %s received, got:\n%s", match, s.describe())
+	}
+	return mail
+}
+
+//AssertNotReceived fails the test if a received mail matches
+func (s *Server) AssertNotReceived(t testing.TB, match Match) {
+	t.Helper()
+	if _, found := s.Find(match); found {
+		t.Errorf("mailpietest: unexpected mail matching %s received, got:\n%s", match, s.describe())
+	}
+}
+
+//describe lists the recipients and subjects of the received mails for the failure messages
+func (s *Server) describe() string {
+	mails := s.Mails()
+	if len(mails) == 0 {
+		return "  no mails"
+	}
+	var description strings.Builder
+	for _, mail := range mails {
+		description.WriteString("  to " + strings.Join(mail.Recipients(), ", ") + ": " + mail.Subject() + "\n")
+	}
+	return description.String()
+}
+
+//WaitFor returns the first mail matching which was received before or is received until the context ends. It is
+//notified by the event queue of the server, so it returns as soon as the mail is stored
+func (s *Server) WaitFor(ctx context.Context, match Match) (instances.Mail, error) {
+	stored := make(chan instances.Mail, 1)
+	//subscribed before looking at the stored mails, so that no mail stored in between is missed. Only the first match
+	//is kept, the handler must not block since looking at the stored mails flushes the queue
+	subscription := s.MessageQueue().Subscribe(store.NewMailStoredEvent, func(_ string, data interface{}) {
+		mail := data.(store.MailStored).Mail
+		if !match.Matches(mail) {
+			return
+		}
+		select {
+		case stored <- mail:
+		default:
+		}
+	})
+	defer subscription.Cancel()
+	if mail, found := s.Find(match); found {
+		return mail, nil
+	}
+	select {
+	case mail := <-stored:
+		return mail, nil
+	case <-ctx.Done():
+		return instances.Mail{}, ctx.Err()
+	}
+}
+
+//Reset removes all mails, e.g. between the subtests using the same server. The mails confirmed by the SMTP server are
+//stored before, and the subscribers of the store, like the IMAP mailboxes, are updated before Reset returns
+func (s *Server) Reset() {
+	s.Flush()
+	mailStore := s.MailStore()
+	for _, key := range mailStore.Keys() {
+		//fails only if the mail was deleted in the meantime
+		_ = mailStore.Delete(key)
+	}
+	s.MessageQueue().Flush()
+}
+
+//Match selects mails. Empty fields match every mail, so Match{} matches any mail
+type Match struct {
+	//To matches if one of the recipients equals it, ignoring case
+	To string
+	//From matches the envelope sender or the address of the From header, ignoring case
+	From string
+	//Subject matches the decoded subject exactly
+	Subject string
+	//SubjectContains matches if the decoded subject contains it
+	SubjectContains string
+	//BodyContains matches if the text or the html body contains it
+	BodyContains string
+}
+
+//Matches reports whether all set fields of the match apply to the mail
+func (m Match) Matches(mail instances.Mail) bool {
+	if m.To != "" && !containsFold(mail.Recipients(), m.To) {
+		return false
+	}
+	if m.From != "" && !containsFold(senders(mail), m.From) {
+		return false
+	}
+	if m.Subject != "" && mail.Subject() != m.Subject {
+		return false
+	}
+	if m.SubjectContains != "" && !strings.Contains(mail.Subject(), m.SubjectContains) {
+		return false
+	}
+	if m.BodyContains != "" && !bodyContains(mail, m.BodyContains) {
+		return false
+	}
+	return true
+}
+
+//String describes the set fields of the match for failure messages
+func (m Match) String() string {
+	var fields []string
+	for _, field := range [][2]string{
+		{"To", m.To},
+		{"From", m.From},
+		{"Subject", m.Subject},
+		{"SubjectContains", m.SubjectContains},
+		{"BodyContains", m.BodyContains},
+	} {
+		if field[1] != "" {
+			fields = append(fields, field[0]+": "+strconv.Quote(field[1]))
+		}
+	}
+	return "{" + strings.Join(fields, ", ") + "}"
+}
+
+func senders(mail instances.Mail) []string {
+	senders := []string{mail.EnvelopeFrom}
+	if from, err := mail.Header.AddressList("From"); err == nil {
+		for _, address := range from {
+			senders = append(senders, address.Address)
+		}
+	}
+	return senders
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func bodyContains(mail instances.Mail, value string) bool {
+	for _, contentType := range []string{"text/plain", "text/html"} {
+		if part, found := mail.FindPart(contentType); found && bytes.Contains(part.Content, []byte(value)) {
+			return true
+		}
+	}
+	return false
+}
+
+//textLink finds URLs in plain text, the punctuation of the surrounding sentence is trimmed afterwards
+var textLink = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+//ExtractLinks returns the links of the text and the html body of the mail in the order they appear, without
+//duplicates. Links of the html body are the href attributes of a and area elements
+func ExtractLinks(mail instances.Mail) []string {
+	var links []string
+	seen := make(map[string]bool)
+	add := func(link string) {
+		if link != "" && !seen[link] {
+			seen[link] = true
+			links = append(links, link)
+		}
+	}
+	if part, found := mail.FindPart("text/plain"); found {
+		for _, link := range textLink.FindAllString(string(part.Content), -1) {
+			add(strings.TrimRight(link, ".,;:!?)]'"))
+		}
+	}
+	if part, found := mail.FindPart("text/html"); found {
+		tokenizer := html.NewTokenizer(bytes.NewReader(part.Content))
+		for {
+			tokenType := tokenizer.Next()
+			if tokenType == html.ErrorToken {
+				break
+			}
+			if tokenType != html.StartTagToken && tokenType != html.SelfClosingTagToken {
+				continue
+			}
+			token := tokenizer.Token()
+			if token.Data != "a" && token.Data != "area" {
+				continue
+			}
+			for _, attribute := range token.Attr {
+				if attribute.Key == "href" {
+					add(strings.TrimSpace(attribute.Val))
+				}
+			}
+		}
+	}
+	return links
+}
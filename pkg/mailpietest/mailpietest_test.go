@@ -0,0 +1,171 @@
+package mailpietest
+
+import (
+	"context"
+	"fmt"
+	"github.com/da-coda/mailpie"
+	"github.com/da-coda/mailpie/pkg/instances"
+	"github.com/emersion/go-imap/client"
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/mail.v2"
+	"net"
+	"testing"
+	"time"
+)
+
+type MailpieTestSuite struct {
+	suite.Suite
+	server *Server
+}
+
+func (suite *MailpieTestSuite) SetupTest() {
+	suite.server = New(suite.T())
+}
+
+func (suite *MailpieTestSuite) send(to string, subject string, body string) {
+	m := mail.NewMessage()
+	m.SetHeader("From", "alex@example.com")
+	m.SetHeader("To", to)
+	m.SetHeader("Subject", subject)
+	m.SetBody("text/plain", body)
+	d := mail.NewDialer(suite.server.SMTPHost(), suite.server.SMTPPort(), suite.server.Username(), suite.server.Password())
+	suite.Require().Nil(d.DialAndSend(m))
+}
+
+//recordingT records the failures of the assertions instead of failing the test
+type recordingT struct {
+	testing.TB
+	failures []string
+}
+
+func (t *recordingT) Helper() {}
+
+func (t *recordingT) Errorf(format string, args ...interface{}) {
+	t.failures = append(t.failures, fmt.Sprintf(format, args...))
+}
+
+func (suite *MailpieTestSuite) TestAssertReceived() {
+	suite.send("bob@example.com", "Welcome Bob", "Hello Bob")
+	mail := suite.server.AssertReceived(suite.T(), Match{To: "Bob@Example.com", From: "alex@example.com", Subject: "Welcome Bob"})
+	suite.Equal([]string{"bob@example.com"}, mail.Recipients())
+
+	t := &recordingT{TB: suite.T()}
+	suite.server.AssertReceived(t, Match{To: "cora@example.com"})
+	suite.server.AssertReceived(t, Match{BodyContains: "Hello Cora"})
+	suite.Require().Len(t.failures, 2)
+	suite.Contains(t.failures[0], `{To: "cora@example.com"}`)
+	suite.Contains(t.failures[0], "to bob@example.com: Welcome Bob", "The failure should list the received mails")
+
+	t = &recordingT{TB: suite.T()}
+	suite.server.AssertNotReceived(t, Match{SubjectContains: "Welcome"})
+	suite.server.AssertNotReceived(t, Match{SubjectContains: "Goodbye"})
+	suite.Len(t.failures, 1)
+}
+
+func (suite *MailpieTestSuite) TestWaitFor() {
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		suite.send("bob@example.com", "Other", "Not the one")
+		suite.send("bob@example.com", "Sent later", "Hello Bob")
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	mail, err := suite.server.WaitFor(ctx, Match{Subject: "Sent later"})
+	suite.Require().Nil(err)
+	suite.Equal("Sent later", mail.Header.Get("Subject"))
+
+	//mails received before are found right away
+	mail, err = suite.server.WaitFor(ctx, Match{Subject: "Other"})
+	suite.Require().Nil(err)
+	suite.Equal("Other", mail.Header.Get("Subject"))
+}
+
+func (suite *MailpieTestSuite) TestWaitFor_Timeout() {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := suite.server.WaitFor(ctx, Match{To: "nobody@example.com"})
+	suite.Equal(context.DeadlineExceeded, err)
+}
+
+func (suite *MailpieTestSuite) TestReset() {
+	suite.send("bob@example.com", "First", "Hello Bob")
+	c, err := client.Dial(suite.server.Addr(mailpie.IMAP))
+	suite.Require().Nil(err)
+	defer c.Logout()
+	suite.Require().Nil(c.Login(suite.server.Username(), suite.server.Password()))
+
+	suite.server.Reset()
+	suite.Empty(suite.server.Mails())
+	status, err := c.Select("INBOX", true)
+	suite.Require().Nil(err)
+	suite.Equal(uint32(0), status.Messages, "Reset should remove the mails from the IMAP mailboxes")
+
+	suite.send("bob@example.com", "Second", "Hello again")
+	suite.Len(suite.server.Mails(), 1)
+}
+
+func (suite *MailpieTestSuite) TestServersAreIndependent() {
+	other := New(suite.T())
+	suite.NotEqual(suite.server.SMTPAddr(), other.SMTPAddr())
+	suite.send("bob@example.com", "Only here", "Hello Bob")
+	suite.Len(suite.server.Mails(), 1)
+	suite.Empty(other.Mails())
+}
+
+func (suite *MailpieTestSuite) TestCleanup_ClosesIdleClients() {
+	start := time.Now()
+	passed := suite.T().Run("clients left connected", func(t *testing.T) {
+		server := New(t)
+		smtpConn, err := net.Dial("tcp", server.SMTPAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer smtpConn.Close()
+		greeting := make([]byte, 512)
+		if _, err := smtpConn.Read(greeting); err != nil {
+			t.Fatal(err)
+		}
+		imapClient, err := client.Dial(server.Addr(mailpie.IMAP))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := imapClient.Login(server.Username(), server.Password()); err != nil {
+			t.Fatal(err)
+		}
+	})
+	suite.True(passed, "Idle clients should not fail the cleanup")
+	suite.Less(int64(time.Since(start)), int64(shutdownTimeout), "The cleanup should not wait for idle clients")
+}
+
+func (suite *MailpieTestSuite) TestExtractLinks() {
+	raw := "From: alex@example.com\r\n" +
+		"To: bob@example.com\r\n" +
+		"Subject: Confirm\r\n" +
+		"Content-Type: multipart/alternative; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Confirm at https://example.com/confirm?token=abc. Or visit (https://example.com/help)!\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/html\r\n" +
+		"\r\n" +
+		"<p><a href=\"https://example.com/confirm?token=abc\">Confirm</a> <A HREF=\"https://example.com/unsubscribe\">Unsubscribe</A></p>\r\n" +
+		"--b--\r\n"
+	parsed, err := instances.ParseMail([]byte(raw))
+	suite.Require().Nil(err)
+	suite.Equal([]string{
+		"https://example.com/confirm?token=abc",
+		"https://example.com/help",
+		"https://example.com/unsubscribe",
+	}, ExtractLinks(*parsed))
+}
+
+func (suite *MailpieTestSuite) TestMatch_String() {
+	suite.Equal(`{To: "bob@example.com", Subject: "Hi"}`, Match{To: "bob@example.com", Subject: "Hi"}.String())
+	suite.Equal("{}", Match{}.String())
+}
+
+func TestMailpieTestSuite(t *testing.T) {
+	suite.Run(t, new(MailpieTestSuite))
+}
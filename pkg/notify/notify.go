@@ -0,0 +1,389 @@
+//Package notify posts mail events to configured URLs, e.g. to let chat bots or CI jobs react to new mails. Deliveries
+//are signed, retried with exponential backoff and kept in a queue which survives a restart. The recent deliveries can
+//be inspected via the HTTP API
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/da-coda/mailpie/internal/apiutil"
+	"github.com/da-coda/mailpie/pkg/config"
+	"github.com/da-coda/mailpie/pkg/event"
+	"github.com/da-coda/mailpie/pkg/instances"
+	"github.com/da-coda/mailpie/pkg/store"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//the events which can be notified
+const (
+	Stored  = "stored"
+	Deleted = "deleted"
+)
+
+//the formats of the body
+const (
+	Summary = "summary"
+	Raw     = "raw"
+)
+
+const (
+	defaultMaxAttempts = 5
+	defaultRetryDelay  = time.Second
+	//maxRetryDelay caps the exponential backoff
+	maxRetryDelay = time.Hour
+)
+
+//target is a configured notification
+type target struct {
+	config.Notification
+	events    map[string]bool
+	recipient *regexp.Regexp
+	sender    *regexp.Regexp
+	subject   *regexp.Regexp
+}
+
+//matches reports whether the event of the mail is posted to the target
+func (t *target) matches(name string, mail instances.Mail) bool {
+	if !t.events[name] {
+		return false
+	}
+	if t.sender != nil && !t.sender.MatchString(mail.Sender()) {
+		return false
+	}
+	if t.subject != nil && !t.subject.MatchString(mail.Subject()) {
+		return false
+	}
+	if t.recipient == nil {
+		return true
+	}
+	for _, recipient := range mail.Recipients() {
+		if t.recipient.MatchString(recipient) {
+			return true
+		}
+	}
+	return false
+}
+
+//retryDelay is the delay before the next attempt after the given number of failed attempts
+func (t *target) retryDelay(attempts int) time.Duration {
+	delay := t.RetryDelay
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		return maxRetryDelay
+	}
+	return delay
+}
+
+//Notifier posts the events of the mails of a store to the targets
+type Notifier struct {
+	mailStore *store.MailStore
+	targets   []*target
+	client    *http.Client
+	queue     *queue
+	log       *deliveryLog
+	//subscription receives the events of the store until the notifier is closed
+	subscription *event.Subscription
+	//wake interrupts the wait of the worker for the next due delivery
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+//NewNotifier validates the notifications, loads the pending deliveries from the dataDir and subscribes to the events
+//of the mailStore on the messageQueue it dispatches to. Without dataDir, pending deliveries are lost on restart
+func NewNotifier(mailStore *store.MailStore, messageQueue event.Subscribable, notifications []config.Notification, dataDir string) (*Notifier, error) {
+	n := &Notifier{
+		mailStore: mailStore,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		log:       newDeliveryLog(100),
+		wake:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	for i, notification := range notifications {
+		t, err := newTarget(notification)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid notification %d", i)
+		}
+		n.targets = append(n.targets, t)
+	}
+	var err error
+	n.queue, err = loadQueue(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	//deliveries of notifications which were removed or changed their url since the deliveries were persisted are dropped
+	n.queue.retain(func(d delivery) bool {
+		return d.Target < len(n.targets) && n.targets[d.Target].URL == d.URL
+	})
+	n.subscription = messageQueue.SubscribeWithOptions(event.SubscribeOptions{Events: []event.Event{store.NewMailStoredEvent, store.MailDeletedEvent}}, n.mailEvent)
+	go n.work()
+	return n, nil
+}
+
+func newTarget(notification config.Notification) (*target, error) {
+	t := &target{Notification: notification, events: make(map[string]bool)}
+	if t.URL == "" {
+		return nil, errors.New("missing url")
+	}
+	switch t.Format {
+	case "":
+		t.Format = Summary
+	case Summary, Raw:
+	default:
+		return nil, errors.Errorf("unknown format '%s'", t.Format)
+	}
+	if len(t.Events) == 0 {
+		t.Events = []string{Stored, Deleted}
+	}
+	for _, name := range t.Events {
+		if name != Stored && name != Deleted {
+			return nil, errors.Errorf("unknown event '%s'", name)
+		}
+		t.events[name] = true
+	}
+	if t.MaxAttempts <= 0 {
+		t.MaxAttempts = defaultMaxAttempts
+	}
+	if t.RetryDelay <= 0 {
+		t.RetryDelay = defaultRetryDelay
+	}
+	var err error
+	for _, filter := range []struct {
+		pattern string
+		regexp  **regexp.Regexp
+	}{{t.Recipient, &t.recipient}, {t.Sender, &t.sender}, {t.Subject, &t.subject}} {
+		if filter.pattern == "" {
+			continue
+		}
+		*filter.regexp, err = regexp.Compile(filter.pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid filter '%s'", filter.pattern)
+		}
+	}
+	return t, nil
+}
+
+//mailEvent enqueues the events of the mails of the store. Deletions can not be checked for the store of the notifier,
+//since the mail is already removed
+func (n *Notifier) mailEvent(_ string, data interface{}) {
+	switch e := data.(type) {
+	case store.MailStored:
+		if _, err := n.mailStore.GetSingle(e.Mail.Key); err != nil {
+			return
+		}
+		n.enqueue(Stored, e.Mail)
+	case store.MailDeleted:
+		n.enqueue(Deleted, e.Mail)
+	}
+}
+
+//enqueue adds a delivery of the event to every matching target, unless the notifier is closed
+func (n *Notifier) enqueue(name string, mail instances.Mail) {
+	select {
+	case <-n.stop:
+		return
+	default:
+	}
+	now := time.Now()
+	for i, t := range n.targets {
+		if !t.matches(name, mail) {
+			continue
+		}
+		d := delivery{ID: apiutil.NewHexToken(16), Target: i, URL: t.URL, Event: name, Key: mail.Key, Created: now, NextAttempt: now}
+		if t.Format == Raw {
+			d.ContentType = "message/rfc822"
+			d.Body = mail.RawMessage
+		} else {
+			body, err := json.Marshal(summarize(name, mail))
+			if err != nil {
+				logrus.WithError(err).WithField("key", mail.Key).Error("Unable to create notification")
+				continue
+			}
+			d.ContentType = "application/json"
+			d.Body = body
+		}
+		n.queue.add(d)
+	}
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+//work sends the due deliveries until the notifier is closed
+func (n *Notifier) work() {
+	defer close(n.done)
+	for {
+		for _, d := range n.queue.due(time.Now()) {
+			n.attempt(d)
+		}
+		wait := time.Minute
+		if next, ok := n.queue.next(); ok {
+			wait = time.Until(next)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-n.stop:
+			timer.Stop()
+			return
+		case <-n.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+//attempt sends the delivery and reschedules it on failure until the attempts of its target are used up
+func (n *Notifier) attempt(d delivery) {
+	t := n.targets[d.Target]
+	start := time.Now()
+	status, err := n.send(t, d)
+	d.Attempts++
+	entry := logEntry{Delivery: d.ID, URL: d.URL, Event: d.Event, Key: d.Key, Attempt: d.Attempts, Status: status, Time: start, Duration: time.Since(start).String()}
+	if err == nil && (status < 200 || status > 299) {
+		err = errors.Errorf("unexpected status %d", status)
+	}
+	if err == nil {
+		entry.Result = "delivered"
+		n.queue.remove(d.ID)
+	} else if d.Attempts >= t.MaxAttempts {
+		entry.Result = "failed"
+		entry.Error = err.Error()
+		n.queue.remove(d.ID)
+		logrus.WithError(err).WithField("url", d.URL).WithField("key", d.Key).Warn("Giving up notification")
+	} else {
+		entry.Result = "retrying"
+		entry.Error = err.Error()
+		d.NextAttempt = time.Now().Add(t.retryDelay(d.Attempts))
+		n.queue.update(d)
+	}
+	n.log.add(entry)
+}
+
+//send posts the body of the delivery. With a secret, the X-Mailpie-Signature header holds the hex encoded HMAC-SHA256
+//of the timestamp, a dot and the body
+func (n *Notifier) send(t *target, d delivery) (int, error) {
+	request, err := http.NewRequest(http.MethodPost, d.URL, bytes.NewReader(d.Body))
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to create request")
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", d.ContentType)
+	request.Header.Set("User-Agent", "Mailpie-Notification")
+	request.Header.Set("X-Mailpie-Event", d.Event)
+	request.Header.Set("X-Mailpie-Delivery", d.ID)
+	request.Header.Set("X-Mailpie-Timestamp", timestamp)
+	if t.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(t.Secret))
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(d.Body)
+		request.Header.Set("X-Mailpie-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := n.client.Do(request)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to post notification")
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
+
+//Close stops sending deliveries and adding new ones. Pending deliveries stay in the queue
+func (n *Notifier) Close() {
+	n.once.Do(func() {
+		n.subscription.Cancel()
+		close(n.stop)
+	})
+	<-n.done
+}
+
+//Register adds the routes to inspect the delivery log and the pending deliveries
+func (n *Notifier) Register(router *mux.Router) {
+	router.HandleFunc("/api/notifications/log", n.serveLog).Methods("GET")
+	router.HandleFunc("/api/notifications/queue", n.serveQueue).Methods("GET")
+}
+
+//serveLog handles GET /api/notifications/log, the attempts are listed newest first
+func (n *Notifier) serveLog(w http.ResponseWriter, _ *http.Request) {
+	apiutil.WriteJSON(w, http.StatusOK, n.log.entries())
+}
+
+//pending describes a delivery in the queue without its body
+type pending struct {
+	ID          string    `json:"id"`
+	URL         string    `json:"url"`
+	Event       string    `json:"event"`
+	Key         string    `json:"key"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt"`
+}
+
+//serveQueue handles GET /api/notifications/queue
+func (n *Notifier) serveQueue(w http.ResponseWriter, _ *http.Request) {
+	deliveries := n.queue.list()
+	queued := make([]pending, 0, len(deliveries))
+	for _, d := range deliveries {
+		queued = append(queued, pending{ID: d.ID, URL: d.URL, Event: d.Event, Key: d.Key, Attempts: d.Attempts, NextAttempt: d.NextAttempt})
+	}
+	apiutil.WriteJSON(w, http.StatusOK, queued)
+}
+
+//summary is the body of notifications in the summary format
+type summary struct {
+	Event        string    `json:"event"`
+	Key          string    `json:"key"`
+	MessageID    string    `json:"messageId"`
+	From         string    `json:"from"`
+	To           []string  `json:"to"`
+	Subject      string    `json:"subject"`
+	EnvelopeFrom string    `json:"envelopeFrom"`
+	Recipients   []string  `json:"recipients"`
+	Received     time.Time `json:"received"`
+	Size         int       `json:"size"`
+	Attachments  int       `json:"attachments"`
+}
+
+func summarize(name string, mail instances.Mail) summary {
+	s := summary{
+		Event:        name,
+		Key:          mail.Key,
+		MessageID:    mail.Header.Get("Message-Id"),
+		From:         mail.Header.Get("From"),
+		To:           []string{},
+		Subject:      mail.Subject(),
+		EnvelopeFrom: mail.EnvelopeFrom,
+		Recipients:   mail.Recipients(),
+		Received:     mail.Received,
+		Size:         len(mail.RawMessage),
+	}
+	if addresses, err := mail.Header.AddressList("To"); err == nil {
+		for _, address := range addresses {
+			s.To = append(s.To, address.Address)
+		}
+	}
+	if s.Recipients == nil {
+		s.Recipients = []string{}
+	}
+	for _, part := range mail.Parts() {
+		if part.IsAttachment() {
+			s.Attachments++
+		}
+	}
+	return s
+}
+
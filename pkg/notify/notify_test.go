@@ -0,0 +1,203 @@
+package notify
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/da-coda/mailpie/pkg/config"
+	"github.com/da-coda/mailpie/pkg/event"
+	"github.com/da-coda/mailpie/pkg/instances"
+	"github.com/da-coda/mailpie/pkg/store"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/suite"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const rawMail = "From: Alex <alex@example.com>\r\nTo: bob@example.com\r\nMessage-ID: <build@example.com>\r\nSubject: Build failed\r\n\r\nSee the log\r\n"
+
+//received is a notification received by the application
+type received struct {
+	path   string
+	header http.Header
+	body   []byte
+}
+
+type NotifierTestSuite struct {
+	suite.Suite
+	mailStore *store.MailStore
+	app       *httptest.Server
+	received  chan received
+	//failures is the number of requests the application answers with an error before accepting them
+	failures int32
+	notifier *Notifier
+}
+
+func (suite *NotifierTestSuite) SetupTest() {
+	suite.mailStore = store.CreateMailStore(event.CreateOrGet())
+	suite.received = make(chan received, 16)
+	suite.failures = 0
+	suite.app = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		suite.received <- received{path: r.URL.Path, header: r.Header, body: body}
+		if atomic.AddInt32(&suite.failures, -1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+}
+
+func (suite *NotifierTestSuite) TearDownTest() {
+	if suite.notifier != nil {
+		suite.notifier.Close()
+		suite.notifier = nil
+	}
+	suite.app.Close()
+}
+
+func (suite *NotifierTestSuite) start(dataDir string, notifications ...config.Notification) {
+	var err error
+	suite.notifier, err = NewNotifier(suite.mailStore, event.CreateOrGet(), notifications, dataDir)
+	suite.Require().Nil(err)
+}
+
+func (suite *NotifierTestSuite) store(key string) {
+	mail, err := instances.ParseMail([]byte(rawMail))
+	suite.Require().Nil(err)
+	mail.EnvelopeFrom = "ci@example.com"
+	mail.EnvelopeTo = []string{"bob@example.com"}
+	suite.Require().Nil(suite.mailStore.Add(key, *mail))
+}
+
+func (suite *NotifierTestSuite) receive() received {
+	select {
+	case r := <-suite.received:
+		return r
+	case <-time.After(5 * time.Second):
+		suite.FailNow("Notification not received")
+	}
+	return received{}
+}
+
+//get requests a route of the API of the notifier and decodes the response
+func (suite *NotifierTestSuite) get(path string, body interface{}) {
+	router := mux.NewRouter()
+	suite.notifier.Register(router)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	suite.Require().Equal(http.StatusOK, recorder.Code)
+	suite.Require().Nil(json.Unmarshal(recorder.Body.Bytes(), body))
+}
+
+func (suite *NotifierTestSuite) TestMailStored() {
+	suite.start("",
+		config.Notification{URL: suite.app.URL + "/ignored", Subject: "^Deploy"},
+		config.Notification{URL: suite.app.URL + "/ci", Subject: "failed$", Sender: "^ci@", Recipient: "^bob@", Secret: "secret"},
+	)
+	suite.store("build")
+
+	r := suite.receive()
+	suite.Equal("/ci", r.path, "The subject does not match the first notification")
+	suite.Equal(Stored, r.header.Get("X-Mailpie-Event"))
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(r.header.Get("X-Mailpie-Timestamp") + "."))
+	mac.Write(r.body)
+	suite.Equal("sha256="+hex.EncodeToString(mac.Sum(nil)), r.header.Get("X-Mailpie-Signature"))
+
+	var s summary
+	suite.Require().Nil(json.Unmarshal(r.body, &s))
+	suite.Equal(Stored, s.Event)
+	suite.Equal("build", s.Key)
+	suite.Equal("<build@example.com>", s.MessageID)
+	suite.Equal("Build failed", s.Subject)
+	suite.Equal([]string{"bob@example.com"}, s.To)
+	suite.Equal("ci@example.com", s.EnvelopeFrom)
+	suite.Equal(len(rawMail), s.Size)
+}
+
+func (suite *NotifierTestSuite) TestMailDeleted() {
+	suite.start("", config.Notification{URL: suite.app.URL + "/raw", Format: Raw, Events: []string{Deleted}})
+	suite.store("build")
+	suite.Require().Nil(suite.mailStore.Delete("build"))
+
+	r := suite.receive()
+	suite.Equal(Deleted, r.header.Get("X-Mailpie-Event"))
+	suite.Equal("message/rfc822", r.header.Get("Content-Type"))
+	suite.Equal(rawMail, string(r.body))
+	suite.Empty(r.header.Get("X-Mailpie-Signature"), "Notifications without secret are not signed")
+}
+
+func (suite *NotifierTestSuite) TestRetry() {
+	suite.failures = 2
+	suite.start("", config.Notification{URL: suite.app.URL, Events: []string{Stored}, RetryDelay: 10 * time.Millisecond})
+	suite.store("build")
+	first := suite.receive()
+	suite.receive()
+	third := suite.receive()
+	suite.Equal(first.header.Get("X-Mailpie-Delivery"), third.header.Get("X-Mailpie-Delivery"), "Retries keep the delivery id")
+
+	var entries []logEntry
+	suite.Eventually(func() bool {
+		suite.get("/api/notifications/log", &entries)
+		return len(entries) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	suite.Equal([]string{"delivered", "retrying", "retrying"}, []string{entries[0].Result, entries[1].Result, entries[2].Result})
+	suite.Equal(3, entries[0].Attempt)
+	suite.Equal(http.StatusServiceUnavailable, entries[1].Status)
+	var queued []pending
+	suite.get("/api/notifications/queue", &queued)
+	suite.Empty(queued)
+}
+
+func (suite *NotifierTestSuite) TestQueue_Persisted() {
+	dataDir := suite.T().TempDir()
+	suite.failures = 1
+	notification := config.Notification{URL: suite.app.URL, Events: []string{Stored}, RetryDelay: time.Hour}
+	suite.start(dataDir, notification)
+	suite.store("build")
+	suite.receive()
+	var queued []pending
+	suite.Eventually(func() bool {
+		suite.get("/api/notifications/queue", &queued)
+		return len(queued) == 1 && queued[0].Attempts == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	suite.notifier.Close()
+
+	suite.start(dataDir, notification)
+	suite.get("/api/notifications/queue", &queued)
+	suite.Require().Len(queued, 1, "The pending delivery should be loaded from the data directory")
+	suite.Equal("build", queued[0].Key)
+	suite.True(queued[0].NextAttempt.After(time.Now()), "The backoff should be kept")
+	suite.notifier.Close()
+
+	suite.start(dataDir, config.Notification{URL: suite.app.URL + "/changed"})
+	suite.get("/api/notifications/queue", &queued)
+	suite.Empty(queued, "Deliveries to changed notifications should be dropped")
+}
+
+func (suite *NotifierTestSuite) TestRetryDelay() {
+	t := &target{Notification: config.Notification{RetryDelay: time.Second}}
+	suite.Equal(time.Second, t.retryDelay(1))
+	suite.Equal(4*time.Second, t.retryDelay(3))
+	suite.Equal(maxRetryDelay, t.retryDelay(100))
+}
+
+func (suite *NotifierTestSuite) TestNewNotifier_Invalid() {
+	for _, notification := range []config.Notification{
+		{},
+		{URL: "http://localhost", Format: "xml"},
+		{URL: "http://localhost", Events: []string{"read"}},
+		{URL: "http://localhost", Subject: "("},
+	} {
+		_, err := NewNotifier(suite.mailStore, event.CreateOrGet(), []config.Notification{notification}, "")
+		suite.NotNil(err, notification)
+	}
+}
+
+func TestNotifierTestSuite(t *testing.T) {
+	suite.Run(t, new(NotifierTestSuite))
+}
@@ -0,0 +1,204 @@
+package notify
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+//delivery is a notification which is not delivered yet
+type delivery struct {
+	ID string `json:"id"`
+	//Target is the index of the notification
+	Target      int       `json:"target"`
+	URL         string    `json:"url"`
+	Event       string    `json:"event"`
+	Key         string    `json:"key"`
+	ContentType string    `json:"contentType"`
+	Body        []byte    `json:"body"`
+	Created     time.Time `json:"created"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt"`
+}
+
+//queue holds the pending deliveries and persists them to the notifications.json in the data directory on every change,
+//so that they are retried after a restart of Mailpie
+type queue struct {
+	sync.Mutex
+	//path is empty if the deliveries are not persisted
+	path       string
+	deliveries []delivery
+}
+
+//loadQueue reads the pending deliveries from the notifications.json in dataDir. A missing file is not an error
+func loadQueue(dataDir string) (*queue, error) {
+	q := &queue{}
+	if dataDir == "" {
+		return q, nil
+	}
+	q.path = filepath.Join(dataDir, "notifications.json")
+	content, err := os.ReadFile(q.path)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read pending notifications")
+	}
+	err = json.Unmarshal(content, &q.deliveries)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to parse pending notifications")
+	}
+	return q, nil
+}
+
+func (q *queue) add(d delivery) {
+	q.Lock()
+	defer q.Unlock()
+	q.deliveries = append(q.deliveries, d)
+	q.persist()
+}
+
+//update replaces the delivery with the same id
+func (q *queue) update(d delivery) {
+	q.Lock()
+	defer q.Unlock()
+	for i := range q.deliveries {
+		if q.deliveries[i].ID == d.ID {
+			q.deliveries[i] = d
+			break
+		}
+	}
+	q.persist()
+}
+
+func (q *queue) remove(id string) {
+	q.retain(func(d delivery) bool {
+		return d.ID != id
+	})
+}
+
+//retain removes all deliveries for which keep returns false
+func (q *queue) retain(keep func(d delivery) bool) {
+	q.Lock()
+	defer q.Unlock()
+	kept := q.deliveries[:0]
+	for _, d := range q.deliveries {
+		if keep(d) {
+			kept = append(kept, d)
+		}
+	}
+	q.deliveries = kept
+	q.persist()
+}
+
+//due returns the deliveries whose next attempt is not after now, oldest first
+func (q *queue) due(now time.Time) []delivery {
+	q.Lock()
+	defer q.Unlock()
+	var due []delivery
+	for _, d := range q.deliveries {
+		if !d.NextAttempt.After(now) {
+			due = append(due, d)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool {
+		return due[i].Created.Before(due[j].Created)
+	})
+	return due
+}
+
+//next returns the time of the earliest next attempt, false if the queue is empty
+func (q *queue) next() (time.Time, bool) {
+	q.Lock()
+	defer q.Unlock()
+	var next time.Time
+	for _, d := range q.deliveries {
+		if next.IsZero() || d.NextAttempt.Before(next) {
+			next = d.NextAttempt
+		}
+	}
+	return next, !next.IsZero()
+}
+
+func (q *queue) list() []delivery {
+	q.Lock()
+	defer q.Unlock()
+	return append([]delivery{}, q.deliveries...)
+}
+
+//persist writes the deliveries to disk, the caller holds the lock. Failures are only logged, the deliveries are still
+//retried as long as Mailpie runs
+func (q *queue) persist() {
+	if q.path == "" {
+		return
+	}
+	content, err := json.Marshal(q.deliveries)
+	if err != nil {
+		logrus.WithError(err).Error("Unable to marshal pending notifications")
+		return
+	}
+	err = os.MkdirAll(filepath.Dir(q.path), 0755)
+	if err != nil {
+		logrus.WithError(err).Error("Unable to create data directory")
+		return
+	}
+	//write to a temporary file first so that a crash doesn't leave a broken file behind
+	tmp := q.path + ".tmp"
+	err = os.WriteFile(tmp, content, 0644)
+	if err == nil {
+		err = os.Rename(tmp, q.path)
+	}
+	if err != nil {
+		logrus.WithError(err).Error("Unable to write pending notifications")
+	}
+}
+
+//logEntry is an attempt of a delivery
+type logEntry struct {
+	Delivery string    `json:"delivery"`
+	URL      string    `json:"url"`
+	Event    string    `json:"event"`
+	Key      string    `json:"key"`
+	Attempt  int       `json:"attempt"`
+	Status   int       `json:"status,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Result   string    `json:"result"`
+	Time     time.Time `json:"time"`
+	Duration string    `json:"duration"`
+}
+
+//deliveryLog keeps the latest attempts in memory
+type deliveryLog struct {
+	sync.Mutex
+	size     int
+	attempts []logEntry
+}
+
+func newDeliveryLog(size int) *deliveryLog {
+	return &deliveryLog{size: size}
+}
+
+func (l *deliveryLog) add(entry logEntry) {
+	l.Lock()
+	defer l.Unlock()
+	l.attempts = append(l.attempts, entry)
+	if len(l.attempts) > l.size {
+		l.attempts = l.attempts[len(l.attempts)-l.size:]
+	}
+}
+
+//entries returns the attempts, newest first
+func (l *deliveryLog) entries() []logEntry {
+	l.Lock()
+	defer l.Unlock()
+	entries := make([]logEntry, 0, len(l.attempts))
+	for i := len(l.attempts) - 1; i >= 0; i-- {
+		entries = append(entries, l.attempts[i])
+	}
+	return entries
+}
@@ -0,0 +1,352 @@
+package sieve
+
+import (
+	"github.com/da-coda/mailpie/pkg/instances"
+	"mime"
+	gomail "net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+)
+
+const (
+	ActionKeep       = "keep"
+	ActionFileInto   = "fileinto"
+	ActionDiscard    = "discard"
+	ActionSetFlag    = "setflag"
+	ActionAddFlag    = "addflag"
+	ActionRemoveFlag = "removeflag"
+	ActionStop       = "stop"
+	//Inbox is the mailbox used by keep
+	Inbox = "INBOX"
+)
+
+//Action is a single action taken by a script. Flag actions only change the flags used by following keep and fileinto
+//actions, but are still reported so that a dry run shows everything the script did
+type Action struct {
+	Type     string   `json:"type"`
+	Mailbox  string   `json:"mailbox,omitempty"`
+	Flags    []string `json:"flags,omitempty"`
+	Copy     bool     `json:"copy,omitempty"`
+	Implicit bool     `json:"implicit,omitempty"`
+	Line     int      `json:"line,omitempty"`
+}
+
+//Result is the list of actions taken by a script for a single mail
+type Result struct {
+	Actions []Action `json:"actions"`
+}
+
+//Delivery describes a mailbox a mail should be placed in and the flags it should get there
+type Delivery struct {
+	Mailbox string
+	Flags   []string
+}
+
+//Deliveries returns the mailboxes a mail should be placed in, in the order the script filed the mail into them.
+//Returns an empty slice if the mail was discarded
+func (r *Result) Deliveries() []Delivery {
+	var deliveries []Delivery
+	index := make(map[string]int)
+	for _, action := range r.Actions {
+		if action.Type != ActionKeep && action.Type != ActionFileInto {
+			continue
+		}
+		if i, exists := index[action.Mailbox]; exists {
+			deliveries[i].Flags = mergeFlags(deliveries[i].Flags, action.Flags)
+			continue
+		}
+		index[action.Mailbox] = len(deliveries)
+		deliveries = append(deliveries, Delivery{Mailbox: action.Mailbox, Flags: action.Flags})
+	}
+	return deliveries
+}
+
+//interpreter holds the state of a single script evaluation
+type interpreter struct {
+	script     *Script
+	mail       instances.Mail
+	variables  map[string]string
+	matches    []string
+	flags      []string
+	result     *Result
+	cancelKeep bool
+	stopped    bool
+}
+
+//Evaluate runs the script for the given mail and returns the resulting actions, including the implicit keep
+func (s *Script) Evaluate(mail instances.Mail) (*Result, error) {
+	in := &interpreter{script: s, mail: mail, variables: make(map[string]string), result: &Result{Actions: []Action{}}}
+	err := in.run(s.commands)
+	if err != nil {
+		return nil, err
+	}
+	if !in.cancelKeep {
+		in.result.Actions = append(in.result.Actions, Action{Type: ActionKeep, Mailbox: Inbox, Flags: in.flags, Implicit: true})
+	}
+	return in.result, nil
+}
+
+func (in *interpreter) run(commands []*compiledCommand) error {
+	chainMatched := false
+	for _, cmd := range commands {
+		if in.stopped {
+			return nil
+		}
+		switch cmd.name {
+		case "if", "elsif", "else":
+			if cmd.name != "if" && chainMatched {
+				continue
+			}
+			matched := true
+			if cmd.test != nil {
+				var err error
+				matched, err = in.test(cmd.test)
+				if err != nil {
+					return err
+				}
+			}
+			chainMatched = matched
+			if matched {
+				err := in.run(cmd.block)
+				if err != nil {
+					return err
+				}
+			}
+		default:
+			err := in.execute(cmd)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (in *interpreter) execute(cmd *compiledCommand) error {
+	switch cmd.name {
+	case "stop":
+		in.stopped = true
+		in.result.Actions = append(in.result.Actions, Action{Type: ActionStop, Line: cmd.line})
+	case "discard":
+		in.cancelKeep = true
+		in.result.Actions = append(in.result.Actions, Action{Type: ActionDiscard, Line: cmd.line})
+	case "keep", "fileinto":
+		flags := in.flags
+		if cmd.hasFlags {
+			flags = parseFlags(in.expandAll(cmd.flags))
+		}
+		action := Action{Type: cmd.name, Mailbox: Inbox, Flags: flags, Copy: cmd.copy, Line: cmd.line}
+		if cmd.name == ActionFileInto {
+			action.Mailbox = in.expand(cmd.mailbox)
+		}
+		if !cmd.copy {
+			in.cancelKeep = true
+		}
+		in.result.Actions = append(in.result.Actions, action)
+	case "setflag", "addflag", "removeflag":
+		flags := parseFlags(in.expandAll(cmd.flags))
+		current := in.flags
+		if cmd.variable != "" {
+			current = parseFlags([]string{in.variables[cmd.variable]})
+		}
+		switch cmd.name {
+		case ActionSetFlag:
+			current = flags
+		case ActionAddFlag:
+			current = mergeFlags(current, flags)
+		case ActionRemoveFlag:
+			current = removeFlags(current, flags)
+		}
+		if cmd.variable != "" {
+			in.variables[cmd.variable] = strings.Join(current, " ")
+		} else {
+			in.flags = current
+		}
+		in.result.Actions = append(in.result.Actions, Action{Type: cmd.name, Flags: flags, Line: cmd.line})
+	case "set":
+		in.variables[cmd.variable] = applyModifiers(in.expand(cmd.value), cmd.modifiers)
+	}
+	return nil
+}
+
+func (in *interpreter) test(t *compiledTest) (bool, error) {
+	switch t.name {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "not":
+		result, err := in.test(t.tests[0])
+		return !result, err
+	case "allof", "anyof":
+		for _, inner := range t.tests {
+			result, err := in.test(inner)
+			if err != nil {
+				return false, err
+			}
+			if t.name == "anyof" && result {
+				return true, nil
+			}
+			if t.name == "allof" && !result {
+				return false, nil
+			}
+		}
+		return t.name == "allof", nil
+	case "exists":
+		for _, name := range in.expandAll(t.sources) {
+			if len(in.headerValues(name)) == 0 {
+				return false, nil
+			}
+		}
+		return true, nil
+	case "size":
+		if t.over {
+			return int64(in.mail.Len()) > t.size, nil
+		}
+		return int64(in.mail.Len()) < t.size, nil
+	case "header":
+		var values []string
+		for _, name := range in.expandAll(t.sources) {
+			values = append(values, in.headerValues(name)...)
+		}
+		return in.matchAny(t.match, values, in.expandAll(t.keys))
+	case "address":
+		var values []string
+		for _, name := range in.expandAll(t.sources) {
+			for _, value := range in.headerValues(name) {
+				addresses, err := gomail.ParseAddressList(value)
+				if err != nil {
+					continue
+				}
+				for _, address := range addresses {
+					values = append(values, addressPart(address.Address, t.match.addressPart))
+				}
+			}
+		}
+		return in.matchAny(t.match, values, in.expandAll(t.keys))
+	case "envelope":
+		var values []string
+		for _, part := range t.sources {
+			switch strings.ToLower(part) {
+			case "from":
+				values = append(values, addressPart(strings.Trim(in.mail.EnvelopeFrom, "<>"), t.match.addressPart))
+			case "to":
+				for _, recipient := range in.mail.Recipients() {
+					values = append(values, addressPart(strings.Trim(recipient, "<>"), t.match.addressPart))
+				}
+			}
+		}
+		return in.matchAny(t.match, values, in.expandAll(t.keys))
+	case "string":
+		return in.matchAny(t.match, in.expandAll(t.sources), in.expandAll(t.keys))
+	case "hasflag":
+		flags := in.flags
+		if len(t.variables) > 0 {
+			flags = nil
+			for _, variable := range t.variables {
+				flags = append(flags, parseFlags([]string{in.variables[strings.ToLower(variable)]})...)
+			}
+		}
+		return in.matchAny(t.match, flags, in.expandAll(t.keys))
+	}
+	return false, nil
+}
+
+//matchAny returns true if any value matches any key. Match variables are updated on the first successful match
+func (in *interpreter) matchAny(options matchOptions, values []string, keys []string) (bool, error) {
+	for _, value := range values {
+		for _, key := range keys {
+			matched, captures, err := match(options, value, key)
+			if err != nil {
+				return false, err
+			}
+			if matched {
+				if captures != nil {
+					in.matches = captures
+				}
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+//headerValues returns all values of the header with MIME encoded words decoded
+func (in *interpreter) headerValues(name string) []string {
+	decoder := new(mime.WordDecoder)
+	raw := in.mail.Header[textproto.CanonicalMIMEHeaderKey(name)]
+	values := make([]string, 0, len(raw))
+	for _, value := range raw {
+		decoded, err := decoder.DecodeHeader(value)
+		if err != nil {
+			decoded = value
+		}
+		values = append(values, decoded)
+	}
+	return values
+}
+
+func addressPart(address string, part string) string {
+	at := strings.LastIndex(address, "@")
+	switch part {
+	case addressPartLocal:
+		if at < 0 {
+			return address
+		}
+		return address[:at]
+	case addressPartDomain:
+		if at < 0 {
+			return ""
+		}
+		return address[at+1:]
+	}
+	return address
+}
+
+//parseFlags splits space separated flags and removes duplicates
+func parseFlags(lists []string) []string {
+	return mergeFlags(nil, lists)
+}
+
+func mergeFlags(current []string, additional []string) []string {
+	merged := append([]string{}, current...)
+	for _, list := range additional {
+		for _, flag := range strings.Fields(list) {
+			exists := false
+			for _, existing := range merged {
+				if strings.EqualFold(existing, flag) {
+					exists = true
+					break
+				}
+			}
+			if !exists {
+				merged = append(merged, flag)
+			}
+		}
+	}
+	return merged
+}
+
+func removeFlags(current []string, remove []string) []string {
+	var remaining []string
+	for _, flag := range current {
+		removed := false
+		for _, candidate := range remove {
+			if strings.EqualFold(flag, candidate) {
+				removed = true
+				break
+			}
+		}
+		if !removed {
+			remaining = append(remaining, flag)
+		}
+	}
+	return remaining
+}
+
+func sortModifiers(modifiers []string) {
+	sort.SliceStable(modifiers, func(i, j int) bool {
+		return modifierPrecedence[modifiers[i]] > modifierPrecedence[modifiers[j]]
+	})
+}
@@ -0,0 +1,250 @@
+package sieve
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdentifier
+	tokenTag
+	tokenNumber
+	tokenString
+	tokenSpecial
+)
+
+type token struct {
+	kind   tokenKind
+	text   string
+	number int64
+	line   int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of script"
+	case tokenString:
+		return strconv.Quote(t.text)
+	case tokenTag:
+		return ":" + t.text
+	}
+	return t.text
+}
+
+//lexer splits a sieve script into tokens as described in RFC 5228 section 8.1
+type lexer struct {
+	input []rune
+	pos   int
+	line  int
+}
+
+func lex(script string) ([]token, error) {
+	l := &lexer{input: []rune(script), line: 1}
+	var tokens []token
+	for {
+		t, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+		if t.kind == tokenEOF {
+			return tokens, nil
+		}
+	}
+}
+
+func (l *lexer) errorf(format string, args ...interface{}) error {
+	return &SyntaxError{Line: l.line, Message: fmt.Sprintf(format, args...)}
+}
+
+func (l *lexer) peek(offset int) rune {
+	if l.pos+offset >= len(l.input) {
+		return 0
+	}
+	return l.input[l.pos+offset]
+}
+
+func (l *lexer) skipWhitespaceAndComments() error {
+	for l.pos < len(l.input) {
+		r := l.input[l.pos]
+		switch {
+		case r == '\n':
+			l.line++
+			l.pos++
+		case r == ' ' || r == '\t' || r == '\r':
+			l.pos++
+		case r == '#':
+			for l.pos < len(l.input) && l.input[l.pos] != '\n' {
+				l.pos++
+			}
+		case r == '/' && l.peek(1) == '*':
+			l.pos += 2
+			for {
+				if l.pos >= len(l.input) {
+					return l.errorf("unterminated comment")
+				}
+				if l.input[l.pos] == '*' && l.peek(1) == '/' {
+					l.pos += 2
+					break
+				}
+				if l.input[l.pos] == '\n' {
+					l.line++
+				}
+				l.pos++
+			}
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func isIdentifierStart(r rune) bool {
+	return r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+}
+
+func isIdentifierPart(r rune) bool {
+	return isIdentifierStart(r) || (r >= '0' && r <= '9')
+}
+
+func (l *lexer) identifier() string {
+	start := l.pos
+	for l.pos < len(l.input) && isIdentifierPart(l.input[l.pos]) {
+		l.pos++
+	}
+	return string(l.input[start:l.pos])
+}
+
+func (l *lexer) next() (token, error) {
+	err := l.skipWhitespaceAndComments()
+	if err != nil {
+		return token{}, err
+	}
+	if l.pos >= len(l.input) {
+		return token{kind: tokenEOF, line: l.line}, nil
+	}
+	r := l.input[l.pos]
+	line := l.line
+	switch {
+	case strings.ContainsRune("[](){},;", r):
+		l.pos++
+		return token{kind: tokenSpecial, text: string(r), line: line}, nil
+	case r == ':':
+		l.pos++
+		if !isIdentifierStart(l.peek(0)) {
+			return token{}, l.errorf("expected tag name after ':'")
+		}
+		return token{kind: tokenTag, text: strings.ToLower(l.identifier()), line: line}, nil
+	case r == '"':
+		return l.quotedString()
+	case r >= '0' && r <= '9':
+		return l.number()
+	case isIdentifierStart(r):
+		name := l.identifier()
+		if strings.ToLower(name) == "text" && l.peek(0) == ':' {
+			l.pos++
+			return l.multiLineString(line)
+		}
+		return token{kind: tokenIdentifier, text: strings.ToLower(name), line: line}, nil
+	}
+	return token{}, l.errorf("unexpected character %q", r)
+}
+
+func (l *lexer) number() (token, error) {
+	line := l.line
+	start := l.pos
+	for l.pos < len(l.input) && l.input[l.pos] >= '0' && l.input[l.pos] <= '9' {
+		l.pos++
+	}
+	value, err := strconv.ParseInt(string(l.input[start:l.pos]), 10, 64)
+	if err != nil {
+		return token{}, l.errorf("invalid number: %s", err)
+	}
+	switch l.peek(0) {
+	case 'K', 'k':
+		value *= 1 << 10
+		l.pos++
+	case 'M', 'm':
+		value *= 1 << 20
+		l.pos++
+	case 'G', 'g':
+		value *= 1 << 30
+		l.pos++
+	}
+	return token{kind: tokenNumber, number: value, text: string(l.input[start:l.pos]), line: line}, nil
+}
+
+func (l *lexer) quotedString() (token, error) {
+	line := l.line
+	l.pos++
+	var builder strings.Builder
+	for {
+		if l.pos >= len(l.input) {
+			return token{}, &SyntaxError{Line: line, Message: "unterminated string"}
+		}
+		r := l.input[l.pos]
+		l.pos++
+		switch r {
+		case '"':
+			return token{kind: tokenString, text: builder.String(), line: line}, nil
+		case '\\':
+			if l.pos < len(l.input) {
+				builder.WriteRune(l.input[l.pos])
+				l.pos++
+			}
+		case '\n':
+			l.line++
+			builder.WriteRune(r)
+		default:
+			builder.WriteRune(r)
+		}
+	}
+}
+
+//multiLineString reads a text: string. The content starts after the current line and ends with a line containing
+//only a dot. Lines starting with a dot have their leading dot removed
+func (l *lexer) multiLineString(line int) (token, error) {
+	for l.pos < len(l.input) && (l.input[l.pos] == ' ' || l.input[l.pos] == '\t') {
+		l.pos++
+	}
+	if l.peek(0) == '#' {
+		for l.pos < len(l.input) && l.input[l.pos] != '\n' {
+			l.pos++
+		}
+	}
+	if l.peek(0) == '\r' {
+		l.pos++
+	}
+	if l.peek(0) != '\n' {
+		return token{}, l.errorf("expected line break after text:")
+	}
+	l.pos++
+	l.line++
+
+	var builder strings.Builder
+	for {
+		if l.pos >= len(l.input) {
+			return token{}, &SyntaxError{Line: line, Message: "unterminated multi-line string"}
+		}
+		end := l.pos
+		for end < len(l.input) && l.input[end] != '\n' {
+			end++
+		}
+		current := strings.TrimSuffix(string(l.input[l.pos:end]), "\r")
+		l.pos = end
+		if l.pos < len(l.input) {
+			l.pos++
+			l.line++
+		}
+		if current == "." {
+			return token{kind: tokenString, text: builder.String(), line: line}, nil
+		}
+		builder.WriteString(strings.TrimPrefix(current, "."))
+		builder.WriteString("\r\n")
+	}
+}
@@ -0,0 +1,76 @@
+package sieve
+
+import (
+	"regexp"
+	"strings"
+)
+
+//match compares value against key with the given comparator and match type. For :matches and :regex the captured
+//groups are returned, starting with the whole match, so they can be used as match variables
+func match(options matchOptions, value string, key string) (bool, []string, error) {
+	caseInsensitive := options.comparator == comparatorCasemap
+	switch options.matchType {
+	case matchContains:
+		if caseInsensitive {
+			return strings.Contains(asciiLower(value), asciiLower(key)), nil, nil
+		}
+		return strings.Contains(value, key), nil, nil
+	case matchMatches:
+		expression := "(?s)^" + wildcardToRegex(key) + "$"
+		return matchRegexp(expression, value, caseInsensitive)
+	case matchRegex:
+		return matchRegexp(key, value, caseInsensitive)
+	}
+	if caseInsensitive {
+		return asciiLower(value) == asciiLower(key), nil, nil
+	}
+	return value == key, nil, nil
+}
+
+func matchRegexp(expression string, value string, caseInsensitive bool) (bool, []string, error) {
+	if caseInsensitive {
+		expression = "(?i)" + expression
+	}
+	compiled, err := regexp.Compile(expression)
+	if err != nil {
+		return false, nil, err
+	}
+	captures := compiled.FindStringSubmatch(value)
+	if captures == nil {
+		return false, nil, nil
+	}
+	return true, captures, nil
+}
+
+//wildcardToRegex converts a :matches pattern into a regular expression. Every * and ? becomes a capture group, * is
+//matched non-greedy so that match variables contain the shortest possible match as described in RFC 5229
+func wildcardToRegex(pattern string) string {
+	var builder strings.Builder
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		switch runes[i] {
+		case '*':
+			builder.WriteString("(.*?)")
+		case '?':
+			builder.WriteString("(.)")
+		case '\\':
+			if i+1 < len(runes) {
+				i++
+			}
+			builder.WriteString(regexp.QuoteMeta(string(runes[i])))
+		default:
+			builder.WriteString(regexp.QuoteMeta(string(runes[i])))
+		}
+	}
+	return builder.String()
+}
+
+//asciiLower implements the i;ascii-casemap comparator, which only folds the ASCII letters
+func asciiLower(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r + ('a' - 'A')
+		}
+		return r
+	}, value)
+}
@@ -0,0 +1,221 @@
+package sieve
+
+import (
+	"fmt"
+)
+
+//SyntaxError is returned if a script can't be parsed or uses commands, tests or extensions which are not supported
+type SyntaxError struct {
+	Line    int
+	Message string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("sieve: line %d: %s", e.Line, e.Message)
+}
+
+type argumentKind int
+
+const (
+	argumentStrings argumentKind = iota
+	argumentNumber
+	argumentTag
+)
+
+//argument is a positional or tagged argument of a command or test
+type argument struct {
+	kind    argumentKind
+	strings []string
+	number  int64
+	tag     string
+	line    int
+}
+
+type test struct {
+	name      string
+	arguments []argument
+	tests     []test
+	line      int
+}
+
+type command struct {
+	name      string
+	arguments []argument
+	tests     []test
+	block     []command
+	line      int
+}
+
+//parser builds the command tree from the tokens of the lexer, following the grammar in RFC 5228 section 8.2
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func parse(script string) ([]command, error) {
+	tokens, err := lex(script)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	commands, err := p.commands()
+	if err != nil {
+		return nil, err
+	}
+	if p.current().kind != tokenEOF {
+		return nil, p.unexpected()
+	}
+	return commands, nil
+}
+
+func (p *parser) current() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) isSpecial(text string) bool {
+	t := p.current()
+	return t.kind == tokenSpecial && t.text == text
+}
+
+func (p *parser) expectSpecial(text string) error {
+	if !p.isSpecial(text) {
+		return &SyntaxError{Line: p.current().line, Message: fmt.Sprintf("expected '%s' but found %s", text, p.current())}
+	}
+	p.pos++
+	return nil
+}
+
+func (p *parser) unexpected() error {
+	return &SyntaxError{Line: p.current().line, Message: fmt.Sprintf("unexpected %s", p.current())}
+}
+
+func (p *parser) commands() ([]command, error) {
+	var commands []command
+	for p.current().kind == tokenIdentifier {
+		cmd, err := p.command()
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, cmd)
+	}
+	return commands, nil
+}
+
+func (p *parser) command() (command, error) {
+	name := p.current()
+	p.pos++
+	cmd := command{name: name.text, line: name.line}
+	var err error
+	cmd.arguments, cmd.tests, err = p.argumentsAndTests()
+	if err != nil {
+		return command{}, err
+	}
+	if p.isSpecial(";") {
+		p.pos++
+		return cmd, nil
+	}
+	if !p.isSpecial("{") {
+		return command{}, &SyntaxError{Line: p.current().line, Message: fmt.Sprintf("expected ';' or block after %s", name.text)}
+	}
+	p.pos++
+	cmd.block, err = p.commands()
+	if err != nil {
+		return command{}, err
+	}
+	if cmd.block == nil {
+		cmd.block = []command{}
+	}
+	return cmd, p.expectSpecial("}")
+}
+
+func (p *parser) argumentsAndTests() ([]argument, []test, error) {
+	var arguments []argument
+	for {
+		t := p.current()
+		switch {
+		case t.kind == tokenTag:
+			arguments = append(arguments, argument{kind: argumentTag, tag: t.text, line: t.line})
+			p.pos++
+		case t.kind == tokenNumber:
+			arguments = append(arguments, argument{kind: argumentNumber, number: t.number, line: t.line})
+			p.pos++
+		case t.kind == tokenString || (t.kind == tokenSpecial && t.text == "["):
+			list, err := p.stringList()
+			if err != nil {
+				return nil, nil, err
+			}
+			arguments = append(arguments, argument{kind: argumentStrings, strings: list, line: t.line})
+		case t.kind == tokenIdentifier:
+			single, err := p.test()
+			if err != nil {
+				return nil, nil, err
+			}
+			return arguments, []test{single}, nil
+		case t.kind == tokenSpecial && t.text == "(":
+			tests, err := p.testList()
+			return arguments, tests, err
+		default:
+			return arguments, nil, nil
+		}
+	}
+}
+
+func (p *parser) stringList() ([]string, error) {
+	if p.current().kind == tokenString {
+		value := p.current().text
+		p.pos++
+		return []string{value}, nil
+	}
+	if err := p.expectSpecial("["); err != nil {
+		return nil, err
+	}
+	list := []string{}
+	for {
+		if p.current().kind != tokenString {
+			return nil, p.unexpected()
+		}
+		list = append(list, p.current().text)
+		p.pos++
+		if p.isSpecial("]") {
+			p.pos++
+			return list, nil
+		}
+		if err := p.expectSpecial(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) test() (test, error) {
+	name := p.current()
+	if name.kind != tokenIdentifier {
+		return test{}, p.unexpected()
+	}
+	p.pos++
+	arguments, tests, err := p.argumentsAndTests()
+	if err != nil {
+		return test{}, err
+	}
+	return test{name: name.text, arguments: arguments, tests: tests, line: name.line}, nil
+}
+
+func (p *parser) testList() ([]test, error) {
+	if err := p.expectSpecial("("); err != nil {
+		return nil, err
+	}
+	var tests []test
+	for {
+		single, err := p.test()
+		if err != nil {
+			return nil, err
+		}
+		tests = append(tests, single)
+		if p.isSpecial(")") {
+			p.pos++
+			return tests, nil
+		}
+		if err := p.expectSpecial(","); err != nil {
+			return nil, err
+		}
+	}
+}
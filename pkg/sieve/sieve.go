@@ -0,0 +1,480 @@
+//Package sieve implements an interpreter for RFC 5228 Sieve scripts, which decide where captured mails are placed.
+//Supported extensions are fileinto, envelope, copy, imap4flags (RFC 5232), regex and variables (RFC 5229)
+package sieve
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+var supportedExtensions = map[string]bool{
+	"fileinto":                   true,
+	"envelope":                   true,
+	"copy":                       true,
+	"imap4flags":                 true,
+	"regex":                      true,
+	"variables":                  true,
+	"comparator-i;octet":         true,
+	"comparator-i;ascii-casemap": true,
+}
+
+const (
+	comparatorOctet   = "i;octet"
+	comparatorCasemap = "i;ascii-casemap"
+	matchIs           = "is"
+	matchContains     = "contains"
+	matchMatches      = "matches"
+	matchRegex        = "regex"
+	addressPartAll    = "all"
+	addressPartLocal  = "localpart"
+	addressPartDomain = "domain"
+)
+
+//Script is a parsed and validated sieve script which can be evaluated for any number of mails
+type Script struct {
+	commands   []*compiledCommand
+	extensions map[string]bool
+}
+
+type matchOptions struct {
+	comparator  string
+	matchType   string
+	addressPart string
+}
+
+type compiledTest struct {
+	name      string
+	match     matchOptions
+	sources   []string
+	keys      []string
+	size      int64
+	over      bool
+	variables []string
+	tests     []*compiledTest
+	line      int
+}
+
+type compiledCommand struct {
+	name      string
+	test      *compiledTest
+	block     []*compiledCommand
+	mailbox   string
+	copy      bool
+	flags     []string
+	hasFlags  bool
+	variable  string
+	value     string
+	modifiers []string
+	line      int
+}
+
+//ParseFile reads and parses the sieve script at path
+func ParseFile(path string) (*Script, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(string(content))
+}
+
+//Parse parses a sieve script and checks that it only uses supported and required extensions
+func Parse(script string) (*Script, error) {
+	commands, err := parse(script)
+	if err != nil {
+		return nil, err
+	}
+	compiled := &Script{extensions: make(map[string]bool)}
+	compiled.commands, err = compiled.compileCommands(commands, true)
+	if err != nil {
+		return nil, err
+	}
+	return compiled, nil
+}
+
+func syntaxErrorf(line int, format string, args ...interface{}) error {
+	return &SyntaxError{Line: line, Message: fmt.Sprintf(format, args...)}
+}
+
+func (s *Script) requireExtension(line int, extension string, usage string) error {
+	if !s.extensions[extension] {
+		return syntaxErrorf(line, "%s requires the extension \"%s\"", usage, extension)
+	}
+	return nil
+}
+
+func (s *Script) compileCommands(commands []command, topLevel bool) ([]*compiledCommand, error) {
+	var compiled []*compiledCommand
+	requireAllowed := topLevel
+	previous := ""
+	for _, cmd := range commands {
+		if cmd.name == "require" {
+			if !requireAllowed {
+				return nil, syntaxErrorf(cmd.line, "require is only allowed at the beginning of a script")
+			}
+			err := s.compileRequire(cmd)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		requireAllowed = false
+		if (cmd.name == "elsif" || cmd.name == "else") && previous != "if" && previous != "elsif" {
+			return nil, syntaxErrorf(cmd.line, "%s without preceding if", cmd.name)
+		}
+		c, err := s.compileCommand(cmd)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, c)
+		previous = cmd.name
+	}
+	return compiled, nil
+}
+
+func (s *Script) compileRequire(cmd command) error {
+	if len(cmd.arguments) != 1 || cmd.arguments[0].kind != argumentStrings || cmd.tests != nil || cmd.block != nil {
+		return syntaxErrorf(cmd.line, "require expects a string list")
+	}
+	for _, extension := range cmd.arguments[0].strings {
+		extension = strings.ToLower(extension)
+		if !supportedExtensions[extension] {
+			return syntaxErrorf(cmd.line, "unsupported extension \"%s\"", extension)
+		}
+		s.extensions[extension] = true
+	}
+	return nil
+}
+
+//taggedArguments splits the arguments into tagged arguments and positional arguments. allowed maps each allowed tag
+//to the amount of arguments following the tag (0 or 1)
+func taggedArguments(line int, arguments []argument, allowed map[string]int) (map[string]*argument, []argument, error) {
+	tags := make(map[string]*argument)
+	var positional []argument
+	for i := 0; i < len(arguments); i++ {
+		arg := arguments[i]
+		if arg.kind != argumentTag {
+			positional = append(positional, arg)
+			continue
+		}
+		if len(positional) > 0 {
+			return nil, nil, syntaxErrorf(arg.line, "tagged argument :%s must come before positional arguments", arg.tag)
+		}
+		following, ok := allowed[arg.tag]
+		if !ok {
+			return nil, nil, syntaxErrorf(arg.line, "unexpected tagged argument :%s", arg.tag)
+		}
+		if _, duplicate := tags[arg.tag]; duplicate {
+			return nil, nil, syntaxErrorf(arg.line, "duplicate tagged argument :%s", arg.tag)
+		}
+		tags[arg.tag] = &arguments[i]
+		if following == 1 {
+			if i+1 >= len(arguments) || arguments[i+1].kind == argumentTag {
+				return nil, nil, syntaxErrorf(line, "missing value for :%s", arg.tag)
+			}
+			i++
+			tags[arg.tag] = &arguments[i]
+		}
+	}
+	return tags, positional, nil
+}
+
+func (s *Script) compileMatchOptions(line int, tags map[string]*argument, withAddressPart bool) (matchOptions, error) {
+	options := matchOptions{comparator: comparatorCasemap, matchType: matchIs, addressPart: addressPartAll}
+	if comparator, ok := tags["comparator"]; ok {
+		if comparator.kind != argumentStrings || len(comparator.strings) != 1 {
+			return options, syntaxErrorf(line, ":comparator expects a single string")
+		}
+		options.comparator = strings.ToLower(comparator.strings[0])
+		if options.comparator != comparatorOctet && options.comparator != comparatorCasemap {
+			return options, syntaxErrorf(line, "unsupported comparator \"%s\"", options.comparator)
+		}
+	}
+	matchTypes := 0
+	for _, matchType := range []string{matchIs, matchContains, matchMatches, matchRegex} {
+		if _, ok := tags[matchType]; ok {
+			options.matchType = matchType
+			matchTypes++
+		}
+	}
+	if matchTypes > 1 {
+		return options, syntaxErrorf(line, "only one match type is allowed")
+	}
+	if options.matchType == matchRegex {
+		if err := s.requireExtension(line, "regex", ":regex"); err != nil {
+			return options, err
+		}
+	}
+	if withAddressPart {
+		parts := 0
+		for _, part := range []string{addressPartAll, addressPartLocal, addressPartDomain} {
+			if _, ok := tags[part]; ok {
+				options.addressPart = part
+				parts++
+			}
+		}
+		if parts > 1 {
+			return options, syntaxErrorf(line, "only one address part is allowed")
+		}
+	}
+	return options, nil
+}
+
+func matchTags(withAddressPart bool) map[string]int {
+	tags := map[string]int{"comparator": 1, matchIs: 0, matchContains: 0, matchMatches: 0, matchRegex: 0}
+	if withAddressPart {
+		tags[addressPartAll] = 0
+		tags[addressPartLocal] = 0
+		tags[addressPartDomain] = 0
+	}
+	return tags
+}
+
+func expectStringLists(line int, name string, positional []argument, count int) error {
+	if len(positional) != count {
+		return syntaxErrorf(line, "%s expects %d string list arguments", name, count)
+	}
+	for _, arg := range positional {
+		if arg.kind != argumentStrings {
+			return syntaxErrorf(arg.line, "%s expects string list arguments", name)
+		}
+	}
+	return nil
+}
+
+func (s *Script) compileCommand(cmd command) (*compiledCommand, error) {
+	compiled := &compiledCommand{name: cmd.name, line: cmd.line}
+	if cmd.name != "if" && cmd.name != "elsif" && cmd.name != "else" && cmd.block != nil {
+		return nil, syntaxErrorf(cmd.line, "%s does not take a block", cmd.name)
+	}
+	switch cmd.name {
+	case "if", "elsif", "else":
+		if cmd.block == nil {
+			return nil, syntaxErrorf(cmd.line, "%s requires a block", cmd.name)
+		}
+		if cmd.name == "else" {
+			if len(cmd.arguments) > 0 || cmd.tests != nil {
+				return nil, syntaxErrorf(cmd.line, "else does not take arguments")
+			}
+		} else {
+			if len(cmd.arguments) > 0 || len(cmd.tests) != 1 {
+				return nil, syntaxErrorf(cmd.line, "%s expects exactly one test", cmd.name)
+			}
+			test, err := s.compileTest(cmd.tests[0])
+			if err != nil {
+				return nil, err
+			}
+			compiled.test = test
+		}
+		block, err := s.compileCommands(cmd.block, false)
+		if err != nil {
+			return nil, err
+		}
+		compiled.block = block
+		return compiled, nil
+	case "stop", "discard":
+		if len(cmd.arguments) > 0 || cmd.tests != nil {
+			return nil, syntaxErrorf(cmd.line, "%s does not take arguments", cmd.name)
+		}
+		return compiled, nil
+	case "keep", "fileinto":
+		allowed := map[string]int{}
+		if s.extensions["imap4flags"] {
+			allowed["flags"] = 1
+		}
+		if s.extensions["copy"] && cmd.name == "fileinto" {
+			allowed["copy"] = 0
+		}
+		if cmd.name == "fileinto" {
+			if err := s.requireExtension(cmd.line, "fileinto", "fileinto"); err != nil {
+				return nil, err
+			}
+		}
+		tags, positional, err := taggedArguments(cmd.line, cmd.arguments, allowed)
+		if err != nil {
+			return nil, err
+		}
+		if cmd.tests != nil {
+			return nil, syntaxErrorf(cmd.line, "%s does not take tests", cmd.name)
+		}
+		if flags, ok := tags["flags"]; ok {
+			if flags.kind != argumentStrings {
+				return nil, syntaxErrorf(cmd.line, ":flags expects a string list")
+			}
+			compiled.hasFlags = true
+			compiled.flags = flags.strings
+		}
+		_, compiled.copy = tags["copy"]
+		if cmd.name == "keep" {
+			if len(positional) > 0 {
+				return nil, syntaxErrorf(cmd.line, "keep does not take positional arguments")
+			}
+			return compiled, nil
+		}
+		if err := expectStringLists(cmd.line, "fileinto", positional, 1); err != nil {
+			return nil, err
+		}
+		if len(positional[0].strings) != 1 {
+			return nil, syntaxErrorf(cmd.line, "fileinto expects a single mailbox")
+		}
+		compiled.mailbox = positional[0].strings[0]
+		return compiled, nil
+	case "setflag", "addflag", "removeflag":
+		if err := s.requireExtension(cmd.line, "imap4flags", cmd.name); err != nil {
+			return nil, err
+		}
+		if cmd.tests != nil || len(cmd.arguments) < 1 || len(cmd.arguments) > 2 {
+			return nil, syntaxErrorf(cmd.line, "%s expects an optional variable name and a list of flags", cmd.name)
+		}
+		if err := expectStringLists(cmd.line, cmd.name, cmd.arguments, len(cmd.arguments)); err != nil {
+			return nil, err
+		}
+		if len(cmd.arguments) == 2 {
+			if len(cmd.arguments[0].strings) != 1 {
+				return nil, syntaxErrorf(cmd.line, "%s expects a single variable name", cmd.name)
+			}
+			compiled.variable = strings.ToLower(cmd.arguments[0].strings[0])
+		}
+		compiled.flags = cmd.arguments[len(cmd.arguments)-1].strings
+		return compiled, nil
+	case "set":
+		if err := s.requireExtension(cmd.line, "variables", "set"); err != nil {
+			return nil, err
+		}
+		allowed := map[string]int{}
+		for modifier := range modifierPrecedence {
+			allowed[modifier] = 0
+		}
+		tags, positional, err := taggedArguments(cmd.line, cmd.arguments, allowed)
+		if err != nil {
+			return nil, err
+		}
+		if cmd.tests != nil {
+			return nil, syntaxErrorf(cmd.line, "set does not take tests")
+		}
+		if err := expectStringLists(cmd.line, "set", positional, 2); err != nil {
+			return nil, err
+		}
+		if len(positional[0].strings) != 1 || len(positional[1].strings) != 1 {
+			return nil, syntaxErrorf(cmd.line, "set expects a single name and value")
+		}
+		compiled.variable = strings.ToLower(positional[0].strings[0])
+		if !isVariableName(compiled.variable) {
+			return nil, syntaxErrorf(cmd.line, "invalid variable name \"%s\"", compiled.variable)
+		}
+		compiled.value = positional[1].strings[0]
+		for modifier := range tags {
+			if modifier == "quoteregex" {
+				if err := s.requireExtension(cmd.line, "regex", ":quoteregex"); err != nil {
+					return nil, err
+				}
+			}
+			compiled.modifiers = append(compiled.modifiers, modifier)
+		}
+		sortModifiers(compiled.modifiers)
+		return compiled, nil
+	}
+	return nil, syntaxErrorf(cmd.line, "unknown command \"%s\"", cmd.name)
+}
+
+func (s *Script) compileTest(t test) (*compiledTest, error) {
+	compiled := &compiledTest{name: t.name, line: t.line}
+	switch t.name {
+	case "true", "false":
+		if len(t.arguments) > 0 || t.tests != nil {
+			return nil, syntaxErrorf(t.line, "%s does not take arguments", t.name)
+		}
+		return compiled, nil
+	case "not", "allof", "anyof":
+		if len(t.arguments) > 0 || len(t.tests) == 0 || (t.name == "not" && len(t.tests) != 1) {
+			return nil, syntaxErrorf(t.line, "%s expects tests as arguments", t.name)
+		}
+		for _, inner := range t.tests {
+			compiledInner, err := s.compileTest(inner)
+			if err != nil {
+				return nil, err
+			}
+			compiled.tests = append(compiled.tests, compiledInner)
+		}
+		return compiled, nil
+	}
+	if t.tests != nil {
+		return nil, syntaxErrorf(t.line, "%s does not take tests as arguments", t.name)
+	}
+	switch t.name {
+	case "exists":
+		if err := expectStringLists(t.line, t.name, t.arguments, 1); err != nil {
+			return nil, err
+		}
+		compiled.sources = t.arguments[0].strings
+		return compiled, nil
+	case "size":
+		tags, positional, err := taggedArguments(t.line, t.arguments, map[string]int{"over": 0, "under": 0})
+		if err != nil {
+			return nil, err
+		}
+		_, over := tags["over"]
+		_, under := tags["under"]
+		if over == under || len(positional) != 1 || positional[0].kind != argumentNumber {
+			return nil, syntaxErrorf(t.line, "size expects :over or :under and a number")
+		}
+		compiled.over = over
+		compiled.size = positional[0].number
+		return compiled, nil
+	case "header", "address", "envelope", "string", "hasflag":
+		withAddressPart := t.name == "address" || t.name == "envelope"
+		switch t.name {
+		case "envelope":
+			if err := s.requireExtension(t.line, "envelope", "envelope"); err != nil {
+				return nil, err
+			}
+		case "string":
+			if err := s.requireExtension(t.line, "variables", "string"); err != nil {
+				return nil, err
+			}
+		case "hasflag":
+			if err := s.requireExtension(t.line, "imap4flags", "hasflag"); err != nil {
+				return nil, err
+			}
+		}
+		for _, arg := range t.arguments {
+			if arg.kind == argumentTag && (arg.tag == "count" || arg.tag == "value") {
+				return nil, syntaxErrorf(arg.line, "match type :%s (relational extension) is not supported", arg.tag)
+			}
+		}
+		tags, positional, err := taggedArguments(t.line, t.arguments, matchTags(withAddressPart))
+		if err != nil {
+			return nil, err
+		}
+		compiled.match, err = s.compileMatchOptions(t.line, tags, withAddressPart)
+		if err != nil {
+			return nil, err
+		}
+		if t.name == "hasflag" && len(positional) == 1 {
+			if err := expectStringLists(t.line, t.name, positional, 1); err != nil {
+				return nil, err
+			}
+			compiled.keys = positional[0].strings
+			return compiled, nil
+		}
+		if err := expectStringLists(t.line, t.name, positional, 2); err != nil {
+			return nil, err
+		}
+		compiled.sources = positional[0].strings
+		compiled.keys = positional[1].strings
+		if t.name == "hasflag" {
+			compiled.variables = compiled.sources
+			compiled.sources = nil
+		}
+		if t.name == "envelope" {
+			for _, part := range compiled.sources {
+				part = strings.ToLower(part)
+				if part != "from" && part != "to" {
+					return nil, syntaxErrorf(t.line, "unsupported envelope part \"%s\"", part)
+				}
+			}
+		}
+		return compiled, nil
+	}
+	return nil, syntaxErrorf(t.line, "unknown test \"%s\"", t.name)
+}
@@ -0,0 +1,164 @@
+package sieve
+
+import (
+	"github.com/da-coda/mailpie/pkg/instances"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+var rawMail = []byte(`MIME-Version: 1.0
+Date: Wed, 27 Jan 2021 17:00:48 +0100
+From: "Alex" <alex@example.com>
+To: bob@example.com, cora@example.org
+List-Id: Mailpie Developers <dev.lists.example.com>
+Subject: =?UTF-8?Q?[SPAM]_Hello_W=C3=B6rld!?=
+Content-Type: text/plain; charset=UTF-8
+
+Hello Bob and Cora!
+`)
+
+type SieveUnitTestSuite struct {
+	suite.Suite
+	mail instances.Mail
+}
+
+func (suite *SieveUnitTestSuite) SetupTest() {
+	mail, err := instances.ParseMail(rawMail)
+	suite.Require().Nil(err)
+	mail.EnvelopeFrom = "bounce@example.com"
+	mail.EnvelopeTo = []string{"bob+test@example.com"}
+	suite.mail = *mail
+}
+
+func (suite *SieveUnitTestSuite) evaluate(script string) *Result {
+	parsed, err := Parse(script)
+	suite.Require().Nil(err, "Unexpected error parsing script")
+	result, err := parsed.Evaluate(suite.mail)
+	suite.Require().Nil(err, "Unexpected error evaluating script")
+	return result
+}
+
+func (suite *SieveUnitTestSuite) TestImplicitKeep() {
+	result := suite.evaluate(`# nothing to do`)
+	suite.Equal([]Delivery{{Mailbox: Inbox}}, result.Deliveries())
+	suite.True(result.Actions[0].Implicit)
+}
+
+func (suite *SieveUnitTestSuite) TestFileInto_Header() {
+	result := suite.evaluate(`require "fileinto";
+if header :contains "subject" "[spam]" {
+	fileinto "Junk";
+	stop;
+}
+fileinto "Archive";`)
+	suite.Equal([]Delivery{{Mailbox: "Junk"}}, result.Deliveries())
+}
+
+func (suite *SieveUnitTestSuite) TestFileInto_Copy() {
+	result := suite.evaluate(`require ["fileinto", "copy"];
+fileinto :copy "Archive";`)
+	suite.Equal([]Delivery{{Mailbox: "Archive"}, {Mailbox: Inbox}}, result.Deliveries())
+}
+
+func (suite *SieveUnitTestSuite) TestDiscard() {
+	result := suite.evaluate(`if address :domain :is "to" "example.org" { discard; }`)
+	suite.Empty(result.Deliveries())
+	suite.Equal(ActionDiscard, result.Actions[0].Type)
+}
+
+func (suite *SieveUnitTestSuite) TestIfElsifElse() {
+	result := suite.evaluate(`require "fileinto";
+if false { fileinto "A"; }
+elsif size :over 10K { fileinto "B"; }
+elsif allof(exists "List-Id", not address :localpart "from" "bob") { fileinto "C"; }
+else { fileinto "D"; }`)
+	suite.Equal([]Delivery{{Mailbox: "C"}}, result.Deliveries())
+}
+
+func (suite *SieveUnitTestSuite) TestEnvelope() {
+	result := suite.evaluate(`require ["envelope", "fileinto"];
+if envelope :localpart :matches "to" "bob+*" { fileinto "Tagged"; }
+if anyof(envelope :is "from" "nobody@example.com", false) { discard; }`)
+	suite.Equal([]Delivery{{Mailbox: "Tagged"}}, result.Deliveries())
+}
+
+func (suite *SieveUnitTestSuite) TestFlags() {
+	result := suite.evaluate(`require ["imap4flags", "fileinto"];
+addflag "\\Seen";
+addflag ["$Important", "\\Seen"];
+if hasflag "$important" { fileinto "Important"; }
+removeflag "\\Seen";
+keep :flags "\\Flagged";`)
+	suite.Equal([]Delivery{
+		{Mailbox: "Important", Flags: []string{"\\Seen", "$Important"}},
+		{Mailbox: Inbox, Flags: []string{"\\Flagged"}},
+	}, result.Deliveries())
+}
+
+func (suite *SieveUnitTestSuite) TestVariables_MatchVariables() {
+	result := suite.evaluate(`require ["fileinto", "variables"];
+if header :matches "List-Id" "*<*.lists.*>" {
+	set :upperfirst "list" "${2}";
+	fileinto "Lists/${list}";
+}`)
+	suite.Equal([]Delivery{{Mailbox: "Lists/Dev"}}, result.Deliveries())
+}
+
+func (suite *SieveUnitTestSuite) TestVariables_Regex() {
+	result := suite.evaluate(`require ["fileinto", "variables", "regex"];
+if address :regex "from" "^([a-z]+)@(.+)$" {
+	set :lower :length "len" "${1}";
+	fileinto "${2}/${len}";
+}`)
+	suite.Equal([]Delivery{{Mailbox: "example.com/4"}}, result.Deliveries())
+}
+
+func (suite *SieveUnitTestSuite) TestVariables_StringTest() {
+	result := suite.evaluate(`require ["fileinto", "variables"];
+set "folder" "Work";
+if string :is "${folder}" "work" { fileinto text:
+${folder}
+.
+; }`)
+	suite.Equal([]Delivery{{Mailbox: "Work\r\n"}}, result.Deliveries())
+}
+
+func (suite *SieveUnitTestSuite) TestComparator_Octet() {
+	result := suite.evaluate(`if header :comparator "i;octet" :contains "Subject" "[spam]" { discard; }`)
+	suite.Len(result.Deliveries(), 1)
+}
+
+func (suite *SieveUnitTestSuite) TestParse_Errors() {
+	scripts := []string{
+		`fileinto "Junk";`,
+		`require "vacation";`,
+		`if header :regex "subject" "x" { keep; }`,
+		`keep; require "fileinto";`,
+		`else { keep; }`,
+		`if true keep;`,
+		`unknown;`,
+		`if header :count "gt" "to" "1" { keep; }`,
+		`keep`,
+		`"unterminated`,
+	}
+	for _, script := range scripts {
+		_, err := Parse(script)
+		assert.Error(suite.T(), err, "Expected error for script %s", script)
+	}
+}
+
+func (suite *SieveUnitTestSuite) TestParse_SyntaxErrorLine() {
+	_, err := Parse("require \"fileinto\";\n\nfileinto ;")
+	var syntaxError *SyntaxError
+	suite.ErrorAs(err, &syntaxError)
+	suite.Equal(3, syntaxError.Line)
+}
+
+func (suite *SieveUnitTestSuite) TestWildcardToRegex() {
+	suite.Equal(`(.*?)@(.)\.com\*`, wildcardToRegex(`*@?.com\*`))
+}
+
+func TestSieve(t *testing.T) {
+	suite.Run(t, new(SieveUnitTestSuite))
+}
@@ -0,0 +1,105 @@
+package sieve
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	variableNamePattern  = regexp.MustCompile(`^[a-z_][a-z0-9_]*(\.[a-z_][a-z0-9_]*)*$`)
+	matchVariablePattern = regexp.MustCompile(`^[0-9]+$`)
+)
+
+//modifierPrecedence of the set modifiers as defined in RFC 5229 section 4. Higher precedence is applied first
+var modifierPrecedence = map[string]int{
+	"lower":         40,
+	"upper":         40,
+	"lowerfirst":    30,
+	"upperfirst":    30,
+	"quotewildcard": 20,
+	"quoteregex":    20,
+	"length":        10,
+}
+
+func isVariableName(name string) bool {
+	return variableNamePattern.MatchString(name)
+}
+
+//expand replaces ${name} and ${number} references if the script requires the variables extension. Unknown variables
+//expand to the empty string, anything which is not a valid reference is kept as it is
+func (in *interpreter) expand(value string) string {
+	if !in.script.extensions["variables"] || !strings.Contains(value, "${") {
+		return value
+	}
+	var builder strings.Builder
+	for {
+		start := strings.Index(value, "${")
+		if start < 0 {
+			builder.WriteString(value)
+			return builder.String()
+		}
+		end := strings.Index(value[start:], "}")
+		if end < 0 {
+			builder.WriteString(value)
+			return builder.String()
+		}
+		end += start
+		name := strings.ToLower(value[start+2 : end])
+		switch {
+		case matchVariablePattern.MatchString(name):
+			builder.WriteString(value[:start])
+			index, _ := strconv.Atoi(name)
+			if index < len(in.matches) {
+				builder.WriteString(in.matches[index])
+			}
+			value = value[end+1:]
+		case isVariableName(name):
+			builder.WriteString(value[:start])
+			builder.WriteString(in.variables[name])
+			value = value[end+1:]
+		default:
+			builder.WriteString(value[:start+2])
+			value = value[start+2:]
+		}
+	}
+}
+
+func (in *interpreter) expandAll(values []string) []string {
+	expanded := make([]string, len(values))
+	for i, value := range values {
+		expanded[i] = in.expand(value)
+	}
+	return expanded
+}
+
+//applyModifiers applies the already sorted set modifiers to value
+func applyModifiers(value string, modifiers []string) string {
+	for _, modifier := range modifiers {
+		switch modifier {
+		case "lower":
+			value = strings.ToLower(value)
+		case "upper":
+			value = strings.ToUpper(value)
+		case "lowerfirst", "upperfirst":
+			first, size := utf8.DecodeRuneInString(value)
+			if size == 0 {
+				continue
+			}
+			changed := strings.ToLower(string(first))
+			if modifier == "upperfirst" {
+				changed = strings.ToUpper(string(first))
+			}
+			value = changed + value[size:]
+		case "quotewildcard":
+			replacer := strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`)
+			value = replacer.Replace(value)
+		case "quoteregex":
+			value = regexp.QuoteMeta(value)
+		case "length":
+			value = strconv.Itoa(utf8.RuneCountInString(value))
+		}
+	}
+	return value
+}
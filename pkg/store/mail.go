@@ -3,15 +3,57 @@ package store
 import (
 	"github.com/da-coda/mailpie/pkg/event"
 	"github.com/da-coda/mailpie/pkg/instances"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 const NewMailStoredEvent event.Event = "newMailStored"
+const MailDeletedEvent event.Event = "mailDeleted"
+const MailUpdatedEvent event.Event = "mailUpdated"
 const EventDispatcher = "MailStore"
 
+//MailStored is the data of NewMailStoredEvent
+type MailStored struct {
+	Mail instances.Mail
+}
+
+//MailDeleted is the data of MailDeletedEvent
+type MailDeleted struct {
+	Mail instances.Mail
+}
+
+//MailUpdated is the data of MailUpdatedEvent
+type MailUpdated struct {
+	Mail     instances.Mail
+	Previous instances.Mail
+}
+
 //MailStore holds a bunch of instances.Mail within a map and notifies via the message queue on mail updates
 type MailStore struct {
-	mails        map[string]instances.Mail
+	lock  sync.RWMutex
+	mails map[string]instances.Mail
+	//order holds the keys in the order the mails were added
+	order []string
+	//folders maps the key of a mail to the folders it is in per user
+	folders      map[string]map[string][]string
 	messageQueue event.Dispatcher
+	//received and deleted count the mails since the store was created
+	received int
+	deleted  int
+}
+
+//Stats are the counters of a MailStore
+type Stats struct {
+	//Mails is the number of stored mails
+	Mails int
+	//Received and Deleted count the mails stored and deleted since the store was created, replaced mails are not
+	//counted again
+	Received int
+	Deleted  int
+	//Size is the size of the stored raw messages in bytes
+	Size int
 }
 
 //CreateMailStore always creates and returns a new MailStore. Needs a event.Dispatcher to notify others on mail updates
@@ -19,30 +61,79 @@ func CreateMailStore(messageQueue event.Dispatcher) *MailStore {
 	var store *MailStore
 	store = &MailStore{messageQueue: messageQueue}
 	store.mails = make(map[string]instances.Mail)
+	store.folders = make(map[string]map[string][]string)
 	return store
 }
 
 //Add puts a instances.Mail into the internal map with the given key if the key not exists. Key can be any string but should be recreatable for receiving purposes
-//Returns an AlreadyExistsError if key exists in Map
+//Returns an AlreadyExistsError if key exists in Map. The key and, if not set yet, the received time are set on the stored mail
 func (store *MailStore) Add(key string, mailData instances.Mail) error {
+	mailData.Key = key
+	if mailData.Received.IsZero() {
+		mailData.Received = time.Now()
+	}
+	store.lock.Lock()
 	_, exists := store.mails[key]
 	if exists {
+		store.lock.Unlock()
 		return AlreadyExistsError
 	}
+	store.mails[key] = mailData
+	store.order = append(store.order, key)
+	store.received++
+	store.lock.Unlock()
 
-	store.Set(key, mailData)
+	store.messageQueue.Dispatch(NewMailStoredEvent, EventDispatcher, MailStored{Mail: mailData})
 	return nil
 }
 
-//Set puts a instances.Mail into the internal map with the given key, regardless of key existence
+//Set puts a instances.Mail into the internal map with the given key, regardless of key existence. Replacing a mail is
+//notified with MailUpdatedEvent, so that subscribers don't see the same key as a new mail twice
 func (store *MailStore) Set(key string, data instances.Mail) {
+	data.Key = key
+	if data.Received.IsZero() {
+		data.Received = time.Now()
+	}
+	store.lock.Lock()
+	previous, exists := store.mails[key]
+	if !exists {
+		store.order = append(store.order, key)
+		store.received++
+	}
 	store.mails[key] = data
-	store.messageQueue.Dispatch(NewMailStoredEvent, EventDispatcher, data)
+	store.lock.Unlock()
+	if exists {
+		store.messageQueue.Dispatch(MailUpdatedEvent, EventDispatcher, MailUpdated{Mail: data, Previous: previous})
+		return
+	}
+	store.messageQueue.Dispatch(NewMailStoredEvent, EventDispatcher, MailStored{Mail: data})
 }
 
-// GetSingle for retrieving a single mail by key.
-// Returns KeyNotExistsError if given key does not exist in internal map.
+//Update changes the stored mail with the given key and notifies via the message queue with MailUpdatedEvent, not with
+//NewMailStoredEvent like Set, so that subscribers processing new mails don't process it again. Returns
+//KeyNotExistsError if given key does not exist
+func (store *MailStore) Update(key string, update func(mail *instances.Mail)) error {
+	store.lock.Lock()
+	mail, exists := store.mails[key]
+	if !exists {
+		store.lock.Unlock()
+		return KeyNotExistsError
+	}
+	previous := mail
+	update(&mail)
+	mail.Key = key
+	store.mails[key] = mail
+	store.lock.Unlock()
+
+	store.messageQueue.Dispatch(MailUpdatedEvent, EventDispatcher, MailUpdated{Mail: mail, Previous: previous})
+	return nil
+}
+
+//GetSingle for retrieving a single mail by key.
+//Returns KeyNotExistsError if given key does not exist in internal map.
 func (store *MailStore) GetSingle(key string) (instances.Mail, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
 	mail, exists := store.mails[key]
 	if !exists {
 		return instances.Mail{}, KeyNotExistsError
@@ -50,8 +141,8 @@ func (store *MailStore) GetSingle(key string) (instances.Mail, error) {
 	return mail, nil
 }
 
-// GetMultiple retrieves multiple mails for a given key slice. If any of the keys not exist, a KeyNotExistsError will be returned
-// but the function will still gather the rest. Any not found key will be within the notFoundKeys return parameter
+//GetMultiple retrieves multiple mails for a given key slice. If any of the keys not exist, a KeyNotExistsError will be returned
+//but the function will still gather the rest. Any not found key will be within the notFoundKeys return parameter
 func (store *MailStore) GetMultiple(keys []string) (mails map[string]instances.Mail, err error, notFoundKeys []string) {
 	mails = make(map[string]instances.Mail)
 	for _, key := range keys {
@@ -65,3 +156,122 @@ func (store *MailStore) GetMultiple(keys []string) (mails map[string]instances.M
 	}
 	return
 }
+
+//Keys returns the sorted keys of all stored mails
+func (store *MailStore) Keys() []string {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	keys := make([]string, 0, len(store.mails))
+	for key := range store.mails {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//KeysByArrival returns the keys of all stored mails in the order they were added
+func (store *MailStore) KeysByArrival() []string {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	return append([]string{}, store.order...)
+}
+
+//Delete removes the mail with the given key together with its folder membership and notifies via the message queue.
+//Returns KeyNotExistsError if given key does not exist
+func (store *MailStore) Delete(key string) error {
+	store.lock.Lock()
+	mail, exists := store.mails[key]
+	if !exists {
+		store.lock.Unlock()
+		return KeyNotExistsError
+	}
+	delete(store.mails, key)
+	delete(store.folders, key)
+	store.deleted++
+	for i, ordered := range store.order {
+		if ordered == key {
+			store.order = append(store.order[:i:i], store.order[i+1:]...)
+			break
+		}
+	}
+	store.lock.Unlock()
+
+	store.messageQueue.Dispatch(MailDeletedEvent, EventDispatcher, MailDeleted{Mail: mail})
+	return nil
+}
+
+//AddToFolder records that the mail with the key is in the folder of the user
+func (store *MailStore) AddToFolder(key string, user string, folder string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if _, exists := store.mails[key]; !exists {
+		return KeyNotExistsError
+	}
+	if store.folders[key] == nil {
+		store.folders[key] = make(map[string][]string)
+	}
+	for _, existing := range store.folders[key][user] {
+		if existing == folder {
+			return nil
+		}
+	}
+	store.folders[key][user] = append(store.folders[key][user], folder)
+	sort.Strings(store.folders[key][user])
+	return nil
+}
+
+//RemoveFromFolder records that the mail with the key is no longer in the folder of the user
+func (store *MailStore) RemoveFromFolder(key string, user string, folder string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	folders := store.folders[key][user]
+	for i, existing := range folders {
+		if existing == folder {
+			store.folders[key][user] = append(folders[:i:i], folders[i+1:]...)
+			break
+		}
+	}
+	if len(store.folders[key][user]) == 0 {
+		delete(store.folders[key], user)
+	}
+}
+
+//RenameFolder updates the folder membership of all mails of the user after a folder was renamed. Subfolders separated
+//by delimiter are renamed as well
+func (store *MailStore) RenameFolder(user string, from string, to string, delimiter string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for _, userFolders := range store.folders {
+		folders := userFolders[user]
+		for i, folder := range folders {
+			if folder == from {
+				folders[i] = to
+			} else if strings.HasPrefix(folder, from+delimiter) {
+				folders[i] = to + strings.TrimPrefix(folder, from)
+			}
+		}
+		sort.Strings(folders)
+	}
+}
+
+//Folders returns the folders the mail with the key is in, per user
+func (store *MailStore) Folders(key string) map[string][]string {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	folders := make(map[string][]string, len(store.folders[key]))
+	for user, userFolders := range store.folders[key] {
+		folders[user] = append([]string{}, userFolders...)
+	}
+	return folders
+}
+
+//Stats returns the counters and the size of the stored mails
+func (store *MailStore) Stats() Stats {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	stats := Stats{Mails: len(store.mails), Received: store.received, Deleted: store.deleted}
+	for _, mail := range store.mails {
+		stats.Size += len(mail.RawMessage)
+	}
+	return stats
+}
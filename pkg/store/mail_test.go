@@ -8,6 +8,7 @@ import (
 	"github.com/stretchr/testify/suite"
 	"io/ioutil"
 	"testing"
+	"time"
 )
 
 var rawMail = []byte(`Received: from localhost (localhost [127.0.0.1])
@@ -51,17 +52,20 @@ func (suite *MailStoreUnitTest) TestCreate() {
 	assert.NotNil(suite.T(), store.mails)
 }
 
-// Also tests Set()
+//Also tests Set()
 func (suite *MailStoreUnitTest) TestAdd_NotExist_Dispatch() {
 	mockDispatcher := new(MockMessageQueue)
 	mail, err := instances.ParseMail(rawMail)
 	assert.Nil(suite.T(), err, "Unexpected error")
 	store := CreateMailStore(mockDispatcher)
+	mail.Received = time.Date(2021, 1, 27, 17, 0, 48, 0, time.UTC)
 
-	mockDispatcher.On("Dispatch", NewMailStoredEvent, EventDispatcher, *mail).Return()
+	expected := MailStored{Mail: *mail}
+	expected.Mail.Key = "test"
+	mockDispatcher.On("Dispatch", NewMailStoredEvent, EventDispatcher, expected).Return()
 	err = store.Add("test", *mail)
 	assert.Nil(suite.T(), err, "Unexpected error")
-	mockDispatcher.AssertCalled(suite.T(), "Dispatch", NewMailStoredEvent, EventDispatcher, *mail)
+	mockDispatcher.AssertCalled(suite.T(), "Dispatch", NewMailStoredEvent, EventDispatcher, expected)
 
 	assert.Contains(suite.T(), store.mails, "test", "Mail was not correctly added")
 	mailFromStore := store.mails["test"]
@@ -69,6 +73,17 @@ func (suite *MailStoreUnitTest) TestAdd_NotExist_Dispatch() {
 	assert.Equal(suite.T(), rawMail, readFromStore, "Mail in store isn't equal to original mail")
 }
 
+func (suite *MailStoreUnitTest) TestAdd_SetsReceived() {
+	mockDispatcher := new(MockMessageQueue)
+	mockDispatcher.On("Dispatch", NewMailStoredEvent, EventDispatcher, mock.Anything).Return()
+	mail, err := instances.ParseMail(rawMail)
+	assert.Nil(suite.T(), err, "Unexpected error")
+	store := CreateMailStore(mockDispatcher)
+	before := time.Now()
+	assert.Nil(suite.T(), store.Add("test", *mail))
+	assert.False(suite.T(), store.mails["test"].Received.Before(before), "Received should be set to the time the mail was added")
+}
+
 func (suite *MailStoreUnitTest) TestAdd_Exist() {
 	mockDispatcher := new(MockMessageQueue)
 	mail, err := instances.ParseMail(rawMail)
@@ -115,6 +130,97 @@ func (suite *MailStoreUnitTest) TestGetMultiple() {
 	assert.Contains(suite.T(), keys, "nonexistingtest", "Key 'nonexistingtest' should be in returned error keys")
 }
 
+func (suite *MailStoreUnitTest) TestKeys() {
+	mockDispatcher := new(MockMessageQueue)
+	store := CreateMailStore(mockDispatcher)
+	mail, err := instances.ParseMail(rawMail)
+	assert.Nil(suite.T(), err, "Unexpected error")
+	store.mails["b"] = *mail
+	store.mails["a"] = *mail
+	assert.Equal(suite.T(), []string{"a", "b"}, store.Keys())
+}
+
+func (suite *MailStoreUnitTest) TestDelete() {
+	mockDispatcher := new(MockMessageQueue)
+	store := CreateMailStore(mockDispatcher)
+	mail, err := instances.ParseMail(rawMail)
+	assert.Nil(suite.T(), err, "Unexpected error")
+	mockDispatcher.On("Dispatch", NewMailStoredEvent, EventDispatcher, mock.Anything).Return()
+	mockDispatcher.On("Dispatch", MailUpdatedEvent, EventDispatcher, mock.Anything).Return()
+	mockDispatcher.On("Dispatch", MailDeletedEvent, EventDispatcher, mock.Anything).Return()
+	assert.Nil(suite.T(), store.Add("c", *mail))
+	assert.Nil(suite.T(), store.Add("a", *mail))
+	store.Set("b", *mail)
+	store.Set("a", *mail)
+	assert.Equal(suite.T(), "b", mockDispatcher.dispatched[NewMailStoredEvent][EventDispatcher].(MailStored).Mail.Key)
+	assert.Equal(suite.T(), "a", mockDispatcher.dispatched[MailUpdatedEvent][EventDispatcher].(MailUpdated).Previous.Key)
+	mockDispatcher.AssertNumberOfCalls(suite.T(), "Dispatch", 4)
+	assert.Equal(suite.T(), []string{"c", "a", "b"}, store.KeysByArrival())
+
+	assert.Nil(suite.T(), store.Delete("a"))
+	deleted := mockDispatcher.dispatched[MailDeletedEvent][EventDispatcher].(MailDeleted)
+	assert.Equal(suite.T(), "a", deleted.Mail.Key)
+	assert.Equal(suite.T(), []string{"c", "b"}, store.KeysByArrival())
+	assert.ErrorIs(suite.T(), store.Delete("a"), KeyNotExistsError)
+	_, err = store.GetSingle("a")
+	assert.ErrorIs(suite.T(), err, KeyNotExistsError)
+}
+
+func (suite *MailStoreUnitTest) TestUpdate() {
+	mockDispatcher := new(MockMessageQueue)
+	store := CreateMailStore(mockDispatcher)
+	mail, err := instances.ParseMail(rawMail)
+	assert.Nil(suite.T(), err, "Unexpected error")
+	mockDispatcher.On("Dispatch", NewMailStoredEvent, EventDispatcher, mock.Anything).Return()
+	mockDispatcher.On("Dispatch", MailUpdatedEvent, EventDispatcher, mock.Anything).Return()
+	assert.Nil(suite.T(), store.Add("a", *mail))
+
+	assert.Nil(suite.T(), store.Update("a", func(mail *instances.Mail) {
+		mail.Metadata.Tags = append(mail.Metadata.Tags, "checked")
+	}))
+	updated := mockDispatcher.dispatched[MailUpdatedEvent][EventDispatcher].(MailUpdated)
+	assert.Equal(suite.T(), []string{"checked"}, updated.Mail.Metadata.Tags)
+	assert.Empty(suite.T(), updated.Previous.Metadata.Tags)
+	stored, err := store.GetSingle("a")
+	assert.Nil(suite.T(), err, "Unexpected error")
+	assert.Equal(suite.T(), updated.Mail, stored)
+	mockDispatcher.AssertNumberOfCalls(suite.T(), "Dispatch", 2)
+	assert.ErrorIs(suite.T(), store.Update("b", func(mail *instances.Mail) {}), KeyNotExistsError)
+}
+
+func (suite *MailStoreUnitTest) TestFolders() {
+	mockDispatcher := new(MockMessageQueue)
+	store := CreateMailStore(mockDispatcher)
+	mail, err := instances.ParseMail(rawMail)
+	assert.Nil(suite.T(), err, "Unexpected error")
+	store.mails["test"] = *mail
+	assert.ErrorIs(suite.T(), store.AddToFolder("missing", "bob", "INBOX"), KeyNotExistsError)
+
+	assert.Nil(suite.T(), store.AddToFolder("test", "bob", "INBOX"))
+	assert.Nil(suite.T(), store.AddToFolder("test", "bob", "Projects/Mailpie"))
+	assert.Nil(suite.T(), store.AddToFolder("test", "bob", "INBOX"))
+	assert.Nil(suite.T(), store.AddToFolder("test", "cora", "INBOX"))
+	store.RenameFolder("bob", "Projects", "Archive", "/")
+	store.RemoveFromFolder("test", "bob", "INBOX")
+	store.RemoveFromFolder("test", "cora", "INBOX")
+	assert.Equal(suite.T(), map[string][]string{"bob": {"Archive/Mailpie"}}, store.Folders("test"))
+}
+
+func (suite *MailStoreUnitTest) TestStats() {
+	mockDispatcher := new(MockMessageQueue)
+	store := CreateMailStore(mockDispatcher)
+	mail, err := instances.ParseMail(rawMail)
+	assert.Nil(suite.T(), err, "Unexpected error")
+	mockDispatcher.On("Dispatch", NewMailStoredEvent, EventDispatcher, mock.Anything).Return()
+	mockDispatcher.On("Dispatch", MailDeletedEvent, EventDispatcher, mock.Anything).Return()
+	mockDispatcher.On("Dispatch", MailUpdatedEvent, EventDispatcher, mock.Anything).Return()
+	assert.Nil(suite.T(), store.Add("a", *mail))
+	store.Set("b", *mail)
+	store.Set("b", *mail)
+	assert.Nil(suite.T(), store.Delete("a"))
+	assert.Equal(suite.T(), Stats{Mails: 1, Received: 2, Deleted: 1, Size: len(rawMail)}, store.Stats())
+}
+
 func TestMailStore(t *testing.T) {
 	suite.Run(t, new(MailStoreUnitTest))
 }
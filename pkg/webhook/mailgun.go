@@ -0,0 +1,97 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/da-coda/mailpie/internal/apiutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//mailgun formats events like the webhooks of Mailgun. The signature is part of the payload, it is the HMAC of the
+//timestamp followed by the token, keyed with the webhook signing key
+type mailgun struct {
+	signingKey string
+}
+
+//mailgunEvents maps the events to the events of Mailgun, which reports bounces and deferrals as failed
+var mailgunEvents = map[string]string{
+	Delivered:   "delivered",
+	Bounce:      "failed",
+	Deferred:    "failed",
+	Open:        "opened",
+	Click:       "clicked",
+	SpamReport:  "complained",
+	Unsubscribe: "unsubscribed",
+}
+
+func (mg mailgun) request(url string, e deliveryEvent) (*http.Request, error) {
+	recipientDomain := e.recipient[strings.LastIndex(e.recipient, "@")+1:]
+	eventData := map[string]interface{}{
+		"id":               apiutil.NewToken(16),
+		"event":            mailgunEvents[e.name],
+		"timestamp":        float64(e.time.UnixNano()) / 1e9,
+		"recipient":        e.recipient,
+		"recipient-domain": recipientDomain,
+		"tags":             nonNil(e.mail.Metadata.Tags),
+		"user-variables":   nonNilMap(e.mail.Metadata.Variables),
+		"envelope":         map[string]string{"sender": e.mail.EnvelopeFrom, "targets": e.recipient},
+		"message": map[string]interface{}{
+			"headers": map[string]string{
+				"message-id": messageID(e.mail),
+				"from":       e.mail.Header.Get("From"),
+				"to":         e.mail.Header.Get("To"),
+				"subject":    e.mail.Header.Get("Subject"),
+			},
+			"size": len(e.mail.RawMessage),
+		},
+	}
+	switch e.name {
+	case Delivered:
+		eventData["delivery-status"] = map[string]interface{}{"code": 250, "message": "OK", "attempt-no": 1}
+	case Bounce:
+		eventData["severity"] = "permanent"
+		eventData["reason"] = "bounce"
+		eventData["delivery-status"] = map[string]interface{}{"code": 550, "message": "5.1.1 The email account that you tried to reach does not exist.", "attempt-no": 1}
+	case Deferred:
+		eventData["severity"] = "temporary"
+		eventData["reason"] = "generic"
+		eventData["delivery-status"] = map[string]interface{}{"code": 421, "message": "4.7.0 Try again later", "attempt-no": 1}
+	case Open, Click:
+		eventData["client-info"] = map[string]string{"user-agent": userAgent}
+		eventData["ip"] = clientIP
+		if e.name == Click {
+			eventData["url"] = clickedURL(e.mail)
+		}
+	}
+	timestamp := strconv.FormatInt(e.time.Unix(), 10)
+	token := apiutil.NewHexToken(25)
+	mac := hmac.New(sha256.New, []byte(mg.signingKey))
+	mac.Write([]byte(timestamp + token))
+	payload := map[string]interface{}{
+		"signature": map[string]string{
+			"timestamp": timestamp,
+			"token":     token,
+			"signature": hex.EncodeToString(mac.Sum(nil)),
+		},
+		"event-data": eventData,
+	}
+	request, _, err := postJSON(url, payload)
+	return request, err
+}
+
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
+
+func nonNilMap(values map[string]string) map[string]string {
+	if values == nil {
+		return map[string]string{}
+	}
+	return values
+}
@@ -0,0 +1,123 @@
+package webhook
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"github.com/da-coda/mailpie/internal/apiutil"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+//sendGrid formats events like the Event Webhook of SendGrid and signs them like the Signed Event Webhook: an ECDSA
+//signature of the timestamp followed by the payload, which the application verifies with the public key
+type sendGrid struct {
+	key *ecdsa.PrivateKey
+	//publicKey is base64 encoded like the verification key shown by SendGrid
+	publicKey string
+}
+
+//newSendGrid loads the private key from keyFile or generates a key if keyFile is empty
+func newSendGrid(keyFile string) (*sendGrid, error) {
+	var key *ecdsa.PrivateKey
+	if keyFile == "" {
+		generated, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to generate SendGrid signing key")
+		}
+		key = generated
+	} else {
+		content, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read SendGrid signing key")
+		}
+		key, err = parsePrivateKey(content)
+		if err != nil {
+			return nil, err
+		}
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to encode SendGrid verification key")
+	}
+	sg := &sendGrid{key: key, publicKey: base64.StdEncoding.EncodeToString(publicKey)}
+	if keyFile == "" {
+		logrus.WithField("publicKey", sg.publicKey).Info("Generated key to sign SendGrid webhook events")
+	}
+	return sg, nil
+}
+
+//parsePrivateKey accepts PKCS #8 and SEC 1 encoded keys
+func parsePrivateKey(content []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, errors.New("SendGrid signing key is not PEM encoded")
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to parse SendGrid signing key")
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("SendGrid signing key is not an ECDSA key")
+	}
+	return ecKey, nil
+}
+
+func (sg *sendGrid) request(url string, e deliveryEvent) (*http.Request, error) {
+	payload := map[string]interface{}{
+		"email":         e.recipient,
+		"timestamp":     e.time.Unix(),
+		"event":         e.name,
+		"smtp-id":       e.mail.Header.Get("Message-Id"),
+		"sg_event_id":   apiutil.NewToken(16),
+		"sg_message_id": messageID(e.mail),
+	}
+	//custom arguments are added to the events by SendGrid, categories are a list
+	for name, value := range e.mail.Metadata.Variables {
+		payload[name] = value
+	}
+	if len(e.mail.Metadata.Tags) > 0 {
+		payload["category"] = e.mail.Metadata.Tags
+	}
+	switch e.name {
+	case Delivered:
+		payload["response"] = "250 OK"
+	case Bounce:
+		payload["type"] = "bounce"
+		payload["status"] = "5.1.1"
+		payload["reason"] = "550 5.1.1 The email account that you tried to reach does not exist."
+	case Deferred:
+		payload["response"] = "421 4.7.0 Try again later"
+		payload["attempt"] = "1"
+	case Open, Click:
+		payload["useragent"] = userAgent
+		payload["ip"] = clientIP
+		if e.name == Click {
+			payload["url"] = clickedURL(e.mail)
+		}
+	}
+	request, body, err := postJSON(url, []map[string]interface{}{payload})
+	if err != nil {
+		return nil, err
+	}
+	timestamp := strconv.FormatInt(e.time.Unix(), 10)
+	hash := sha256.Sum256(append([]byte(timestamp), body...))
+	signature, err := ecdsa.SignASN1(rand.Reader, sg.key, hash[:])
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to sign SendGrid event")
+	}
+	request.Header.Set("X-Twilio-Email-Event-Webhook-Signature", base64.StdEncoding.EncodeToString(signature))
+	request.Header.Set("X-Twilio-Email-Event-Webhook-Timestamp", timestamp)
+	return request, nil
+}
@@ -0,0 +1,326 @@
+//Package webhook simulates the delivery events mail providers send to the webhooks of an application. For every stored
+//mail, the configured events are posted per recipient in the format of the provider, signed like the provider signs
+//them. Events can also be triggered manually via the HTTP API
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/da-coda/mailpie/internal/apiutil"
+	"github.com/da-coda/mailpie/pkg/config"
+	"github.com/da-coda/mailpie/pkg/event"
+	"github.com/da-coda/mailpie/pkg/instances"
+	"github.com/da-coda/mailpie/pkg/store"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+//the events which can be simulated, named like the events of SendGrid
+const (
+	Delivered   = "delivered"
+	Bounce      = "bounce"
+	Deferred    = "deferred"
+	Open        = "open"
+	Click       = "click"
+	SpamReport  = "spamreport"
+	Unsubscribe = "unsubscribe"
+)
+
+//the client of open and click events
+const (
+	userAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36"
+	clientIP  = "203.0.113.7"
+)
+
+var knownEvents = map[string]bool{Delivered: true, Bounce: true, Deferred: true, Open: true, Click: true, SpamReport: true, Unsubscribe: true}
+
+//deliveryEvent is an event of a recipient of a mail, which the providers format into their payload
+type deliveryEvent struct {
+	name      string
+	mail      instances.Mail
+	recipient string
+	time      time.Time
+}
+
+//provider formats and signs the events like a mail provider
+type provider interface {
+	request(url string, e deliveryEvent) (*http.Request, error)
+}
+
+type rule struct {
+	recipient *regexp.Regexp
+	events    []string
+}
+
+//target is a configured webhook
+type target struct {
+	config.Webhook
+	provider provider
+	rules    []rule
+}
+
+//events returns the events of the first rule matching the recipient, the events of the webhook otherwise
+func (t *target) events(recipient string) []string {
+	for _, r := range t.rules {
+		if r.recipient.MatchString(recipient) {
+			return r.events
+		}
+	}
+	return t.defaultEvents()
+}
+
+func (t *target) defaultEvents() []string {
+	if len(t.Events) == 0 {
+		return []string{Delivered}
+	}
+	return t.Events
+}
+
+//Simulator posts the events of every stored mail to the webhooks
+type Simulator struct {
+	mailStore *store.MailStore
+	targets   []*target
+	client    *http.Client
+
+	lock sync.Mutex
+	//stopped ends the delays of the running simulations on Close
+	stopped context.Context
+	stop    context.CancelFunc
+	running sync.WaitGroup
+}
+
+//NewSimulator validates the webhooks. Every mail stored afterwards, as announced on the messageQueue, triggers the
+//delivery events of the webhooks for its recipients
+func NewSimulator(mailStore *store.MailStore, messageQueue event.Subscribable, webhooks []config.Webhook) (*Simulator, error) {
+	s := &Simulator{mailStore: mailStore, client: &http.Client{Timeout: 10 * time.Second}}
+	s.stopped, s.stop = context.WithCancel(context.Background())
+	for i, webhook := range webhooks {
+		t := &target{Webhook: webhook}
+		var err error
+		switch webhook.Provider {
+		case "sendgrid":
+			t.provider, err = newSendGrid(webhook.SigningKey)
+		case "mailgun":
+			t.provider = mailgun{signingKey: webhook.SigningKey}
+		default:
+			err = errors.Errorf("unknown provider '%s'", webhook.Provider)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid webhook %d", i)
+		}
+		if err := validateEvents(webhook.Events); err != nil {
+			return nil, errors.Wrapf(err, "invalid webhook %d", i)
+		}
+		for _, r := range webhook.Rules {
+			recipient, err := regexp.Compile(r.Recipient)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid recipient of rule of webhook %d", i)
+			}
+			if err := validateEvents(r.Events); err != nil {
+				return nil, errors.Wrapf(err, "invalid rule of webhook %d", i)
+			}
+			t.rules = append(t.rules, rule{recipient: recipient, events: r.Events})
+		}
+		s.targets = append(s.targets, t)
+	}
+	messageQueue.Subscribe(store.NewMailStoredEvent, s.mailStored)
+	return s, nil
+}
+
+func validateEvents(events []string) error {
+	for _, name := range events {
+		if !knownEvents[name] {
+			return errors.Errorf("unknown event '%s'", name)
+		}
+	}
+	return nil
+}
+
+func (s *Simulator) mailStored(_ string, data interface{}) {
+	mail := data.(store.MailStored).Mail
+	if _, err := s.mailStore.GetSingle(mail.Key); err != nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stopped.Err() != nil {
+		return
+	}
+	for _, t := range s.targets {
+		for _, recipient := range mail.EnvelopeTo {
+			s.running.Add(1)
+			go func(t *target, recipient string) {
+				defer s.running.Done()
+				s.simulate(t, mail, recipient, t.events(recipient))
+			}(t, recipient)
+		}
+	}
+}
+
+//Close stops simulating the events of stored mails and waits for the events being sent. Events still waiting for
+//their delay are dropped
+func (s *Simulator) Close() {
+	s.lock.Lock()
+	s.stop()
+	s.lock.Unlock()
+	s.running.Wait()
+}
+
+//simulate sends the events of a recipient one after the other, waiting the delay of the webhook before each
+func (s *Simulator) simulate(t *target, mail instances.Mail, recipient string, events []string) {
+	for _, name := range events {
+		if t.Delay > 0 {
+			select {
+			case <-time.After(t.Delay):
+			case <-s.stopped.Done():
+				return
+			}
+		}
+		_, err := s.send(t, deliveryEvent{name: name, mail: mail, recipient: recipient, time: time.Now()})
+		if err != nil {
+			logrus.WithError(err).WithField("url", t.URL).WithField("event", name).Warn("Unable to send webhook event")
+		}
+	}
+}
+
+//send posts the event to the webhook and returns the status of the response
+func (s *Simulator) send(t *target, e deliveryEvent) (int, error) {
+	request, err := t.provider.request(t.URL, e)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to create request")
+	}
+	resp, err := s.client.Do(request)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to post event")
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	logrus.WithField("url", t.URL).WithField("event", e.name).WithField("status", resp.StatusCode).Debug("Sent webhook event")
+	return resp.StatusCode, nil
+}
+
+//Register adds the routes to list the webhooks and to trigger events manually
+func (s *Simulator) Register(router *mux.Router) {
+	router.HandleFunc("/api/webhooks", s.list).Methods("GET")
+	router.HandleFunc("/api/webhooks/trigger", s.trigger).Methods("POST")
+}
+
+//webhook describes a configured webhook. PublicKey is the key to verify SendGrid signatures with
+type webhook struct {
+	Provider  string   `json:"provider"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	PublicKey string   `json:"publicKey,omitempty"`
+}
+
+func (s *Simulator) list(w http.ResponseWriter, _ *http.Request) {
+	webhooks := make([]webhook, 0, len(s.targets))
+	for _, t := range s.targets {
+		described := webhook{Provider: t.Provider, URL: t.URL, Events: t.defaultEvents()}
+		if sg, ok := t.provider.(*sendGrid); ok {
+			described.PublicKey = sg.publicKey
+		}
+		webhooks = append(webhooks, described)
+	}
+	apiutil.WriteJSON(w, http.StatusOK, webhooks)
+}
+
+//triggerRequest triggers an event of a stored mail for a recipient, for all recipients of the mail if empty
+type triggerRequest struct {
+	Key       string `json:"key"`
+	Event     string `json:"event"`
+	Recipient string `json:"recipient"`
+}
+
+//delivery is the result of a triggered event
+type delivery struct {
+	URL       string `json:"url"`
+	Recipient string `json:"recipient"`
+	Status    int    `json:"status,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+//trigger handles POST /api/webhooks/trigger. The event is sent immediately to all webhooks, the response holds the
+//status of every webhook
+func (s *Simulator) trigger(w http.ResponseWriter, r *http.Request) {
+	var request triggerRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if !knownEvents[request.Event] {
+		http.Error(w, fmt.Sprintf("Unknown event '%s'", request.Event), http.StatusBadRequest)
+		return
+	}
+	mail, err := s.mailStore.GetSingle(request.Key)
+	if err != nil {
+		http.Error(w, "Mail not found", http.StatusNotFound)
+		return
+	}
+	recipients := mail.EnvelopeTo
+	if request.Recipient != "" {
+		recipients = []string{request.Recipient}
+	}
+	deliveries := make([]delivery, 0, len(s.targets)*len(recipients))
+	for _, t := range s.targets {
+		for _, recipient := range recipients {
+			status, err := s.send(t, deliveryEvent{name: request.Event, mail: mail, recipient: recipient, time: time.Now()})
+			d := delivery{URL: t.URL, Recipient: recipient, Status: status}
+			if err != nil {
+				d.Error = err.Error()
+			}
+			deliveries = append(deliveries, d)
+		}
+	}
+	apiutil.WriteJSON(w, http.StatusOK, deliveries)
+}
+
+//postJSON creates the POST request of a JSON payload
+func postJSON(url string, payload interface{}) (*http.Request, []byte, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "Mailpie-Webhook")
+	return request, body, nil
+}
+
+//messageID is the id the provider gave the mail or its Message-ID
+func messageID(mail instances.Mail) string {
+	if mail.Metadata.MessageID != "" {
+		return mail.Metadata.MessageID
+	}
+	id := mail.Header.Get("Message-Id")
+	if len(id) > 2 && id[0] == '<' && id[len(id)-1] == '>' {
+		return id[1 : len(id)-1]
+	}
+	return id
+}
+
+//linkPattern finds the first link in the html of a mail, which is the url of click events
+var linkPattern = regexp.MustCompile(`href="(https?://[^"]+)"`)
+
+func clickedURL(mail instances.Mail) string {
+	for _, part := range mail.Parts() {
+		if part.ContentType != "text/html" {
+			continue
+		}
+		if match := linkPattern.FindSubmatch(part.Content); match != nil {
+			return string(match[1])
+		}
+	}
+	return "https://example.com/"
+}
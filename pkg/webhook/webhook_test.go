@@ -0,0 +1,239 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/da-coda/mailpie/pkg/config"
+	"github.com/da-coda/mailpie/pkg/event"
+	"github.com/da-coda/mailpie/pkg/instances"
+	"github.com/da-coda/mailpie/pkg/store"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/suite"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+)
+
+const rawMail = "From: Alex <alex@example.com>\r\nTo: bob@example.com, bounce@example.com\r\nMessage-ID: <invoice@example.com>\r\nSubject: Invoice\r\nContent-Type: text/html\r\n\r\n<a href=\"https://example.com/invoice\">Invoice</a>\r\n"
+
+//received is a request received by the application
+type received struct {
+	path   string
+	header http.Header
+	body   []byte
+}
+
+type SimulatorTestSuite struct {
+	suite.Suite
+	mailStore *store.MailStore
+	app       *httptest.Server
+	received  chan received
+	simulator *Simulator
+	api       *httptest.Server
+}
+
+func (suite *SimulatorTestSuite) SetupTest() {
+	suite.mailStore = store.CreateMailStore(event.CreateOrGet())
+	suite.received = make(chan received, 16)
+	suite.app = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		suite.received <- received{path: r.URL.Path, header: r.Header, body: body}
+	}))
+	var err error
+	suite.simulator, err = NewSimulator(suite.mailStore, event.CreateOrGet(), []config.Webhook{
+		{Provider: "sendgrid", URL: suite.app.URL + "/sendgrid", Events: []string{Delivered, Open}},
+		{Provider: "mailgun", URL: suite.app.URL + "/mailgun", SigningKey: "key-test", Delay: time.Millisecond,
+			Rules: []config.WebhookRule{{Recipient: "^bounce@", Events: []string{Bounce}}}},
+	})
+	suite.Require().Nil(err)
+	router := mux.NewRouter()
+	suite.simulator.Register(router)
+	suite.api = httptest.NewServer(router)
+}
+
+func (suite *SimulatorTestSuite) TearDownTest() {
+	suite.api.Close()
+	suite.app.Close()
+}
+
+func (suite *SimulatorTestSuite) store(key string) {
+	mail, err := instances.ParseMail([]byte(rawMail))
+	suite.Require().Nil(err)
+	mail.EnvelopeFrom = "alex@example.com"
+	mail.EnvelopeTo = []string{"bob@example.com", "bounce@example.com"}
+	mail.Metadata = instances.Metadata{Tags: []string{"billing"}, Variables: map[string]string{"customer": "42"}}
+	suite.Require().Nil(suite.mailStore.Add(key, *mail))
+}
+
+//receive waits for count requests and returns them sorted by path and body, since they are sent concurrently
+func (suite *SimulatorTestSuite) receive(count int) []received {
+	var requests []received
+	for len(requests) < count {
+		select {
+		case r := <-suite.received:
+			requests = append(requests, r)
+		case <-time.After(5 * time.Second):
+			suite.FailNow("Webhook events not received")
+		}
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		if requests[i].path != requests[j].path {
+			return requests[i].path < requests[j].path
+		}
+		return bytes.Compare(requests[i].body, requests[j].body) < 0
+	})
+	return requests
+}
+
+//verifySendGrid checks the ECDSA signature of the event and returns the event
+func (suite *SimulatorTestSuite) verifySendGrid(r received) map[string]interface{} {
+	der, err := base64.StdEncoding.DecodeString(suite.simulator.targets[0].provider.(*sendGrid).publicKey)
+	suite.Require().Nil(err)
+	publicKey, err := x509.ParsePKIXPublicKey(der)
+	suite.Require().Nil(err)
+	signature, err := base64.StdEncoding.DecodeString(r.header.Get("X-Twilio-Email-Event-Webhook-Signature"))
+	suite.Require().Nil(err)
+	hash := sha256.Sum256(append([]byte(r.header.Get("X-Twilio-Email-Event-Webhook-Timestamp")), r.body...))
+	suite.True(ecdsa.VerifyASN1(publicKey.(*ecdsa.PublicKey), hash[:], signature), "SendGrid signature is invalid")
+
+	var events []map[string]interface{}
+	suite.Require().Nil(json.Unmarshal(r.body, &events))
+	suite.Require().Len(events, 1)
+	return events[0]
+}
+
+//verifyMailgun checks the HMAC in the payload and returns the event data
+func (suite *SimulatorTestSuite) verifyMailgun(r received) map[string]interface{} {
+	var payload struct {
+		Signature struct {
+			Timestamp string
+			Token     string
+			Signature string
+		}
+		EventData map[string]interface{} `json:"event-data"`
+	}
+	suite.Require().Nil(json.Unmarshal(r.body, &payload))
+	mac := hmac.New(sha256.New, []byte("key-test"))
+	mac.Write([]byte(payload.Signature.Timestamp + payload.Signature.Token))
+	suite.Equal(hex.EncodeToString(mac.Sum(nil)), payload.Signature.Signature, "Mailgun signature is invalid")
+	return payload.EventData
+}
+
+func (suite *SimulatorTestSuite) TestMailStored() {
+	suite.store("invoice")
+	requests := suite.receive(6)
+
+	var mailgunEvents []map[string]interface{}
+	for _, r := range requests[:2] {
+		suite.Equal("/mailgun", r.path)
+		mailgunEvents = append(mailgunEvents, suite.verifyMailgun(r))
+	}
+	sort.Slice(mailgunEvents, func(i, j int) bool {
+		return mailgunEvents[i]["recipient"].(string) < mailgunEvents[j]["recipient"].(string)
+	})
+	suite.Equal("delivered", mailgunEvents[0]["event"])
+	suite.Equal("bob@example.com", mailgunEvents[0]["recipient"])
+	suite.Equal("failed", mailgunEvents[1]["event"], "The rule lets bounce@example.com bounce")
+	suite.Equal("permanent", mailgunEvents[1]["severity"])
+	suite.Equal([]interface{}{"billing"}, mailgunEvents[0]["tags"])
+	suite.Equal(map[string]interface{}{"customer": "42"}, mailgunEvents[0]["user-variables"])
+	suite.Equal("invoice@example.com", mailgunEvents[0]["message"].(map[string]interface{})["headers"].(map[string]interface{})["message-id"])
+
+	counts := make(map[string]int)
+	for _, r := range requests[2:] {
+		suite.Equal("/sendgrid", r.path)
+		e := suite.verifySendGrid(r)
+		counts[e["event"].(string)+" "+e["email"].(string)]++
+		suite.Equal("invoice@example.com", e["sg_message_id"])
+		suite.Equal("42", e["customer"])
+		suite.Equal([]interface{}{"billing"}, e["category"])
+	}
+	suite.Equal(map[string]int{"delivered bob@example.com": 1, "open bob@example.com": 1, "delivered bounce@example.com": 1, "open bounce@example.com": 1}, counts)
+}
+
+func (suite *SimulatorTestSuite) TestTrigger() {
+	suite.store("manual")
+	suite.receive(6)
+
+	body := `{"key": "manual", "event": "click", "recipient": "bob@example.com"}`
+	resp, err := http.Post(suite.api.URL+"/api/webhooks/trigger", "application/json", bytes.NewBufferString(body))
+	suite.Require().Nil(err)
+	defer resp.Body.Close()
+	suite.Equal(http.StatusOK, resp.StatusCode)
+	var deliveries []delivery
+	suite.Require().Nil(json.NewDecoder(resp.Body).Decode(&deliveries))
+	suite.Equal([]delivery{
+		{URL: suite.app.URL + "/sendgrid", Recipient: "bob@example.com", Status: http.StatusOK},
+		{URL: suite.app.URL + "/mailgun", Recipient: "bob@example.com", Status: http.StatusOK},
+	}, deliveries)
+
+	requests := suite.receive(2)
+	eventData := suite.verifyMailgun(requests[0])
+	suite.Equal("clicked", eventData["event"])
+	suite.Equal("https://example.com/invoice", eventData["url"])
+	e := suite.verifySendGrid(requests[1])
+	suite.Equal("click", e["event"])
+	suite.Equal("https://example.com/invoice", e["url"])
+
+	for body, status := range map[string]int{
+		`{"key": "manual", "event": "exploded"}`:   http.StatusBadRequest,
+		`{"key": "missing", "event": "delivered"}`: http.StatusNotFound,
+	} {
+		resp, err := http.Post(suite.api.URL+"/api/webhooks/trigger", "application/json", bytes.NewBufferString(body))
+		suite.Require().Nil(err)
+		resp.Body.Close()
+		suite.Equal(status, resp.StatusCode)
+	}
+}
+
+func (suite *SimulatorTestSuite) TestClose() {
+	mailStore := store.CreateMailStore(event.CreateOrGet())
+	simulator, err := NewSimulator(mailStore, event.CreateOrGet(), []config.Webhook{
+		{Provider: "mailgun", URL: suite.app.URL + "/delayed", SigningKey: "key-test", Delay: time.Hour},
+	})
+	suite.Require().Nil(err)
+	mail, err := instances.ParseMail([]byte(rawMail))
+	suite.Require().Nil(err)
+	suite.Require().Nil(mailStore.Add("delayed", *mail))
+	event.CreateOrGet().Flush()
+
+	closed := make(chan struct{})
+	go func() {
+		simulator.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		suite.FailNow("Close should not wait for the delay of the events")
+	}
+	suite.Require().Nil(mailStore.Add("after", *mail))
+	event.CreateOrGet().Flush()
+	simulator.Close()
+	suite.Empty(suite.received, "No events should be sent after Close")
+}
+
+func (suite *SimulatorTestSuite) TestNewSimulator_Invalid() {
+	for _, webhook := range []config.Webhook{
+		{Provider: "postmark", URL: "http://localhost"},
+		{Provider: "mailgun", URL: "http://localhost", Events: []string{"exploded"}},
+		{Provider: "mailgun", URL: "http://localhost", Rules: []config.WebhookRule{{Recipient: "(", Events: []string{Bounce}}}},
+		{Provider: "sendgrid", URL: "http://localhost", SigningKey: "/does/not/exist.pem"},
+	} {
+		_, err := NewSimulator(suite.mailStore, event.CreateOrGet(), []config.Webhook{webhook})
+		suite.NotNil(err, webhook)
+	}
+}
+
+func TestSimulatorTestSuite(t *testing.T) {
+	suite.Run(t, new(SimulatorTestSuite))
+}
@@ -0,0 +1,544 @@
+package mailpie
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/da-coda/mailpie/pkg/auth"
+	"github.com/da-coda/mailpie/pkg/certs"
+	"github.com/da-coda/mailpie/pkg/config"
+	"github.com/da-coda/mailpie/pkg/event"
+	"github.com/da-coda/mailpie/pkg/exechook"
+	"github.com/da-coda/mailpie/pkg/handler"
+	"github.com/da-coda/mailpie/pkg/handler/imap"
+	"github.com/da-coda/mailpie/pkg/handler/jmap"
+	"github.com/da-coda/mailpie/pkg/handler/mailcatcher"
+	"github.com/da-coda/mailpie/pkg/handler/mailgun"
+	"github.com/da-coda/mailpie/pkg/handler/mailhog"
+	"github.com/da-coda/mailpie/pkg/handler/pop3"
+	"github.com/da-coda/mailpie/pkg/handler/postmark"
+	"github.com/da-coda/mailpie/pkg/handler/sendgrid"
+	"github.com/da-coda/mailpie/pkg/handler/ses"
+	"github.com/da-coda/mailpie/pkg/handler/sparkpost"
+	"github.com/da-coda/mailpie/pkg/inbound"
+	"github.com/da-coda/mailpie/pkg/notify"
+	"github.com/da-coda/mailpie/pkg/sieve"
+	"github.com/da-coda/mailpie/pkg/store"
+	"github.com/da-coda/mailpie/pkg/webhook"
+	"github.com/gorilla/mux"
+	"github.com/mhale/smtpd"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Options configure a Server
+type Options struct {
+	//Config decides which services are started and where they listen. Port 0 picks a free port, the bound address is
+	//returned by Server.Addr
+	Config config.Config
+	//RestartDelay is the delay before a failed service is bound again, doubled with every failure in a row up to a
+	//minute. One second if zero
+	RestartDelay time.Duration
+}
+
+//Server is a Mailpie instance. It owns its event queue, mail store and listeners, so that several servers can run in
+//the same process without affecting each other
+type Server struct {
+	config       config.Config
+	messageQueue *event.MessageQueue
+	mailStore    *store.MailStore
+	notifier     *notify.Notifier
+	runner       *exechook.Runner
+	simulator    *webhook.Simulator
+	forwarder    *inbound.Forwarder
+	services     []*service
+	restartDelay time.Duration
+	//failed receives the error of the first service which failed more often in a row than the config allows
+	failed chan error
+
+	lock      sync.Mutex
+	started   bool
+	startedAt time.Time
+	stopping  bool
+	//stopped is closed on shutdown to cancel pending restarts
+	stopped chan struct{}
+	serving sync.WaitGroup
+}
+
+//service is a server accepting connections on one listener
+type service struct {
+	name Service
+	addr string
+	//tlsConfig makes the listener accept implicit TLS connections, if set
+	tlsConfig *tls.Config
+	serve     func(listener net.Listener) error
+	//stop shuts down servers which close their listener themselves, like the HTTP server. Without, the listener is
+	//closed and the sessions are drained
+	stop func(ctx context.Context) error
+	//drain closes the idle sessions and waits for the ones inside a transaction or command
+	drain func(ctx context.Context) error
+	//close releases what the server keeps running besides its sessions, called once every service was shut down since
+	//servers can be shared by several services
+	close    func() error
+	listener net.Listener
+	//connections are tracked by the listener if set, kept when the listener is bound again
+	connections *connections
+
+	//the state of the supervisor, guarded by the lock of the server
+	status      Status
+	failures    int
+	restarts    int
+	lastError   error
+	lastFailure time.Time
+}
+
+//bind creates the listener of the service
+func (svc *service) bind(ctx context.Context) error {
+	var listenConfig net.ListenConfig
+	listener, err := listenConfig.Listen(ctx, "tcp", svc.addr)
+	if err != nil {
+		return err
+	}
+	if svc.connections != nil {
+		listener = svc.connections.track(listener)
+	}
+	//wrapped after the tracking, so that the connections are closed including their TLS layer
+	if svc.tlsConfig != nil {
+		listener = tls.NewListener(listener, svc.tlsConfig)
+	}
+	svc.listener = listener
+	return nil
+}
+
+//shutdown stops accepting connections, closes the idle sessions and waits for the others. Once the context ends, the
+//remaining connections are closed and an error is returned
+func (svc *service) shutdown(ctx context.Context) error {
+	if svc.stop != nil {
+		return svc.stop(ctx)
+	}
+	_ = svc.listener.Close()
+	return svc.drain(ctx)
+}
+
+//NewServer sets up the mail store and all enabled services of the config. Nothing is bound before Start
+func NewServer(options Options) (*Server, error) {
+	conf := options.Config
+	s := &Server{
+		config:       conf,
+		messageQueue: event.New(),
+		restartDelay: options.RestartDelay,
+		failed:       make(chan error, 1),
+		stopped:      make(chan struct{}),
+	}
+	if s.restartDelay <= 0 {
+		s.restartDelay = time.Second
+	}
+	s.mailStore = store.CreateMailStore(s.messageQueue)
+
+	var sieveScript *sieve.Script
+	if conf.SieveScript != "" {
+		var err error
+		sieveScript, err = sieve.ParseFile(conf.SieveScript)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to load sieve script")
+		}
+	}
+
+	tlsConfig, err := certs.Load(conf.TLS.CertFile, conf.TLS.KeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to load TLS certificate")
+	}
+
+	authenticator := auth.NewAuthenticator(conf.Users)
+
+	if len(conf.Webhooks) > 0 {
+		s.simulator, err = webhook.NewSimulator(s.mailStore, s.messageQueue, conf.Webhooks)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to set up webhooks")
+		}
+	}
+	if len(conf.InboundRoutes) > 0 {
+		s.forwarder, err = inbound.NewForwarder(s.mailStore, s.messageQueue, conf.InboundRoutes)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to set up inbound routes")
+		}
+	}
+	if len(conf.Notifications) > 0 {
+		s.notifier, err = notify.NewNotifier(s.mailStore, s.messageQueue, conf.Notifications, conf.DataDir)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to set up notifications")
+		}
+	}
+	if len(conf.ExecHooks) > 0 {
+		s.runner, err = exechook.NewRunner(s.mailStore, s.messageQueue, conf.ExecHooks)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to set up exec hooks")
+		}
+	}
+
+	smtpHandler := handler.CreateSmtpHandler(s.mailStore)
+	if !conf.DisableHTTP {
+		apis := []routeRegisterer{mailhog.NewHandler(s.mailStore), healthHandler{server: s}, statusHandler{server: s}}
+		if s.simulator != nil {
+			apis = append(apis, s.simulator)
+		}
+		if s.forwarder != nil {
+			apis = append(apis, s.forwarder)
+		}
+		if s.notifier != nil {
+			apis = append(apis, s.notifier)
+		}
+		if s.runner != nil {
+			apis = append(apis, s.runner)
+		}
+		if !conf.DisableSendGrid {
+			apis = append(apis, sendgrid.NewHandler(&smtpHandler, conf.SendGrid.TemplateDir))
+		}
+		if !conf.DisableMailgun {
+			apis = append(apis, mailgun.NewHandler(&smtpHandler))
+		}
+		if !conf.DisablePostmark {
+			apis = append(apis, postmark.NewHandler(&smtpHandler, conf.Postmark.TemplateDir, conf.Postmark.ServerTokens))
+		}
+		if !conf.DisableSparkPost {
+			apis = append(apis, sparkpost.NewHandler(&smtpHandler, conf.SparkPost.APIKeys))
+		}
+		if !conf.DisableJMAP {
+			apis = append(apis, jmap.NewHandler(s.mailStore, s.messageQueue, authenticator))
+		}
+		if conf.EnableMailCatcher {
+			apis = append(apis, mailcatcher.NewHandler(s.mailStore, s.messageQueue))
+		}
+		s.services = append(s.services, newSPAService(conf, handler.NewSieveHandler(s.mailStore, sieveScript), apis))
+	}
+
+	if !conf.DisableSMTP {
+		s.services = append(s.services, newSMTPService(conf, smtpHandler, authenticator))
+	}
+
+	if !conf.DisableIMAP {
+		options := imap.BackendOptions{
+			PerRecipient:  conf.IMAP.PerRecipient,
+			AdminUser:     conf.IMAP.AdminUser,
+			Authenticator: authenticator,
+			Sieve:         sieveScript,
+			MailStore:     s.mailStore,
+			MessageQueue:  s.messageQueue,
+			DataDir:       conf.DataDir,
+		}
+		s.services = append(s.services, newIMAPServices(conf, options, tlsConfig)...)
+	}
+
+	if !conf.DisablePOP3 {
+		options := pop3.Options{
+			MailStore:     s.mailStore,
+			Authenticator: authenticator,
+			TLSConfig:     tlsConfig,
+			DeletePerUser: conf.POP3.DeletePerUser,
+		}
+		s.services = append(s.services, newPOP3Service(conf, options))
+	}
+
+	if !conf.DisableSES {
+		options := ses.Options{
+			SmtpHandler:      &smtpHandler,
+			TemplateDir:      conf.SES.TemplateDir,
+			VerifySignatures: conf.SES.VerifySignatures,
+			Credentials:      conf.SES.Credentials,
+		}
+		s.services = append(s.services, newSESService(conf, ses.NewHandler(options)))
+	}
+	for _, svc := range s.services {
+		svc.status = Stopped
+	}
+	return s, nil
+}
+
+//Start binds the listeners of all services and serves them in the background. If a listener can't be bound, the
+//listeners bound so far are closed again and nothing is served. The context only limits the binding. Services failing
+//afterwards are restarted by the supervisor
+func (s *Server) Start(ctx context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.started {
+		return errors.New("server already started")
+	}
+	for _, svc := range s.services {
+		if err := svc.bind(ctx); err != nil {
+			for _, bound := range s.services {
+				if bound.listener != nil {
+					_ = bound.listener.Close()
+					bound.listener = nil
+				}
+			}
+			return errors.Wrapf(err, "Unable to start %s server", svc.name)
+		}
+	}
+	s.started = true
+	s.startedAt = time.Now()
+	for _, svc := range s.services {
+		logrus.WithField("Address", svc.listener.Addr().String()).Infof("Starting %s server", strings.ToUpper(string(svc.name)))
+		svc.status = Running
+		s.serving.Add(1)
+		go s.supervise(svc)
+	}
+	return nil
+}
+
+//Shutdown stops accepting connections, closes the idle sessions and waits until the others are finished, the events
+//dispatched so far are handled, the exec hooks are finished and the notifier, webhooks and inbound routes stopped. The
+//HTTP servers wait for running requests and end the event sources and WebSockets, the SMTP servers for running mail
+//transactions and the IMAP and POP3 servers for running commands, so that nothing is cut off before the deadline. Once
+//the context ends, the remaining connections are closed and an error is returned
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lock.Lock()
+	if s.stopping {
+		s.lock.Unlock()
+		return nil
+	}
+	s.stopping = true
+	close(s.stopped)
+	started := s.started
+	s.lock.Unlock()
+
+	var failures []error
+	fail := func(err error) {
+		if err != nil {
+			failures = append(failures, err)
+		}
+	}
+	if started {
+		errorChannel := make(chan error, len(s.services))
+		for _, svc := range s.services {
+			go func(svc *service) {
+				err := svc.shutdown(ctx)
+				if err != nil {
+					err = errors.Wrapf(err, "Unable to stop %s server", svc.name)
+				}
+				errorChannel <- err
+			}(svc)
+		}
+		for range s.services {
+			fail(<-errorChannel)
+		}
+		fail(wait(ctx, s.serving.Wait))
+		s.lock.Lock()
+		for _, svc := range s.services {
+			svc.status = Stopped
+		}
+		s.lock.Unlock()
+	}
+	for _, svc := range s.services {
+		if svc.close != nil {
+			fail(errors.Wrapf(svc.close(), "Unable to close %s server", svc.name))
+		}
+	}
+	//the mails stored by the last sessions reach the hooks and notifications before they are stopped
+	fail(wait(ctx, s.messageQueue.Flush))
+	if s.runner != nil {
+		fail(errors.Wrap(wait(ctx, s.runner.Wait), "Unable to wait for the exec hooks"))
+	}
+	if s.simulator != nil {
+		fail(errors.Wrap(wait(ctx, s.simulator.Close), "Unable to stop the webhooks"))
+	}
+	if s.forwarder != nil {
+		fail(errors.Wrap(wait(ctx, s.forwarder.Close), "Unable to stop the inbound routes"))
+	}
+	if s.notifier != nil {
+		fail(errors.Wrap(wait(ctx, s.notifier.Close), "Unable to stop the notifier"))
+	}
+	if len(failures) > 0 {
+		//cancelling waits for the handlers, which did not finish in time
+		go s.messageQueue.Close()
+		for _, err := range failures[1:] {
+			logrus.WithError(err).Error("Error during shutdown")
+		}
+		return failures[0]
+	}
+	s.messageQueue.Close()
+	return nil
+}
+
+//wait calls the function and returns once it returned or the context ended
+func wait(ctx context.Context, function func()) error {
+	done := make(chan struct{})
+	go func() {
+		function()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//Addr returns the address the service listens on, which includes the port picked if the config has port 0. A service
+//with port 0 gets a new port if it is restarted. Returns an empty string if the service is disabled or the server isn't
+//started
+func (s *Server) Addr(name Service) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, svc := range s.services {
+		if svc.name == name && svc.listener != nil {
+			return svc.listener.Addr().String()
+		}
+	}
+	return ""
+}
+
+//Flush waits until the mails accepted via SMTP so far are stored and the events dispatched so far are handled. The SMTP
+//server confirms a mail before it is handed to the handler, so a mail the client sent completely may not be stored yet
+func (s *Server) Flush() {
+	for _, svc := range s.services {
+		if svc.connections != nil {
+			<-svc.connections.settled()
+		}
+	}
+	s.messageQueue.Flush()
+}
+
+//MailStore returns the store holding the mails received by the server
+func (s *Server) MailStore() *store.MailStore {
+	return s.mailStore
+}
+
+//MessageQueue returns the queue the MailStore of the server dispatches its events to
+func (s *Server) MessageQueue() *event.MessageQueue {
+	return s.messageQueue
+}
+
+//Config returns the configuration the server was created with
+func (s *Server) Config() config.Config {
+	return s.config
+}
+
+//newSMTPService sets up the SMTP server. Needs an SMTP handler which handles incoming mails and the authenticator for
+//SMTP logins
+func newSMTPService(conf config.Config, smtpHandler handler.SmtpHandler, authenticator *auth.Authenticator) *service {
+	addr := conf.NetworkConfigs.SMTP.Host + ":" + strconv.Itoa(conf.NetworkConfigs.SMTP.Port)
+	//the mails accepted by smtpd are waited for on shutdown
+	connections := newConnections()
+	srv := &smtpd.Server{
+		Addr: addr,
+		Handler: func(remoteAddr net.Addr, from string, to []string, data []byte) {
+			defer connections.done()
+			smtpHandler.Handle(remoteAddr, from, to, data)
+		},
+		Appname:      "Mailpie",
+		Hostname:     "localhost",
+		Timeout:      5 * time.Minute,
+		AuthRequired: false,
+		//auth is optional, but if a client logs in, the credentials are checked against the configured users
+		AuthHandler: func(remoteAddr net.Addr, mechanism string, username []byte, password []byte, shared []byte) (bool, error) {
+			return authenticator.Authenticate(string(username), string(password)), nil
+		},
+		LogWrite: func(remoteIP, verb, line string) {
+			logrus.WithField("ip", remoteIP).WithField("verb", verb).Debug(line)
+		},
+		AuthMechs: map[string]bool{"PLAIN": true, "LOGIN": true, "CRAM-MD5": false},
+	}
+	//smtpd has no shutdown, the listener is closed and the sessions are drained
+	return &service{name: SMTP, addr: addr, serve: srv.Serve, drain: connections.drain, connections: connections}
+}
+
+//routeRegisterer is an API served next to the SPA, like the Mailhog, MailCatcher, SendGrid, Mailgun or JMAP API
+type routeRegisterer interface {
+	Register(router *mux.Router)
+}
+
+//newSPAService sets up the MailPie Single-Page-Application and the API, including the enabled compatibility APIs. The
+//routes of the APIs are added before the SPA, which catches all other GET requests
+func newSPAService(conf config.Config, sieveHandler *handler.SieveHandler, apis []routeRegisterer) *service {
+	router := mux.NewRouter()
+	router.Handle("/api/sieve/dry-run", sieveHandler).Methods("GET", "POST")
+	for _, api := range apis {
+		api.Register(router)
+	}
+	spa := handler.NewSpaHandler(dist, indexHtml)
+	router.PathPrefix("/").Handler(spa).Methods("GET")
+
+	//no write timeout, the JMAP event source keeps responses open to push changes
+	srv := &http.Server{
+		Handler:     router,
+		Addr:        conf.NetworkConfigs.HTTP.Host + ":" + strconv.Itoa(conf.NetworkConfigs.HTTP.Port),
+		ReadTimeout: 15 * time.Second,
+	}
+	return newHTTPService(SPA, srv)
+}
+
+//newSESService sets up the Amazon SES API on its own port, since the AWS SDKs expect it at the root of the endpoint
+func newSESService(conf config.Config, sesHandler *ses.Handler) *service {
+	srv := &http.Server{
+		Handler:     sesHandler,
+		Addr:        conf.NetworkConfigs.SES.Host + ":" + strconv.Itoa(conf.NetworkConfigs.SES.Port),
+		ReadTimeout: 15 * time.Second,
+	}
+	return newHTTPService(SES, srv)
+}
+
+//newHTTPService serves the HTTP server. On stop, the server waits for running requests until the context ends and
+//closes the remaining connections afterwards. The context of the requests is cancelled right away, which ends the
+//event sources and WebSockets
+func newHTTPService(name Service, srv *http.Server) *service {
+	base, cancel := context.WithCancel(context.Background())
+	srv.BaseContext = func(net.Listener) context.Context {
+		return base
+	}
+	srv.RegisterOnShutdown(cancel)
+	return &service{
+		name: name,
+		addr: srv.Addr,
+		serve: func(listener net.Listener) error {
+			err := srv.Serve(listener)
+			if err == http.ErrServerClosed {
+				return nil
+			}
+			return err
+		},
+		stop: func(ctx context.Context) error {
+			err := srv.Shutdown(ctx)
+			if err != nil {
+				_ = srv.Close()
+			}
+			return err
+		},
+	}
+}
+
+//newIMAPServices sets up the IMAP server. Unless disabled, STARTTLS is offered on the IMAP port and a second listener
+//with implicit TLS is added on the IMAPS port, both served by the same server so that updates reach every client
+func newIMAPServices(conf config.Config, options imap.BackendOptions, tlsConfig *tls.Config) []*service {
+	be := imap.NewBackend(options)
+	s := imap.NewServer(be)
+	imapLogger := logrus.StandardLogger()
+	s.Debug = imapLogger.Writer()
+	s.Addr = conf.NetworkConfigs.IMAP.Host + ":" + strconv.Itoa(conf.NetworkConfigs.IMAP.Port)
+	s.AllowInsecureAuth = !conf.IMAP.DisableInsecureAuth
+	if !conf.IMAP.DisableStartTLS {
+		s.TLSConfig = tlsConfig
+	}
+	//go-imap would close all sessions right away, the listeners are closed and the sessions drained instead. Closing
+	//the drained server stops the delivery of the backend updates
+	services := []*service{{name: IMAP, addr: s.Addr, serve: s.Serve, drain: s.Drain, close: s.Close}}
+	if !conf.IMAP.DisableIMAPS {
+		addr := conf.NetworkConfigs.IMAP.Host + ":" + strconv.Itoa(conf.IMAP.TLSPort)
+		services = append(services, &service{name: IMAPS, addr: addr, tlsConfig: tlsConfig, serve: s.Serve, drain: s.Drain, close: s.Close})
+	}
+	return services
+}
+
+//newPOP3Service sets up the POP3 server reading the mails from the MailStore. STLS is offered with the shared TLS
+//certificate
+func newPOP3Service(conf config.Config, options pop3.Options) *service {
+	addr := conf.NetworkConfigs.POP3.Host + ":" + strconv.Itoa(conf.NetworkConfigs.POP3.Port)
+	s := pop3.NewServer(options)
+	//closing the listener is all pop3.Server.Close does, the sessions are drained
+	return &service{name: POP3, addr: addr, serve: s.Serve, drain: s.Drain}
+}
@@ -0,0 +1,314 @@
+package mailpie
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/da-coda/mailpie/pkg/config"
+	"github.com/emersion/go-imap/client"
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/mail.v2"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type ServerTestSuite struct {
+	suite.Suite
+}
+
+//newTestServer starts a server with all services on free ports of the loopback interface
+func (suite *ServerTestSuite) newTestServer() *Server {
+	conf, err := config.Default()
+	suite.Require().Nil(err)
+	conf.NetworkConfigs.SMTP.Host, conf.NetworkConfigs.SMTP.Port = "127.0.0.1", 0
+	conf.NetworkConfigs.IMAP.Host, conf.NetworkConfigs.IMAP.Port = "127.0.0.1", 0
+	conf.NetworkConfigs.HTTP.Host, conf.NetworkConfigs.HTTP.Port = "127.0.0.1", 0
+	conf.NetworkConfigs.POP3.Host, conf.NetworkConfigs.POP3.Port = "127.0.0.1", 0
+	conf.NetworkConfigs.SES.Host, conf.NetworkConfigs.SES.Port = "127.0.0.1", 0
+	conf.IMAP.TLSPort = 0
+	conf.DataDir = ""
+	server, err := NewServer(Options{Config: conf})
+	suite.Require().Nil(err)
+	suite.Require().Nil(server.Start(context.Background()))
+	suite.T().Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		suite.Nil(server.Shutdown(ctx))
+	})
+	return server
+}
+
+func (suite *ServerTestSuite) send(server *Server, subject string) {
+	host, port, err := net.SplitHostPort(server.Addr(SMTP))
+	suite.Require().Nil(err)
+	portNumber, err := strconv.Atoi(port)
+	suite.Require().Nil(err)
+	m := mail.NewMessage()
+	m.SetHeader("From", "alex@example.com")
+	m.SetHeader("To", "bob@example.com")
+	m.SetHeader("Subject", subject)
+	m.SetBody("text/plain", "Hello Bob!")
+	suite.Require().Nil(mail.NewDialer(host, portNumber, "", "").DialAndSend(m))
+}
+
+func (suite *ServerTestSuite) TestAddr() {
+	server := suite.newTestServer()
+	for _, name := range []Service{SMTP, SPA, IMAP, IMAPS, POP3, SES} {
+		_, port, err := net.SplitHostPort(server.Addr(name))
+		suite.Nil(err, "%s should be bound", name)
+		suite.NotEqual("0", port, "%s should report the picked port", name)
+	}
+}
+
+func (suite *ServerTestSuite) TestTwoServers() {
+	first := suite.newTestServer()
+	second := suite.newTestServer()
+	suite.NotEqual(first.Addr(SMTP), second.Addr(SMTP))
+
+	suite.send(first, "Only for the first server")
+	suite.Len(first.MailStore().Keys(), 1)
+	suite.Empty(second.MailStore().Keys(), "A mail of one server should not reach the other")
+
+	first.MessageQueue().Flush()
+	imapConnect(suite.T(), first.Addr(IMAP), "Only for the first server")
+
+	response, err := http.Get(fmt.Sprintf("http://%s/api/v2/messages", second.Addr(SPA)))
+	suite.Require().Nil(err)
+	defer response.Body.Close()
+	var messages struct {
+		Total int `json:"total"`
+	}
+	suite.Require().Nil(json.NewDecoder(response.Body).Decode(&messages))
+	suite.Equal(0, messages.Total)
+}
+
+//newSMTPServer starts a server with only SMTP enabled, shut down by the test
+func (suite *ServerTestSuite) newSMTPServer() *Server {
+	conf, err := config.Default()
+	suite.Require().Nil(err)
+	conf.NetworkConfigs.SMTP.Host, conf.NetworkConfigs.SMTP.Port = "127.0.0.1", 0
+	conf.DisableHTTP, conf.DisableIMAP, conf.DisablePOP3, conf.DisableSES = true, true, true, true
+	conf.DataDir = ""
+	server, err := NewServer(Options{Config: conf})
+	suite.Require().Nil(err)
+	suite.Require().Nil(server.Start(context.Background()))
+	return server
+}
+
+func (suite *ServerTestSuite) TestShutdown() {
+	server := suite.newSMTPServer()
+	addr := server.Addr(SMTP)
+	suite.Empty(server.Addr(IMAP), "Disabled services should have no address")
+
+	suite.Nil(server.Shutdown(context.Background()))
+	_, err := net.DialTimeout("tcp", addr, time.Second)
+	suite.NotNil(err, "The listener should be closed")
+	suite.Nil(server.Shutdown(context.Background()), "A second shutdown should do nothing")
+}
+
+func (suite *ServerTestSuite) TestShutdown_DrainsSessions() {
+	server := suite.newSMTPServer()
+	addr := server.Addr(SMTP)
+	c, err := smtp.Dial(addr)
+	suite.Require().Nil(err)
+	suite.Require().Nil(c.Mail("alex@example.com"))
+	suite.Require().Nil(c.Rcpt("bob@example.com"))
+	data, err := c.Data()
+	suite.Require().Nil(err)
+	_, err = data.Write([]byte("Subject: In flight\r\n\r\nHello"))
+	suite.Require().Nil(err)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- server.Shutdown(context.Background())
+	}()
+	suite.Eventually(func() bool {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			_ = conn.Close()
+		}
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond, "New connections should be refused during the shutdown")
+	select {
+	case <-shutdown:
+		suite.FailNow("Shutdown should wait for the open session")
+	default:
+	}
+
+	_, err = data.Write([]byte(" Bob\r\n"))
+	suite.Require().Nil(err)
+	suite.Require().Nil(data.Close())
+	//the session is idle after the transaction and closed, QUIT may get the reply of the shutdown
+	if err := c.Quit(); err != nil {
+		suite.Contains(err.Error(), "421")
+	}
+	select {
+	case err := <-shutdown:
+		suite.Nil(err)
+	case <-time.After(5 * time.Second):
+		suite.FailNow("Shutdown should return once the session ended")
+	}
+	suite.Len(server.MailStore().Keys(), 1, "The mail of the session should be stored")
+}
+
+func (suite *ServerTestSuite) TestShutdown_Deadline() {
+	server := suite.newSMTPServer()
+	c, err := smtp.Dial(server.Addr(SMTP))
+	suite.Require().Nil(err)
+	defer c.Close()
+	suite.Require().Nil(c.Mail("alex@example.com"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	suite.NotNil(err, "Shutdown should fail if a transaction is still running at the deadline")
+	suite.True(errors.Is(err, context.DeadlineExceeded))
+	suite.NotNil(c.Rcpt("bob@example.com"), "The session should be closed")
+}
+
+//readReply reads an SMTP reply and returns its last line
+func (suite *ServerTestSuite) readReply(reader *bufio.Reader) string {
+	for {
+		line, err := reader.ReadString('\n')
+		suite.Require().Nil(err)
+		if len(line) < 4 || line[3] != '-' {
+			return line
+		}
+	}
+}
+
+func (suite *ServerTestSuite) TestShutdown_PipelinedSession() {
+	server := suite.newSMTPServer()
+	conn, err := net.Dial("tcp", server.Addr(SMTP))
+	suite.Require().Nil(err)
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	suite.readReply(reader)
+	_, err = conn.Write([]byte("EHLO client\r\nMAIL FROM:<alex@example.com>\r\nRCPT TO:<bob@example.com>\r\nDATA\r\n"))
+	suite.Require().Nil(err)
+	for _, code := range []string{"250", "250", "250", "354"} {
+		suite.Require().True(strings.HasPrefix(suite.readReply(reader), code))
+	}
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- server.Shutdown(context.Background())
+	}()
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-shutdown:
+		suite.FailNow("Shutdown should wait for the pipelined transaction")
+	default:
+	}
+
+	_, err = conn.Write([]byte("Subject: Pipelined\r\n\r\nHello Bob\r\n.\r\nQUIT\r\n"))
+	suite.Require().Nil(err)
+	suite.True(strings.HasPrefix(suite.readReply(reader), "250"), "The mail should be accepted")
+	select {
+	case err := <-shutdown:
+		suite.Nil(err)
+	case <-time.After(5 * time.Second):
+		suite.FailNow("Shutdown should return once the session ended")
+	}
+	suite.Len(server.MailStore().Keys(), 1, "The mail of the session should be stored")
+}
+
+func (suite *ServerTestSuite) TestShutdown_StartTLS() {
+	server := suite.newSMTPServer()
+	conn, err := net.Dial("tcp", server.Addr(SMTP))
+	suite.Require().Nil(err)
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	suite.readReply(reader)
+	_, err = conn.Write([]byte("EHLO client\r\nSTARTTLS\r\n"))
+	suite.Require().Nil(err)
+	suite.readReply(reader)
+	//the session stays in plain text, so the tracking still follows it
+	suite.True(strings.HasPrefix(suite.readReply(reader), "502"), "STARTTLS should not be offered")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	suite.Nil(server.Shutdown(ctx))
+	suite.Less(int64(time.Since(start)), int64(2*time.Second), "The idle session should be closed right away")
+	suite.True(strings.HasPrefix(suite.readReply(reader), "421 "), "The client should be told about the shutdown")
+}
+
+func (suite *ServerTestSuite) TestShutdown_ClosesIdleSessions() {
+	server := suite.newTestServer()
+	smtpConn, err := net.Dial("tcp", server.Addr(SMTP))
+	suite.Require().Nil(err)
+	defer smtpConn.Close()
+	smtpReader := bufio.NewReader(smtpConn)
+	_, err = smtpReader.ReadString('\n')
+	suite.Require().Nil(err)
+
+	imapClient, err := client.Dial(server.Addr(IMAP))
+	suite.Require().Nil(err)
+	suite.Require().Nil(imapClient.Login("bob@example.com", "password"))
+
+	pop3Conn, err := net.Dial("tcp", server.Addr(POP3))
+	suite.Require().Nil(err)
+	defer pop3Conn.Close()
+	pop3Reader := bufio.NewReader(pop3Conn)
+	_, err = pop3Reader.ReadString('\n')
+	suite.Require().Nil(err)
+
+	events, err := http.Get(fmt.Sprintf("http://%s/jmap/eventsource?types=*&ping=0", server.Addr(SPA)))
+	suite.Require().Nil(err)
+	defer events.Body.Close()
+	suite.Require().Equal(http.StatusOK, events.StatusCode)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	suite.Nil(server.Shutdown(ctx), "Idle sessions closed on shutdown are no error")
+	suite.Less(int64(time.Since(start)), int64(2*time.Second), "Idle sessions should be closed right away")
+
+	_ = smtpConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := io.ReadAll(smtpReader)
+	suite.Nil(err)
+	suite.True(strings.HasPrefix(string(reply), "421 "), "SMTP clients should be told about the shutdown: %s", reply)
+	select {
+	case <-imapClient.LoggedOut():
+	case <-time.After(5 * time.Second):
+		suite.Fail("The IMAP client should be logged out")
+	}
+	_ = pop3Conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadAll(pop3Reader)
+	suite.Nil(err, "The POP3 session should be closed")
+	_, err = io.ReadAll(events.Body)
+	suite.Nil(err, "The event source should end")
+}
+
+func (suite *ServerTestSuite) TestStart_AddressInUse() {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	suite.Require().Nil(err)
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	conf, err := config.Default()
+	suite.Require().Nil(err)
+	conf.NetworkConfigs.HTTP.Host, conf.NetworkConfigs.HTTP.Port = "127.0.0.1", 0
+	conf.NetworkConfigs.SMTP.Host = "127.0.0.1"
+	conf.NetworkConfigs.SMTP.Port, _ = strconv.Atoi(port)
+	conf.DisableIMAP, conf.DisablePOP3, conf.DisableSES = true, true, true
+	conf.DataDir = ""
+	server, err := NewServer(Options{Config: conf})
+	suite.Require().Nil(err)
+	suite.NotNil(server.Start(context.Background()))
+	suite.Empty(server.Addr(SPA), "Listeners bound before the failure should be closed")
+}
+
+func TestServer(t *testing.T) {
+	suite.Run(t, new(ServerTestSuite))
+}
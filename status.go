@@ -0,0 +1,214 @@
+package mailpie
+
+import (
+	"github.com/da-coda/mailpie/internal/apiutil"
+	"github.com/da-coda/mailpie/pkg/config"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/url"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+//Version of Mailpie, set when building a release with -ldflags "-X github.com/da-coda/mailpie.Version=v1.0.0". If
+//empty, the version of the module from the build info is reported
+var Version string
+
+//masked replaces the secrets in the status
+const masked = "********"
+
+//statusHandler serves an overview of the server for debugging a deployment
+type statusHandler struct {
+	server *Server
+}
+
+//status is the JSON response of /status
+type status struct {
+	Version   string         `json:"version"`
+	Build     build          `json:"build"`
+	StartedAt time.Time      `json:"startedAt"`
+	Uptime    float64        `json:"uptimeSeconds"`
+	Services  []ServiceState `json:"services"`
+	Mails     mails          `json:"mails"`
+	Config    configSummary  `json:"config"`
+}
+
+type build struct {
+	GoVersion string `json:"goVersion"`
+	Platform  string `json:"platform"`
+	Module    string `json:"module,omitempty"`
+}
+
+type mails struct {
+	Stored   int `json:"stored"`
+	Received int `json:"received"`
+	Deleted  int `json:"deleted"`
+	//Size of the stored raw messages in bytes
+	Size int `json:"size"`
+}
+
+//configSummary is the part of the config which helps to understand a deployment, without the secrets
+type configSummary struct {
+	LogLevel           string `json:"logLevel"`
+	DataDir            string `json:"dataDir"`
+	SieveScript        string `json:"sieveScript,omitempty"`
+	TLSCertificate     string `json:"tlsCertificate"`
+	ShutdownTimeout    int    `json:"shutdownTimeout"`
+	MaxServiceFailures int    `json:"maxServiceFailures"`
+	//APIs are the mail provider APIs served by the HTTP server
+	APIs []string `json:"apis"`
+	//Users maps the usernames to the masked passwords
+	Users                map[string]string `json:"users,omitempty"`
+	SESCredentials       map[string]string `json:"sesCredentials,omitempty"`
+	PostmarkServerTokens []string          `json:"postmarkServerTokens,omitempty"`
+	SparkPostAPIKeys     []string          `json:"sparkPostApiKeys,omitempty"`
+	Webhooks             []endpoint        `json:"webhooks,omitempty"`
+	InboundRoutes        []endpoint        `json:"inboundRoutes,omitempty"`
+	Notifications        []endpoint        `json:"notifications,omitempty"`
+	//ExecHooks are the programs of the exec hooks, their arguments can hold secrets
+	ExecHooks []string `json:"execHooks,omitempty"`
+}
+
+//endpoint is a webhook, inbound route or notification
+type endpoint struct {
+	Provider string `json:"provider,omitempty"`
+	URL      string `json:"url"`
+	//Secret is the masked signing key or secret
+	Secret string `json:"secret,omitempty"`
+}
+
+//Register adds the status route
+func (h statusHandler) Register(router *mux.Router) {
+	router.HandleFunc("/status", h.status).Methods("GET")
+}
+
+//status handles GET /status
+func (h statusHandler) status(w http.ResponseWriter, _ *http.Request) {
+	h.server.lock.Lock()
+	startedAt := h.server.startedAt
+	h.server.lock.Unlock()
+	stats := h.server.MailStore().Stats()
+	response := status{
+		Version:   version(),
+		Build:     build{GoVersion: runtime.Version(), Platform: runtime.GOOS + "/" + runtime.GOARCH},
+		StartedAt: startedAt,
+		Services:  h.server.Services(),
+		Mails: mails{
+			Stored:   stats.Mails,
+			Received: stats.Received,
+			Deleted:  stats.Deleted,
+			Size:     stats.Size,
+		},
+		Config: summarize(h.server.Config()),
+	}
+	if !startedAt.IsZero() {
+		response.Uptime = time.Since(startedAt).Round(time.Second).Seconds()
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		response.Build.Module = info.Main.Path
+	}
+	apiutil.WriteJSON(w, http.StatusOK, response)
+}
+
+//version returns Version or the version of the module, dev for builds from a checkout
+func version() string {
+	if Version != "" {
+		return Version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return "dev"
+}
+
+func summarize(conf config.Config) configSummary {
+	summary := configSummary{
+		LogLevel:           conf.LogrusLevel.String(),
+		DataDir:            conf.DataDir,
+		SieveScript:        conf.SieveScript,
+		TLSCertificate:     conf.TLS.CertFile,
+		ShutdownTimeout:    conf.ShutdownTimeout,
+		MaxServiceFailures: conf.MaxServiceFailures,
+		APIs:               []string{},
+	}
+	if summary.TLSCertificate == "" {
+		summary.TLSCertificate = "self-signed"
+	}
+	if !conf.DisableHTTP {
+		summary.APIs = append(summary.APIs, "mailhog")
+		for _, api := range []struct {
+			name    string
+			enabled bool
+		}{
+			{"sendgrid", !conf.DisableSendGrid},
+			{"mailgun", !conf.DisableMailgun},
+			{"postmark", !conf.DisablePostmark},
+			{"sparkpost", !conf.DisableSparkPost},
+			{"jmap", !conf.DisableJMAP},
+			{"mailcatcher", conf.EnableMailCatcher},
+		} {
+			if api.enabled {
+				summary.APIs = append(summary.APIs, api.name)
+			}
+		}
+	}
+	if !conf.DisableSES {
+		summary.APIs = append(summary.APIs, "ses")
+	}
+	if len(conf.Users) > 0 {
+		summary.Users = make(map[string]string, len(conf.Users))
+		for _, user := range conf.Users {
+			summary.Users[user.Username] = mask(user.Password)
+		}
+	}
+	if len(conf.SES.Credentials) > 0 {
+		summary.SESCredentials = make(map[string]string, len(conf.SES.Credentials))
+		for accessKey, secretKey := range conf.SES.Credentials {
+			summary.SESCredentials[accessKey] = mask(secretKey)
+		}
+	}
+	for _, token := range conf.Postmark.ServerTokens {
+		summary.PostmarkServerTokens = append(summary.PostmarkServerTokens, mask(token))
+	}
+	for _, key := range conf.SparkPost.APIKeys {
+		summary.SparkPostAPIKeys = append(summary.SparkPostAPIKeys, mask(key))
+	}
+	for _, webhook := range conf.Webhooks {
+		summary.Webhooks = append(summary.Webhooks, endpoint{Provider: webhook.Provider, URL: maskURL(webhook.URL), Secret: mask(webhook.SigningKey)})
+	}
+	for _, route := range conf.InboundRoutes {
+		summary.InboundRoutes = append(summary.InboundRoutes, endpoint{Provider: route.Provider, URL: maskURL(route.URL), Secret: mask(route.SigningKey)})
+	}
+	for _, notification := range conf.Notifications {
+		summary.Notifications = append(summary.Notifications, endpoint{URL: maskURL(notification.URL), Secret: mask(notification.Secret)})
+	}
+	for _, hook := range conf.ExecHooks {
+		if len(hook.Command) > 0 {
+			summary.ExecHooks = append(summary.ExecHooks, hook.Command[0])
+		}
+	}
+	return summary
+}
+
+//mask hides a secret, empty secrets stay empty to show that none is configured
+func mask(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return masked
+}
+
+//maskURL keeps the scheme and the host of the URL. Credentials, path and query are masked, since the URLs of chat
+//webhooks carry their token in the path
+func maskURL(raw string) string {
+	parsed, err := url.Parse(raw)
+	if err != nil || parsed.Host == "" {
+		return mask(raw)
+	}
+	result := parsed.Scheme + "://" + parsed.Host
+	if (parsed.Path != "" && parsed.Path != "/") || parsed.RawQuery != "" || parsed.User != nil {
+		result += "/" + masked
+	}
+	return result
+}
@@ -0,0 +1,167 @@
+package mailpie
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+//maxRestartDelay limits the backoff of failed services. A service which served longer than that since its last
+//failure counts as recovered, so that its next failure is restarted after the initial delay again
+const maxRestartDelay = time.Minute
+
+//Status is the state of a service as seen by the supervisor
+type Status string
+
+const (
+	//Running services accept connections
+	Running Status = "running"
+	//Restarting services failed and are bound again after a delay
+	Restarting Status = "restarting"
+	//Failed services failed more often in a row than the config allows and are not restarted anymore
+	Failed Status = "failed"
+	//Stopped services are not started yet or shut down
+	Stopped Status = "stopped"
+)
+
+//ServiceState describes a service of the Server
+type ServiceState struct {
+	Name Service `json:"name"`
+	//Addr is the address the service listens on, empty if it is not bound
+	Addr   string `json:"addr,omitempty"`
+	Status Status `json:"status"`
+	//Failures counts the failures in a row, it is reset once the service served longer than the maximum restart delay
+	Failures    int        `json:"failures"`
+	Restarts    int        `json:"restarts"`
+	LastError   string     `json:"lastError,omitempty"`
+	LastFailure *time.Time `json:"lastFailure,omitempty"`
+}
+
+//Healthy reports whether the service accepts connections
+func (state ServiceState) Healthy() bool {
+	return state.Status == Running
+}
+
+//Services returns the state of all enabled services in the order they are started
+func (s *Server) Services() []ServiceState {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	states := make([]ServiceState, 0, len(s.services))
+	for _, svc := range s.services {
+		state := ServiceState{Name: svc.name, Status: svc.status, Failures: svc.failures, Restarts: svc.restarts}
+		if svc.listener != nil && svc.status == Running {
+			state.Addr = svc.listener.Addr().String()
+		}
+		if svc.lastError != nil {
+			lastFailure := svc.lastFailure
+			state.LastError = svc.lastError.Error()
+			state.LastFailure = &lastFailure
+		}
+		states = append(states, state)
+	}
+	return states
+}
+
+//Failed receives an error once a service failed more often in a row than MaxServiceFailures of the config allows. The
+//other services keep running until the server is shut down
+func (s *Server) Failed() <-chan error {
+	return s.failed
+}
+
+//supervise serves the service until the server is shut down. If the service fails, it is marked unhealthy and its
+//listener is bound again after a delay, which doubles with every failure in a row
+func (s *Server) supervise(svc *service) {
+	defer s.serving.Done()
+	for {
+		started := time.Now()
+		err := svc.serve(svc.listener)
+		if s.isStopping() {
+			return
+		}
+		if err == nil {
+			err = errors.New("stopped accepting connections")
+		}
+		if time.Since(started) >= maxRestartDelay {
+			s.recovered(svc)
+		}
+		for {
+			delay, restart := s.failure(svc, err)
+			if !restart {
+				return
+			}
+			select {
+			case <-time.After(delay):
+			case <-s.stopped:
+				return
+			}
+			err = s.rebind(svc)
+			if err == nil {
+				break
+			}
+			if s.isStopping() {
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) isStopping() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stopping
+}
+
+func (s *Server) recovered(svc *service) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	svc.failures = 0
+}
+
+//failure marks the service unhealthy and returns the delay before it is restarted. If the service failed too often in
+//a row, it is given up and the error is sent to Failed instead
+func (s *Server) failure(svc *service, err error) (time.Duration, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	svc.failures++
+	svc.lastError = err
+	svc.lastFailure = time.Now()
+	entry := logrus.WithError(err).WithField("Origin", svc.name).WithField("Failures", svc.failures)
+	if limit := s.config.MaxServiceFailures; limit > 0 && svc.failures >= limit {
+		svc.status = Failed
+		entry.Error("Service failed too often, giving up")
+		select {
+		case s.failed <- errors.Wrapf(err, "%s server failed %d times in a row", svc.name, svc.failures):
+		default:
+		}
+		return 0, false
+	}
+	delay := s.restartDelay
+	for i := 1; i < svc.failures && delay < maxRestartDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRestartDelay {
+		delay = maxRestartDelay
+	}
+	svc.status = Restarting
+	entry.WithField("Delay", delay).Error("Service received unexpected error, restarting")
+	return delay, true
+}
+
+//rebind binds the listener of the failed service again, unless the server is shut down in the meantime
+func (s *Server) rebind(svc *service) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stopping {
+		return errors.New("server is shut down")
+	}
+	_ = svc.listener.Close()
+	if err := svc.bind(context.Background()); err != nil {
+		return errors.Wrapf(err, "Unable to restart %s server", svc.name)
+	}
+	svc.status = Running
+	svc.restarts++
+	logrus.WithField("Address", svc.listener.Addr().String()).Infof("Restarted %s server", strings.ToUpper(string(svc.name)))
+	return nil
+}
@@ -0,0 +1,173 @@
+package mailpie
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/da-coda/mailpie/pkg/config"
+	"github.com/stretchr/testify/suite"
+	"net"
+	"net/http"
+	"net/smtp"
+	"testing"
+	"time"
+)
+
+type SupervisorTestSuite struct {
+	suite.Suite
+}
+
+//newServer starts a server with SMTP and the HTTP server on free ports, shut down with the test. The configure
+//functions can enable further services
+func (suite *SupervisorTestSuite) newServer(restartDelay time.Duration, maxFailures int, configure ...func(conf *config.Config)) *Server {
+	conf, err := config.Default()
+	suite.Require().Nil(err)
+	conf.NetworkConfigs.SMTP.Host, conf.NetworkConfigs.SMTP.Port = "127.0.0.1", 0
+	conf.NetworkConfigs.HTTP.Host, conf.NetworkConfigs.HTTP.Port = "127.0.0.1", 0
+	conf.DisableIMAP, conf.DisablePOP3, conf.DisableSES = true, true, true
+	conf.DataDir = ""
+	conf.MaxServiceFailures = maxFailures
+	for _, c := range configure {
+		c(&conf)
+	}
+	server, err := NewServer(Options{Config: conf, RestartDelay: restartDelay})
+	suite.Require().Nil(err)
+	suite.Require().Nil(server.Start(context.Background()))
+	suite.T().Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		suite.Nil(server.Shutdown(ctx))
+	})
+	return server
+}
+
+//fail closes the listener of the service, like a listener failing while the server is running
+func (suite *SupervisorTestSuite) fail(server *Server, name Service) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	for _, svc := range server.services {
+		if svc.name == name {
+			suite.Require().Nil(svc.listener.Close())
+		}
+	}
+}
+
+func (suite *SupervisorTestSuite) state(server *Server, name Service) ServiceState {
+	for _, state := range server.Services() {
+		if state.Name == name {
+			return state
+		}
+	}
+	suite.FailNow("service not found", name)
+	return ServiceState{}
+}
+
+func (suite *SupervisorTestSuite) TestRestart() {
+	server := suite.newServer(10*time.Millisecond, 0)
+	suite.Equal(Running, suite.state(server, SMTP).Status)
+
+	suite.fail(server, SMTP)
+	suite.Eventually(func() bool {
+		return suite.state(server, SMTP).Restarts == 1
+	}, 5*time.Second, 10*time.Millisecond, "The failed service should be restarted")
+	state := suite.state(server, SMTP)
+	suite.Equal(Running, state.Status)
+	suite.Equal(1, state.Failures)
+	suite.NotEmpty(state.LastError)
+	suite.NotNil(state.LastFailure)
+	suite.Equal(server.Addr(SMTP), state.Addr)
+
+	conn, err := net.Dial("tcp", server.Addr(SMTP))
+	suite.Require().Nil(err, "The restarted service should accept connections")
+	_ = conn.Close()
+	suite.Equal(Running, suite.state(server, SPA).Status, "The other services should not be affected")
+}
+
+func (suite *SupervisorTestSuite) TestRestart_IMAP() {
+	server := suite.newServer(10*time.Millisecond, 0, func(conf *config.Config) {
+		conf.NetworkConfigs.IMAP.Host, conf.NetworkConfigs.IMAP.Port = "127.0.0.1", 0
+		conf.IMAP.TLSPort = 0
+		conf.DisableIMAP = false
+	})
+	suite.fail(server, IMAP)
+	suite.Eventually(func() bool {
+		return suite.state(server, IMAP).Restarts == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	suite.Equal(Running, suite.state(server, IMAPS).Status)
+
+	//the restarted listener passes its connections to the IMAP server serving both listeners
+	message := "From: alex@example.com\r\nTo: bob@example.com\r\nSubject: After the restart\r\n\r\nHello Bob!\r\n"
+	suite.Require().Nil(smtp.SendMail(server.Addr(SMTP), nil, "alex@example.com", []string{"bob@example.com"}, []byte(message)))
+	server.MessageQueue().Flush()
+	imapConnect(suite.T(), server.Addr(IMAP), "After the restart")
+}
+
+func (suite *SupervisorTestSuite) TestMaxFailures() {
+	server := suite.newServer(10*time.Millisecond, 2)
+	suite.fail(server, SMTP)
+	suite.Eventually(func() bool {
+		return suite.state(server, SMTP).Restarts == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	select {
+	case <-server.Failed():
+		suite.FailNow("One failure should be restarted")
+	default:
+	}
+
+	suite.fail(server, SMTP)
+	select {
+	case err := <-server.Failed():
+		suite.Contains(err.Error(), "smtp server failed 2 times in a row")
+	case <-time.After(5 * time.Second):
+		suite.FailNow("The second failure in a row should be reported")
+	}
+	suite.Equal(Failed, suite.state(server, SMTP).Status)
+	suite.Empty(suite.state(server, SMTP).Addr)
+}
+
+func (suite *SupervisorTestSuite) TestHealth() {
+	server := suite.newServer(time.Minute, 0)
+	health := func() (int, health) {
+		response, err := http.Get(fmt.Sprintf("http://%s/healthz", server.Addr(SPA)))
+		suite.Require().Nil(err)
+		defer response.Body.Close()
+		var body health
+		suite.Require().Nil(json.NewDecoder(response.Body).Decode(&body))
+		return response.StatusCode, body
+	}
+	status, body := health()
+	suite.Equal(http.StatusOK, status)
+	suite.Equal("ok", body.Status)
+	suite.Len(body.Services, 2)
+
+	suite.fail(server, SMTP)
+	suite.Eventually(func() bool {
+		return suite.state(server, SMTP).Status == Restarting
+	}, 5*time.Second, 10*time.Millisecond)
+	status, body = health()
+	suite.Equal(http.StatusServiceUnavailable, status)
+	suite.Equal("unhealthy", body.Status)
+	for _, state := range body.Services {
+		if state.Name == SMTP {
+			suite.Equal(Restarting, state.Status)
+			suite.False(state.Healthy())
+		}
+	}
+}
+
+func (suite *SupervisorTestSuite) TestShutdown_CancelsRestart() {
+	server := suite.newServer(time.Minute, 0)
+	suite.fail(server, SMTP)
+	suite.Eventually(func() bool {
+		return suite.state(server, SMTP).Status == Restarting
+	}, 5*time.Second, 10*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	suite.Nil(server.Shutdown(ctx), "Shutdown should not wait for the pending restart")
+	suite.Equal(Stopped, suite.state(server, SMTP).Status)
+}
+
+func TestSupervisor(t *testing.T) {
+	suite.Run(t, new(SupervisorTestSuite))
+}
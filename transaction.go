@@ -0,0 +1,161 @@
+package mailpie
+
+import (
+	"bytes"
+	"strings"
+)
+
+//smtpShutdownReply is sent to the sessions outside of a transaction before they are closed on shutdown
+const smtpShutdownReply = "421 4.3.2 localhost Mailpie ESMTP Service shutting down, closing transmission channel\r\n"
+
+//maxPrefix is the part of a line kept to recognize the commands, the replies and the end of the mail data
+const maxPrefix = 16
+
+//smtpTransaction follows the commands of an SMTP client and the replies of the server to tell whether the session is
+//inside a mail transaction. A transaction starts with an accepted MAIL and ends once its data is accepted, or with RSET,
+//HELO, EHLO or QUIT. smtpd answers every line outside of the mail data with exactly one reply, so the replies are
+//matched to the lines in the order they were sent, even if the client pipelines its commands. The session is followed
+//in plain text: the server does not offer STARTTLS, so a client asking for it gets a 502 and the session stays
+//readable. A TLS layer has to be added outside of the tracked connection, like the listener of a service with implicit
+//TLS does
+type smtpTransaction struct {
+	//line is the start of the line the client is sending, reply the start of the reply the server is writing
+	line  []byte
+	reply []byte
+	//pending are the lines of the client which the server has not replied to yet
+	pending []smtpLine
+	//greeted is set once the first reply was written, which is the greeting if it has the code 220
+	greeted     bool
+	transaction bool
+	//data is set while the client sends the mail after the server accepted DATA
+	data bool
+}
+
+//smtpLine is the start of a line sent by the client which waits for its reply
+type smtpLine struct {
+	line string
+	//end is set for the line ending the mail data
+	end bool
+}
+
+//running returns true if the session is inside a mail transaction or the server has not replied to every command yet
+func (t *smtpTransaction) running() bool {
+	return t.transaction || t.data || len(t.pending) > 0
+}
+
+//read follows the data the client sent
+func (t *smtpTransaction) read(p []byte) {
+	for len(p) > 0 {
+		end := bytes.IndexByte(p, '\n')
+		if end < 0 {
+			t.line = keep(t.line, p)
+			return
+		}
+		t.line = keep(t.line, p[:end])
+		t.received(string(t.line))
+		t.line = t.line[:0]
+		p = p[end+1:]
+	}
+}
+
+//received follows a complete line of the client, without its line feed
+func (t *smtpTransaction) received(line string) {
+	if t.data {
+		//like smtpd, only a lone period with CRLF ends the data
+		if line == ".\r" {
+			t.data = false
+			t.pending = append(t.pending, smtpLine{line: line, end: true})
+		}
+		return
+	}
+	t.pending = append(t.pending, smtpLine{line: line})
+}
+
+//written follows the replies of the server. Returns the number of mails the replies accepted
+func (t *smtpTransaction) written(p []byte) int {
+	accepted := 0
+	for len(p) > 0 {
+		end := bytes.IndexByte(p, '\n')
+		if end < 0 {
+			t.reply = keep(t.reply, p)
+			return accepted
+		}
+		t.reply = keep(t.reply, p[:end])
+		//the lines of a multiline reply but the last have a hyphen after the code
+		if len(t.reply) >= 3 && (len(t.reply) == 3 || t.reply[3] != '-') && t.replied(string(t.reply[:3])) {
+			accepted++
+		}
+		t.reply = t.reply[:0]
+		p = p[end+1:]
+	}
+	return accepted
+}
+
+//replied follows the reply with the code to the oldest line the server has not replied to yet. Returns true if the
+//reply accepted the mail of the transaction
+func (t *smtpTransaction) replied(code string) bool {
+	if !t.greeted {
+		t.greeted = true
+		if code == "220" {
+			return false
+		}
+	}
+	//replies to no line, like the notice of a timeout, change nothing
+	if len(t.pending) == 0 {
+		return false
+	}
+	line := t.pending[0]
+	t.pending = t.pending[1:]
+	positive := code[0] == '2'
+	if line.end {
+		//smtpd keeps the sender and recipients if it rejects the data, the client may send it again
+		if code == "250" {
+			t.transaction = false
+			return true
+		}
+		return false
+	}
+	verb := strings.TrimRight(line.line, "\r")
+	if space := strings.IndexByte(verb, ' '); space >= 0 {
+		verb = verb[:space]
+	}
+	switch strings.ToUpper(verb) {
+	case "MAIL":
+		if positive {
+			t.transaction = true
+		}
+	case "DATA":
+		if code == "354" {
+			t.startData()
+		}
+	case "RSET", "HELO", "EHLO":
+		if positive {
+			t.transaction = false
+		}
+	case "QUIT":
+		t.transaction = false
+	}
+	return false
+}
+
+//startData reads the lines the client sent after DATA as mail data. A client may only send them once DATA is
+//accepted, but a pipelining client could have sent them already
+func (t *smtpTransaction) startData() {
+	t.data = true
+	sent := t.pending
+	t.pending = nil
+	for _, line := range sent {
+		t.received(line.line)
+	}
+}
+
+//keep adds the start of the data to the line
+func keep(line []byte, p []byte) []byte {
+	if free := maxPrefix - len(line); free > 0 {
+		if len(p) > free {
+			p = p[:free]
+		}
+		line = append(line, p...)
+	}
+	return line
+}
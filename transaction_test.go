@@ -0,0 +1,92 @@
+package mailpie
+
+import (
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+type TransactionTestSuite struct {
+	suite.Suite
+	transaction smtpTransaction
+}
+
+func (suite *TransactionTestSuite) SetupTest() {
+	suite.transaction = smtpTransaction{}
+}
+
+//exchange passes a command and its reply
+func (suite *TransactionTestSuite) exchange(command string, reply string) {
+	suite.transaction.read([]byte(command))
+	suite.transaction.written([]byte(reply))
+}
+
+func (suite *TransactionTestSuite) TestMail() {
+	suite.exchange("EHLO client\r\n", "250-localhost greets client\r\n250 AUTH PLAIN\r\n")
+	suite.False(suite.transaction.running())
+	suite.exchange("MAIL FROM:<alex@example.com>\r\n", "250 2.1.0 Ok\r\n")
+	suite.True(suite.transaction.running())
+	suite.exchange("RCPT TO:<bob@example.com>\r\n", "250 2.1.5 Ok\r\n")
+	suite.exchange("DATA\r\n", "354 Start mail input\r\n")
+	suite.transaction.read([]byte("Subject: Hello\r\n\r\nMAIL FROM is no command here\r\nQUIT\r\n"))
+	suite.True(suite.transaction.running(), "The data should not be read as commands")
+	suite.transaction.read([]byte("Bye\r\n."))
+	suite.transaction.read([]byte("\r\n"))
+	suite.True(suite.transaction.running(), "The transaction should run until the reply to the data")
+	suite.Equal(1, suite.transaction.written([]byte("250 2.0.0 Ok: queued\r\n")), "The mail should be accepted")
+	suite.False(suite.transaction.running())
+}
+
+func (suite *TransactionTestSuite) TestDataRejected() {
+	suite.exchange("MAIL FROM:<alex@example.com>\r\n", "250 2.1.0 Ok\r\n")
+	suite.exchange("DATA\r\n", "503 5.5.1 Bad sequence of commands\r\n")
+	suite.exchange("RSET\r\n", "250 2.0.0 Ok\r\n")
+	suite.False(suite.transaction.running(), "Commands after a rejected DATA should not be read as data")
+}
+
+func (suite *TransactionTestSuite) TestReset() {
+	for _, command := range []string{"RSET", "rset", "HELO client", "EHLO client", "QUIT"} {
+		suite.exchange("mail from:<alex@example.com>\r\n", "250 2.1.0 Ok\r\n")
+		suite.True(suite.transaction.running())
+		suite.exchange(command+"\r\n", "250 2.0.0 Ok\r\n")
+		suite.False(suite.transaction.running(), "%s should end the transaction", command)
+	}
+}
+
+func (suite *TransactionTestSuite) TestPipelining() {
+	suite.transaction.written([]byte("220 localhost Mailpie ESMTP Service ready\r\n"))
+	suite.transaction.read([]byte("EHLO client\r\nMAIL FROM:<alex@example.com>\r\nRCPT TO:<bob@example.com>\r\nDATA\r\n"))
+	suite.True(suite.transaction.running(), "Commands waiting for their reply should count as running")
+	suite.transaction.written([]byte("250-localhost greets client\r\n250 AUTH PLAIN\r\n"))
+	suite.transaction.written([]byte("250 2.1.0 Ok\r\n"))
+	suite.transaction.written([]byte("250 2.1.5 Ok\r\n"))
+	suite.transaction.read([]byte("Subject: Hello\r\n\r\nRSET\r\n.\r\nRSET\r\n"))
+	suite.Equal(0, suite.transaction.written([]byte("354 Start mail input\r\n")))
+	suite.True(suite.transaction.running(), "The lines sent before the reply to DATA should be read as data")
+	suite.Equal(1, suite.transaction.written([]byte("250 2.0.0 Ok: queued\r\n")), "The mail should be accepted")
+	suite.True(suite.transaction.running(), "The RSET after the data should wait for its reply")
+	suite.transaction.written([]byte("250 2.0.0 Ok\r\n"))
+	suite.False(suite.transaction.running())
+}
+
+func (suite *TransactionTestSuite) TestMailRejected() {
+	suite.exchange("MAIL FROM:alex\r\n", "501 5.5.4 Syntax error in parameters or arguments\r\n")
+	suite.False(suite.transaction.running())
+	suite.exchange("MAIL FROM:<alex@example.com>\r\n", "250 2.1.0 Ok\r\n")
+	suite.exchange("RCPT TO:<bob@example.com>\r\n", "250 2.1.5 Ok\r\n")
+	suite.exchange("DATA\r\n", "354 Start mail input\r\n")
+	suite.transaction.read([]byte("Hello\r\n.\r\n"))
+	suite.Equal(0, suite.transaction.written([]byte("552 5.3.4 Requested mail action aborted\r\n")))
+	suite.True(suite.transaction.running(), "smtpd keeps the transaction if the data is rejected")
+}
+
+func (suite *TransactionTestSuite) TestStartTLS() {
+	suite.exchange("EHLO client\r\n", "250-localhost greets client\r\n250 AUTH PLAIN\r\n")
+	suite.exchange("STARTTLS\r\n", "502 5.5.1 Command not implemented\r\n")
+	suite.False(suite.transaction.running(), "A refused STARTTLS should leave the session idle")
+	suite.exchange("MAIL FROM:<alex@example.com>\r\n", "250 2.1.0 Ok\r\n")
+	suite.True(suite.transaction.running(), "The session should still be followed")
+}
+
+func TestTransaction(t *testing.T) {
+	suite.Run(t, new(TransactionTestSuite))
+}